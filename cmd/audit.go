@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/knadh/listmonk/internal/core"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+)
+
+// auditCore returns the core for making subscriber, subscription, and list changes
+// that records the request's admin user, the given source, and the IP in the audit log
+// and in the consent records of new subscriptions. IPs and user agents on public pages
+// are only recorded if recording opt-in IPs is enabled.
+func auditCore(c echo.Context, source string) *core.Core {
+	var (
+		app  = c.Get("app").(*App)
+		meta = models.AuditMeta{Source: source}
+	)
+
+	if source == models.AuditSourceAPI {
+		meta.Actor, _, _ = c.Request().BasicAuth()
+		meta.IP = c.RealIP()
+		meta.UserAgent = c.Request().UserAgent()
+	} else if app.constants.Privacy.RecordOptinIP {
+		meta.IP = c.RealIP()
+		meta.UserAgent = c.Request().UserAgent()
+	}
+
+	return app.core.WithAudit(meta)
+}
+
+// handleGetSubscriberAuditLog handles the retrieval of a subscriber's audit log.
+func handleGetSubscriberAuditLog(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		pg    = app.paginator.NewFromURL(c.Request().URL.Query())
+		id, _ = strconv.Atoi(c.Param("id"))
+		out   models.PageResults
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	res, total, err := app.core.GetSubscriberAuditLog(id, pg.Offset, pg.Limit)
+	if err != nil {
+		return err
+	}
+
+	out.Results = res
+	out.Total = total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
@@ -34,6 +34,9 @@ type campaignReq struct {
 	// to the outside world.
 	ListIDs []int `json:"lists"`
 
+	// Saved segments to target, alongside or instead of lists.
+	SegmentIDs []int `json:"segments"`
+
 	MediaIDs []int `json:"media"`
 
 	// This is only relevant to campaign test requests.
@@ -208,6 +211,12 @@ func handleCreateCampaign(c echo.Context) error {
 		o.Type = models.CampaignTypeRegular
 	}
 
+	// Fill in the fields that aren't set with the sending defaults of the lists.
+	o, err := applyListDefaults(o, app)
+	if err != nil {
+		return err
+	}
+
 	if o.ContentType == "" {
 		o.ContentType = models.CampaignContentTypeRichtext
 	}
@@ -226,7 +235,7 @@ func handleCreateCampaign(c echo.Context) error {
 		o.ArchiveTemplateID = o.TemplateID
 	}
 
-	out, err := app.core.CreateCampaign(o.Campaign, o.ListIDs, o.MediaIDs)
+	out, err := app.core.CreateCampaign(o.Campaign, o.ListIDs, o.SegmentIDs, o.MediaIDs)
 	if err != nil {
 		return err
 	}
@@ -270,7 +279,7 @@ func handleUpdateCampaign(c echo.Context) error {
 		o = c
 	}
 
-	out, err := app.core.UpdateCampaign(id, o.Campaign, o.ListIDs, o.MediaIDs, o.SendLater)
+	out, err := app.core.UpdateCampaign(id, o.Campaign, o.ListIDs, o.SegmentIDs, o.MediaIDs, o.SendLater)
 	if err != nil {
 		return err
 	}
@@ -571,7 +580,7 @@ func handleSendCampaignMail(c echo.Context) error {
 	}
 
 	// Add the subscriber to the campaign list
-	err = app.core.AddSubscriptions([]int{sub.ID}, []int{campaignListId}, models.SubscriptionStatusUnconfirmed)
+	err = auditCore(c, models.AuditSourceAPI).AddSubscriptions([]int{sub.ID}, []int{campaignListId}, models.SubscriptionStatusUnconfirmed)
 	if err != nil {
 		app.log.Printf("error adding subscriber to list: %v", err)
 		return echo.NewHTTPError(http.StatusNotFound,
@@ -670,10 +679,15 @@ func validateCampaignFields(c campaignReq, app *App) (campaignReq, error) {
 		}
 	}
 
-	if len(c.ListIDs) == 0 {
+	if len(c.ListIDs) == 0 && len(c.SegmentIDs) == 0 {
 		return c, errors.New(app.i18n.T("campaigns.fieldInvalidListIDs"))
 	}
 
+	// Opt-in campaigns are sent to the unconfirmed subscribers of lists only.
+	if c.Type == models.CampaignTypeOptin && len(c.SegmentIDs) > 0 {
+		return c, errors.New(app.i18n.T("campaigns.optinSegments"))
+	}
+
 	if !app.manager.HasMessenger(c.Messenger) {
 		return c, errors.New(app.i18n.Ts("campaigns.fieldInvalidMessenger", "name", c.Messenger))
 	}
@@ -706,6 +720,91 @@ func validateCampaignFields(c campaignReq, app *App) (campaignReq, error) {
 	return c, nil
 }
 
+// applyListDefaults fills in the from address, template, messenger, and headers of a
+// campaign that aren't set with the sending defaults of its lists. A list's reply-to
+// address is added as a Reply-To header. If the lists have different defaults for a
+// field that isn't set on the campaign, an error naming the fields is returned.
+func applyListDefaults(o campaignReq, app *App) (campaignReq, error) {
+	if len(o.ListIDs) == 0 {
+		return o, nil
+	}
+
+	lists, err := app.core.GetListsByOptin(o.ListIDs, "")
+	if err != nil {
+		return o, err
+	}
+
+	// pick returns the value of a field that's set on one or more of the lists.
+	var conflicts []string
+	pick := func(field string, val func(l models.List) string) string {
+		out := ""
+		for _, l := range lists {
+			v := val(l)
+			if v == "" || v == out {
+				continue
+			}
+			if out != "" {
+				conflicts = append(conflicts, field)
+				return ""
+			}
+			out = v
+		}
+		return out
+	}
+
+	if o.FromEmail == "" {
+		o.FromEmail = pick("from_email", func(l models.List) string { return l.FromEmail })
+	}
+
+	if o.TemplateID == 0 {
+		v := pick("template_id", func(l models.List) string {
+			if !l.TemplateID.Valid {
+				return ""
+			}
+			return strconv.Itoa(l.TemplateID.Int)
+		})
+		o.TemplateID, _ = strconv.Atoi(v)
+	}
+
+	if o.Messenger == "" {
+		o.Messenger = pick("messenger", func(l models.List) string { return l.Messenger })
+	}
+
+	if len(o.Headers) == 0 {
+		v := pick("headers", func(l models.List) string {
+			if len(l.Headers) == 0 {
+				return ""
+			}
+			b, _ := json.Marshal(l.Headers)
+			return string(b)
+		})
+		if v != "" {
+			_ = json.Unmarshal([]byte(v), &o.Headers)
+		}
+	}
+
+	hasReplyTo := false
+	for _, h := range o.Headers {
+		for k := range h {
+			if strings.EqualFold(k, "Reply-To") {
+				hasReplyTo = true
+			}
+		}
+	}
+	if !hasReplyTo {
+		if v := pick("reply_to", func(l models.List) string { return l.ReplyTo }); v != "" {
+			o.Headers = append(o.Headers, map[string]string{"Reply-To": v})
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return o, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("campaigns.listDefaultsConflict", "name", strings.Join(conflicts, ", ")))
+	}
+
+	return o, nil
+}
+
 // isCampaignalMutable tells if a campaign's in a state where it's
 // properties can be mutated.
 func isCampaignalMutable(status string) bool {
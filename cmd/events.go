@@ -6,6 +6,8 @@ import (
 	"log"
 	"time"
 
+	"github.com/knadh/listmonk/internal/events"
+	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
 )
 
@@ -50,3 +52,15 @@ func handleEventStream(c echo.Context) error {
 
 	return nil
 }
+
+// publishJobProgress publishes the progress of a background job on the event stream.
+func (app *App) publishJobProgress(p models.JobProgress) {
+	// Progress events are informational, and a full event queue shouldn't
+	// hold up the job.
+	_ = app.events.Publish(events.Event{
+		ID:      p.ID,
+		Type:    events.TypeProgress,
+		Message: p.Job,
+		Data:    p,
+	})
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/knadh/listmonk/internal/subexporter"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+)
+
+// exportReq represents a request to start a background subscriber export.
+type exportReq struct {
+	Query         string                `json:"query"`
+	Filter        *models.SegmentFilter `json:"filter"`
+	ListIDs       []int                 `json:"list_ids"`
+	SubscriberIDs []int                 `json:"ids"`
+	SubStatus     string                `json:"subscription_status"`
+	Format        string                `json:"format"`
+	Fields        []string              `json:"fields"`
+	IncludeLists  bool                  `json:"include_lists"`
+}
+
+// exportStatusTpl is the data for the export status notification template.
+type exportStatusTpl struct {
+	ID       int64
+	Status   string
+	Exported int
+	Error    string
+	URL      string
+}
+
+// handleGetExportJobs returns subscriber export jobs, latest first.
+func handleGetExportJobs(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		pg  = app.paginator.NewFromURL(c.Request().URL.Query())
+		out models.PageResults
+	)
+
+	res, total, err := app.core.QueryExportJobs(pg.Offset, pg.Limit)
+	if err != nil {
+		return err
+	}
+	for i := range res {
+		res[i].URL = exportURL(res[i], app)
+	}
+
+	out.Results = res
+	out.Total = total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetExportJob returns a subscriber export job.
+func handleGetExportJob(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.ParseInt(c.Param("id"), 10, 64)
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	out, err := app.core.GetExportJob(id)
+	if err != nil {
+		return err
+	}
+	out.URL = exportURL(out, app)
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCreateExportJob starts a background export of the given subscribers, or
+// subscribers matching an arbitrary SQL expression, to a file in the private export
+// directory. The progress of the export is published on the event stream and admins
+// are notified with a link to download the file when it's done.
+func handleCreateExportJob(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req exportReq
+	)
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if req.Format == "" {
+		req.Format = models.ExportFormatCSV
+	}
+	if !subexporter.IsFormat(req.Format) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("subscribers.invalidExportFormat"))
+	}
+
+	if len(req.Fields) == 0 {
+		req.Fields = subexporter.BaseFields
+	}
+	if err := subexporter.ValidateFields(req.Fields); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("subscribers.invalidExportFields", "error", err.Error()))
+	}
+
+	switch req.SubStatus {
+	case "", models.SubscriptionStatusUnconfirmed, models.SubscriptionStatusConfirmed, models.SubscriptionStatusUnsubscribed:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "subscription_status"))
+	}
+
+	// Get the batched export iterator. This validates the query before the job starts.
+	exp, err := app.core.ExportSubscribers(sanitizeSQLExp(req.Query), req.Filter, req.SubscriberIDs,
+		req.ListIDs, req.SubStatus, app.constants.DBBatchSize)
+	if err != nil {
+		return err
+	}
+
+	job := models.ExportJob{
+		Format:       req.Format,
+		Fields:       req.Fields,
+		IncludeLists: req.IncludeLists,
+	}
+	job.CreatedBy, _, _ = c.Request().BasicAuth()
+
+	job, err = app.core.CreateExportJob(job)
+	if err != nil {
+		return err
+	}
+
+	go app.runExportJob(job, exp)
+
+	return c.JSON(http.StatusOK, okResp{job})
+}
+
+// handleDeleteExportJob deletes an export job that isn't running along with its file.
+func handleDeleteExportJob(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.ParseInt(c.Param("id"), 10, 64)
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	filename, err := app.core.DeleteExportJob(id)
+	if err != nil {
+		return err
+	}
+
+	if filename != "" {
+		if err := os.Remove(exportPath(filename, app)); err != nil && !os.IsNotExist(err) {
+			app.log.Printf("error deleting export file '%s': %v", filename, err)
+		}
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// handleDownloadExportJob serves the file of a finished export job.
+func handleDownloadExportJob(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.ParseInt(c.Param("id"), 10, 64)
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	job, err := app.core.GetExportJob(id)
+	if err != nil {
+		return err
+	}
+
+	// The file may have been deleted after the retention period.
+	fPath := exportPath(job.Filename, app)
+	if _, err := os.Stat(fPath); job.Filename == "" || err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("subscribers.exportUnavailable"))
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, subexporter.ContentType(job.Format))
+	return c.Attachment(fPath, job.Filename)
+}
+
+// runExportJob writes the subscribers from the export iterator to a file in the
+// export directory, batch by batch. The progress is recorded in the DB and published
+// on the event stream.
+func (app *App) runExportJob(job models.ExportJob, exp func() ([]models.SubscriberExport, error)) {
+	prog := models.JobProgress{
+		ID:     job.UUID,
+		Job:    "subscribers.export",
+		Status: models.JobStatusRunning,
+	}
+	app.publishJobProgress(prog)
+
+	err := app.writeExportFile(&job, exp, func() {
+		prog.Done = job.Exported
+		prog.Total = job.Exported
+		app.publishJobProgress(prog)
+	})
+
+	job.Status = models.JobStatusFinished
+	if err != nil {
+		app.log.Printf("error exporting subscribers (job %d): %v", job.ID, err)
+		job.Status = models.JobStatusFailed
+		job.Error = err.Error()
+	}
+	_ = app.core.UpdateExportJob(job)
+
+	prog.Status, prog.Done, prog.Total = job.Status, job.Exported, job.Exported
+	prog.URL = exportURL(job, app)
+	app.publishJobProgress(prog)
+
+	subject := fmt.Sprintf("%s: subscriber export #%d", job.Status, job.ID)
+	app.sendNotification(app.constants.NotifyEmails, subject, notifTplExport, exportStatusTpl{
+		ID:       job.ID,
+		Status:   job.Status,
+		Exported: job.Exported,
+		Error:    job.Error,
+		URL:      prog.URL,
+	})
+}
+
+// writeExportFile writes the subscribers from the export iterator to a file in the
+// export directory. The files contain PII and are only readable by the app and only
+// served to admins. onBatch is called after each batch is written.
+func (app *App) writeExportFile(job *models.ExportJob, exp func() ([]models.SubscriberExport, error), onBatch func()) (err error) {
+	name := fmt.Sprintf("subscribers-%s.%s", job.UUID, job.Format)
+	f, err := os.OpenFile(exportPath(name, app), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+
+	wr, err := subexporter.New(job.Format, f, job.Fields, job.IncludeLists)
+	if err != nil {
+		return err
+	}
+
+	for {
+		subs, err := exp()
+		if err != nil {
+			return err
+		}
+		if len(subs) == 0 {
+			break
+		}
+
+		var lists map[int]json.RawMessage
+		if job.IncludeLists {
+			ids := make([]int, len(subs))
+			for i, s := range subs {
+				ids[i] = s.ID
+			}
+
+			if lists, err = app.core.GetSubscriberListsForExport(ids); err != nil {
+				return err
+			}
+		}
+
+		for _, s := range subs {
+			if err := wr.Write(s, lists[s.ID]); err != nil {
+				return err
+			}
+		}
+
+		job.Exported += len(subs)
+		_ = app.core.UpdateExportJob(*job)
+		onBatch()
+	}
+
+	if err := wr.Close(); err != nil {
+		return err
+	}
+	job.Filename = name
+
+	return nil
+}
+
+// exportURL returns the admin URL for downloading the file of a finished export job.
+func exportURL(job models.ExportJob, app *App) string {
+	if job.Filename == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/api/subscribers/exports/%d/download", app.constants.RootURL, job.ID)
+}
+
+// exportPath returns the path of an export file in the export directory.
+func exportPath(filename string, app *App) string {
+	return filepath.Join(app.constants.ExportDir, filepath.Base(filename))
+}
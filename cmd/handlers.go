@@ -7,6 +7,7 @@ import (
 	"path"
 	"regexp"
 
+	"github.com/knadh/listmonk/internal/messenger/email"
 	"github.com/knadh/paginator"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -78,6 +79,7 @@ func initHTTPHandlers(e *echo.Echo, app *App) {
 
 	// API endpoints.
 	g.GET("/api/health", handleHealthCheck)
+	g.GET("/api/health/smtp", handleGetSMTPHealth)
 	g.GET("/api/config", handleGetServerConfig)
 	g.GET("/api/lang/:lang", handleGetI18nLang)
 	g.GET("/api/dashboard/charts", handleGetDashboardCharts)
@@ -86,6 +88,7 @@ func initHTTPHandlers(e *echo.Echo, app *App) {
 	g.GET("/api/settings", handleGetSettings)
 	g.PUT("/api/settings", handleUpdateSettings)
 	g.POST("/api/settings/smtp/test", handleTestSMTPSettings)
+	g.POST("/api/settings/smtp/dkim/test", handleTestDKIMSettings)
 	g.POST("/api/admin/reload", handleReloadApp)
 	g.GET("/api/logs", handleGetLogs)
 	g.GET("/api/about", handleGetAboutInfo)
@@ -93,10 +96,22 @@ func initHTTPHandlers(e *echo.Echo, app *App) {
 	g.GET("/api/subscribers/:id", handleGetSubscriber)
 	g.GET("/api/subscribers/:id/export", handleExportSubscriberData)
 	g.GET("/api/subscribers/:id/bounces", handleGetSubscriberBounces)
+	g.GET("/api/subscribers/:id/audit", handleGetSubscriberAuditLog)
 	g.DELETE("/api/subscribers/:id/bounces", handleDeleteSubscriberBounces)
 	g.POST("/api/subscribers", handleCreateSubscriber)
 	g.PUT("/api/subscribers/:id", handleUpdateSubscriber)
 	g.POST("/api/subscribers/:id/optin", handleSubscriberSendOptin)
+	g.POST("/api/subscribers/:id/merge", handleMergeSubscribers)
+	g.GET("/api/subscribers/duplicates", handleQueryDuplicateSubscribers)
+	g.GET("/api/subscribers/sunset", handleQuerySunsetSubscribers)
+	g.GET("/api/subscribers/trash", handleQueryTrashedSubscribers)
+	g.PUT("/api/subscribers/trash/restore", handleRestoreSubscribers)
+	g.DELETE("/api/subscribers/trash", handlePurgeTrashedSubscribers)
+	g.GET("/api/subscribers/exports", handleGetExportJobs)
+	g.GET("/api/subscribers/exports/:id", handleGetExportJob)
+	g.GET("/api/subscribers/exports/:id/download", handleDownloadExportJob)
+	g.POST("/api/subscribers/exports", handleCreateExportJob)
+	g.DELETE("/api/subscribers/exports/:id", handleDeleteExportJob)
 	g.PUT("/api/subscribers/blocklist", handleBlocklistSubscribers)
 	g.PUT("/api/subscribers/:id/blocklist", handleBlocklistSubscribers)
 	g.PUT("/api/subscribers/lists/:id", handleManageSubscriberLists)
@@ -114,21 +129,36 @@ func initHTTPHandlers(e *echo.Echo, app *App) {
 	g.POST("/api/subscribers/query/delete", handleDeleteSubscribersByQuery)
 	g.PUT("/api/subscribers/query/blocklist", handleBlocklistSubscribersByQuery)
 	g.PUT("/api/subscribers/query/lists", handleManageSubscriberListsByQuery)
+	g.PUT("/api/subscribers/query/attribs", handleUpdateSubscriberAttribsByQuery)
 	g.GET("/api/subscribers", handleQuerySubscribers)
 	g.GET("/api/subscribers/export",
 		middleware.GzipWithConfig(middleware.GzipConfig{Level: 9})(handleExportSubscribers))
 
-	g.GET("/api/import/subscribers", handleGetImportSubscribers)
+	g.GET("/api/import/subscribers", handleGetImportRuns)
 	g.GET("/api/import/subscribers/logs", handleGetImportSubscriberStats)
+	g.GET("/api/import/subscribers/rejected", handleGetImportRejected)
+	g.GET("/api/import/subscribers/:id", handleGetImportSubscriberSession)
+	g.GET("/api/import/subscribers/:id/logs", handleGetImportSubscriberStats)
+	g.GET("/api/import/subscribers/:id/rejected", handleGetImportRejected)
 	g.POST("/api/import/subscribers", handleImportSubscribers)
 	g.DELETE("/api/import/subscribers", handleStopImportSubscribers)
+	g.DELETE("/api/import/subscribers/:id", handleStopImportSubscribers)
 
 	g.GET("/api/lists", handleGetLists)
 	g.GET("/api/lists/:id", handleGetLists)
+	g.GET("/api/lists/:id/stats", handleGetListStats)
+	g.POST("/api/lists/:id/:op", handleListOp)
 	g.POST("/api/lists", handleCreateList)
 	g.PUT("/api/lists/:id", handleUpdateList)
 	g.DELETE("/api/lists/:id", handleDeleteLists)
 
+	g.GET("/api/segments", handleGetSegments)
+	g.GET("/api/segments/:id", handleGetSegments)
+	g.POST("/api/segments", handleCreateSegment)
+	g.PUT("/api/segments/:id", handleUpdateSegment)
+	g.PUT("/api/segments/:id/count", handleRefreshSegmentCount)
+	g.DELETE("/api/segments/:id", handleDeleteSegments)
+
 	g.GET("/api/campaigns", handleGetCampaigns)
 	g.GET("/api/campaigns/running/stats", handleGetRunningCampaignStats)
 	g.GET("/api/campaigns/:id", handleGetCampaign)
@@ -251,6 +281,21 @@ func handleHealthCheck(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
+// handleGetSMTPHealth returns the health state of the SMTP servers.
+func handleGetSMTPHealth(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	out := struct {
+		SMTP []email.ServerHealth `json:"smtp"`
+	}{[]email.ServerHealth{}}
+
+	if e, ok := app.messengers[emailMsgr].(*email.Emailer); ok {
+		out.SMTP = e.Health()
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
 // serveCustomAppearance serves the given custom CSS/JS appearance blob
 // meant for customizing public and admin pages from the admin settings UI.
 func serveCustomAppearance(name string) echo.HandlerFunc {
@@ -2,9 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/knadh/listmonk/internal/subimporter"
@@ -13,15 +16,10 @@ import (
 )
 
 // handleImportSubscribers handles the uploading and bulk importing of
-// a ZIP file of one or more CSV files.
+// a ZIP file of one or more CSV files. Each upload starts a new import session.
 func handleImportSubscribers(c echo.Context) error {
 	app := c.Get("app").(*App)
 
-	// Is an import already running?
-	if app.importer.GetStats().Status == subimporter.StatusImporting {
-		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("import.alreadyRunning"))
-	}
-
 	// Unmarshal the JSON params.
 	var opt subimporter.SessionOpt
 	if err := json.Unmarshal([]byte(c.FormValue("params")), &opt); err != nil {
@@ -50,6 +48,14 @@ func handleImportSubscribers(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("import.invalidSubStatus"))
 	}
 
+	// Empty attribute cells in the merge mode leave attributes unchanged by default.
+	if opt.EmptyCells == "" {
+		opt.EmptyCells = subimporter.EmptyCellsKeep
+	}
+	if opt.EmptyCells != subimporter.EmptyCellsKeep && opt.EmptyCells != subimporter.EmptyCellsClear {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("import.invalidEmptyCells"))
+	}
+
 	if len(opt.Delim) != 1 {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("import.invalidDelim"))
 	}
@@ -66,7 +72,8 @@ func handleImportSubscribers(c echo.Context) error {
 	}
 	defer src.Close()
 
-	out, err := os.CreateTemp("", "listmonk")
+	// Retain the extension as the file is loaded based on it.
+	out, err := os.CreateTemp("", "listmonk*"+strings.ToLower(filepath.Ext(file.Filename)))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("import.errorCopyingFile", "error", err.Error()))
@@ -80,6 +87,8 @@ func handleImportSubscribers(c echo.Context) error {
 
 	// Start the importer session.
 	opt.Filename = file.Filename
+	opt.Actor, _, _ = c.Request().BasicAuth()
+	opt.IP = c.RealIP()
 	impSess, err := app.importer.NewSession(opt)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError,
@@ -87,10 +96,10 @@ func handleImportSubscribers(c echo.Context) error {
 	}
 	go impSess.Start()
 
-	if strings.HasSuffix(strings.ToLower(file.Filename), ".csv") {
-		go impSess.LoadCSV(out.Name(), rune(opt.Delim[0]))
+	if subimporter.IsLoadable(file.Filename) {
+		go impSess.Load(out.Name(), rune(opt.Delim[0]))
 	} else {
-		// Only 1 CSV from the ZIP is considered. If multiple files have
+		// Only 1 file from the ZIP is considered. If multiple files have
 		// to be processed, counting the net number of lines (to track progress),
 		// keeping the global import state (failed / successful) etc. across
 		// multiple files becomes complex. Instead, it's just easier for the
@@ -101,32 +110,161 @@ func handleImportSubscribers(c echo.Context) error {
 			return echo.NewHTTPError(http.StatusInternalServerError,
 				app.i18n.Ts("import.errorProcessingZIP", "error", err.Error()))
 		}
-		go impSess.LoadCSV(dir+"/"+files[0], rune(opt.Delim[0]))
+		go impSess.Load(dir+"/"+files[0], rune(opt.Delim[0]))
 	}
 
-	return c.JSON(http.StatusOK, okResp{app.importer.GetStats()})
+	st, _ := app.importer.GetSession(impSess.ID())
+	return c.JSON(http.StatusOK, okResp{st})
 }
 
-// handleGetImportSubscribers returns import statistics.
-func handleGetImportSubscribers(c echo.Context) error {
+// handleGetImportRuns returns the history of import sessions, latest first. The status
+// and counters of the sessions in progress are live.
+func handleGetImportRuns(c echo.Context) error {
 	var (
 		app = c.Get("app").(*App)
-		s   = app.importer.GetStats()
+		pg  = app.paginator.NewFromURL(c.Request().URL.Query())
+		out models.PageResults
 	)
-	return c.JSON(http.StatusOK, okResp{s})
+
+	res, total, err := app.core.QueryImportRuns(pg.Offset, pg.Limit)
+	if err != nil {
+		return err
+	}
+	for i, r := range res {
+		if st, ok := app.importer.GetSession(r.ID); ok {
+			res[i] = st
+		}
+	}
+
+	out.Results = res
+	out.Total = total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetImportSubscriberSession returns an import session.
+func handleGetImportSubscriberSession(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	id, err := getImportSessionID(c)
+	if err != nil {
+		return err
+	}
+
+	if st, ok := app.importer.GetSession(id); ok {
+		return c.JSON(http.StatusOK, okResp{st})
+	}
+
+	out, err := app.core.GetImportRun(id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
 }
 
-// handleGetImportSubscriberStats returns import statistics.
+// handleGetImportSubscriberStats returns the log of an import session, or without
+// an ID, of the latest one.
 func handleGetImportSubscriberStats(c echo.Context) error {
 	app := c.Get("app").(*App)
-	return c.JSON(http.StatusOK, okResp{string(app.importer.GetLogs())})
+
+	id, err := getImportSessionID(c)
+	if err != nil {
+		return err
+	}
+	if id == 0 {
+		return c.JSON(http.StatusOK, okResp{""})
+	}
+
+	// The logs of the sessions that aren't in memory are in the DB.
+	if b, ok := app.importer.GetLogs(id); ok {
+		return c.JSON(http.StatusOK, okResp{string(b)})
+	}
+
+	out, err := app.core.GetImportRunLog(id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
 }
 
-// handleStopImportSubscribers sends a stop signal to the importer.
-// If there's an ongoing import, it'll be stopped, and if an import
-// is finished, it's state is cleared.
+// handleStopImportSubscribers sends a stop signal to an import session in progress,
+// or to all of them if there's no ID.
 func handleStopImportSubscribers(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.ParseInt(c.Param("id"), 10, 64)
+	)
+
+	if c.Param("id") == "" {
+		app.importer.StopAll()
+		return c.JSON(http.StatusOK, okResp{true})
+	}
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if err := app.importer.Stop(id); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("import.notRunning"))
+	}
+
+	st, _ := app.importer.GetSession(id)
+	return c.JSON(http.StatusOK, okResp{st})
+}
+
+// handleGetImportRejected returns the rows rejected in an import session, or without
+// an ID, in the latest one, as a CSV file. The rows are only retained in memory for
+// the recent sessions.
+func handleGetImportRejected(c echo.Context) error {
 	app := c.Get("app").(*App)
-	app.importer.Stop()
-	return c.JSON(http.StatusOK, okResp{app.importer.GetStats()})
+
+	id, err := getImportSessionID(c)
+	if err != nil {
+		return err
+	}
+
+	// Check that the session is in memory before writing the headers.
+	if _, ok := app.importer.GetSession(id); !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("import.rejectedUnavailable"))
+	}
+
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, "text/csv")
+	h.Set(echo.HeaderContentDisposition, "attachment; filename="+fmt.Sprintf("rejected-%d.csv", id))
+	h.Set("Cache-Control", "no-cache")
+
+	if err := app.importer.WriteRejectedCSV(id, c.Response()); err != nil {
+		app.log.Printf("error writing rejected rows: %v", err)
+	}
+
+	return nil
+}
+
+// getImportSessionID returns the import session ID in the URL. The routes without
+// an ID, which predate concurrent import sessions, refer to the latest session, and
+// if there are no sessions, 0 is returned.
+func getImportSessionID(c echo.Context) (int64, error) {
+	app := c.Get("app").(*App)
+
+	if c.Param("id") == "" {
+		res, _, err := app.core.QueryImportRuns(0, 1)
+		if err != nil {
+			return 0, err
+		}
+		if len(res) == 0 {
+			return 0, nil
+		}
+		return res[0].ID, nil
+	}
+
+	id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	if id < 1 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	return id, nil
 }
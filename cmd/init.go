@@ -28,6 +28,7 @@ import (
 	"github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/providers/posflag"
 	"github.com/knadh/koanf/v2"
+	"github.com/knadh/listmonk/internal/attribs"
 	"github.com/knadh/listmonk/internal/bounce"
 	"github.com/knadh/listmonk/internal/bounce/mailbox"
 	"github.com/knadh/listmonk/internal/captcha"
@@ -39,6 +40,8 @@ import (
 	"github.com/knadh/listmonk/internal/media/providers/s3"
 	"github.com/knadh/listmonk/internal/messenger/email"
 	"github.com/knadh/listmonk/internal/messenger/postback"
+	"github.com/knadh/listmonk/internal/messenger/sink"
+	"github.com/knadh/listmonk/internal/messenger/subprocess"
 	"github.com/knadh/listmonk/internal/subimporter"
 	"github.com/knadh/listmonk/models"
 	"github.com/knadh/stuffbin"
@@ -52,6 +55,9 @@ const (
 
 	// Root URI of the admin frontend.
 	adminRoot = "/admin"
+
+	// Maximum number of past days the daily list stats are filled in for.
+	listStatsBackfillDays = 30
 )
 
 // constants contains static, constant config values required by the app.
@@ -86,6 +92,11 @@ type constants struct {
 	AdminUsername []byte `koanf:"admin_username"`
 	AdminPassword []byte `koanf:"admin_password"`
 
+	// Private directory for subscriber export files (config file only) and the
+	// duration after which the files are deleted.
+	ExportDir       string        `koanf:"export_dir"`
+	ExportRetention time.Duration `koanf:"export_retention"`
+
 	Appearance struct {
 		AdminCSS  []byte `koanf:"admin.custom_css"`
 		AdminJS   []byte `koanf:"admin.custom_js"`
@@ -396,6 +407,16 @@ func initConstants() *constants {
 	c.MediaUpload.Extensions = ko.Strings("upload.extensions")
 	c.Privacy.DomainBlocklist = ko.Strings("privacy.domain_blocklist")
 
+	if c.ExportDir == "" {
+		c.ExportDir = filepath.Join(os.TempDir(), "listmonk-exports")
+	}
+	if err := os.MkdirAll(c.ExportDir, 0700); err != nil {
+		lo.Fatalf("error creating export directory: %v", err)
+	}
+	if c.ExportRetention < time.Hour {
+		c.ExportRetention = time.Hour * 24
+	}
+
 	// Static URLS.
 	// url.com/subscription/{campaign_uuid}/{subscriber_uuid}
 	c.UnsubURL = fmt.Sprintf("%s/subscription/%%s/%%s", c.RootURL)
@@ -498,14 +519,42 @@ func initTxTemplates(m *manager.Manager, app *App) {
 	}
 }
 
+// initAttribSchema loads the subscriber attribute schema from the settings.
+func initAttribSchema(i *i18n.I18n) *attribs.Schema {
+	var defs []models.AttribDef
+	if err := ko.UnmarshalWithConf("attribs", &defs, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+		lo.Fatalf("error loading subscriber attribute schema: %v", err)
+	}
+
+	s, err := attribs.New(defs, i)
+	if err != nil {
+		lo.Fatalf("error loading subscriber attribute schema: %v", err)
+	}
+
+	return s
+}
+
 // initImporter initializes the bulk subscriber importer.
 func initImporter(q *models.Queries, db *sqlx.DB, core *core.Core, app *App) *subimporter.Importer {
+	// Sessions that were in progress when the app was stopped can't be resumed.
+	if _, err := q.FailInterruptedImportRuns.Exec("interrupted by a restart"); err != nil {
+		lo.Printf("error marking interrupted imports: %v", err)
+	}
+
 	return subimporter.New(
 		subimporter.Options{
 			DomainBlocklist:    app.constants.Privacy.DomainBlocklist,
+			SourceDirRoot:      ko.String("app.import_source_root"),
+			Attribs:            app.attribs,
 			UpsertStmt:         q.UpsertSubscriber.Stmt,
+			MergeStmt:          q.UpsertMergeSubscriber.Stmt,
 			BlocklistStmt:      q.UpsertBlocklistSubscriber.Stmt,
 			UpdateListDateStmt: q.UpdateListsDate.Stmt,
+			ExistingStmt:       q.GetImportSubscribers.Stmt,
+			AuditStmt:          q.InsertImportAuditLog.Stmt,
+			InsertRunStmt:      q.InsertImportRun.Stmt,
+			UpdateRunStmt:      q.UpdateImportRun.Stmt,
+			UnsubAbsentStmt:    q.UnsubscribeAbsentSubscribers.Stmt,
 			NotifCB: func(subject string, data interface{}) error {
 				// Refresh cached subscriber counts and stats.
 				core.RefreshMatViews(true)
@@ -571,6 +620,11 @@ func initPostbackMessengers(m *manager.Manager) []manager.Messenger {
 			continue
 		}
 
+		// Messengers without a type are postback messengers.
+		if typ := item.String("type"); typ != "" && typ != messengerTypePostback {
+			continue
+		}
+
 		// Read the Postback server config.
 		var (
 			name = item.String("name")
@@ -593,6 +647,85 @@ func initPostbackMessengers(m *manager.Manager) []manager.Messenger {
 	return out
 }
 
+// initSinkMessengers initializes and returns all the enabled
+// sink messengers that write messages to disk.
+func initSinkMessengers(m *manager.Manager) []manager.Messenger {
+	items := ko.Slices("messengers")
+	if len(items) == 0 {
+		return nil
+	}
+
+	var out []manager.Messenger
+	for _, item := range items {
+		if !item.Bool("enabled") || item.String("type") != messengerTypeSink {
+			continue
+		}
+
+		// Read the sink messenger config.
+		var (
+			name = item.String("name")
+			o    sink.Options
+		)
+		if err := item.UnmarshalWithConf("", &o, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+			lo.Printf("error reading sink messenger config: %v", err)
+			continue
+		}
+
+		// Directories are restricted to the sink root in the config.
+		o.Root = ko.String("app.sink_root")
+
+		// Initialize the Messenger. A failing sink is skipped so that it
+		// doesn't stop the app from starting.
+		f, err := sink.New(o)
+		if err != nil {
+			lo.Printf("error initializing sink messenger %s: %v", name, err)
+			continue
+		}
+		out = append(out, f)
+
+		lo.Printf("loaded sink messenger: %s (%s)", name, o.Directory)
+	}
+
+	return out
+}
+
+// initSubprocessMessengers initializes and returns all the messengers that
+// launch local executables and stream messages to them. As they execute programs
+// on the server, they can only be configured in the config file and not in the
+// DB settings.
+func initSubprocessMessengers(m *manager.Manager) []manager.Messenger {
+	items := ko.Slices("app.subprocess_messengers")
+	if len(items) == 0 {
+		return nil
+	}
+
+	var out []manager.Messenger
+	for _, item := range items {
+		// Read the subprocess config.
+		var o subprocess.Options
+		if err := item.UnmarshalWithConf("", &o, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+			lo.Fatalf("error reading subprocess messenger config: %v", err)
+		}
+
+		name := reAlphaNum.ReplaceAllString(strings.ToLower(o.Name), "")
+		if name == "" || name == emailMsgr {
+			lo.Fatalf("invalid subprocess messenger name: %s", o.Name)
+		}
+		o.Name = name
+
+		// Initialize the Messenger.
+		p, err := subprocess.New(o, lo)
+		if err != nil {
+			lo.Fatalf("error initializing subprocess messenger %s: %v", name, err)
+		}
+		out = append(out, p)
+
+		lo.Printf("loaded subprocess messenger: %s (%s)", name, o.Command)
+	}
+
+	return out
+}
+
 // initMediaStore initializes Upload manager with a custom backend.
 func initMediaStore() media.Store {
 	switch provider := ko.String("upload.provider"); provider {
@@ -828,6 +961,215 @@ func initCron(core *core.Core) {
 	lo.Printf("IMPORTANT: database slow query caching is enabled. Aggregate numbers and stats will not be realtime. Next refresh at: %v", c.Entries()[0].Next)
 }
 
+// initEngagementCron starts the cron that periodically recomputes subscriber
+// engagement scores and if enabled, applies the sunset policy.
+func initEngagementCron(core *core.Core) {
+	var (
+		halfLife = ko.Int("engagement.half_life_days")
+		sunset   = ko.Bool("engagement.sunset_enabled")
+		policy   = sunsetPolicyFromConfig()
+	)
+
+	c := cron.New()
+	_, err := c.Add(ko.MustString("engagement.score_interval"), func() {
+		lo.Println("refreshing subscriber engagement scores")
+		n, err := core.RefreshEngagementScores(halfLife)
+		if err != nil {
+			return
+		}
+		lo.Printf("updated engagement scores of %d subscribers", n)
+
+		if !sunset {
+			return
+		}
+
+		// Without individual tracking, every subscriber would appear to be inactive.
+		if !ko.Bool("privacy.individual_tracking") {
+			lo.Println("skipping sunset policy as individual subscriber tracking is disabled")
+			return
+		}
+
+		n, err = core.SunsetSubscribers(policy)
+		if err != nil {
+			return
+		}
+		lo.Printf("sunset policy (%s after %d days) applied to %d subscribers", policy.Action, policy.Days, n)
+	})
+	if err != nil {
+		lo.Printf("error initializing engagement cron: %v", err)
+		return
+	}
+
+	c.Start()
+}
+
+// initTrashCron starts the cron that purges subscribers that have been in the
+// trash for longer than the retention period in the settings. A retention
+// period of 0 keeps subscribers in the trash until they're purged manually.
+func initTrashCron(core *core.Core) {
+	days := ko.Int("privacy.trash_retention_days")
+	if days < 1 {
+		return
+	}
+
+	c := cron.New()
+	_, err := c.Add("@daily", func() {
+		n, err := core.PurgeTrashedSubscribers(nil, days)
+		if err != nil {
+			return
+		}
+		lo.Printf("purged %d subscribers from the trash", n)
+	})
+	if err != nil {
+		lo.Printf("error initializing trash purge cron: %v", err)
+		return
+	}
+
+	c.Start()
+}
+
+// initExportCron starts the cron that deletes the files of subscriber export jobs
+// that finished longer than the export retention period ago, and any other files
+// in the export directory that are older than that, eg: left by interrupted jobs.
+func initExportCron(app *App) {
+	var (
+		dir       = app.constants.ExportDir
+		retention = app.constants.ExportRetention
+	)
+
+	c := cron.New()
+	_, err := c.Add("@hourly", func() {
+		files, err := app.core.ExpireExportJobs(retention)
+		if err != nil {
+			return
+		}
+		for _, f := range files {
+			if err := os.Remove(filepath.Join(dir, filepath.Base(f))); err != nil && !os.IsNotExist(err) {
+				lo.Printf("error deleting export file '%s': %v", f, err)
+			}
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			lo.Printf("error reading export directory: %v", err)
+			return
+		}
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil || !info.Mode().IsRegular() || time.Since(info.ModTime()) < retention {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				lo.Printf("error deleting export file '%s': %v", e.Name(), err)
+			}
+		}
+	})
+	if err != nil {
+		lo.Printf("error initializing export cleanup cron: %v", err)
+		return
+	}
+
+	c.Start()
+}
+
+// initListStatsCron starts the cron that records the daily growth and churn stats of
+// lists. It runs hourly so that days missed while the app was down are filled in soon
+// after it starts. Days that are already recorded are skipped.
+func initListStatsCron(core *core.Core) {
+	c := cron.New()
+	_, err := c.Add("@hourly", func() {
+		n, err := core.SnapshotListStats(listStatsBackfillDays)
+		if err != nil || n == 0 {
+			return
+		}
+		lo.Printf("recorded %d daily list stats", n)
+	})
+	if err != nil {
+		lo.Printf("error initializing list stats cron: %v", err)
+		return
+	}
+
+	c.Start()
+}
+
+// initOptinCron starts the cron that expires the unconfirmed subscriptions on double
+// opt-in lists that are past the lists' expiry days, and if opt-in confirmations are
+// enabled, sends the opt-in reminders that are due.
+func initOptinCron(core *core.Core) {
+	var (
+		reminders = ko.Bool("app.send_optin_confirmation")
+		batchSize = ko.Int("app.batch_size")
+	)
+
+	c := cron.New()
+	_, err := c.Add("@hourly", func() {
+		if n, err := core.ExpireUnconfirmedSubscriptions(); err == nil && n > 0 {
+			lo.Printf("expired %d unconfirmed subscriptions", n)
+		}
+
+		if !reminders {
+			return
+		}
+		if n, err := core.SendOptinReminders(batchSize); err == nil && n > 0 {
+			lo.Printf("sent %d opt-in reminders", n)
+		}
+	})
+	if err != nil {
+		lo.Printf("error initializing opt-in cron: %v", err)
+		return
+	}
+
+	c.Start()
+}
+
+// initImportSources starts the crons that import subscribers from the enabled
+// import sources in the settings on their schedules.
+func initImportSources(app *App) {
+	var sources []models.ImportSource
+	if err := ko.UnmarshalWithConf("import.sources", &sources, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+		lo.Printf("error loading import sources: %v", err)
+		return
+	}
+
+	c := cron.New()
+	n := 0
+	for _, src := range sources {
+		if !src.Enabled {
+			continue
+		}
+
+		src := src
+		if _, err := c.Add(src.Cron, func() {
+			lo.Printf("running import source '%s'", src.Name)
+			if err := app.importer.RunSource(src); err != nil {
+				lo.Printf("error running import source '%s': %v", src.Name, err)
+				return
+			}
+			lo.Printf("finished import source '%s'", src.Name)
+		}); err != nil {
+			lo.Printf("error initializing import source '%s' cron: %v", src.Name, err)
+			continue
+		}
+		n++
+	}
+
+	if n == 0 {
+		return
+	}
+
+	lo.Printf("scheduled %d import source(s)", n)
+	c.Start()
+}
+
+// sunsetPolicyFromConfig returns the sunset policy in the settings.
+func sunsetPolicyFromConfig() models.SunsetPolicy {
+	return models.SunsetPolicy{
+		Days:   ko.Int("engagement.sunset_days"),
+		Action: ko.String("engagement.sunset_action"),
+		ListID: ko.Int("engagement.sunset_list_id"),
+	}
+}
+
 func awaitReload(sigChan chan os.Signal, closerWait chan bool, closer func()) chan bool {
 	// The blocking signal handler that main() waits on.
 	out := make(chan bool)
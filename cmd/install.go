@@ -73,7 +73,7 @@ func install(lastVer string, db *sqlx.DB, fs stuffbin.FileSystem, prompt, idempo
 		models.ListTypePrivate,
 		models.ListOptinSingle,
 		pq.StringArray{"test"},
-		"",
+		"", "", "", nil, "", "", models.Headers{}, "", pq.Int64Array{}, 0,
 	); err != nil {
 		lo.Fatalf("error creating list: %v", err)
 	}
@@ -83,7 +83,7 @@ func install(lastVer string, db *sqlx.DB, fs stuffbin.FileSystem, prompt, idempo
 		models.ListTypePublic,
 		models.ListOptinDouble,
 		pq.StringArray{"test"},
-		"",
+		"", "", "", nil, "", "", models.Headers{}, "", pq.Int64Array{}, 0,
 	); err != nil {
 		lo.Fatalf("error creating list: %v", err)
 	}
@@ -96,7 +96,8 @@ func install(lastVer string, db *sqlx.DB, fs stuffbin.FileSystem, prompt, idempo
 		`{"type": "known", "good": true, "city": "Bengaluru"}`,
 		pq.Int64Array{int64(defList)},
 		models.SubscriptionStatusUnconfirmed,
-		true); err != nil {
+		true,
+		`{"source": "system"}`); err != nil {
 		lo.Fatalf("Error creating subscriber: %v", err)
 	}
 	if _, err := q.UpsertSubscriber.Exec(
@@ -106,7 +107,8 @@ func install(lastVer string, db *sqlx.DB, fs stuffbin.FileSystem, prompt, idempo
 		`{"type": "unknown", "good": true, "city": "Bengaluru"}`,
 		pq.Int64Array{int64(optinList)},
 		models.SubscriptionStatusUnconfirmed,
-		true); err != nil {
+		true,
+		`{"source": "system"}`); err != nil {
 		lo.Fatalf("error creating subscriber: %v", err)
 	}
 
@@ -162,6 +164,7 @@ func install(lastVer string, db *sqlx.DB, fs stuffbin.FileSystem, prompt, idempo
 		archiveTplID,
 		`{"name": "Subscriber"}`,
 		nil,
+		nil,
 	); err != nil {
 		lo.Fatalf("error creating sample campaign: %v", err)
 	}
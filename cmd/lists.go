@@ -1,14 +1,27 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/gofrs/uuid/v5"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
 )
 
+const (
+	listStatsDateFormat = "2006-01-02"
+
+	// Maximum number of lists a list can be split into.
+	maxListSplitParts = 100
+
+	// Maximum number of opt-in reminders of a list.
+	maxOptinReminders = 10
+)
+
 // handleGetLists retrieves lists with additional metadata like subscriber counts. This may be slow.
 func handleGetLists(c echo.Context) error {
 	var (
@@ -96,11 +109,12 @@ func handleCreateList(c echo.Context) error {
 	}
 
 	// Validate.
-	if !strHasLen(l.Name, 1, stdInputMaxLen) {
-		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("lists.invalidName"))
+	l, err := validateListFields(l, l.Optin, app)
+	if err != nil {
+		return err
 	}
 
-	out, err := app.core.CreateList(l)
+	out, err := auditCore(c, models.AuditSourceAPI).CreateList(l)
 	if err != nil {
 		return err
 	}
@@ -125,12 +139,24 @@ func handleUpdateList(c echo.Context) error {
 		return err
 	}
 
+	// An empty opt-in keeps the list's current one, which the opt-in reminders and
+	// expiry are validated against.
+	optin := l.Optin
+	if optin == "" {
+		cur, err := app.core.GetList(id, "")
+		if err != nil {
+			return err
+		}
+		optin = cur.Optin
+	}
+
 	// Validate.
-	if !strHasLen(l.Name, 1, stdInputMaxLen) {
-		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("lists.invalidName"))
+	l, err := validateListFields(l, optin, app)
+	if err != nil {
+		return err
 	}
 
-	out, err := app.core.UpdateList(id, l)
+	out, err := auditCore(c, models.AuditSourceAPI).UpdateList(id, l)
 	if err != nil {
 		return err
 	}
@@ -154,9 +180,293 @@ func handleDeleteLists(c echo.Context) error {
 		ids = append(ids, int(id))
 	}
 
-	if err := app.core.DeleteLists(ids); err != nil {
+	if err := auditCore(c, models.AuditSourceAPI).DeleteLists(ids); err != nil {
 		return err
 	}
 
 	return c.JSON(http.StatusOK, okResp{true})
 }
+
+// handleGetListStats handles the retrieval of the daily growth and churn stats of a list
+// between the optional `from` and `to` dates (YYYY-MM-DD). It defaults to the last 30 days.
+func handleGetListStats(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		from  = c.QueryParam("from")
+		to    = c.QueryParam("to")
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	now := time.Now()
+	if to == "" {
+		to = now.Format(listStatsDateFormat)
+	}
+	if from == "" {
+		from = now.AddDate(0, 0, -30).Format(listStatsDateFormat)
+	}
+
+	fromDate, err := time.Parse(listStatsDateFormat, from)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("analytics.invalidDates"))
+	}
+	toDate, err := time.Parse(listStatsDateFormat, to)
+	if err != nil || toDate.Before(fromDate) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("analytics.invalidDates"))
+	}
+
+	// Check that the list exists.
+	if _, err := app.core.GetList(id, ""); err != nil {
+		return err
+	}
+
+	out, err := app.core.GetListStats(id, from, to)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// validateListFields validates the fields of a list and its optional campaign defaults.
+// optin is the opt-in the list will have, which may differ from l.Optin when it's kept
+// by an update.
+func validateListFields(l models.List, optin string, app *App) (models.List, error) {
+	if !strHasLen(l.Name, 1, stdInputMaxLen) {
+		return l, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("lists.invalidName"))
+	}
+
+	l.ConsentText = strings.TrimSpace(l.ConsentText)
+
+	// Opt-in reminders and expiry only apply to double opt-in lists. Reminders are
+	// sent in the order of their days.
+	if optin != models.ListOptinDouble {
+		l.OptinReminderDays, l.OptinExpiryDays = nil, 0
+	}
+	if len(l.OptinReminderDays) > maxOptinReminders {
+		return l, echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "optin_reminder_days"))
+	}
+	for i, d := range l.OptinReminderDays {
+		if d < 1 || (i > 0 && d <= l.OptinReminderDays[i-1]) {
+			return l, echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "optin_reminder_days"))
+		}
+	}
+	if l.OptinExpiryDays < 0 {
+		return l, echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "optin_expiry_days"))
+	}
+	l.FromEmail = strings.TrimSpace(l.FromEmail)
+	if l.FromEmail != "" && !regexFromAddress.MatchString(l.FromEmail) {
+		if _, err := app.importer.SanitizeEmail(l.FromEmail); err != nil {
+			return l, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.fieldInvalidFromEmail"))
+		}
+	}
+
+	l.ReplyTo = strings.TrimSpace(l.ReplyTo)
+	if l.ReplyTo != "" && !regexFromAddress.MatchString(l.ReplyTo) {
+		if _, err := app.importer.SanitizeEmail(l.ReplyTo); err != nil {
+			return l, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidFields", "name", "reply_to"))
+		}
+	}
+
+	if l.Messenger != "" && !app.manager.HasMessenger(l.Messenger) {
+		return l, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("campaigns.fieldInvalidMessenger", "name", l.Messenger))
+	}
+
+	if l.TemplateID.Int < 1 {
+		l.TemplateID.Valid = false
+	} else {
+		tpl, err := app.core.GetTemplate(l.TemplateID.Int, true)
+		if err != nil {
+			return l, err
+		}
+		if tpl.Type != models.TemplateTypeCampaign {
+			return l, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidFields", "name", "template_id"))
+		}
+	}
+
+	return l, nil
+}
+
+// listOpReq represents the parameters of a merge, split, or sample list operation.
+type listOpReq struct {
+	// Merge.
+	TargetListID int `json:"target_list_id"`
+
+	// Split.
+	Parts int `json:"parts"`
+
+	// Sample.
+	Percent float64 `json:"percent"`
+
+	// Name of the list(s) created by a split or sample. Defaults to the source list's name.
+	Name string `json:"name"`
+}
+
+// listOpResp is the response of a list operation with the job running in the
+// background and the lists created for it.
+type listOpResp struct {
+	Job   models.JobProgress `json:"job"`
+	Lists []models.List      `json:"lists"`
+}
+
+// handleListOp handles the merge, split, and sample list operations on a source list.
+// The lists for split and sample are created upfront and the subscriptions are copied
+// in the background. The job's progress is published on the event stream.
+func handleListOp(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		core  = auditCore(c, models.AuditSourceAPI)
+		id, _ = strconv.Atoi(c.Param("id"))
+		op    = c.Param("op")
+		req   listOpReq
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	src, err := getOpList(id, app)
+	if err != nil {
+		return err
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = src.Name
+	}
+
+	var (
+		out = listOpResp{Lists: []models.List{}}
+		run func(progress func(done, total int)) (int, error)
+	)
+	switch op {
+	case "merge":
+		if req.TargetListID == id {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "target_list_id"))
+		}
+		target, err := getOpList(req.TargetListID, app)
+		if err != nil {
+			return err
+		}
+		out.Lists = append(out.Lists, target)
+
+		run = func(progress func(done, total int)) (int, error) {
+			return core.MergeList(id, target.ID, app.constants.DBBatchSize, progress)
+		}
+
+	case "split":
+		if req.Parts < 2 || req.Parts > maxListSplitParts {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "parts"))
+		}
+
+		ids := make([]int, 0, req.Parts)
+		for i := 1; i <= req.Parts; i++ {
+			l, err := core.CreateList(newOpList(src, fmt.Sprintf("%s (%d/%d)", name, i, req.Parts)))
+			if err != nil {
+				return err
+			}
+			out.Lists = append(out.Lists, l)
+			ids = append(ids, l.ID)
+		}
+
+		run = func(progress func(done, total int)) (int, error) {
+			return core.SplitList(id, ids, app.constants.DBBatchSize, progress)
+		}
+
+	case "sample":
+		if req.Percent <= 0 || req.Percent > 100 {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "percent"))
+		}
+
+		l, err := core.CreateList(newOpList(src, fmt.Sprintf("%s (%g%% sample)", name, req.Percent)))
+		if err != nil {
+			return err
+		}
+		out.Lists = append(out.Lists, l)
+
+		run = func(progress func(done, total int)) (int, error) {
+			return core.SampleList(id, l.ID, req.Percent, app.constants.DBBatchSize, progress)
+		}
+
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidData"))
+	}
+
+	uu, err := uuid.NewV4()
+	if err != nil {
+		app.log.Printf("error generating UUID: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, app.i18n.Ts("globals.messages.internalError"))
+	}
+
+	job := models.JobProgress{
+		ID:     uu.String(),
+		Job:    "lists." + op,
+		Status: models.JobStatusRunning,
+	}
+	out.Job = job
+
+	go func() {
+		app.publishJobProgress(job)
+
+		n, err := run(func(done, total int) {
+			job.Done, job.Total = done, total
+			app.publishJobProgress(job)
+		})
+
+		job.Updated, job.Status = n, models.JobStatusFinished
+		if err != nil {
+			app.log.Printf("error running list %s on list %d: %v", op, id, err)
+			job.Status = models.JobStatusFailed
+		} else {
+			job.Done = job.Total
+		}
+		app.publishJobProgress(job)
+	}()
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// getOpList returns a list for a list operation. Dynamic lists have no subscriptions
+// to operate on.
+func getOpList(id int, app *App) (models.List, error) {
+	l, err := app.core.GetList(id, "")
+	if err != nil {
+		return models.List{}, err
+	}
+	if l.Type == models.ListTypeDynamic {
+		return models.List{}, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("lists.errorDynamicListOp"))
+	}
+
+	return l, nil
+}
+
+// newOpList returns a new list with the given name and the settings of the source list
+// of a list operation.
+func newOpList(src models.List, name string) models.List {
+	return models.List{
+		Name:        name,
+		Type:        src.Type,
+		Optin:       src.Optin,
+		Tags:        src.Tags,
+		Description: src.Description,
+
+		FromEmail:  src.FromEmail,
+		TemplateID: src.TemplateID,
+		Messenger:  src.Messenger,
+		ReplyTo:    src.ReplyTo,
+		Headers:    src.Headers,
+
+		ConsentText:       src.ConsentText,
+		OptinReminderDays: src.OptinReminderDays,
+		OptinExpiryDays:   src.OptinExpiryDays,
+	}
+}
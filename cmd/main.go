@@ -15,6 +15,7 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/knadh/koanf/providers/env"
 	"github.com/knadh/koanf/v2"
+	"github.com/knadh/listmonk/internal/attribs"
 	"github.com/knadh/listmonk/internal/bounce"
 	"github.com/knadh/listmonk/internal/buflog"
 	"github.com/knadh/listmonk/internal/captcha"
@@ -31,6 +32,10 @@ import (
 
 const (
 	emailMsgr = "email"
+
+	// Types of additional messengers in the `messengers` settings.
+	messengerTypePostback = "postback"
+	messengerTypeSink     = "sink"
 )
 
 // App contains the "global" components that are
@@ -43,6 +48,7 @@ type App struct {
 	constants  *constants
 	manager    *manager.Manager
 	importer   *subimporter.Importer
+	attribs    *attribs.Schema
 	messengers map[string]manager.Messenger
 	media      media.Store
 	i18n       *i18n.I18n
@@ -188,11 +194,13 @@ func main() {
 
 	// Load i18n language map.
 	app.i18n = initI18n(app.constants.Lang, fs)
+	app.attribs = initAttribSchema(app.i18n)
 	cOpt := &core.Opt{
 		Constants: core.Constants{
 			SendOptinConfirmation: app.constants.SendOptinConfirmation,
 			CacheSlowQueries:      ko.Bool("app.cache_slow_queries"),
 		},
+		Attribs: app.attribs,
 		Queries: queries,
 		DB:      db,
 		I18n:    app.i18n,
@@ -210,6 +218,10 @@ func main() {
 	app.queries = queries
 	app.manager = initCampaignManager(app.queries, app.constants, app)
 	app.importer = initImporter(app.queries, db, app.core, app)
+
+	// Export jobs that were running when the app was stopped can't be resumed.
+	_ = app.core.FailInterruptedExportJobs("interrupted by a restart")
+
 	app.notifTpls = initNotifTemplates("/email-templates/*.html", fs, app.i18n, app.constants)
 	initTxTemplates(app.manager, app)
 
@@ -226,6 +238,17 @@ func main() {
 		app.messengers[m.Name()] = m
 	}
 
+	// Initialize any sink messengers that write messages to disk.
+	for _, m := range initSinkMessengers(app.manager) {
+		app.messengers[m.Name()] = m
+	}
+
+	// Initialize any subprocess messengers in the config that stream messages
+	// to local executables.
+	for _, m := range initSubprocessMessengers(app.manager) {
+		app.messengers[m.Name()] = m
+	}
+
 	// Attach all messengers to the campaign manager.
 	for _, m := range app.messengers {
 		app.manager.AddMessenger(m)
@@ -238,6 +261,12 @@ func main() {
 	if cOpt.Constants.CacheSlowQueries {
 		initCron(app.core)
 	}
+	initEngagementCron(app.core)
+	initTrashCron(app.core)
+	initListStatsCron(app.core)
+	initExportCron(app)
+	initOptinCron(app.core)
+	initImportSources(app)
 
 	// Start the campaign workers. The campaign batches (fetch from DB, push out
 	// messages) get processed at the specified interval.
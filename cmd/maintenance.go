@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
 )
 
@@ -21,9 +22,9 @@ func handleGCSubscribers(c echo.Context) error {
 
 	switch typ {
 	case "blocklisted":
-		n, err = app.core.DeleteBlocklistedSubscribers()
+		n, err = auditCore(c, models.AuditSourceAPI).DeleteBlocklistedSubscribers()
 	case "orphan":
-		n, err = app.core.DeleteOrphanSubscribers()
+		n, err = auditCore(c, models.AuditSourceAPI).DeleteOrphanSubscribers()
 	default:
 		err = echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidData"))
 	}
@@ -48,7 +49,7 @@ func handleGCSubscriptions(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidData"))
 	}
 
-	n, err := app.core.DeleteUnconfirmedSubscriptions(t)
+	n, err := auditCore(c, models.AuditSourceAPI).DeleteUnconfirmedSubscriptions(t)
 	if err != nil {
 		return err
 	}
@@ -32,6 +32,12 @@ func newManagerStore(q *models.Queries, c *core.Core, m media.Store) *store {
 // campaigns that are also being processed. Additionally, it takes a map of campaignID:sentCount
 // of campaigns that are being processed and updates them in the DB.
 func (s *store) NextCampaigns(currentIDs []int64, sentCounts []int64) ([]*models.Campaign, error) {
+	// Record the recipients of campaigns that target segments or dynamic lists and are
+	// about to start. Such campaigns are only picked up once they are snapshotted.
+	// Errors are logged by core.
+	_ = s.core.SnapshotCampaignSegments()
+	_ = s.core.SnapshotCampaignLists()
+
 	var out []*models.Campaign
 	err := s.queries.NextCampaigns.Select(&out, pq.Int64Array(currentIDs), pq.Int64Array(sentCounts))
 	return out, err
@@ -11,6 +11,7 @@ import (
 const (
 	notifTplImport       = "import-status"
 	notifTplCampaign     = "campaign-status"
+	notifTplExport       = "export-status"
 	notifSubscriberOptin = "subscriber-optin"
 	notifSubscriberData  = "subscriber-data"
 )
@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/knadh/listmonk/internal/attribs"
 	"github.com/knadh/listmonk/internal/i18n"
 	"github.com/knadh/listmonk/internal/manager"
 	"github.com/knadh/listmonk/models"
@@ -66,6 +67,15 @@ type unsubTpl struct {
 	AllowWipe        bool
 	AllowPreferences bool
 	ShowManage       bool
+
+	// Attributes from the attribute schema that the subscriber can edit.
+	Attribs []publicAttrib
+}
+
+// publicAttrib represents a subscriber attribute on the preferences page.
+type publicAttrib struct {
+	models.AttribDef
+	Value string
 }
 
 type optinTpl struct {
@@ -231,12 +241,16 @@ func handleSubscriptionPage(c echo.Context) error {
 
 		out.Subscriptions = make([]models.Subscription, 0, len(subs))
 		for _, s := range subs {
-			if s.Type == models.ListTypePrivate {
+			if s.Type == models.ListTypePrivate || s.Type == models.ListTypeDynamic {
 				continue
 			}
 
 			out.Subscriptions = append(out.Subscriptions, s)
 		}
+
+		for _, a := range app.attribs.Public() {
+			out.Attribs = append(out.Attribs, publicAttrib{AttribDef: a, Value: attribs.String(s.Attribs[a.Name])})
+		}
 	}
 
 	return c.Render(http.StatusOK, "subscription", out)
@@ -276,7 +290,7 @@ func handleSubscriptionPrefs(c echo.Context) error {
 					"name", app.i18n.T("globals.terms.subscriber"))))
 		}
 		sub.Status = models.SubscriberStatusDisabled
-		if _, err := app.core.UpdateSubscriber(sub.ID, sub); err != nil {
+		if _, err := auditCore(c, models.AuditSourcePublic).UpdateSubscriber(sub.ID, sub); err != nil {
 			return c.Render(http.StatusInternalServerError, tplMessage,
 				makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.T("public.errorProcessingRequest")))
 		}
@@ -287,7 +301,7 @@ func handleSubscriptionPrefs(c echo.Context) error {
 	// Simple unsubscribe.
 	blocklist := app.constants.Privacy.AllowBlocklist && req.Blocklist
 	if !req.Manage || blocklist {
-		if err := app.core.UnsubscribeByCampaign(subUUID, campUUID, blocklist); err != nil {
+		if err := auditCore(c, models.AuditSourcePublic).UnsubscribeByCampaign(subUUID, campUUID, blocklist); err != nil {
 			return c.Render(http.StatusInternalServerError, tplMessage,
 				makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.T("public.errorProcessingRequest")))
 		}
@@ -318,8 +332,21 @@ func handleSubscriptionPrefs(c echo.Context) error {
 	}
 	sub.Name = req.Name
 
-	// Update name.
-	if _, err := app.core.UpdateSubscriber(sub.ID, sub); err != nil {
+	// Editable attributes. The form fields are named attrib.$name.
+	params, _ := c.FormParams()
+	attr := make(map[string]string)
+	for _, a := range app.attribs.Public() {
+		if v, ok := params["attrib."+a.Name]; ok && len(v) > 0 {
+			attr[a.Name] = v[0]
+		}
+	}
+	if sub.Attribs, err = app.attribs.ValidatePublic(attr, sub.Attribs); err != nil {
+		return c.Render(http.StatusBadRequest, tplMessage,
+			makeMsgTpl(app.i18n.T("public.errorTitle"), "", err.Error()))
+	}
+
+	// Update name and attributes.
+	if _, err := auditCore(c, models.AuditSourcePublic).UpdateSubscriber(sub.ID, sub); err != nil {
 		return c.Render(http.StatusInternalServerError, tplMessage,
 			makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.T("public.errorProcessingRequest")))
 	}
@@ -338,7 +365,7 @@ func handleSubscriptionPrefs(c echo.Context) error {
 
 	unsubUUIDs := make([]string, 0, len(req.ListUUIDs))
 	for _, s := range subs {
-		if s.Type == models.ListTypePrivate {
+		if s.Type == models.ListTypePrivate || s.Type == models.ListTypeDynamic {
 			continue
 		}
 		if _, ok := reqUUIDs[s.UUID]; !ok {
@@ -347,7 +374,7 @@ func handleSubscriptionPrefs(c echo.Context) error {
 	}
 
 	// Unsubscribe from lists.
-	if err := app.core.UnsubscribeLists([]int{sub.ID}, nil, unsubUUIDs); err != nil {
+	if err := auditCore(c, models.AuditSourcePublic).UnsubscribeLists([]int{sub.ID}, nil, unsubUUIDs); err != nil {
 		return c.Render(http.StatusInternalServerError, tplMessage,
 			makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.T("public.errorProcessingRequest")))
 
@@ -411,7 +438,7 @@ func handleOptinPage(c echo.Context) error {
 			}
 		}
 
-		if err := app.core.ConfirmOptionSubscription(subUUID, out.ListUUIDs, meta); err != nil {
+		if err := auditCore(c, models.AuditSourceOptin).ConfirmOptionSubscription(subUUID, out.ListUUIDs, meta); err != nil {
 			app.log.Printf("error unsubscribing: %v", err)
 			return c.Render(http.StatusInternalServerError, tplMessage,
 				makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.Ts("public.errorProcessingRequest")))
@@ -644,8 +671,9 @@ func handleSelfExportSubscriberData(c echo.Context) error {
 }
 
 // handleWipeSubscriberData allows a subscriber to delete their data. The
-// profile and subscriptions are deleted, while the campaign_views and link
-// clicks remain as orphan data unconnected to any subscriber.
+// profile and subscriptions are deleted immediately without going to the trash,
+// while the campaign_views and link clicks remain as orphan data unconnected to
+// any subscriber.
 func handleWipeSubscriberData(c echo.Context) error {
 	var (
 		app     = c.Get("app").(*App)
@@ -658,7 +686,7 @@ func handleWipeSubscriberData(c echo.Context) error {
 			makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.Ts("public.invalidFeature")))
 	}
 
-	if err := app.core.DeleteSubscribers(nil, []string{subUUID}); err != nil {
+	if err := auditCore(c, models.AuditSourcePublic).WipeSubscribers(nil, []string{subUUID}); err != nil {
 		app.log.Printf("error wiping subscriber data: %s", err)
 		return c.Render(http.StatusInternalServerError, tplMessage,
 			makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.Ts("public.errorProcessingRequest")))
@@ -726,7 +754,7 @@ func processSubForm(c echo.Context) (bool, error) {
 	listUUIDs := pq.StringArray(req.FormListUUIDs)
 
 	// Insert the subscriber into the DB.
-	_, hasOptin, err := app.core.InsertSubscriber(models.Subscriber{
+	_, hasOptin, err := auditCore(c, models.AuditSourcePublic).InsertSubscriber(models.Subscriber{
 		Name:   req.Name,
 		Email:  req.Email,
 		Status: models.SubscriberStatusEnabled,
@@ -739,7 +767,7 @@ func processSubForm(c echo.Context) (bool, error) {
 				return false, err
 			}
 
-			_, hasOptin, err := app.core.UpdateSubscriberWithLists(sub.ID, sub, nil, listUUIDs, false, false)
+			_, hasOptin, err := auditCore(c, models.AuditSourcePublic).UpdateSubscriberWithLists(sub.ID, sub, nil, listUUIDs, false, false)
 			if err != nil {
 				return false, err
 			}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+)
+
+// handleGetSegments retrieves saved segments with their cached subscriber counts.
+func handleGetSegments(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		pg  = app.paginator.NewFromURL(c.Request().URL.Query())
+
+		query   = strings.TrimSpace(c.FormValue("query"))
+		orderBy = c.FormValue("order_by")
+		order   = c.FormValue("order")
+		id, _   = strconv.Atoi(c.Param("id"))
+
+		out models.PageResults
+	)
+
+	// Fetch one segment.
+	if id > 0 {
+		out, err := app.core.GetSegment(id)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, okResp{out})
+	}
+
+	res, total, err := app.core.QuerySegments(query, orderBy, order, pg.Offset, pg.Limit)
+	if err != nil {
+		return err
+	}
+
+	out.Query = query
+	out.Results = res
+	out.Total = total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCreateSegment handles segment creation.
+func handleCreateSegment(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		s   = models.Segment{}
+	)
+
+	if err := c.Bind(&s); err != nil {
+		return err
+	}
+
+	if err := validateSegment(s, app); err != nil {
+		return err
+	}
+
+	out, err := app.core.CreateSegment(s)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleUpdateSegment handles segment modification.
+func handleUpdateSegment(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var s models.Segment
+	if err := c.Bind(&s); err != nil {
+		return err
+	}
+
+	if err := validateSegment(s, app); err != nil {
+		return err
+	}
+
+	out, err := app.core.UpdateSegment(id, s)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleRefreshSegmentCount re-counts the subscribers in a segment.
+func handleRefreshSegmentCount(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	out, err := app.core.RefreshSegmentCount(id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleDeleteSegments handles segment deletion.
+func handleDeleteSegments(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if err := app.core.DeleteSegments([]int{id}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// validateSegment validates the fields of a segment.
+func validateSegment(s models.Segment, app *App) error {
+	if !strHasLen(s.Name, 1, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("segments.invalidName"))
+	}
+
+	if strings.TrimSpace(s.Query) == "" && s.Filter == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("segments.emptyQuery"))
+	}
+
+	return nil
+}
@@ -17,7 +17,10 @@ import (
 	"github.com/knadh/koanf/parsers/json"
 	"github.com/knadh/koanf/providers/rawbytes"
 	"github.com/knadh/koanf/v2"
+	"github.com/knadh/listmonk/internal/attribs"
 	"github.com/knadh/listmonk/internal/messenger/email"
+	"github.com/knadh/listmonk/internal/messenger/sink"
+	"github.com/knadh/listmonk/internal/subimporter"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
 )
@@ -60,6 +63,9 @@ func handleGetSettings(c echo.Context) error {
 	// Empty out passwords.
 	for i := 0; i < len(s.SMTP); i++ {
 		s.SMTP[i].Password = strings.Repeat(pwdMask, utf8.RuneCountInString(s.SMTP[i].Password))
+		for j := 0; j < len(s.SMTP[i].DKIM); j++ {
+			s.SMTP[i].DKIM[j].PrivateKey = strings.Repeat(pwdMask, utf8.RuneCountInString(s.SMTP[i].DKIM[j].PrivateKey))
+		}
 	}
 	for i := 0; i < len(s.BounceBoxes); i++ {
 		s.BounceBoxes[i].Password = strings.Repeat(pwdMask, utf8.RuneCountInString(s.BounceBoxes[i].Password))
@@ -67,6 +73,15 @@ func handleGetSettings(c echo.Context) error {
 	for i := 0; i < len(s.Messengers); i++ {
 		s.Messengers[i].Password = strings.Repeat(pwdMask, utf8.RuneCountInString(s.Messengers[i].Password))
 	}
+
+	// Import source headers usually carry credentials.
+	for i := 0; i < len(s.ImportSources); i++ {
+		for _, h := range s.ImportSources[i].Headers {
+			for k, v := range h {
+				h[k] = strings.Repeat(pwdMask, utf8.RuneCountInString(v))
+			}
+		}
+	}
 	s.UploadS3AwsSecretAccessKey = strings.Repeat(pwdMask, utf8.RuneCountInString(s.UploadS3AwsSecretAccessKey))
 	s.SendgridKey = strings.Repeat(pwdMask, utf8.RuneCountInString(s.SendgridKey))
 	s.SecurityCaptchaSecret = strings.Repeat(pwdMask, utf8.RuneCountInString(s.SecurityCaptchaSecret))
@@ -112,6 +127,11 @@ func handleUpdateSettings(c echo.Context) error {
 		// This is a common mistake when copy-pasting SMTP settings.
 		set.SMTP[i].Host = strings.TrimSpace(s.Host)
 
+		// Servers without a weight get an equal share of messages.
+		if s.Weight < 1 {
+			set.SMTP[i].Weight = 1
+		}
+
 		// If there's no password coming in from the frontend, copy the existing
 		// password by matching the UUID.
 		if s.Password == "" {
@@ -121,6 +141,22 @@ func handleUpdateSettings(c echo.Context) error {
 				}
 			}
 		}
+
+		// Similarly, copy existing DKIM private keys by matching the UUID and the domain.
+		for j, d := range s.DKIM {
+			set.SMTP[i].DKIM[j].Domain = strings.ToLower(strings.TrimSpace(d.Domain))
+			if d.PrivateKey == "" {
+				set.SMTP[i].DKIM[j].PrivateKey = getSMTPDKIMKey(cur, s.UUID, set.SMTP[i].DKIM[j].Domain)
+			}
+
+			// An invalid key would fail the SMTP messenger on reload.
+			if s.Enabled {
+				if err := email.ValidateDKIMKey(email.DKIMKey(set.SMTP[i].DKIM[j])); err != nil {
+					return echo.NewHTTPError(http.StatusBadRequest,
+						app.i18n.Ts("globals.messages.invalidFields", "name", "dkim: "+err.Error()))
+				}
+			}
+		}
 	}
 	if !has {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("settings.errorNoSMTP"))
@@ -186,6 +222,25 @@ func handleUpdateSettings(c echo.Context) error {
 
 		set.Messengers[i].Name = name
 		names[name] = true
+
+		switch m.Type {
+		case "", messengerTypePostback:
+			set.Messengers[i].Type = messengerTypePostback
+		case messengerTypeSink:
+			// Directories are restricted to the sink root in the config.
+			dir, err := sink.Dir(ko.String("app.sink_root"), strings.TrimSpace(m.Directory))
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest,
+					app.i18n.Ts("globals.messages.invalidFields", "name", name+": directory: "+err.Error()))
+			}
+			set.Messengers[i].Directory = dir
+			if m.Format != sink.FormatEML && m.Format != sink.FormatMbox {
+				set.Messengers[i].Format = sink.FormatEML
+			}
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidFields", "name", name+": type"))
+		}
 	}
 
 	// S3 password?
@@ -216,6 +271,17 @@ func handleUpdateSettings(c echo.Context) error {
 	}
 	set.DomainBlocklist = doms
 
+	if set.PrivacyTrashRetentionDays < 0 {
+		set.PrivacyTrashRetentionDays = 0
+	}
+
+	// Validate the subscriber attribute schema.
+	sch, err := attribs.New(set.Attribs, app.i18n)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	set.Attribs = sch.Defs()
+
 	// Validate slow query caching cron.
 	if set.CacheSlowQueries {
 		if _, err := cron.ParseStandard(set.CacheSlowQueriesInterval); err != nil {
@@ -223,6 +289,121 @@ func handleUpdateSettings(c echo.Context) error {
 		}
 	}
 
+	// Validate the engagement scoring cron and the sunset policy.
+	if _, err := cron.ParseStandard(set.EngagementScoreInterval); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": engagement cron: "+err.Error())
+	}
+	if set.EngagementHalfLifeDays < 1 {
+		set.EngagementHalfLifeDays = 30
+	}
+	if set.SunsetEnabled {
+		// Without individual tracking, views and clicks aren't recorded against subscribers,
+		// and every subscriber would appear to be inactive.
+		if !set.PrivacyIndividualTracking {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("settings.engagement.sunsetNeedsTracking"))
+		}
+		if set.SunsetDays < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "sunset_days"))
+		}
+		switch set.SunsetAction {
+		case models.SunsetActionUnsubscribe:
+		case models.SunsetActionMove:
+			if set.SunsetListID < 1 {
+				return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("settings.engagement.invalidList"))
+			}
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "sunset_action"))
+		}
+	}
+
+	// Validate the import sources.
+	for i, s := range set.ImportSources {
+		// UUID to keep track of header changes similar to the SMTP logic above.
+		if s.UUID == "" {
+			set.ImportSources[i].UUID = uuid.Must(uuid.NewV4()).String()
+		}
+
+		name := strings.TrimSpace(s.Name)
+		if name == "" {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidFields", "name", "import source: name"))
+		}
+		set.ImportSources[i].Name = name
+
+		switch s.Type {
+		case models.ImportSourceURL:
+			set.ImportSources[i].URL = strings.TrimSpace(s.URL)
+			if !strHasLen(set.ImportSources[i].URL, 1, stdInputMaxLen) ||
+				!(strings.HasPrefix(set.ImportSources[i].URL, "http://") || strings.HasPrefix(set.ImportSources[i].URL, "https://")) {
+				return echo.NewHTTPError(http.StatusBadRequest,
+					app.i18n.Ts("globals.messages.invalidFields", "name", name+": url"))
+			}
+		case models.ImportSourceDir:
+			set.ImportSources[i].Directory = strings.TrimSpace(s.Directory)
+			if set.ImportSources[i].Directory == "" {
+				return echo.NewHTTPError(http.StatusBadRequest,
+					app.i18n.Ts("globals.messages.invalidFields", "name", name+": directory"))
+			}
+
+			// Directories are restricted to the import source root in the config.
+			dir, err := app.importer.SourceDir(set.ImportSources[i].Directory)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest,
+					app.i18n.Ts("globals.messages.invalidFields", "name", name+": directory: "+err.Error()))
+			}
+			set.ImportSources[i].Directory = dir
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidFields", "name", name+": type"))
+		}
+
+		if _, err := cron.ParseStandard(s.Cron); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": "+name+" cron: "+err.Error())
+		}
+
+		if s.Mode != subimporter.ModeSubscribe && s.Mode != subimporter.ModeBlocklist {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("import.invalidMode"))
+		}
+		if s.SubStatus == "" {
+			set.ImportSources[i].SubStatus = models.SubscriptionStatusUnconfirmed
+			if s.Mode == subimporter.ModeBlocklist {
+				set.ImportSources[i].SubStatus = models.SubscriptionStatusUnsubscribed
+			}
+		}
+		if s.EmptyCells != subimporter.EmptyCellsClear {
+			set.ImportSources[i].EmptyCells = subimporter.EmptyCellsKeep
+		}
+		if len(s.Delim) != 1 {
+			set.ImportSources[i].Delim = ","
+		}
+		if s.ListIDs == nil {
+			set.ImportSources[i].ListIDs = []int{}
+		}
+		if s.Headers == nil {
+			set.ImportSources[i].Headers = []map[string]string{}
+		}
+
+		// If there's no header value coming in from the frontend, copy the existing
+		// value by matching the UUID and the header.
+		for _, h := range s.Headers {
+			for k, v := range h {
+				if v != "" {
+					continue
+				}
+				for _, c := range cur.ImportSources {
+					if c.UUID != s.UUID {
+						continue
+					}
+					for _, ch := range c.Headers {
+						if cv, ok := ch[k]; ok {
+							h[k] = cv
+						}
+					}
+				}
+			}
+		}
+	}
+
 	// Update the settings in the DB.
 	if err := app.core.UpdateSettings(set); err != nil {
 		return err
@@ -284,6 +465,20 @@ func handleTestSMTPSettings(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.missingFields", "name", "email"))
 	}
 
+	// DKIM private keys aren't sent back from the frontend unless changed.
+	// Copy the existing ones from the DB.
+	for i, d := range req.DKIM {
+		if d.PrivateKey != "" {
+			continue
+		}
+
+		cur, err := app.core.GetSettings()
+		if err != nil {
+			return err
+		}
+		req.DKIM[i].PrivateKey = getSMTPDKIMKey(cur, ko.String("uuid"), strings.ToLower(strings.TrimSpace(d.Domain)))
+	}
+
 	// Initialize a new SMTP pool.
 	req.MaxConns = 1
 	req.IdleTimeout = time.Second * 2
@@ -313,6 +508,57 @@ func handleTestSMTPSettings(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{app.bufLog.Lines()})
 }
 
+// handleTestDKIMSettings signs a sample message with the given DKIM key and
+// verifies the signature against the key's public key and the one published in DNS.
+func handleTestDKIMSettings(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	var req struct {
+		email.DKIMKey
+
+		// UUID of the SMTP server to pick the existing private key from
+		// if there's no key in the request.
+		UUID string `json:"uuid"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	req.Domain = strings.ToLower(strings.TrimSpace(req.Domain))
+	if req.PrivateKey == "" && req.UUID != "" {
+		cur, err := app.core.GetSettings()
+		if err != nil {
+			return err
+		}
+		req.PrivateKey = getSMTPDKIMKey(cur, req.UUID, req.Domain)
+	}
+
+	out, err := email.TestDKIM(req.DKIMKey)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// getSMTPDKIMKey returns the DKIM private key of a domain in the SMTP
+// server with the given UUID from the settings.
+func getSMTPDKIMKey(set models.Settings, uuid, domain string) string {
+	for _, s := range set.SMTP {
+		if s.UUID != uuid {
+			continue
+		}
+
+		for _, d := range s.DKIM {
+			if d.Domain == domain {
+				return d.PrivateKey
+			}
+		}
+	}
+
+	return ""
+}
+
 func handleGetAboutInfo(c echo.Context) error {
 	var (
 		app = c.Get("app").(*App)
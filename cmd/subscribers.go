@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/gofrs/uuid/v5"
 	"github.com/knadh/listmonk/internal/subimporter"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
@@ -22,12 +23,13 @@ const (
 // subQueryReq is a "catch all" struct for reading various
 // subscriber related requests.
 type subQueryReq struct {
-	Query         string `json:"query"`
-	ListIDs       []int  `json:"list_ids"`
-	TargetListIDs []int  `json:"target_list_ids"`
-	SubscriberIDs []int  `json:"ids"`
-	Action        string `json:"action"`
-	Status        string `json:"status"`
+	Query         string                `json:"query"`
+	Filter        *models.SegmentFilter `json:"filter"`
+	ListIDs       []int                 `json:"list_ids"`
+	TargetListIDs []int                 `json:"target_list_ids"`
+	SubscriberIDs []int                 `json:"ids"`
+	Action        string                `json:"action"`
+	Status        string                `json:"status"`
 }
 
 // subProfileData represents a subscriber's collated data in JSON
@@ -101,7 +103,13 @@ func handleQuerySubscribers(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
 
-	res, total, err := app.core.QuerySubscribers(query, listIDs, subStatus, order, orderBy, pg.Offset, pg.Limit)
+	// Optional structured segment filter.
+	filter, err := getSegmentFilter(c.FormValue("filter"), app)
+	if err != nil {
+		return err
+	}
+
+	res, total, err := app.core.QuerySubscribers(query, filter, listIDs, subStatus, order, orderBy, pg.Offset, pg.Limit)
 	if err != nil {
 		return err
 	}
@@ -139,8 +147,14 @@ func handleExportSubscribers(c echo.Context) error {
 	// Filter by subscription status
 	subStatus := c.QueryParam("subscription_status")
 
+	// Optional structured segment filter.
+	filter, err := getSegmentFilter(c.FormValue("filter"), app)
+	if err != nil {
+		return err
+	}
+
 	// Get the batched export iterator.
-	exp, err := app.core.ExportSubscribers(query, subIDs, listIDs, subStatus, app.constants.DBBatchSize)
+	exp, err := app.core.ExportSubscribers(query, filter, subIDs, listIDs, subStatus, app.constants.DBBatchSize)
 	if err != nil {
 		return err
 	}
@@ -202,7 +216,7 @@ func handleCreateSubscriber(c echo.Context) error {
 	}
 
 	// Insert the subscriber into the DB.
-	sub, _, err := app.core.InsertSubscriber(req.Subscriber, req.Lists, req.ListUUIDs, req.PreconfirmSubs)
+	sub, _, err := auditCore(c, models.AuditSourceAPI).InsertSubscriber(req.Subscriber, req.Lists, req.ListUUIDs, req.PreconfirmSubs)
 	if err != nil {
 		return err
 	}
@@ -241,7 +255,7 @@ func handleUpdateSubscriber(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("subscribers.invalidName"))
 	}
 
-	out, _, err := app.core.UpdateSubscriberWithLists(id, req.Subscriber, req.Lists, nil, req.PreconfirmSubs, true)
+	out, _, err := auditCore(c, models.AuditSourceAPI).UpdateSubscriberWithLists(id, req.Subscriber, req.Lists, nil, req.PreconfirmSubs, true)
 	if err != nil {
 		return err
 	}
@@ -305,7 +319,7 @@ func handleBlocklistSubscribers(c echo.Context) error {
 		subIDs = req.SubscriberIDs
 	}
 
-	if err := app.core.BlocklistSubscribers(subIDs); err != nil {
+	if err := auditCore(c, models.AuditSourceAPI).BlocklistSubscribers(subIDs); err != nil {
 		return err
 	}
 
@@ -350,11 +364,11 @@ func handleManageSubscriberLists(c echo.Context) error {
 	var err error
 	switch req.Action {
 	case "add":
-		err = app.core.AddSubscriptions(subIDs, req.TargetListIDs, req.Status)
+		err = auditCore(c, models.AuditSourceAPI).AddSubscriptions(subIDs, req.TargetListIDs, req.Status)
 	case "remove":
-		err = app.core.DeleteSubscriptions(subIDs, req.TargetListIDs)
+		err = auditCore(c, models.AuditSourceAPI).DeleteSubscriptions(subIDs, req.TargetListIDs)
 	case "unsubscribe":
-		err = app.core.UnsubscribeLists(subIDs, req.TargetListIDs, nil)
+		err = auditCore(c, models.AuditSourceAPI).UnsubscribeLists(subIDs, req.TargetListIDs, nil)
 	default:
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("subscribers.invalidAction"))
 	}
@@ -396,26 +410,192 @@ func handleDeleteSubscribers(c echo.Context) error {
 		subIDs = i
 	}
 
-	if err := app.core.DeleteSubscribers(subIDs, nil); err != nil {
+	if err := auditCore(c, models.AuditSourceAPI).DeleteSubscribers(subIDs, nil); err != nil {
 		return err
 	}
 
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
-// handleDeleteSubscribersByQuery bulk deletes based on an
-// arbitrary SQL expression.
-func handleDeleteSubscribersByQuery(c echo.Context) error {
+// handleQueryDuplicateSubscribers handles retrieval of groups of likely duplicate
+// subscribers. Subscribers are matched on their normalized e-mails and optionally,
+// on the attributes given in the ?attrib= query params.
+func handleQueryDuplicateSubscribers(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		pg  = app.paginator.NewFromURL(c.Request().URL.Query())
+		out models.PageResults
+	)
+
+	attribs := []string{}
+	for _, a := range c.QueryParams()["attrib"] {
+		if a = strings.TrimSpace(a); a != "" {
+			attribs = append(attribs, a)
+		}
+	}
+
+	res, total, err := app.core.QueryDuplicateSubscribers(attribs, pg.Offset, pg.Limit)
+	if err != nil {
+		return err
+	}
+
+	out.Results = res
+	out.Total = total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleQuerySunsetSubscribers handles the dry-run report of the sunset policy, that is,
+// the subscribers that the policy would unsubscribe or move if it were applied now.
+// The policy in the settings can be overridden with the days, action, and list_id params.
+func handleQuerySunsetSubscribers(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		pg  = app.paginator.NewFromURL(c.Request().URL.Query())
+		p   = sunsetPolicyFromConfig()
+		out models.PageResults
+	)
+
+	if v := c.QueryParam("days"); v != "" {
+		p.Days, _ = strconv.Atoi(v)
+	}
+	if v := c.QueryParam("action"); v != "" {
+		p.Action = v
+	}
+	if v := c.QueryParam("list_id"); v != "" {
+		p.ListID, _ = strconv.Atoi(v)
+	}
+
+	if !app.constants.Privacy.IndividualTracking {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("settings.engagement.sunsetNeedsTracking"))
+	}
+
+	res, total, err := app.core.QuerySunsetSubscribers(p, pg.Offset, pg.Limit)
+	if err != nil {
+		return err
+	}
+
+	out.Results = res
+	out.Total = total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleMergeSubscribers handles merging the subscribers in the request body
+// into the subscriber in the URI. The merged subscribers are deleted.
+func handleMergeSubscribers(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		req   subQueryReq
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if len(req.SubscriberIDs) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("subscribers.errorNoIDs"))
+	}
+
+	out, err := auditCore(c, models.AuditSourceAPI).MergeSubscribers(id, req.SubscriberIDs)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleQueryTrashedSubscribers handles retrieval of the subscribers in the trash.
+func handleQueryTrashedSubscribers(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		pg  = app.paginator.NewFromURL(c.Request().URL.Query())
+		out models.PageResults
+	)
+
+	res, total, err := app.core.QueryTrashedSubscribers(c.QueryParam("query"), pg.Offset, pg.Limit)
+	if err != nil {
+		return err
+	}
+
+	out.Results = res
+	out.Total = total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleRestoreSubscribers handles restoring the subscribers in the request body
+// from the trash.
+func handleRestoreSubscribers(c echo.Context) error {
 	var (
 		app = c.Get("app").(*App)
 		req subQueryReq
 	)
 
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if len(req.SubscriberIDs) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("subscribers.errorNoIDs"))
+	}
+
+	n, err := auditCore(c, models.AuditSourceAPI).RestoreSubscribers(req.SubscriberIDs)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{struct {
+		Count int `json:"count"`
+	}{n}})
+}
+
+// handlePurgeTrashedSubscribers handles permanently deleting subscribers in the trash.
+// It takes a list of IDs in the query params, or all=true to empty the trash.
+func handlePurgeTrashedSubscribers(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		all = c.QueryParam("all") == "true"
+	)
+
+	subIDs, err := parseStringIDs(c.Request().URL.Query()["id"])
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.errorInvalidIDs", "error", err.Error()))
+	}
+	if len(subIDs) == 0 && !all {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("subscribers.errorNoIDs"))
+	}
+
+	n, err := auditCore(c, models.AuditSourceAPI).PurgeTrashedSubscribers(subIDs, 0)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{struct {
+		Count int `json:"count"`
+	}{n}})
+}
+
+// handleDeleteSubscribersByQuery bulk deletes (moves to the trash) based on an
+// arbitrary SQL expression.
+func handleDeleteSubscribersByQuery(c echo.Context) error {
+	var req subQueryReq
+
 	if err := c.Bind(&req); err != nil {
 		return err
 	}
 
-	if err := app.core.DeleteSubscribersByQuery(req.Query, req.ListIDs); err != nil {
+	if err := auditCore(c, models.AuditSourceAPI).DeleteSubscribersByQuery(req.Query, req.Filter, req.ListIDs); err != nil {
 		return err
 	}
 
@@ -425,22 +605,87 @@ func handleDeleteSubscribersByQuery(c echo.Context) error {
 // handleBlocklistSubscribersByQuery bulk blocklists subscribers
 // based on an arbitrary SQL expression.
 func handleBlocklistSubscribersByQuery(c echo.Context) error {
-	var (
-		app = c.Get("app").(*App)
-		req subQueryReq
-	)
+	var req subQueryReq
 
 	if err := c.Bind(&req); err != nil {
 		return err
 	}
 
-	if err := app.core.BlocklistSubscribersByQuery(req.Query, req.ListIDs); err != nil {
+	if err := auditCore(c, models.AuditSourceAPI).BlocklistSubscribersByQuery(req.Query, req.Filter, req.ListIDs); err != nil {
 		return err
 	}
 
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
+// handleUpdateSubscriberAttribsByQuery bulk updates the attributes of the given
+// subscribers, or subscribers matching an arbitrary SQL expression, with a JSON merge
+// patch or JSON patch operations. The update runs in the background and its progress
+// is published on the event stream.
+func handleUpdateSubscriberAttribsByQuery(c echo.Context) error {
+	var (
+		app  = c.Get("app").(*App)
+		core = auditCore(c, models.AuditSourceAPI)
+		req  struct {
+			subQueryReq
+			models.AttribsUpdate
+		}
+	)
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if err := core.ValidateAttribsUpdate(req.AttribsUpdate); err != nil {
+		return err
+	}
+
+	// Snapshot the matching subscribers so that the update doesn't run on
+	// subscribers that start matching the query as it's being updated.
+	subIDs := req.SubscriberIDs
+	if len(subIDs) == 0 {
+		ids, err := core.QuerySubscriberIDs(req.Query, req.Filter, req.ListIDs)
+		if err != nil {
+			return err
+		}
+		subIDs = ids
+	}
+
+	uu, err := uuid.NewV4()
+	if err != nil {
+		app.log.Printf("error generating UUID: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, app.i18n.Ts("globals.messages.internalError"))
+	}
+
+	job := models.JobProgress{
+		ID:     uu.String(),
+		Job:    "subscribers.attribs",
+		Status: models.JobStatusRunning,
+		Total:  len(subIDs),
+	}
+	out := job
+
+	go func() {
+		app.publishJobProgress(job)
+
+		updated, failed, err := core.UpdateSubscribersAttribs(subIDs, req.AttribsUpdate, app.constants.DBBatchSize,
+			func(done, updated, failed int) {
+				job.Done, job.Updated, job.Failed = done, updated, failed
+				app.publishJobProgress(job)
+			})
+
+		job.Updated, job.Failed, job.Status = updated, failed, models.JobStatusFinished
+		if err != nil {
+			app.log.Printf("error updating subscriber attributes: %v", err)
+			job.Status = models.JobStatusFailed
+		} else {
+			job.Done = job.Total
+		}
+		app.publishJobProgress(job)
+	}()
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
 // handleManageSubscriberListsByQuery bulk adds/removes/unsubscribes subscribers
 // from one or more lists based on an arbitrary SQL expression.
 func handleManageSubscriberListsByQuery(c echo.Context) error {
@@ -461,11 +706,11 @@ func handleManageSubscriberListsByQuery(c echo.Context) error {
 	var err error
 	switch req.Action {
 	case "add":
-		err = app.core.AddSubscriptionsByQuery(req.Query, req.ListIDs, req.TargetListIDs, req.Status)
+		err = auditCore(c, models.AuditSourceAPI).AddSubscriptionsByQuery(req.Query, req.Filter, req.ListIDs, req.TargetListIDs, req.Status)
 	case "remove":
-		err = app.core.DeleteSubscriptionsByQuery(req.Query, req.ListIDs, req.TargetListIDs)
+		err = auditCore(c, models.AuditSourceAPI).DeleteSubscriptionsByQuery(req.Query, req.Filter, req.ListIDs, req.TargetListIDs)
 	case "unsubscribe":
-		err = app.core.UnsubscribeListsByQuery(req.Query, req.ListIDs, req.TargetListIDs)
+		err = auditCore(c, models.AuditSourceAPI).UnsubscribeListsByQuery(req.Query, req.Filter, req.ListIDs, req.TargetListIDs)
 	default:
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("subscribers.invalidAction"))
 	}
@@ -528,7 +773,7 @@ func handleExportSubscriberData(c echo.Context) error {
 }
 
 // exportSubscriberData collates the data of a subscriber including profile,
-// subscriptions, campaign_views, link_clicks (if they're enabled in the config)
+// subscriptions, campaign_views, link_clicks, audit (if they're enabled in the config)
 // and returns a formatted, indented JSON payload. Either takes a numeric id
 // and an empty subUUID or takes 0 and a string subUUID.
 func exportSubscriberData(id int, subUUID string, exportables map[string]bool, app *App) (models.SubscriberExportProfile, []byte, error) {
@@ -550,6 +795,9 @@ func exportSubscriberData(id int, subUUID string, exportables map[string]bool, a
 	if _, ok := exportables["link_clicks"]; !ok {
 		data.LinkClicks = nil
 	}
+	if _, ok := exportables["audit"]; !ok {
+		data.Audit = nil
+	}
 
 	// Marshal the data into an indented payload.
 	b, err := json.MarshalIndent(data, "", "  ")
@@ -595,6 +843,21 @@ func getQueryInts(param string, qp url.Values) ([]int, error) {
 	return out, nil
 }
 
+// getSegmentFilter parses an optional JSON segment filter from a request param.
+func getSegmentFilter(v string, app *App) (*models.SegmentFilter, error) {
+	if strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+
+	var f models.SegmentFilter
+	if err := json.Unmarshal([]byte(v), &f); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("subscribers.invalidFilter", "error", err.Error()))
+	}
+
+	return &f, nil
+}
+
 // sendOptinConfirmationHook returns an enclosed callback that sends optin confirmation e-mails.
 // This is plugged into the 'core' package to send optin confirmations when a new subscriber is
 // created via `core.CreateSubscriber()`.
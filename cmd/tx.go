@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/knadh/listmonk/internal/manager"
+	"github.com/knadh/listmonk/internal/subimporter"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
 )
@@ -80,40 +81,21 @@ func handleSendTxMessage(c echo.Context) error {
 			app.i18n.Ts("globals.messages.notFound", "name", fmt.Sprintf("template %d", m.TemplateID)))
 	}
 
+	// Resolve the recipients.
 	var (
-		num      = len(m.SubscriberEmails)
-		isEmails = true
+		subs     []models.Subscriber
+		notFound []string
 	)
-	if len(m.SubscriberIDs) > 0 {
-		num = len(m.SubscriberIDs)
-		isEmails = false
+	if m.SubscriberMode == models.TxSubscriberModeExternal {
+		subs, notFound, err = getTxExternalRecipients(m, app)
+	} else {
+		subs, notFound, err = getTxSubscribers(m, app)
+	}
+	if err != nil {
+		return err
 	}
 
-	notFound := []string{}
-	for n := 0; n < num; n++ {
-		var (
-			subID    int
-			subEmail string
-		)
-
-		if !isEmails {
-			subID = m.SubscriberIDs[n]
-		} else {
-			subEmail = m.SubscriberEmails[n]
-		}
-
-		// Get the subscriber.
-		sub, err := app.core.GetSubscriber(subID, "", subEmail)
-		if err != nil {
-			// If the subscriber is not found, log that error and move on without halting on the list.
-			if er, ok := err.(*echo.HTTPError); ok && er.Code == http.StatusBadRequest {
-				notFound = append(notFound, fmt.Sprintf("%v", er.Message))
-				continue
-			}
-
-			return err
-		}
-
+	for _, sub := range subs {
 		// Render the message.
 		if err := m.Render(sub, tpl); err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest,
@@ -160,7 +142,110 @@ func handleSendTxMessage(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
+// getTxSubscribers looks up the subscribers (by ID or e-mail) to whom a tx message
+// is to be sent. Subscribers that aren't found are returned as error messages.
+func getTxSubscribers(m models.TxMessage, app *App) ([]models.Subscriber, []string, error) {
+	var (
+		num      = len(m.SubscriberEmails)
+		isEmails = true
+	)
+	if len(m.SubscriberIDs) > 0 {
+		num = len(m.SubscriberIDs)
+		isEmails = false
+	}
+
+	var (
+		out      = make([]models.Subscriber, 0, num)
+		notFound = []string{}
+	)
+	for n := 0; n < num; n++ {
+		var (
+			subID    int
+			subEmail string
+		)
+
+		if !isEmails {
+			subID = m.SubscriberIDs[n]
+		} else {
+			subEmail = m.SubscriberEmails[n]
+		}
+
+		// Get the subscriber.
+		sub, err := app.core.GetSubscriber(subID, "", subEmail)
+		if err != nil {
+			// If the subscriber is not found, log that error and move on without halting on the list.
+			if er, ok := err.(*echo.HTTPError); ok && er.Code == http.StatusBadRequest {
+				notFound = append(notFound, fmt.Sprintf("%v", er.Message))
+				continue
+			}
+
+			return nil, nil, err
+		}
+
+		out = append(out, sub)
+	}
+
+	return out, notFound, nil
+}
+
+// getTxExternalRecipients prepares synthetic subscribers from the raw recipients
+// in a tx message without them having to exist in the subscribers table. Addresses
+// that are blocklisted or have hard bounced are skipped and returned as error messages.
+func getTxExternalRecipients(m models.TxMessage, app *App) ([]models.Subscriber, []string, error) {
+	emails := make([]string, 0, len(m.Recipients))
+	for _, r := range m.Recipients {
+		emails = append(emails, r.Email)
+	}
+
+	sup, err := app.core.GetSuppressedEmails(emails)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		out        = make([]models.Subscriber, 0, len(m.Recipients))
+		suppressed = []string{}
+	)
+	for _, r := range m.Recipients {
+		if strSliceContains(strings.ToLower(r.Email), sup) {
+			suppressed = append(suppressed, app.i18n.Ts("subscribers.suppressed", "email", r.Email))
+			continue
+		}
+
+		attribs := r.Attribs
+		if attribs == nil {
+			attribs = models.JSON{}
+		}
+
+		out = append(out, models.Subscriber{
+			Email:   r.Email,
+			Name:    r.Name,
+			Attribs: attribs,
+			Status:  models.SubscriberStatusEnabled,
+		})
+	}
+
+	return out, suppressed, nil
+}
+
 func validateTxMessage(m models.TxMessage, app *App) (models.TxMessage, error) {
+	if m.SubscriberMode == "" {
+		m.SubscriberMode = models.TxSubscriberModeDefault
+	}
+
+	switch m.SubscriberMode {
+	case models.TxSubscriberModeDefault:
+		if len(m.Recipients) > 0 {
+			return m, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidFields", "name", "`recipients` require `subscriber_mode` external"))
+		}
+	case models.TxSubscriberModeExternal:
+		return validateTxExternalMessage(m, app)
+	default:
+		return m, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "subscriber_mode"))
+	}
+
 	if len(m.SubscriberEmails) > 0 && m.SubscriberEmail != "" {
 		return m, echo.NewHTTPError(http.StatusBadRequest,
 			app.i18n.Ts("globals.messages.invalidFields", "name", "do not send `subscriber_email`"))
@@ -193,6 +278,50 @@ func validateTxMessage(m models.TxMessage, app *App) (models.TxMessage, error) {
 		}
 	}
 
+	return validateTxMessageMeta(m, app)
+}
+
+// validateTxExternalMessage validates a tx message whose recipients are raw
+// addresses that aren't looked up in the subscribers table.
+func validateTxExternalMessage(m models.TxMessage, app *App) (models.TxMessage, error) {
+	if len(m.SubscriberIDs) > 0 || m.SubscriberID != 0 {
+		return m, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "`subscriber_ids` cannot be used with `subscriber_mode` external"))
+	}
+
+	// Plain e-mails are treated as recipients without names or attributes.
+	if m.SubscriberEmail != "" {
+		m.SubscriberEmails = append(m.SubscriberEmails, m.SubscriberEmail)
+	}
+	for _, email := range m.SubscriberEmails {
+		m.Recipients = append(m.Recipients, models.TxRecipient{Email: email})
+	}
+	m.SubscriberEmails = nil
+	m.SubscriberEmail = ""
+
+	if len(m.Recipients) == 0 {
+		return m, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "send recipients OR subscriber_emails"))
+	}
+
+	for n, r := range m.Recipients {
+		// SanitizeFields sanitizes the e-mail, checks the domain blocklist,
+		// and derives a name from the e-mail if there isn't one.
+		sub, err := app.importer.SanitizeFields(subimporter.SubReq{
+			Subscriber: models.Subscriber{Email: r.Email, Name: r.Name},
+		})
+		if err != nil {
+			return m, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s: %v", r.Email, err))
+		}
+		m.Recipients[n].Email = sub.Email
+		m.Recipients[n].Name = sub.Name
+	}
+
+	return validateTxMessageMeta(m, app)
+}
+
+// validateTxMessageMeta validates and sets defaults for the non-recipient fields of a tx message.
+func validateTxMessageMeta(m models.TxMessage, app *App) (models.TxMessage, error) {
 	if m.FromEmail == "" {
 		m.FromEmail = app.constants.FromEmail
 	}
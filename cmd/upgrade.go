@@ -40,6 +40,7 @@ var migList = []migFunc{
 	{"v3.0.0", migrations.V3_0_0},
 	{"v3.0.1", migrations.V3_0_1},
 	{"v3.0.2", migrations.V3_0_2},
+	{"v3.1.0", migrations.V3_1_0},
 }
 
 // upgrade upgrades the database to the current version by running SQL migration files
@@ -120,6 +120,7 @@ export const getLists = (params) => http.get(
     params: (!params ? { per_page: 'all' } : params),
     loading: models.lists,
     store: models.lists,
+    camelCase: (keyPath) => !keyPath.startsWith('.results.*.headers'),
   },
 );
 
@@ -128,24 +129,25 @@ export const queryLists = (params) => http.get(
   {
     params: (!params ? { per_page: 'all' } : params),
     loading: models.lists,
+    camelCase: (keyPath) => !keyPath.startsWith('.results.*.headers'),
   },
 );
 
 export const getList = async (id) => http.get(
   `/api/lists/${id}`,
-  { loading: models.list },
+  { loading: models.list, camelCase: (keyPath) => !keyPath.startsWith('.headers') },
 );
 
 export const createList = (data) => http.post(
   '/api/lists',
   data,
-  { loading: models.lists },
+  { loading: models.lists, camelCase: (keyPath) => !keyPath.startsWith('.headers') },
 );
 
 export const updateList = (data) => http.put(
   `/api/lists/${data.id}`,
   data,
-  { loading: models.lists },
+  { loading: models.lists, camelCase: (keyPath) => !keyPath.startsWith('.headers') },
 );
 
 export const deleteList = (id) => http.delete(
@@ -153,6 +155,38 @@ export const deleteList = (id) => http.delete(
   { loading: models.lists },
 );
 
+// Segments.
+export const getSegments = (params) => http.get(
+  '/api/segments',
+  {
+    params: (!params ? { per_page: 'all' } : params),
+    loading: models.segments,
+  },
+);
+
+export const createSegment = (data) => http.post(
+  '/api/segments',
+  data,
+  { loading: models.segments },
+);
+
+export const updateSegment = (data) => http.put(
+  `/api/segments/${data.id}`,
+  data,
+  { loading: models.segments },
+);
+
+export const refreshSegmentCount = (id) => http.put(
+  `/api/segments/${id}/count`,
+  {},
+  { loading: models.segments },
+);
+
+export const deleteSegment = (id) => http.delete(
+  `/api/segments/${id}`,
+  { loading: models.segments },
+);
+
 // Subscribers.
 export const getSubscribers = async (params) => http.get(
   '/api/subscribers',
@@ -174,6 +208,15 @@ export const getSubscriberBounces = async (id) => http.get(
   { loading: models.bounces },
 );
 
+export const getSubscriberAuditLog = async (id, params) => http.get(
+  `/api/subscribers/${id}/audit`,
+  {
+    params,
+    loading: models.subscribers,
+    camelCase: (keyPath) => !keyPath.startsWith('.results.*.before') && !keyPath.startsWith('.results.*.after'),
+  },
+);
+
 export const deleteSubscriberBounces = async (id) => http.delete(
   `/api/subscribers/${id}/bounces`,
   { loading: models.bounces },
@@ -207,6 +250,38 @@ export const sendSubscriberOptin = (id) => http.post(
   { loading: models.subscribers },
 );
 
+export const getDuplicateSubscribers = async (params) => http.get(
+  '/api/subscribers/duplicates',
+  { params, loading: models.subscribers },
+);
+
+export const getSunsetSubscribers = async (params) => http.get(
+  '/api/subscribers/sunset',
+  { params, loading: models.subscribers, camelCase: (keyPath) => !keyPath.startsWith('.results.*.attribs') },
+);
+
+export const getTrashedSubscribers = async (params) => http.get(
+  '/api/subscribers/trash',
+  { params, loading: models.subscribers, camelCase: (keyPath) => !keyPath.startsWith('.results.*.attribs') },
+);
+
+export const restoreSubscribers = (ids) => http.put(
+  '/api/subscribers/trash/restore',
+  { ids },
+  { loading: models.subscribers },
+);
+
+export const purgeTrashedSubscribers = (params) => http.delete(
+  '/api/subscribers/trash',
+  { params, loading: models.subscribers },
+);
+
+export const mergeSubscribers = (id, ids) => http.post(
+  `/api/subscribers/${id}/merge`,
+  { ids },
+  { loading: models.subscribers },
+);
+
 export const deleteSubscriber = (id) => http.delete(
   `/api/subscribers/${id}`,
   { loading: models.subscribers },
@@ -237,6 +312,19 @@ export const blocklistSubscribersByQuery = (data) => http.put(
   { loading: models.subscribers },
 );
 
+export const updateSubscribersAttribsByQuery = (data) => http.put(
+  '/api/subscribers/query/attribs',
+  data,
+  { loading: models.subscribers },
+);
+
+// Subscriber export jobs.
+export const getExportJobs = async (params) => http.get('/api/subscribers/exports', { params });
+
+export const createExportJob = (data) => http.post('/api/subscribers/exports', data);
+
+export const deleteExportJob = (id) => http.delete(`/api/subscribers/exports/${id}`);
+
 export const deleteSubscribers = (params) => http.delete(
   '/api/subscribers',
   { params, loading: models.subscribers },
@@ -251,14 +339,16 @@ export const deleteSubscribersByQuery = (data) => http.post(
 // Subscriber import.
 export const importSubscribers = (data) => http.post('/api/import/subscribers', data);
 
-export const getImportStatus = () => http.get('/api/import/subscribers');
+export const getImports = async (params) => http.get('/api/import/subscribers', { params });
+
+export const getImportStatus = (id) => http.get(`/api/import/subscribers/${id}`);
 
-export const getImportLogs = async () => http.get(
-  '/api/import/subscribers/logs',
+export const getImportLogs = async (id) => http.get(
+  `/api/import/subscribers/${id}/logs`,
   { camelCase: false },
 );
 
-export const stopImport = () => http.delete('/api/import/subscribers');
+export const stopImport = (id) => http.delete(`/api/import/subscribers/${id}`);
 
 // Bounces.
 export const getBounces = async (params) => http.get(
@@ -412,6 +502,12 @@ export const testSMTP = async (data) => http.post(
   { loading: models.settings, disableToast: true },
 );
 
+export const testDKIM = async (data) => http.post(
+  '/api/settings/smtp/dkim/test',
+  data,
+  { loading: models.settings },
+);
+
 export const getLogs = async () => http.get(
   '/api/logs',
   { loading: models.logs, camelCase: false },
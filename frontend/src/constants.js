@@ -3,6 +3,7 @@ export const models = Object.freeze({
   lang: 'lang',
   dashboard: 'dashboard',
   lists: 'lists',
+  segments: 'segments',
   subscribers: 'subscribers',
   campaigns: 'campaigns',
   templates: 'templates',
@@ -21,7 +22,7 @@ export const uris = Object.freeze({
   previewCampaign: '/api/campaigns/:id/preview',
   previewTemplate: '/api/templates/:id/preview',
   previewRawTemplate: '/api/templates/preview',
-  exportSubscribers: '/api/subscribers/export',
+  importRejected: '/api/import/subscribers/:id/rejected',
   errorEvents: '/api/events?type=error',
   base: `${baseURL}/static`,
   root: rootURL,
@@ -29,6 +29,12 @@ const routes = [
     meta: { title: 'forms.title', group: 'lists' },
     component: () => import('../views/Forms.vue'),
   },
+  {
+    path: '/lists/segments',
+    name: 'segments',
+    meta: { title: 'globals.terms.segments', group: 'lists' },
+    component: () => import('../views/Segments.vue'),
+  },
   {
     path: '/lists/:id',
     name: 'list',
@@ -53,6 +59,18 @@ const routes = [
     meta: { title: 'globals.terms.bounces', group: 'subscribers' },
     component: () => import('../views/Bounces.vue'),
   },
+  {
+    path: '/subscribers/duplicates',
+    name: 'duplicates',
+    meta: { title: 'subscribers.duplicates', group: 'subscribers' },
+    component: () => import('../views/Duplicates.vue'),
+  },
+  {
+    path: '/subscribers/trash',
+    name: 'trash',
+    meta: { title: 'subscribers.trash', group: 'subscribers' },
+    component: () => import('../views/Trash.vue'),
+  },
   {
     path: '/subscribers/lists/:listID',
     name: 'subscribers_list',
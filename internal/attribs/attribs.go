@@ -0,0 +1,292 @@
+// Package attribs validates subscriber attributes against the admin-defined
+// attribute schema. Attributes in the schema are type checked and normalized,
+// defaults are applied, and required attributes are enforced. Attribute names
+// that differ from a schema attribute only in case (eg: "Plan" and "plan") are
+// folded into the schema attribute. Attributes that are not in the schema are
+// left untouched.
+package attribs
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/internal/i18n"
+	"github.com/knadh/listmonk/models"
+)
+
+const dateFormat = "2006-01-02"
+
+// Schema represents a subscriber attribute schema.
+type Schema struct {
+	defs []models.AttribDef
+
+	// Lowercased attribute name => index in defs.
+	names map[string]int
+	i18n  *i18n.I18n
+}
+
+// New validates the given attribute definitions and returns a new Schema.
+func New(defs []models.AttribDef, i *i18n.I18n) (*Schema, error) {
+	s := &Schema{
+		defs:  make([]models.AttribDef, 0, len(defs)),
+		names: make(map[string]int, len(defs)),
+		i18n:  i,
+	}
+
+	for _, d := range defs {
+		d.Name = strings.TrimSpace(d.Name)
+		if d.Name == "" {
+			return nil, errors.New(i.T("settings.attribs.invalidName"))
+		}
+
+		key := strings.ToLower(d.Name)
+		if _, ok := s.names[key]; ok {
+			return nil, errors.New(i.Ts("settings.attribs.duplicateName", "name", d.Name))
+		}
+
+		switch d.Type {
+		case models.AttribTypeString, models.AttribTypeNumber, models.AttribTypeBoolean, models.AttribTypeDate:
+			d.Enum = nil
+		case models.AttribTypeEnum:
+			enum := make([]string, 0, len(d.Enum))
+			for _, e := range d.Enum {
+				if e = strings.TrimSpace(e); e != "" {
+					enum = append(enum, e)
+				}
+			}
+			if len(enum) == 0 {
+				return nil, errors.New(i.Ts("settings.attribs.emptyEnum", "name", d.Name))
+			}
+			d.Enum = enum
+		default:
+			return nil, errors.New(i.Ts("settings.attribs.invalidType", "name", d.Name))
+		}
+
+		// Normalize the default value to the attribute's type.
+		if !isEmpty(d.Default) {
+			v, err := s.coerce(d, d.Default)
+			if err != nil {
+				return nil, errors.New(i.Ts("settings.attribs.invalidDefault", "name", d.Name))
+			}
+			d.Default = v
+		} else {
+			d.Default = nil
+		}
+
+		s.names[key] = len(s.defs)
+		s.defs = append(s.defs, d)
+	}
+
+	return s, nil
+}
+
+// Defs returns the normalized attribute definitions in the schema.
+func (s *Schema) Defs() []models.AttribDef {
+	if s == nil {
+		return []models.AttribDef{}
+	}
+	return s.defs
+}
+
+// Public returns the attribute definitions that subscribers can edit
+// on the public preferences page.
+func (s *Schema) Public() []models.AttribDef {
+	out := []models.AttribDef{}
+	for _, d := range s.Defs() {
+		if d.Public {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// Validate validates a subscriber's attributes against the schema and returns
+// the normalized attributes.
+func (s *Schema) Validate(in models.JSON) (models.JSON, error) {
+	if s == nil || len(s.defs) == 0 {
+		return in, nil
+	}
+
+	out := s.fold(in)
+	for _, d := range s.defs {
+		v := out[d.Name]
+		if isEmpty(v) {
+			if d.Default != nil {
+				out[d.Name] = d.Default
+				continue
+			}
+			if d.Required {
+				return nil, errors.New(s.i18n.Ts("subscribers.attribRequired", "name", d.Name))
+			}
+
+			delete(out, d.Name)
+			continue
+		}
+
+		val, err := s.coerce(d, v)
+		if err != nil {
+			return nil, err
+		}
+		out[d.Name] = val
+	}
+
+	return out, nil
+}
+
+// ValidatePartial validates a partial set of attributes that's to be merged into a
+// subscriber's existing attributes (eg: an import in the merge mode) and returns the
+// normalized attributes. Only the attributes that are present are checked and defaults
+// aren't applied. A nil value, which clears an attribute, is rejected for required attributes.
+func (s *Schema) ValidatePartial(in models.JSON) (models.JSON, error) {
+	if s == nil || len(s.defs) == 0 {
+		return in, nil
+	}
+
+	out := s.fold(in)
+	for _, d := range s.defs {
+		v, ok := out[d.Name]
+		if !ok {
+			continue
+		}
+
+		if isEmpty(v) {
+			if d.Required {
+				return nil, errors.New(s.i18n.Ts("subscribers.attribRequired", "name", d.Name))
+			}
+			out[d.Name] = nil
+			continue
+		}
+
+		val, err := s.coerce(d, v)
+		if err != nil {
+			return nil, err
+		}
+		out[d.Name] = val
+	}
+
+	return out, nil
+}
+
+// fold returns a copy of the attributes where names that match schema attributes
+// case-insensitively are folded into the schema names. Exact matches take precedence.
+func (s *Schema) fold(in models.JSON) models.JSON {
+	out := make(models.JSON, len(in))
+	for k, v := range in {
+		if i, ok := s.names[strings.ToLower(k)]; ok && s.defs[i].Name != k {
+			out[s.defs[i].Name] = v
+		}
+	}
+	for k, v := range in {
+		if i, ok := s.names[strings.ToLower(k)]; ok && s.defs[i].Name != k {
+			continue
+		}
+		out[k] = v
+	}
+
+	return out
+}
+
+// ValidatePublic takes values of public attributes submitted by a subscriber (eg: on
+// the preferences page), sets them on the subscriber's existing attributes, and
+// validates the result. Values of non-public attributes are ignored.
+func (s *Schema) ValidatePublic(in map[string]string, existing models.JSON) (models.JSON, error) {
+	out := make(models.JSON, len(existing))
+	for k, v := range existing {
+		out[k] = v
+	}
+
+	for _, d := range s.Public() {
+		if v, ok := in[d.Name]; ok {
+			out[d.Name] = v
+		}
+	}
+
+	return s.Validate(out)
+}
+
+// coerce checks a value against an attribute's type and returns the normalized value.
+// Strings are accepted for all types (eg: from CSV imports and HTML forms) and converted.
+func (s *Schema) coerce(d models.AttribDef, v interface{}) (interface{}, error) {
+	str, isStr := v.(string)
+	if isStr {
+		str = strings.TrimSpace(str)
+	}
+
+	switch d.Type {
+	case models.AttribTypeString:
+		if isStr {
+			return str, nil
+		}
+
+	case models.AttribTypeNumber:
+		switch n := v.(type) {
+		case float64:
+			return n, nil
+		case int:
+			return float64(n), nil
+		case int64:
+			return float64(n), nil
+		case string:
+			if f, err := strconv.ParseFloat(str, 64); err == nil {
+				return f, nil
+			}
+		}
+
+	case models.AttribTypeBoolean:
+		switch b := v.(type) {
+		case bool:
+			return b, nil
+		case string:
+			if b, err := strconv.ParseBool(str); err == nil {
+				return b, nil
+			}
+		}
+
+	case models.AttribTypeDate:
+		if isStr {
+			if t, err := time.Parse(dateFormat, str); err == nil {
+				return t.Format(dateFormat), nil
+			}
+			if _, err := time.Parse(time.RFC3339, str); err == nil {
+				return str, nil
+			}
+		}
+
+	case models.AttribTypeEnum:
+		if isStr {
+			for _, e := range d.Enum {
+				if strings.EqualFold(e, str) {
+					return e, nil
+				}
+			}
+			return nil, errors.New(s.i18n.Ts("subscribers.attribInvalidEnum",
+				"name", d.Name, "values", strings.Join(d.Enum, ", ")))
+		}
+	}
+
+	return nil, errors.New(s.i18n.Ts("subscribers.attribInvalidType", "name", d.Name, "type", d.Type))
+}
+
+// String returns the string representation of an attribute value for use in HTML forms.
+func String(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func isEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	if s, ok := v.(string); ok && strings.TrimSpace(s) == "" {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,309 @@
+package attribs
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/knadh/listmonk/models"
+)
+
+var errPathNotFound = errors.New("path not found")
+
+// Merge applies a JSON merge patch (RFC 7396) to attributes and returns the resulting
+// attributes. Nested objects are merged recursively and null values remove keys.
+func Merge(attr models.JSON, patch map[string]interface{}) models.JSON {
+	return models.JSON(mergeMap(attr, patch))
+}
+
+// ValidatePatch checks that JSON patch (RFC 6902) operations are well formed.
+func ValidatePatch(ops []models.AttribPatchOp) error {
+	for n, o := range ops {
+		path, err := parsePointer(o.Path)
+		if err != nil {
+			return fmt.Errorf("op %d: %v", n, err)
+		}
+
+		switch o.Op {
+		case models.AttribPatchAdd, models.AttribPatchRemove, models.AttribPatchReplace, models.AttribPatchTest:
+		case models.AttribPatchMove, models.AttribPatchCopy:
+			from, err := parsePointer(o.From)
+			if err != nil {
+				return fmt.Errorf("op %d: from: %v", n, err)
+			}
+			if o.Op == models.AttribPatchMove && len(from) < len(path) &&
+				reflect.DeepEqual(from, path[:len(from)]) {
+				return fmt.Errorf("op %d: can't move %s into itself", n, o.From)
+			}
+		default:
+			return fmt.Errorf("op %d: unknown op '%s'", n, o.Op)
+		}
+	}
+
+	return nil
+}
+
+// Patch applies JSON patch (RFC 6902) operations to attributes and returns the resulting
+// attributes. If any of the operations fail, an error is returned and none are applied.
+// The operations should have been validated with ValidatePatch.
+func Patch(attr models.JSON, ops []models.AttribPatchOp) (models.JSON, error) {
+	var doc interface{} = copyValue(map[string]interface{}(attr))
+
+	for n, o := range ops {
+		path, err := parsePointer(o.Path)
+		if err != nil {
+			return nil, fmt.Errorf("op %d: %v", n, err)
+		}
+
+		switch o.Op {
+		case models.AttribPatchAdd:
+			doc, err = patchSet(doc, path, copyValue(o.Value), false)
+
+		case models.AttribPatchReplace:
+			doc, err = patchSet(doc, path, copyValue(o.Value), true)
+
+		case models.AttribPatchRemove:
+			doc, _, err = patchRemove(doc, path)
+
+		case models.AttribPatchMove, models.AttribPatchCopy:
+			from, _ := parsePointer(o.From)
+
+			var v interface{}
+			if o.Op == models.AttribPatchMove {
+				doc, v, err = patchRemove(doc, from)
+			} else {
+				v, err = patchGet(doc, from)
+				v = copyValue(v)
+			}
+			if err == nil {
+				doc, err = patchSet(doc, path, v, false)
+			}
+
+		case models.AttribPatchTest:
+			var v interface{}
+			if v, err = patchGet(doc, path); err == nil && !reflect.DeepEqual(v, o.Value) {
+				err = fmt.Errorf("test failed for %s", o.Path)
+			}
+
+		default:
+			err = fmt.Errorf("unknown op '%s'", o.Op)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("op %d: %v", n, err)
+		}
+	}
+
+	return models.JSON(doc.(map[string]interface{})), nil
+}
+
+// mergeMap returns a copy of dst with the merge patch applied.
+func mergeMap(dst, patch map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(dst)+len(patch))
+	for k, v := range dst {
+		out[k] = v
+	}
+
+	for k, v := range patch {
+		if v == nil {
+			delete(out, k)
+			continue
+		}
+
+		if p, ok := v.(map[string]interface{}); ok {
+			d, _ := out[k].(map[string]interface{})
+			out[k] = mergeMap(d, p)
+			continue
+		}
+
+		out[k] = copyValue(v)
+	}
+
+	return out
+}
+
+// parsePointer parses a JSON pointer (RFC 6901) into its reference tokens. The
+// pointer has to reference a value inside the attributes and not the attributes.
+func parsePointer(p string) ([]string, error) {
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("invalid path '%s'", p)
+	}
+
+	toks := strings.Split(p[1:], "/")
+	for i, t := range toks {
+		toks[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+
+	return toks, nil
+}
+
+// patchGet returns the value at the path in the node.
+func patchGet(node interface{}, path []string) (interface{}, error) {
+	for _, t := range path {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			v, ok := n[t]
+			if !ok {
+				return nil, errPathNotFound
+			}
+			node = v
+
+		case []interface{}:
+			i, err := arrayIndex(t, len(n), false)
+			if err != nil {
+				return nil, err
+			}
+			node = n[i]
+
+		default:
+			return nil, errPathNotFound
+		}
+	}
+
+	return node, nil
+}
+
+// patchSet adds (or with replace, replaces) the value at the path in the node and returns
+// the updated node. Adding to an array inserts the value at the index or at the end for "-".
+func patchSet(node interface{}, path []string, val interface{}, replace bool) (interface{}, error) {
+	if len(path) == 0 {
+		return val, nil
+	}
+
+	t := path[0]
+	switch n := node.(type) {
+	case map[string]interface{}:
+		cur, ok := n[t]
+		if len(path) == 1 {
+			if replace && !ok {
+				return nil, errPathNotFound
+			}
+			n[t] = val
+			return n, nil
+		}
+		if !ok {
+			return nil, errPathNotFound
+		}
+
+		v, err := patchSet(cur, path[1:], val, replace)
+		if err != nil {
+			return nil, err
+		}
+		n[t] = v
+		return n, nil
+
+	case []interface{}:
+		if len(path) == 1 && !replace {
+			i, err := arrayIndex(t, len(n), true)
+			if err != nil {
+				return nil, err
+			}
+
+			out := make([]interface{}, 0, len(n)+1)
+			out = append(out, n[:i]...)
+			out = append(out, val)
+			return append(out, n[i:]...), nil
+		}
+
+		i, err := arrayIndex(t, len(n), false)
+		if err != nil {
+			return nil, err
+		}
+		v, err := patchSet(n[i], path[1:], val, replace)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = v
+		return n, nil
+	}
+
+	return nil, errPathNotFound
+}
+
+// patchRemove removes the value at the path in the node and returns the updated node
+// and the value removed.
+func patchRemove(node interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, errPathNotFound
+	}
+
+	t := path[0]
+	switch n := node.(type) {
+	case map[string]interface{}:
+		cur, ok := n[t]
+		if !ok {
+			return nil, nil, errPathNotFound
+		}
+		if len(path) == 1 {
+			delete(n, t)
+			return n, cur, nil
+		}
+
+		v, old, err := patchRemove(cur, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		n[t] = v
+		return n, old, nil
+
+	case []interface{}:
+		i, err := arrayIndex(t, len(n), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(path) == 1 {
+			old := n[i]
+			return append(n[:i:i], n[i+1:]...), old, nil
+		}
+
+		v, old, err := patchRemove(n[i], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		n[i] = v
+		return n, old, nil
+	}
+
+	return nil, nil, errPathNotFound
+}
+
+// arrayIndex parses an array index in a JSON pointer. If add is true, the index can
+// be the length of the array, or "-" for the end of the array.
+func arrayIndex(t string, ln int, add bool) (int, error) {
+	if add && t == "-" {
+		return ln, nil
+	}
+
+	i, err := strconv.Atoi(t)
+	if err != nil || i < 0 || i > ln || (i == ln && !add) {
+		return 0, fmt.Errorf("invalid array index '%s'", t)
+	}
+
+	return i, nil
+}
+
+// copyValue returns a deep copy of a JSON value.
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			out[k] = copyValue(v)
+		}
+		return out
+
+	case models.JSON:
+		return copyValue(map[string]interface{}(t))
+
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, v := range t {
+			out[i] = copyValue(v)
+		}
+		return out
+	}
+
+	return v
+}
@@ -0,0 +1,208 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// WithAudit returns a copy of the core that records the given actor, source, and IP
+// in the audit log entries of the subscriber, subscription, and list changes made
+// with it. Changes made with the core without audit meta are recorded as system changes.
+func (c *Core) WithAudit(a models.AuditMeta) *Core {
+	cp := *c
+	cp.audit = a
+	return &cp
+}
+
+// GetSubscriberAuditLog returns the audit log of a subscriber, latest first. Along with
+// the paginated and sliced results, the total number of entries is returned.
+func (c *Core) GetSubscriberAuditLog(subID, offset, limit int) ([]models.AuditEntry, int, error) {
+	out := []models.AuditEntry{}
+	if err := c.q.GetSubscriberAuditLog.Select(&out, subID, offset, limit); err != nil {
+		c.log.Printf("error fetching audit log: %v", err)
+		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.auditLog}", "error", pqErrMsg(err)))
+	}
+
+	total := 0
+	if len(out) > 0 {
+		total = out[0].Total
+	}
+
+	return out, total, nil
+}
+
+// logAudit records an audit log entry for each of the given subscribers, or a single entry
+// without a subscriber if there are none. Errors are logged and not returned as the change
+// being audited has already been made.
+func (c *Core) logAudit(action string, subIDs []int, subUUIDs []string, listID int, before, after interface{}) {
+	if subIDs == nil {
+		subIDs = []int{}
+	}
+	if subUUIDs == nil {
+		subUUIDs = []string{}
+	}
+
+	src := c.audit.Source
+	if src == "" {
+		src = models.AuditSourceSystem
+	}
+
+	if _, err := c.q.InsertAuditLog.Exec(pq.Array(subIDs), pq.Array(subUUIDs), listID,
+		action, src, c.audit.Actor, c.audit.IP, auditJSON(before), auditJSON(after)); err != nil {
+		c.log.Printf("error recording audit log (%s): %v", action, err)
+	}
+}
+
+// logSubscriberAudit records the changes between two states of a subscriber. Nothing
+// is recorded if there are no changes.
+func (c *Core) logSubscriberAudit(action string, before, after models.Subscriber) {
+	id := after.ID
+	if id == 0 {
+		id = before.ID
+	}
+
+	b, a := auditDiff(subscriberAuditData(before), subscriberAuditData(after))
+	if len(b) == 0 && len(a) == 0 {
+		return
+	}
+
+	c.logAudit(action, []int{id}, nil, 0, b, a)
+}
+
+// subscriberAuditData returns the audited fields of a subscriber. Subscriptions are
+// represented as a map of list IDs to subscription statuses.
+func subscriberAuditData(s models.Subscriber) map[string]interface{} {
+	if s.ID == 0 {
+		return map[string]interface{}{}
+	}
+
+	var subs []struct {
+		ID     int    `json:"id"`
+		Status string `json:"subscription_status"`
+	}
+	_ = s.Lists.Unmarshal(&subs)
+
+	lists := make(map[string]interface{}, len(subs))
+	for _, l := range subs {
+		lists[strconv.Itoa(l.ID)] = l.Status
+	}
+
+	attribs := make(map[string]interface{}, len(s.Attribs))
+	for k, v := range s.Attribs {
+		attribs[k] = v
+	}
+
+	return map[string]interface{}{
+		"email":   s.Email,
+		"name":    s.Name,
+		"status":  s.Status,
+		"attribs": attribs,
+		"lists":   lists,
+	}
+}
+
+// listAuditData returns the audited fields of a list.
+func listAuditData(l models.List) map[string]interface{} {
+	if l.ID == 0 {
+		return map[string]interface{}{}
+	}
+
+	tags := make([]interface{}, 0, len(l.Tags))
+	for _, t := range l.Tags {
+		tags = append(tags, t)
+	}
+
+	return map[string]interface{}{
+		"name":        l.Name,
+		"type":        l.Type,
+		"optin":       l.Optin,
+		"tags":        tags,
+		"description": l.Description,
+	}
+}
+
+// auditDiff returns the fields that differ between two states of a record. Nested maps
+// (eg: attributes) are compared field by field.
+func auditDiff(before, after map[string]interface{}) (map[string]interface{}, map[string]interface{}) {
+	b := map[string]interface{}{}
+	a := map[string]interface{}{}
+
+	for k, bv := range before {
+		av, ok := after[k]
+		if !ok {
+			b[k] = bv
+			continue
+		}
+
+		bm, bOk := bv.(map[string]interface{})
+		am, aOk := av.(map[string]interface{})
+		if bOk && aOk {
+			if db, da := auditDiff(bm, am); len(db) > 0 || len(da) > 0 {
+				b[k] = db
+				a[k] = da
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(bv, av) {
+			b[k] = bv
+			a[k] = av
+		}
+	}
+
+	for k, av := range after {
+		if _, ok := before[k]; !ok {
+			a[k] = av
+		}
+	}
+
+	return b, a
+}
+
+// consentJSON returns the proof-of-consent record for the subscriptions made with the core
+// from its audit meta. Subscriptions made on public pages are recorded as given on a form.
+func (c *Core) consentJSON() json.RawMessage {
+	cn := models.SubscriptionConsent{
+		Source:      models.ConsentSourceSystem,
+		ConsentedAt: time.Now(),
+		IP:          c.audit.IP,
+		UserAgent:   c.audit.UserAgent,
+	}
+
+	switch c.audit.Source {
+	case models.AuditSourcePublic, models.AuditSourceOptin:
+		cn.Source = models.ConsentSourceForm
+	case models.AuditSourceAPI:
+		cn.Source = models.ConsentSourceAPI
+		cn.SourceName = c.audit.Actor
+	case models.AuditSourceImport:
+		cn.Source = models.ConsentSourceImport
+	}
+
+	b, _ := json.Marshal(cn)
+	return b
+}
+
+// auditJSON returns the JSON to be stored for an optional before or after state.
+func auditJSON(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	if m, ok := v.(map[string]interface{}); ok && len(m) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return b
+}
@@ -56,14 +56,20 @@ func (c *Core) GetBounce(id int) (models.Bounce, error) {
 	return out[0], nil
 }
 
-// RecordBounce records a new bounce.
+// RecordBounce records a new bounce and records the action taken on the subscriber,
+// if any, in the audit log.
 func (c *Core) RecordBounce(b models.Bounce) error {
 	action, ok := c.consts.BounceActions[b.Type]
 	if !ok {
 		return echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("globals.messages.invalidData")+": "+b.Type)
 	}
 
-	_, err := c.q.RecordBounce.Exec(b.SubscriberUUID,
+	var res struct {
+		SubscriberID int           `db:"subscriber_id"`
+		Action       string        `db:"action"`
+		ListIDs      pq.Int64Array `db:"list_ids"`
+	}
+	err := c.q.RecordBounce.Get(&res, b.SubscriberUUID,
 		b.Email,
 		b.CampaignUUID,
 		b.Type,
@@ -81,9 +87,29 @@ func (c *Core) RecordBounce(b models.Bounce) error {
 		}
 
 		c.log.Printf("error recording bounce: %v", err)
+		return err
 	}
 
-	return err
+	var (
+		subIDs = []int{res.SubscriberID}
+		reason = map[string]interface{}{"bounce_type": b.Type, "bounce_source": b.Source}
+	)
+	switch res.Action {
+	case "blocklist":
+		reason["status"] = models.SubscriberStatusBlockListed
+		c.logAudit(models.AuditSubscriberBlocklist, subIDs, nil, 0, nil, reason)
+	case "unsubscribe":
+		listIDs := make([]int, len(res.ListIDs))
+		for i, id := range res.ListIDs {
+			listIDs[i] = int(id)
+		}
+		reason["lists"] = listIDs
+		c.logAudit(models.AuditSubscriptionUnsub, subIDs, nil, 0, nil, reason)
+	case "delete":
+		c.logAudit(models.AuditSubscriberDelete, subIDs, nil, 0, nil, reason)
+	}
+
+	return nil
 }
 
 // DeleteBounce deletes a list.
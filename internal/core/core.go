@@ -12,6 +12,7 @@ import (
 	"strings"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/knadh/listmonk/internal/attribs"
 	"github.com/knadh/listmonk/internal/i18n"
 	"github.com/knadh/listmonk/models"
 	"github.com/lib/pq"
@@ -30,11 +31,15 @@ const (
 type Core struct {
 	h *Hooks
 
-	consts Constants
-	i18n   *i18n.I18n
-	db     *sqlx.DB
-	q      *models.Queries
-	log    *log.Logger
+	consts  Constants
+	attribs *attribs.Schema
+	i18n    *i18n.I18n
+	db      *sqlx.DB
+	q       *models.Queries
+	log     *log.Logger
+
+	// Actor, source, and IP recorded in audit log entries. See WithAudit().
+	audit models.AuditMeta
 }
 
 // Constants represents constant config.
@@ -55,6 +60,7 @@ type Hooks struct {
 // Opt contains the controllers required to start the core.
 type Opt struct {
 	Constants Constants
+	Attribs   *attribs.Schema
 	I18n      *i18n.I18n
 	DB        *sqlx.DB
 	Queries   *models.Queries
@@ -65,19 +71,21 @@ var (
 	regexFullTextQuery  = regexp.MustCompile(`\s+`)
 	regexpSpaces        = regexp.MustCompile(`[\s]+`)
 	campQuerySortFields = []string{"name", "status", "created_at", "updated_at"}
-	subQuerySortFields  = []string{"email", "status", "name", "created_at", "updated_at"}
+	subQuerySortFields  = []string{"email", "status", "name", "created_at", "updated_at", "engagement_score", "last_engaged_at"}
 	listQuerySortFields = []string{"name", "status", "created_at", "updated_at", "subscriber_count"}
+	segQuerySortFields  = []string{"name", "created_at", "updated_at", "subscriber_count"}
 )
 
 // New returns a new instance of the core.
 func New(o *Opt, h *Hooks) *Core {
 	return &Core{
-		h:      h,
-		consts: o.Constants,
-		i18n:   o.I18n,
-		db:     o.DB,
-		q:      o.Queries,
-		log:    o.Log,
+		h:       h,
+		consts:  o.Constants,
+		attribs: o.Attribs,
+		i18n:    o.I18n,
+		db:      o.DB,
+		q:       o.Queries,
+		log:     o.Log,
 	}
 }
 
@@ -176,6 +184,23 @@ func normalizeTags(tags []string) []string {
 	return out
 }
 
+// normalizeHeaders returns an empty set of headers for nil headers, which
+// would otherwise be written as NULL.
+func normalizeHeaders(h models.Headers) models.Headers {
+	if h == nil {
+		return models.Headers{}
+	}
+	return h
+}
+
+// normalizeDays returns an empty array for a nil array of days so that it's not NULL in the DB.
+func normalizeDays(d pq.Int64Array) pq.Int64Array {
+	if d == nil {
+		return pq.Int64Array{}
+	}
+	return d
+}
+
 // sanitizeSQLExp does basic sanitisation on arbitrary
 // SQL query expressions coming from the frontend.
 func sanitizeSQLExp(q string) string {
@@ -0,0 +1,102 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+)
+
+// RefreshEngagementScores recomputes the engagement scores of all subscribers from
+// their campaign views, link clicks, and e-mail events. halfLifeDays is the number
+// of days after which an engagement counts for half its value.
+func (c *Core) RefreshEngagementScores(halfLifeDays int) (int, error) {
+	if halfLifeDays < 1 {
+		halfLifeDays = 1
+	}
+
+	res, err := c.q.UpdateEngagementScores.Exec(halfLifeDays)
+	if err != nil {
+		c.log.Printf("error updating engagement scores: %v", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+// QuerySunsetSubscribers returns the subscribers that the given sunset policy would
+// act on if it were applied now. Along with the paginated and sliced results, the
+// total number of such subscribers is returned.
+func (c *Core) QuerySunsetSubscribers(p models.SunsetPolicy, offset, limit int) ([]models.SunsetSubscriber, int, error) {
+	if err := c.validateSunsetPolicy(p); err != nil {
+		return nil, 0, err
+	}
+
+	out := []models.SunsetSubscriber{}
+	q := fmt.Sprintf(c.q.QuerySunsetSubscribers, c.q.SunsetSubscribersCriteria)
+	if err := c.db.Select(&out, q, p.Days, sunsetListID(p), offset, limit); err != nil {
+		c.log.Printf("error fetching sunset subscribers: %v", err)
+		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	total := 0
+	if len(out) > 0 {
+		total = out[0].Total
+	}
+
+	return out, total, nil
+}
+
+// SunsetSubscribers applies the given sunset policy. Subscribers who haven't engaged
+// in the policy's number of days are unsubscribed from their lists and with
+// SunsetActionMove, subscribed to the policy's dormant list.
+func (c *Core) SunsetSubscribers(p models.SunsetPolicy) (int, error) {
+	if err := c.validateSunsetPolicy(p); err != nil {
+		return 0, err
+	}
+
+	var ids []int
+	q := fmt.Sprintf(c.q.SunsetSubscribers, c.q.SunsetSubscribersCriteria)
+	if err := c.db.Select(&ids, q, p.Days, sunsetListID(p)); err != nil {
+		c.log.Printf("error applying sunset policy: %v", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	if len(ids) > 0 {
+		c.logAudit(models.AuditSubscriptionUnsub, ids, nil, sunsetListID(p), nil, map[string]interface{}{"sunset": p})
+	}
+
+	return len(ids), nil
+}
+
+func (c *Core) validateSunsetPolicy(p models.SunsetPolicy) error {
+	if p.Days < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("globals.messages.invalidFields", "name", "days"))
+	}
+
+	switch p.Action {
+	case models.SunsetActionUnsubscribe:
+	case models.SunsetActionMove:
+		if p.ListID < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, c.i18n.T("settings.engagement.invalidList"))
+		}
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("globals.messages.invalidFields", "name", "action"))
+	}
+
+	return nil
+}
+
+// sunsetListID returns the dormant list ID for the policy or 0 if subscribers
+// are not to be moved.
+func sunsetListID(p models.SunsetPolicy) int {
+	if p.Action != models.SunsetActionMove {
+		return 0
+	}
+	return p.ListID
+}
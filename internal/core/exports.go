@@ -0,0 +1,138 @@
+package core
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// QueryExportJobs returns export jobs, latest first. Along with the paginated
+// and sliced results, the total number of jobs is returned.
+func (c *Core) QueryExportJobs(offset, limit int) ([]models.ExportJob, int, error) {
+	out := []models.ExportJob{}
+	if err := c.q.GetExportJobs.Select(&out, 0, offset, limit); err != nil {
+		c.log.Printf("error fetching export jobs: %v", err)
+		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.exportJobs}", "error", pqErrMsg(err)))
+	}
+
+	total := 0
+	if len(out) > 0 {
+		total = out[0].Total
+	}
+
+	return out, total, nil
+}
+
+// GetExportJob returns an export job.
+func (c *Core) GetExportJob(id int64) (models.ExportJob, error) {
+	var out []models.ExportJob
+	if err := c.q.GetExportJobs.Select(&out, id, 0, 1); err != nil {
+		c.log.Printf("error fetching export job: %v", err)
+		return models.ExportJob{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.exportJob}", "error", pqErrMsg(err)))
+	}
+	if len(out) == 0 {
+		return models.ExportJob{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.exportJob}"))
+	}
+
+	return out[0], nil
+}
+
+// CreateExportJob records a new export job and returns it.
+func (c *Core) CreateExportJob(j models.ExportJob) (models.ExportJob, error) {
+	uu, err := uuid.NewV4()
+	if err != nil {
+		c.log.Printf("error generating UUID: %v", err)
+		return models.ExportJob{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUUID", "error", err.Error()))
+	}
+	j.UUID = uu.String()
+	j.Status = models.JobStatusRunning
+
+	if err := c.q.InsertExportJob.QueryRow(j.UUID, j.Format, pq.Array(j.Fields), j.IncludeLists,
+		j.CreatedBy).Scan(&j.ID, &j.CreatedAt); err != nil {
+		c.log.Printf("error creating export job: %v", err)
+		return models.ExportJob{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorCreating", "name", "{globals.terms.exportJob}", "error", pqErrMsg(err)))
+	}
+
+	return j, nil
+}
+
+// UpdateExportJob records the status and progress of an export job.
+func (c *Core) UpdateExportJob(j models.ExportJob) error {
+	if _, err := c.q.UpdateExportJob.Exec(j.ID, j.Status, j.Exported, j.Filename, j.Error); err != nil {
+		c.log.Printf("error updating export job: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.exportJob}", "error", pqErrMsg(err)))
+	}
+
+	return nil
+}
+
+// DeleteExportJob deletes an export job that isn't running and returns the
+// name of its file in the media store, if any.
+func (c *Core) DeleteExportJob(id int64) (string, error) {
+	var filename string
+	if err := c.q.DeleteExportJob.Get(&filename, id); err != nil {
+		if err == sql.ErrNoRows {
+			return "", echo.NewHTTPError(http.StatusBadRequest,
+				c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.exportJob}"))
+		}
+
+		c.log.Printf("error deleting export job: %v", err)
+		return "", echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.exportJob}", "error", pqErrMsg(err)))
+	}
+
+	return filename, nil
+}
+
+// ExpireExportJobs clears the files of the export jobs that finished longer than the
+// given duration ago and returns the names of the files, which are to be deleted.
+func (c *Core) ExpireExportJobs(retention time.Duration) ([]string, error) {
+	var out []string
+	if err := c.q.ExpireExportJobs.Select(&out, retention.Seconds()); err != nil {
+		c.log.Printf("error expiring export jobs: %v", err)
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// FailInterruptedExportJobs marks the export jobs that were running when the
+// app was stopped as failed.
+func (c *Core) FailInterruptedExportJobs(reason string) error {
+	if _, err := c.q.FailInterruptedExportJobs.Exec(reason); err != nil {
+		c.log.Printf("error marking interrupted export jobs: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// GetSubscriberListsForExport returns the subscriptions of the given subscribers
+// as JSON arrays of {id, name, subscription_status} mapped to subscriber IDs.
+func (c *Core) GetSubscriberListsForExport(subIDs []int) (map[int]json.RawMessage, error) {
+	var res []models.SubscriberExportLists
+	if err := c.q.GetSubscriberListsForExport.Select(&res, pq.Array(subIDs)); err != nil {
+		c.log.Printf("error fetching subscriber lists for export: %v", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.lists}", "error", pqErrMsg(err)))
+	}
+
+	out := make(map[int]json.RawMessage, len(res))
+	for _, r := range res {
+		out[r.SubscriberID] = r.Lists
+	}
+
+	return out, nil
+}
@@ -0,0 +1,490 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// Segment filter operators.
+const (
+	segOpEq          = "eq"
+	segOpNeq         = "neq"
+	segOpGt          = "gt"
+	segOpGte         = "gte"
+	segOpLt          = "lt"
+	segOpLte         = "lte"
+	segOpIn          = "in"
+	segOpNotIn       = "not_in"
+	segOpContains    = "contains"
+	segOpNotContains = "not_contains"
+	segOpExists      = "exists"
+	segOpNotExists   = "not_exists"
+	segOpWithin      = "within"
+
+	// Limits on the size of a filter.
+	segMaxDepth = 10
+	segMaxNodes = 200
+)
+
+var (
+	segCompareOps = map[string]string{
+		segOpEq:  "=",
+		segOpNeq: "!=",
+		segOpGt:  ">",
+		segOpGte: ">=",
+		segOpLt:  "<",
+		segOpLte: "<=",
+	}
+
+	segSubStatuses  = []string{models.SubscriberStatusEnabled, models.SubscriberStatusDisabled, models.SubscriberStatusBlockListed}
+	segListStatuses = []string{models.SubscriptionStatusUnconfirmed, models.SubscriptionStatusConfirmed,
+		models.SubscriptionStatusUnsubscribed}
+
+	segDateFormats = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+	// Relative time intervals, eg: 30 days, 12 hours.
+	reSegInterval = regexp.MustCompile(`^\d{1,6}\s*(minute|hour|day|week|month|year)s?$`)
+
+	// Engagement tables that can be queried as fields.
+	segEngagementFields = map[string]bool{"campaign_views": true, "link_clicks": true, "emails": true}
+)
+
+// segQuery holds the state of a segment filter being compiled.
+type segQuery struct {
+	args   []interface{}
+	offset int
+	nodes  int
+}
+
+// compileSegmentFilter compiles a structured segment filter into an SQL expression
+// for the WHERE clause of subscriber queries. Values are never interpolated into
+// the expression. They're returned as positional arguments that are numbered after
+// the `offset` number of arguments the query the expression is embedded in takes.
+func (c *Core) compileSegmentFilter(f *models.SegmentFilter, offset int) (string, []interface{}, error) {
+	if f == nil {
+		return "", nil, nil
+	}
+
+	s := &segQuery{offset: offset}
+	exp, err := s.compile(*f, 0)
+	if err != nil {
+		return "", nil, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("subscribers.invalidFilter", "error", err.Error()))
+	}
+
+	return exp, s.args, nil
+}
+
+// makeSubQueryCond combines an optional arbitrary SQL expression (that has
+// already been parenthesized and prefixed with AND) with an optional segment
+// filter, which is also parenthesized so that it applies to the whole
+// expression, eg: `a OR b`.
+func (c *Core) makeSubQueryCond(cond string, f *models.SegmentFilter, offset int) (string, []interface{}, error) {
+	exp, args, err := c.compileSegmentFilter(f, offset)
+	if err != nil {
+		return "", nil, err
+	}
+	if exp != "" {
+		cond += " AND (" + exp + ")"
+	}
+
+	return cond, args, nil
+}
+
+// arg adds a positional argument to the query and returns its placeholder.
+func (s *segQuery) arg(v interface{}) string {
+	s.args = append(s.args, v)
+	return "$" + strconv.Itoa(s.offset+len(s.args))
+}
+
+func (s *segQuery) compile(f models.SegmentFilter, depth int) (string, error) {
+	if depth > segMaxDepth {
+		return "", fmt.Errorf("filter is nested deeper than %d levels", segMaxDepth)
+	}
+
+	s.nodes++
+	if s.nodes > segMaxNodes {
+		return "", fmt.Errorf("filter has more than %d conditions", segMaxNodes)
+	}
+
+	n := 0
+	for _, ok := range []bool{len(f.And) > 0, len(f.Or) > 0, f.Not != nil, f.Field != ""} {
+		if ok {
+			n++
+		}
+	}
+	if n != 1 {
+		return "", errors.New("every filter should have exactly one of `and`, `or`, `not`, or `field`")
+	}
+
+	switch {
+	case len(f.And) > 0:
+		return s.group(f.And, " AND ", depth)
+	case len(f.Or) > 0:
+		return s.group(f.Or, " OR ", depth)
+	case f.Not != nil:
+		exp, err := s.compile(*f.Not, depth+1)
+		if err != nil {
+			return "", err
+		}
+		return "(NOT COALESCE(" + exp + ", false))", nil
+	}
+
+	return s.condition(f)
+}
+
+func (s *segQuery) group(items []models.SegmentFilter, sep string, depth int) (string, error) {
+	exps := make([]string, 0, len(items))
+	for _, f := range items {
+		exp, err := s.compile(f, depth+1)
+		if err != nil {
+			return "", err
+		}
+		exps = append(exps, exp)
+	}
+
+	return "(" + strings.Join(exps, sep) + ")", nil
+}
+
+// condition compiles a single field condition.
+func (s *segQuery) condition(f models.SegmentFilter) (string, error) {
+	switch {
+	case f.Field == "id":
+		return s.number("subscribers.id", f)
+	case f.Field == "email", f.Field == "name":
+		return s.text("subscribers."+f.Field, f)
+	case f.Field == "status":
+		return s.status(f)
+	case f.Field == "created_at", f.Field == "updated_at":
+		return s.date("subscribers."+f.Field, f)
+	case strings.HasPrefix(f.Field, "attribs."):
+		return s.attrib(f)
+	case f.Field == "list":
+		return s.list(f)
+	case segEngagementFields[f.Field]:
+		return s.engagement(f)
+	}
+
+	return "", fmt.Errorf("unknown field '%s'", f.Field)
+}
+
+func (s *segQuery) number(col string, f models.SegmentFilter) (string, error) {
+	switch f.Op {
+	case segOpIn, segOpNotIn:
+		ids, err := segInts(f)
+		if err != nil {
+			return "", err
+		}
+		return segNegate(f.Op == segOpNotIn, col+" = ANY("+s.arg(pq.Array(ids))+"::INT[])"), nil
+	}
+
+	op, ok := segCompareOps[f.Op]
+	if !ok {
+		return "", segOpErr(f)
+	}
+	n, ok := segInt(f.Value)
+	if !ok {
+		return "", segValErr(f)
+	}
+
+	return "(" + col + " " + op + " " + s.arg(n) + ")", nil
+}
+
+func (s *segQuery) text(col string, f models.SegmentFilter) (string, error) {
+	switch f.Op {
+	case segOpEq, segOpNeq:
+		v, ok := f.Value.(string)
+		if !ok {
+			return "", segValErr(f)
+		}
+		return "(LOWER(" + col + ") " + segCompareOps[f.Op] + " LOWER(" + s.arg(v) + "))", nil
+
+	case segOpContains, segOpNotContains:
+		v, ok := f.Value.(string)
+		if !ok {
+			return "", segValErr(f)
+		}
+		return segNegate(f.Op == segOpNotContains, col+" ILIKE "+s.arg(segLike(v))), nil
+
+	case segOpIn, segOpNotIn:
+		vals, err := segStrings(f)
+		if err != nil {
+			return "", err
+		}
+		for i, v := range vals {
+			vals[i] = strings.ToLower(v)
+		}
+		return segNegate(f.Op == segOpNotIn, "LOWER("+col+") = ANY("+s.arg(pq.Array(vals))+"::TEXT[])"), nil
+	}
+
+	return "", segOpErr(f)
+}
+
+func (s *segQuery) status(f models.SegmentFilter) (string, error) {
+	var vals []string
+	switch f.Op {
+	case segOpEq, segOpNeq:
+		v, ok := f.Value.(string)
+		if !ok {
+			return "", segValErr(f)
+		}
+		vals = []string{v}
+	case segOpIn, segOpNotIn:
+		v, err := segStrings(f)
+		if err != nil {
+			return "", err
+		}
+		vals = v
+	default:
+		return "", segOpErr(f)
+	}
+
+	for _, v := range vals {
+		if !strSliceContains(v, segSubStatuses) {
+			return "", segValErr(f)
+		}
+	}
+
+	neg := f.Op == segOpNeq || f.Op == segOpNotIn
+	return segNegate(neg, "subscribers.status = ANY("+s.arg(pq.Array(vals))+"::subscriber_status[])"), nil
+}
+
+func (s *segQuery) date(col string, f models.SegmentFilter) (string, error) {
+	if f.Op == segOpWithin {
+		v, ok := f.Value.(string)
+		if !ok || !reSegInterval.MatchString(v) {
+			return "", segValErr(f)
+		}
+		return "(" + col + " > NOW() - " + s.arg(v) + "::INTERVAL)", nil
+	}
+
+	op, ok := segCompareOps[f.Op]
+	if !ok || f.Op == segOpEq || f.Op == segOpNeq {
+		return "", segOpErr(f)
+	}
+
+	v, _ := f.Value.(string)
+	for _, layout := range segDateFormats {
+		if t, err := time.Parse(layout, v); err == nil {
+			return "(" + col + " " + op + " " + s.arg(t) + ")", nil
+		}
+	}
+
+	return "", segValErr(f)
+}
+
+// attrib compiles a condition on a subscriber attribute. The field is in the
+// form attribs.key.nested_key.
+func (s *segQuery) attrib(f models.SegmentFilter) (string, error) {
+	path := strings.Split(strings.TrimPrefix(f.Field, "attribs."), ".")
+	for _, p := range path {
+		if p == "" {
+			return "", fmt.Errorf("invalid attribute '%s'", f.Field)
+		}
+	}
+
+	var (
+		p    = s.arg(pq.Array(path))
+		col  = "(subscribers.attribs #> " + p + "::TEXT[])"
+		text = "(subscribers.attribs #>> " + p + "::TEXT[])"
+	)
+
+	switch f.Op {
+	case segOpExists:
+		return "(" + col + " IS NOT NULL)", nil
+	case segOpNotExists:
+		return "(" + col + " IS NULL)", nil
+
+	case segOpEq:
+		return "(" + col + " = " + s.arg(segJSON(f.Value)) + "::JSONB)", nil
+	case segOpNeq:
+		return "(" + col + " IS DISTINCT FROM " + s.arg(segJSON(f.Value)) + "::JSONB)", nil
+
+	case segOpGt, segOpGte, segOpLt, segOpLte:
+		op := segCompareOps[f.Op]
+		switch v := f.Value.(type) {
+		case float64:
+			return "((CASE WHEN JSONB_TYPEOF(" + col + ") = 'number' THEN " + text + "::NUMERIC END) " +
+				op + " " + s.arg(v) + ")", nil
+		case string:
+			return "(" + text + " " + op + " " + s.arg(v) + ")", nil
+		}
+		return "", segValErr(f)
+
+	case segOpContains, segOpNotContains:
+		if f.Value == nil {
+			return "", segValErr(f)
+		}
+
+		// Array attributes contain the value as an element, and string
+		// attributes contain it as a substring.
+		exp := col + " @> " + s.arg(segJSON(f.Value)) + "::JSONB"
+		if v, ok := f.Value.(string); ok {
+			exp = "(" + exp + " OR (JSONB_TYPEOF(" + col + ") = 'string' AND " + text + " ILIKE " + s.arg(segLike(v)) + "))"
+		}
+		return segNegate(f.Op == segOpNotContains, exp), nil
+
+	case segOpIn, segOpNotIn:
+		vals, ok := f.Value.([]interface{})
+		if !ok || len(vals) == 0 {
+			return "", segValErr(f)
+		}
+		js := make([]string, 0, len(vals))
+		for _, v := range vals {
+			js = append(js, segJSON(v))
+		}
+		return segNegate(f.Op == segOpNotIn, col+" = ANY("+s.arg(pq.Array(js))+"::JSONB[])"), nil
+	}
+
+	return "", segOpErr(f)
+}
+
+// list compiles a list membership condition with an optional subscription status.
+func (s *segQuery) list(f models.SegmentFilter) (string, error) {
+	if f.Op != segOpIn && f.Op != segOpNotIn {
+		return "", segOpErr(f)
+	}
+
+	ids, err := segInts(f)
+	if err != nil {
+		return "", err
+	}
+
+	exp := "EXISTS (SELECT 1 FROM subscriber_lists sl WHERE sl.subscriber_id = subscribers.id AND sl.list_id = ANY(" +
+		s.arg(pq.Array(ids)) + "::INT[])"
+	if f.SubscriptionStatus != "" {
+		if !strSliceContains(f.SubscriptionStatus, segListStatuses) {
+			return "", fmt.Errorf("invalid subscription_status '%s'", f.SubscriptionStatus)
+		}
+		exp += " AND sl.status = " + s.arg(f.SubscriptionStatus) + "::subscription_status"
+	}
+	exp += ")"
+
+	return segNegate(f.Op == segOpNotIn, exp), nil
+}
+
+// engagement compiles a condition on the number of campaign views, link clicks,
+// or e-mails sent to a subscriber, optionally limited to specific campaigns and
+// a recent time interval.
+func (s *segQuery) engagement(f models.SegmentFilter) (string, error) {
+	op, ok := segCompareOps[f.Op]
+	if !ok {
+		return "", segOpErr(f)
+	}
+	n, ok := segInt(f.Value)
+	if !ok {
+		return "", segValErr(f)
+	}
+	if f.Within != "" && !reSegInterval.MatchString(f.Within) {
+		return "", fmt.Errorf("invalid interval '%s' for '%s'", f.Within, f.Field)
+	}
+
+	var exp string
+	if f.Field == "emails" {
+		exp = "SELECT COUNT(*) FROM emails e WHERE e.subscriber_uuid = subscribers.uuid::TEXT"
+		if len(f.CampaignIDs) > 0 {
+			exp += " AND e.campaign_uuid IN (SELECT uuid::TEXT FROM campaigns WHERE id = ANY(" + s.arg(pq.Array(f.CampaignIDs)) + "::INT[]))"
+		}
+		if f.Within != "" {
+			exp += " AND e.sent_at > NOW() - " + s.arg(f.Within) + "::INTERVAL"
+		}
+	} else {
+		// campaign_views and link_clicks.
+		exp = "SELECT COUNT(*) FROM " + f.Field + " e WHERE e.subscriber_id = subscribers.id"
+		if len(f.CampaignIDs) > 0 {
+			exp += " AND e.campaign_id = ANY(" + s.arg(pq.Array(f.CampaignIDs)) + "::INT[])"
+		}
+		if f.Within != "" {
+			exp += " AND e.created_at > NOW() - " + s.arg(f.Within) + "::INTERVAL"
+		}
+	}
+
+	return "((" + exp + ") " + op + " " + s.arg(n) + ")", nil
+}
+
+// segNegate wraps an expression in parentheses, and optionally, negates it.
+// NULLs are treated as false.
+func segNegate(neg bool, exp string) string {
+	if neg {
+		return "(NOT COALESCE(" + exp + ", false))"
+	}
+	return "(" + exp + ")"
+}
+
+// segInt returns the integer in a JSON number value.
+func segInt(v interface{}) (int64, bool) {
+	f, ok := v.(float64)
+	if !ok || f != math.Trunc(f) {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// segInts returns the integers in a non-empty JSON array value.
+func segInts(f models.SegmentFilter) ([]int64, error) {
+	vals, ok := f.Value.([]interface{})
+	if !ok || len(vals) == 0 {
+		return nil, segValErr(f)
+	}
+
+	out := make([]int64, 0, len(vals))
+	for _, v := range vals {
+		n, ok := segInt(v)
+		if !ok {
+			return nil, segValErr(f)
+		}
+		out = append(out, n)
+	}
+
+	return out, nil
+}
+
+// segStrings returns the strings in a non-empty JSON array value.
+func segStrings(f models.SegmentFilter) ([]string, error) {
+	vals, ok := f.Value.([]interface{})
+	if !ok || len(vals) == 0 {
+		return nil, segValErr(f)
+	}
+
+	out := make([]string, 0, len(vals))
+	for _, v := range vals {
+		s, ok := v.(string)
+		if !ok {
+			return nil, segValErr(f)
+		}
+		out = append(out, s)
+	}
+
+	return out, nil
+}
+
+// segJSON returns the JSON encoding of a value decoded from JSON.
+func segJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// segLike returns an ILIKE pattern that matches the given substring.
+func segLike(v string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(v) + "%"
+}
+
+func segOpErr(f models.SegmentFilter) error {
+	return fmt.Errorf("invalid operator '%s' for '%s'", f.Op, f.Field)
+}
+
+func segValErr(f models.SegmentFilter) error {
+	return fmt.Errorf("invalid value for '%s' with operator '%s'", f.Field, f.Op)
+}
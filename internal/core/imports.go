@@ -0,0 +1,60 @@
+package core
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+)
+
+// QueryImportRuns returns import sessions, latest first. Along with the paginated
+// and sliced results, the total number of sessions is returned.
+func (c *Core) QueryImportRuns(offset, limit int) ([]models.ImportRun, int, error) {
+	out := []models.ImportRun{}
+	if err := c.q.GetImportRuns.Select(&out, 0, offset, limit); err != nil {
+		c.log.Printf("error fetching import runs: %v", err)
+		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.importRuns}", "error", pqErrMsg(err)))
+	}
+
+	total := 0
+	if len(out) > 0 {
+		total = out[0].TotalRuns
+	}
+
+	return out, total, nil
+}
+
+// GetImportRun returns an import session.
+func (c *Core) GetImportRun(id int64) (models.ImportRun, error) {
+	var out []models.ImportRun
+	if err := c.q.GetImportRuns.Select(&out, id, 0, 1); err != nil {
+		c.log.Printf("error fetching import session: %v", err)
+		return models.ImportRun{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.importSession}", "error", pqErrMsg(err)))
+	}
+	if len(out) == 0 {
+		return models.ImportRun{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.importSession}"))
+	}
+
+	return out[0], nil
+}
+
+// GetImportRunLog returns the log of an import session.
+func (c *Core) GetImportRunLog(id int64) (string, error) {
+	var out string
+	if err := c.q.GetImportRunLog.Get(&out, id); err != nil {
+		if err == sql.ErrNoRows {
+			return "", echo.NewHTTPError(http.StatusBadRequest,
+				c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.importSession}"))
+		}
+
+		c.log.Printf("error fetching import session log: %v", err)
+		return "", echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.importSession}", "error", pqErrMsg(err)))
+	}
+
+	return out, nil
+}
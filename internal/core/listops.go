@@ -0,0 +1,132 @@
+package core
+
+import (
+	"math"
+	"net/http"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// MergeList copies the subscriptions of a list into another list in batches of
+// batchSize, preserving their statuses, meta, and consent records, which are marked with
+// the source list. Trashed subscribers are not copied. Subscribers who are already on the
+// target list are left as they are. progress, if set, is called after every batch
+// with the number of subscribers processed so far and the total. It returns the
+// number of subscriptions copied.
+func (c *Core) MergeList(srcID, targetID, batchSize int, progress func(done, total int)) (int, error) {
+	subIDs, err := c.getListSubscriberIDs(srcID, false)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := c.copySubscriptions(srcID, targetID, subIDs, batchSize, 0, len(subIDs), progress)
+	_ = c.refreshCache(matListSubStats, false)
+
+	return n, err
+}
+
+// SplitList distributes the subscriptions of a list randomly into the given target
+// lists in (nearly) equal parts. See MergeList for batchSize and progress.
+func (c *Core) SplitList(srcID int, targetIDs []int, batchSize int, progress func(done, total int)) (int, error) {
+	subIDs, err := c.getListSubscriberIDs(srcID, true)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		total  = len(subIDs)
+		size   = int(math.Ceil(float64(total) / float64(len(targetIDs))))
+		copied = 0
+	)
+	for i, id := range targetIDs {
+		start := i * size
+		if start >= total {
+			break
+		}
+		end := start + size
+		if end > total {
+			end = total
+		}
+
+		n, err := c.copySubscriptions(srcID, id, subIDs[start:end], batchSize, start, total, progress)
+		copied += n
+		if err != nil {
+			_ = c.refreshCache(matListSubStats, false)
+			return copied, err
+		}
+	}
+	_ = c.refreshCache(matListSubStats, false)
+
+	return copied, nil
+}
+
+// SampleList copies a random sample of the given percentage of the subscriptions
+// of a list into the target list. See MergeList for batchSize and progress.
+func (c *Core) SampleList(srcID, targetID int, percent float64, batchSize int, progress func(done, total int)) (int, error) {
+	subIDs, err := c.getListSubscriberIDs(srcID, true)
+	if err != nil {
+		return 0, err
+	}
+
+	num := int(math.Round(float64(len(subIDs)) * percent / 100))
+	if num > len(subIDs) {
+		num = len(subIDs)
+	}
+	subIDs = subIDs[:num]
+
+	n, err := c.copySubscriptions(srcID, targetID, subIDs, batchSize, 0, len(subIDs), progress)
+	_ = c.refreshCache(matListSubStats, false)
+
+	return n, err
+}
+
+// getListSubscriberIDs returns the IDs of the subscribers on a list, optionally shuffled.
+func (c *Core) getListSubscriberIDs(listID int, random bool) ([]int, error) {
+	out := []int{}
+	if err := c.q.GetListSubscriberIDs.Select(&out, listID, random); err != nil {
+		c.log.Printf("error fetching list subscribers: %v", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	return out, nil
+}
+
+// copySubscriptions copies the subscriptions of the given subscribers on a list to
+// another list in batches. offset is the number of subscribers of the job processed
+// before these, for reporting progress.
+func (c *Core) copySubscriptions(srcID, targetID int, subIDs []int, batchSize, offset, total int,
+	progress func(done, total int)) (int, error) {
+	if batchSize < 1 {
+		batchSize = 1000
+	}
+
+	copied := 0
+	for i := 0; i < len(subIDs); i += batchSize {
+		end := i + batchSize
+		if end > len(subIDs) {
+			end = len(subIDs)
+		}
+
+		res, err := c.q.CopySubscriptions.Exec(srcID, targetID, pq.Array(subIDs[i:end]))
+		if err != nil {
+			c.log.Printf("error copying subscriptions from list %d to %d: %v", srcID, targetID, err)
+			return copied, echo.NewHTTPError(http.StatusInternalServerError,
+				c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+		}
+
+		n, _ := res.RowsAffected()
+		copied += int(n)
+
+		c.logAudit(models.AuditSubscriptionAdd, subIDs[i:end], nil, targetID, nil,
+			map[string]interface{}{"lists": []int{targetID}, "from_list": srcID})
+
+		if progress != nil {
+			progress(offset+end, total)
+		}
+	}
+
+	return copied, nil
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/gofrs/uuid/v5"
 	"github.com/knadh/listmonk/models"
@@ -132,22 +133,53 @@ func (c *Core) CreateList(l models.List) (models.List, error) {
 	if l.Optin == "" {
 		l.Optin = models.ListOptinSingle
 	}
+	if err := c.prepareListQuery(&l); err != nil {
+		return models.List{}, err
+	}
 
 	// Insert and read ID.
 	var newID int
 	l.UUID = uu.String()
-	if err := c.q.CreateList.Get(&newID, l.UUID, l.Name, l.Type, l.Optin, pq.StringArray(normalizeTags(l.Tags)), l.Description); err != nil {
+	if err := c.q.CreateList.Get(&newID, l.UUID, l.Name, l.Type, l.Optin, pq.StringArray(normalizeTags(l.Tags)), l.Description, l.Query,
+		l.FromEmail, l.TemplateID, l.Messenger, l.ReplyTo, normalizeHeaders(l.Headers), l.ConsentText,
+		normalizeDays(l.OptinReminderDays), l.OptinExpiryDays); err != nil {
 		c.log.Printf("error creating list: %v", err)
 		return models.List{}, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorCreating", "name", "{globals.terms.list}", "error", pqErrMsg(err)))
 	}
 
-	return c.GetList(newID, "")
+	out, err := c.GetList(newID, "")
+	if err != nil {
+		return models.List{}, err
+	}
+	c.logAudit(models.AuditListCreate, nil, nil, newID, nil, listAuditData(out))
+
+	return out, nil
 }
 
 // UpdateList updates a given list.
 func (c *Core) UpdateList(id int, l models.List) (models.List, error) {
-	res, err := c.q.UpdateList.Exec(id, l.Name, l.Type, l.Optin, pq.StringArray(normalizeTags(l.Tags)), l.Description)
+	// Get the list's existing data for the audit log.
+	before, _ := c.GetList(id, "")
+
+	// The type isn't changed if it's not given.
+	typ := l.Type
+	if typ == "" {
+		l.Type = before.Type
+	}
+
+	// A dynamic list keeps its query if it's not given.
+	if l.Type == models.ListTypeDynamic && before.Type == models.ListTypeDynamic && strings.TrimSpace(l.Query) == "" {
+		l.Query = before.Query
+	}
+	if err := c.prepareListQuery(&l); err != nil {
+		return models.List{}, err
+	}
+	l.Type = typ
+
+	res, err := c.q.UpdateList.Exec(id, l.Name, l.Type, l.Optin, pq.StringArray(normalizeTags(l.Tags)), l.Description, l.Query,
+		l.FromEmail, l.TemplateID, l.Messenger, l.ReplyTo, normalizeHeaders(l.Headers), l.ConsentText,
+		normalizeDays(l.OptinReminderDays), l.OptinExpiryDays)
 	if err != nil {
 		c.log.Printf("error updating list: %v", err)
 		return models.List{}, echo.NewHTTPError(http.StatusInternalServerError,
@@ -159,7 +191,63 @@ func (c *Core) UpdateList(id int, l models.List) (models.List, error) {
 			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.list}"))
 	}
 
-	return c.GetList(id, "")
+	out, err := c.GetList(id, "")
+	if err != nil {
+		return models.List{}, err
+	}
+
+	if b, a := auditDiff(listAuditData(before), listAuditData(out)); len(b) > 0 || len(a) > 0 {
+		c.logAudit(models.AuditListUpdate, nil, nil, id, b, a)
+	}
+
+	return out, nil
+}
+
+// SnapshotCampaignLists evaluates the queries of the dynamic lists of campaigns that are
+// due to start and records the matching subscribers, except the ones who have unsubscribed
+// from the lists, as the campaigns' recipients. Like segments, campaigns with dynamic lists
+// are not picked up for sending until their lists are snapshotted. If a list's query can't
+// be evaluated, its campaign is paused.
+func (c *Core) SnapshotCampaignLists() error {
+	var lists []models.List
+	if err := c.q.GetCampaignListsForSnapshot.Select(&lists); err != nil {
+		c.log.Printf("error fetching campaign lists: %v", err)
+		return err
+	}
+
+	for _, l := range lists {
+		if err := c.q.ExecSubQueryTpl(sanitizeSQLExp(l.Query), "", c.q.SnapshotCampaignList, nil, c.db, l.CampaignID, l.ID); err != nil {
+			c.log.Printf("error snapshotting list %d (%s) for campaign %d. pausing campaign: %v",
+				l.ID, l.Name, l.CampaignID, pqErrMsg(err))
+
+			if _, err := c.q.UpdateCampaignStatus.Exec(l.CampaignID, models.CampaignStatusPaused); err != nil {
+				c.log.Printf("error pausing campaign %d: %v", l.CampaignID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// prepareListQuery validates the subscriber query of a dynamic list by counting
+// the subscribers matching it. Dynamic lists are always single opt-in as their
+// members are not subscribed. Other lists have no query.
+func (c *Core) prepareListQuery(l *models.List) error {
+	if l.Type != models.ListTypeDynamic {
+		l.Query = ""
+		return nil
+	}
+
+	l.Query = sanitizeSQLExp(l.Query)
+	if l.Query == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, c.i18n.T("lists.emptyQuery"))
+	}
+	if _, err := c.getSubscriberCount(" AND ("+l.Query+")", "", []int{}); err != nil {
+		return err
+	}
+	l.Optin = models.ListOptinSingle
+
+	return nil
 }
 
 // DeleteList deletes a list.
@@ -174,5 +262,37 @@ func (c *Core) DeleteLists(ids []int) error {
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.list}", "error", pqErrMsg(err)))
 	}
+
+	for _, id := range ids {
+		c.logAudit(models.AuditListDelete, nil, nil, id, nil, nil)
+	}
+
 	return nil
 }
+
+// SnapshotListStats records the daily growth and churn stats of all lists for the
+// days since the last snapshot up to yesterday, going back at most the given number
+// of days. It returns the number of list-days recorded.
+func (c *Core) SnapshotListStats(days int) (int, error) {
+	res, err := c.q.SnapshotListStats.Exec(days)
+	if err != nil {
+		c.log.Printf("error snapshotting list stats: %v", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorCreating", "name", "{globals.terms.analytics}", "error", pqErrMsg(err)))
+	}
+
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+// GetListStats returns the daily growth and churn stats of a list between two dates (YYYY-MM-DD).
+func (c *Core) GetListStats(id int, fromDate, toDate string) ([]models.ListDailyStats, error) {
+	out := []models.ListDailyStats{}
+	if err := c.q.GetListStats.Select(&out, id, fromDate, toDate); err != nil {
+		c.log.Printf("error fetching list stats: %v", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.analytics}", "error", pqErrMsg(err)))
+	}
+
+	return out, nil
+}
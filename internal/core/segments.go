@@ -0,0 +1,224 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// QuerySegments gets segments based on the given query params. Along with the paginated
+// and sliced results, the total number of segments in the DB is returned.
+func (c *Core) QuerySegments(searchStr, orderBy, order string, offset, limit int) ([]models.Segment, int, error) {
+	if searchStr = strings.TrimSpace(searchStr); searchStr != "" {
+		searchStr = "%" + searchStr + "%"
+	}
+
+	// Sort params.
+	if !strSliceContains(orderBy, segQuerySortFields) {
+		orderBy = "created_at"
+	}
+	if order != SortAsc && order != SortDesc {
+		order = SortDesc
+	}
+
+	var (
+		out  = []models.Segment{}
+		stmt = strings.ReplaceAll(c.q.QuerySegments, "%order%", orderBy+" "+order)
+	)
+	if err := c.db.Select(&out, stmt, 0, searchStr, offset, limit); err != nil {
+		c.log.Printf("error fetching segments: %v", err)
+		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.segments}", "error", pqErrMsg(err)))
+	}
+
+	total := 0
+	if len(out) > 0 {
+		total = out[0].Total
+	}
+
+	return out, total, nil
+}
+
+// GetSegment gets a segment by its ID.
+func (c *Core) GetSegment(id int) (models.Segment, error) {
+	var (
+		out  []models.Segment
+		stmt = strings.ReplaceAll(c.q.QuerySegments, "%order%", "id")
+	)
+	if err := c.db.Select(&out, stmt, id, "", 0, 1); err != nil {
+		c.log.Printf("error fetching segment: %v", err)
+		return models.Segment{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.segment}", "error", pqErrMsg(err)))
+	}
+
+	if len(out) == 0 {
+		return models.Segment{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.segment}"))
+	}
+
+	return out[0], nil
+}
+
+// CreateSegment creates a new segment. The segment's query is validated by
+// counting the subscribers that match it.
+func (c *Core) CreateSegment(s models.Segment) (models.Segment, error) {
+	count, err := c.countSegment(s)
+	if err != nil {
+		return models.Segment{}, err
+	}
+
+	uu, err := uuid.NewV4()
+	if err != nil {
+		c.log.Printf("error generating UUID: %v", err)
+		return models.Segment{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUUID", "error", err.Error()))
+	}
+
+	// Insert and read ID.
+	var newID int
+	if err := c.q.CreateSegment.Get(&newID, uu, s.Name, sanitizeSQLExp(s.Query), segmentFilterJSON(s.Filter)); err != nil {
+		c.log.Printf("error creating segment: %v", err)
+		return models.Segment{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorCreating", "name", "{globals.terms.segment}", "error", pqErrMsg(err)))
+	}
+
+	if err := c.updateSegmentCount(newID, count); err != nil {
+		return models.Segment{}, err
+	}
+
+	return c.GetSegment(newID)
+}
+
+// UpdateSegment updates a given segment and its cached subscriber count.
+func (c *Core) UpdateSegment(id int, s models.Segment) (models.Segment, error) {
+	count, err := c.countSegment(s)
+	if err != nil {
+		return models.Segment{}, err
+	}
+
+	res, err := c.q.UpdateSegment.Exec(id, s.Name, sanitizeSQLExp(s.Query), segmentFilterJSON(s.Filter))
+	if err != nil {
+		c.log.Printf("error updating segment: %v", err)
+		return models.Segment{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.segment}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.Segment{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.segment}"))
+	}
+
+	if err := c.updateSegmentCount(id, count); err != nil {
+		return models.Segment{}, err
+	}
+
+	return c.GetSegment(id)
+}
+
+// RefreshSegmentCount re-counts the subscribers matching a segment and updates
+// its cached count.
+func (c *Core) RefreshSegmentCount(id int) (models.Segment, error) {
+	s, err := c.GetSegment(id)
+	if err != nil {
+		return models.Segment{}, err
+	}
+
+	count, err := c.countSegment(s)
+	if err != nil {
+		return models.Segment{}, err
+	}
+
+	if err := c.updateSegmentCount(id, count); err != nil {
+		return models.Segment{}, err
+	}
+
+	return c.GetSegment(id)
+}
+
+// DeleteSegments deletes segments.
+func (c *Core) DeleteSegments(ids []int) error {
+	if _, err := c.q.DeleteSegments.Exec(pq.Array(ids)); err != nil {
+		c.log.Printf("error deleting segments: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.segment}", "error", pqErrMsg(err)))
+	}
+
+	return nil
+}
+
+// SnapshotCampaignSegments evaluates the segments of campaigns that are due to start
+// and records the matching subscribers as the campaigns' recipients. This keeps the
+// recipients (and to_send) of a campaign stable while it's running. Campaigns with
+// segments are not picked up for sending until their segments are snapshotted.
+// If a segment can't be evaluated, its campaign is paused.
+func (c *Core) SnapshotCampaignSegments() error {
+	var segs []models.Segment
+	if err := c.q.GetCampaignSegmentsForSnapshot.Select(&segs); err != nil {
+		c.log.Printf("error fetching campaign segments: %v", err)
+		return err
+	}
+
+	for _, s := range segs {
+		// The query template takes 4 arguments before the segment filter's.
+		segExp, segArgs, err := c.compileSegmentFilter(s.Filter, 4)
+		if err == nil {
+			args := append([]interface{}{s.CampaignID, s.ID}, segArgs...)
+			err = c.q.ExecSubQueryTpl(sanitizeSQLExp(s.Query), segExp, c.q.SnapshotCampaignSegment, nil, c.db, args...)
+		}
+		if err != nil {
+			c.log.Printf("error snapshotting segment %d (%s) for campaign %d. pausing campaign: %v",
+				s.ID, s.Name, s.CampaignID, pqErrMsg(err))
+
+			if _, err := c.q.UpdateCampaignStatus.Exec(s.CampaignID, models.CampaignStatusPaused); err != nil {
+				c.log.Printf("error pausing campaign %d: %v", s.CampaignID, err)
+			}
+			continue
+		}
+	}
+
+	return nil
+}
+
+// countSegment returns the number of subscribers matching a segment's query and filter.
+func (c *Core) countSegment(s models.Segment) (int, error) {
+	cond := ""
+	if q := sanitizeSQLExp(s.Query); q != "" {
+		cond = " AND (" + q + ")"
+	}
+
+	// The count query takes 2 arguments before the segment filter's.
+	cond, args, err := c.makeSubQueryCond(cond, s.Filter, 2)
+	if err != nil {
+		return 0, err
+	}
+	if cond == "" {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, c.i18n.T("segments.emptyQuery"))
+	}
+
+	return c.getSubscriberCount(cond, "", []int{}, args...)
+}
+
+func (c *Core) updateSegmentCount(id, count int) error {
+	if _, err := c.q.UpdateSegmentCount.Exec(id, count); err != nil {
+		c.log.Printf("error updating segment count: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.segment}", "error", pqErrMsg(err)))
+	}
+
+	return nil
+}
+
+// segmentFilterJSON returns the JSON to be stored for an optional segment filter.
+func segmentFilterJSON(f *models.SegmentFilter) interface{} {
+	if f == nil {
+		return nil
+	}
+
+	b, _ := json.Marshal(f)
+	return b
+}
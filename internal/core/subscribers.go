@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/gofrs/uuid/v5"
+	"github.com/knadh/listmonk/internal/attribs"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
 	"github.com/lib/pq"
@@ -66,11 +67,12 @@ func (c *Core) GetSubscribersByEmail(emails []string) (models.Subscribers, error
 }
 
 // QuerySubscribers queries and returns paginated subscrribers based on the given params including the total count.
-func (c *Core) QuerySubscribers(query string, listIDs []int, subStatus string, order, orderBy string, offset, limit int) (models.Subscribers, int, error) {
+// query is an arbitrary SQL expression and filter is an optional structured segment filter.
+func (c *Core) QuerySubscribers(query string, filter *models.SegmentFilter, listIDs []int, subStatus string, order, orderBy string, offset, limit int) (models.Subscribers, int, error) {
 	// There's an arbitrary query condition.
 	cond := ""
 	if query != "" {
-		cond = " AND " + query
+		cond = " AND (" + query + ")"
 	}
 
 	// Sort params.
@@ -87,8 +89,13 @@ func (c *Core) QuerySubscribers(query string, listIDs []int, subStatus string, o
 	}
 
 	// Create a readonly transaction that just does COUNT() to obtain the count of results
-	// and to ensure that the arbitrary query is indeed readonly.
-	total, err := c.getSubscriberCount(cond, subStatus, listIDs)
+	// and to ensure that the arbitrary query is indeed readonly. The count query takes
+	// 2 arguments and the results query takes 4 before the segment filter's.
+	countCond, countArgs, err := c.makeSubQueryCond(cond, filter, 2)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := c.getSubscriberCount(countCond, subStatus, listIDs, countArgs...)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -98,6 +105,11 @@ func (c *Core) QuerySubscribers(query string, listIDs []int, subStatus string, o
 		return models.Subscribers{}, 0, nil
 	}
 
+	cond, args, err := c.makeSubQueryCond(cond, filter, 4)
+	if err != nil {
+		return nil, 0, err
+	}
+
 	// Run the query again and fetch the actual data. stmt is the raw SQL query.
 	var out models.Subscribers
 	stmt := fmt.Sprintf(c.q.QuerySubscribersCount, cond)
@@ -111,7 +123,8 @@ func (c *Core) QuerySubscribers(query string, listIDs []int, subStatus string, o
 	}
 	defer tx.Rollback()
 
-	if err := tx.Select(&out, stmt, pq.Array(listIDs), subStatus, offset, limit); err != nil {
+	args = append([]interface{}{pq.Array(listIDs), subStatus, offset, limit}, args...)
+	if err := tx.Select(&out, stmt, args...); err != nil {
 		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
@@ -126,6 +139,25 @@ func (c *Core) QuerySubscribers(query string, listIDs []int, subStatus string, o
 	return out, total, nil
 }
 
+// GetSuppressedEmails returns the e-mails from the given list that belong to
+// blocklisted or hard-bounced subscribers and should not be messaged. E-mails are
+// matched case-insensitively and returned in lowercase.
+func (c *Core) GetSuppressedEmails(emails []string) ([]string, error) {
+	lower := make([]string, len(emails))
+	for i, e := range emails {
+		lower[i] = strings.ToLower(e)
+	}
+
+	var out []string
+	if err := c.q.GetSuppressedEmails.Select(&out, pq.Array(lower)); err != nil {
+		c.log.Printf("error fetching suppressed e-mails: %v", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	return out, nil
+}
+
 // GetSubscriberLists returns a subscriber's lists based on the given conditions.
 func (c *Core) GetSubscriberLists(subID int, uuid string, listIDs []int, listUUIDs []string, subStatus string, listType string) ([]models.List, error) {
 	if listIDs == nil {
@@ -175,11 +207,11 @@ func (c *Core) GetSubscriberProfileForExport(id int, uuid string) (models.Subscr
 // on the given criteria in an exportable form. The iterator function returned can be called
 // repeatedly until there are nil subscribers. It's an iterator because exports can be extremely
 // large and may have to be fetched in batches from the DB and streamed somewhere.
-func (c *Core) ExportSubscribers(query string, subIDs, listIDs []int, subStatus string, batchSize int) (func() ([]models.SubscriberExport, error), error) {
+func (c *Core) ExportSubscribers(query string, filter *models.SegmentFilter, subIDs, listIDs []int, subStatus string, batchSize int) (func() ([]models.SubscriberExport, error), error) {
 	// There's an arbitrary query condition.
 	cond := ""
 	if query != "" {
-		cond = " AND " + query
+		cond = " AND (" + query + ")"
 	}
 
 	stmt := fmt.Sprintf(c.q.QuerySubscribersForExport, cond)
@@ -208,6 +240,13 @@ func (c *Core) ExportSubscribers(query string, subIDs, listIDs []int, subStatus
 		listIDs = []int{}
 	}
 
+	// Add the segment filter. The export query takes 5 arguments before the filter's.
+	cond, args, err := c.makeSubQueryCond(cond, filter, 5)
+	if err != nil {
+		return nil, err
+	}
+	stmt = strings.ReplaceAll(c.q.QuerySubscribersForExport, "%query%", cond)
+
 	// Prepare the actual query statement.
 	tx, err := c.db.Preparex(stmt)
 	if err != nil {
@@ -219,7 +258,8 @@ func (c *Core) ExportSubscribers(query string, subIDs, listIDs []int, subStatus
 	id := 0
 	return func() ([]models.SubscriberExport, error) {
 		var out []models.SubscriberExport
-		if err := tx.Select(&out, pq.Array(listIDs), id, pq.Array(subIDs), subStatus, batchSize); err != nil {
+		a := append([]interface{}{pq.Array(listIDs), id, pq.Array(subIDs), subStatus, batchSize}, args...)
+		if err := tx.Select(&out, a...); err != nil {
 			c.log.Printf("error exporting subscribers by query: %v", err)
 			return nil, echo.NewHTTPError(http.StatusInternalServerError,
 				c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
@@ -245,6 +285,10 @@ func (c *Core) InsertSubscriber(sub models.Subscriber, listIDs []int, listUUIDs
 	}
 	sub.UUID = uu.String()
 
+	if sub.Attribs, err = c.validateAttribs(sub.Attribs); err != nil {
+		return models.Subscriber{}, false, err
+	}
+
 	subStatus := models.SubscriptionStatusUnconfirmed
 	if preconfirm {
 		subStatus = models.SubscriptionStatusConfirmed
@@ -261,6 +305,18 @@ func (c *Core) InsertSubscriber(sub models.Subscriber, listIDs []int, listUUIDs
 		listUUIDs = []string{}
 	}
 
+	// A subscriber in the trash with the same e-mail is restored with its data intact
+	// and subscribed to the given lists, like an existing subscriber would be.
+	if id, err := c.restoreTrashedSubscriberByEmail(sub.Email); err != nil {
+		return models.Subscriber{}, false, err
+	} else if id > 0 {
+		ex, err := c.GetSubscriber(id, "", "")
+		if err != nil {
+			return models.Subscriber{}, false, err
+		}
+		return c.UpdateSubscriberWithLists(id, ex, listIDs, listUUIDs, preconfirm, false)
+	}
+
 	if err = c.q.InsertSubscriber.Get(&sub.ID,
 		sub.UUID,
 		sub.Email,
@@ -269,7 +325,8 @@ func (c *Core) InsertSubscriber(sub models.Subscriber, listIDs []int, listUUIDs
 		sub.Attribs,
 		pq.Array(listIDs),
 		pq.Array(listUUIDs),
-		subStatus); err != nil {
+		subStatus,
+		c.consentJSON()); err != nil {
 		if pqErr, ok := err.(*pq.Error); ok && pqErr.Constraint == "subscribers_email_key" {
 			return models.Subscriber{}, false, echo.NewHTTPError(http.StatusConflict, c.i18n.T("subscribers.emailExists"))
 		} else {
@@ -287,6 +344,13 @@ func (c *Core) InsertSubscriber(sub models.Subscriber, listIDs []int, listUUIDs
 		return models.Subscriber{}, false, err
 	}
 
+	if sub.ID > 0 {
+		c.logSubscriberAudit(models.AuditSubscriberCreate, models.Subscriber{}, out)
+	} else {
+		c.logAudit(models.AuditSubscriptionAdd, []int{out.ID}, nil, 0, nil,
+			map[string]interface{}{"lists": listIDs, "list_uuids": listUUIDs, "status": subStatus})
+	}
+
 	hasOptin := false
 	if !preconfirm && c.consts.SendOptinConfirmation {
 		// Send a confirmation e-mail (if there are any double opt-in lists).
@@ -299,6 +363,12 @@ func (c *Core) InsertSubscriber(sub models.Subscriber, listIDs []int, listUUIDs
 
 // UpdateSubscriber updates a subscriber's properties.
 func (c *Core) UpdateSubscriber(id int, sub models.Subscriber) (models.Subscriber, error) {
+	attr, err := c.validateAttribs(sub.Attribs)
+	if err != nil {
+		return models.Subscriber{}, err
+	}
+	sub.Attribs = attr
+
 	// Format raw JSON attributes.
 	attribs := []byte("{}")
 	if len(sub.Attribs) > 0 {
@@ -311,7 +381,10 @@ func (c *Core) UpdateSubscriber(id int, sub models.Subscriber) (models.Subscribe
 		}
 	}
 
-	_, err := c.q.UpdateSubscriber.Exec(id,
+	// Get the subscriber's existing data for the audit log.
+	before, _ := c.GetSubscriber(id, "", "")
+
+	_, err = c.q.UpdateSubscriber.Exec(id,
 		sub.Email,
 		strings.TrimSpace(sub.Name),
 		sub.Status,
@@ -327,6 +400,7 @@ func (c *Core) UpdateSubscriber(id int, sub models.Subscriber) (models.Subscribe
 	if err != nil {
 		return models.Subscriber{}, err
 	}
+	c.logSubscriberAudit(models.AuditSubscriberUpdate, before, out)
 
 	return out, nil
 }
@@ -340,6 +414,12 @@ func (c *Core) UpdateSubscriberWithLists(id int, sub models.Subscriber, listIDs
 		subStatus = models.SubscriptionStatusConfirmed
 	}
 
+	attr, err := c.validateAttribs(sub.Attribs)
+	if err != nil {
+		return models.Subscriber{}, false, err
+	}
+	sub.Attribs = attr
+
 	// Format raw JSON attributes.
 	attribs := []byte("{}")
 	if len(sub.Attribs) > 0 {
@@ -352,7 +432,10 @@ func (c *Core) UpdateSubscriberWithLists(id int, sub models.Subscriber, listIDs
 		}
 	}
 
-	_, err := c.q.UpdateSubscriberWithLists.Exec(id,
+	// Get the subscriber's existing data for the audit log.
+	before, _ := c.GetSubscriber(id, "", "")
+
+	_, err = c.q.UpdateSubscriberWithLists.Exec(id,
 		sub.Email,
 		strings.TrimSpace(sub.Name),
 		sub.Status,
@@ -360,7 +443,8 @@ func (c *Core) UpdateSubscriberWithLists(id int, sub models.Subscriber, listIDs
 		pq.Array(listIDs),
 		pq.Array(listUUIDs),
 		subStatus,
-		deleteLists)
+		deleteLists,
+		c.consentJSON())
 	if err != nil {
 		c.log.Printf("error updating subscriber: %v", err)
 		return models.Subscriber{}, false, echo.NewHTTPError(http.StatusInternalServerError,
@@ -371,6 +455,7 @@ func (c *Core) UpdateSubscriberWithLists(id int, sub models.Subscriber, listIDs
 	if err != nil {
 		return models.Subscriber{}, false, err
 	}
+	c.logSubscriberAudit(models.AuditSubscriberUpdate, before, out)
 
 	hasOptin := false
 	if !preconfirm && c.consts.SendOptinConfirmation {
@@ -389,22 +474,185 @@ func (c *Core) BlocklistSubscribers(subIDs []int) error {
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("subscribers.errorBlocklisting", "error", err.Error()))
 	}
+	c.logAudit(models.AuditSubscriberBlocklist, subIDs, nil, 0, nil,
+		map[string]interface{}{"status": models.SubscriberStatusBlockListed})
 
 	return nil
 }
 
 // BlocklistSubscribersByQuery blocklists the given list of subscribers.
-func (c *Core) BlocklistSubscribersByQuery(query string, listIDs []int) error {
-	if err := c.q.ExecSubQueryTpl(sanitizeSQLExp(query), c.q.BlocklistSubscribersByQuery, listIDs, c.db); err != nil {
+func (c *Core) BlocklistSubscribersByQuery(query string, filter *models.SegmentFilter, listIDs []int) error {
+	segExp, segArgs, err := c.compileSegmentFilter(filter, 2)
+	if err != nil {
+		return err
+	}
+
+	if err := c.q.ExecSubQueryTpl(sanitizeSQLExp(query), segExp, c.q.BlocklistSubscribersByQuery, listIDs, c.db, segArgs...); err != nil {
 		c.log.Printf("error blocklisting subscribers: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("subscribers.errorBlocklisting", "error", pqErrMsg(err)))
 	}
+	c.logAudit(models.AuditSubscriberBlocklist, nil, nil, 0, nil, auditQuery(query, filter, listIDs))
+
+	return nil
+}
+
+// ValidateAttribsUpdate checks that an attribute update has either a merge patch or
+// well formed JSON patch operations.
+func (c *Core) ValidateAttribsUpdate(upd models.AttribsUpdate) error {
+	if (len(upd.Merge) == 0) == (len(upd.Patch) == 0) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.invalidFields", "name", "merge / patch"))
+	}
+
+	if err := attribs.ValidatePatch(upd.Patch); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("subscribers.errorAttribsPatch", "error", err.Error()))
+	}
 
 	return nil
 }
 
-// DeleteSubscribers deletes the given list of subscribers.
+// QuerySubscriberIDs returns the IDs of all subscribers matching an arbitrary query,
+// segment filter, and/or list IDs.
+func (c *Core) QuerySubscriberIDs(query string, filter *models.SegmentFilter, listIDs []int) ([]int, error) {
+	segExp, segArgs, err := c.compileSegmentFilter(filter, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []int{}
+	if err := c.q.SelectSubQueryTpl(&ids, sanitizeSQLExp(query), segExp, c.q.QuerySubscriberIDsByQuery, listIDs, c.db, segArgs...); err != nil {
+		c.log.Printf("error querying subscribers: %v", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	return ids, nil
+}
+
+// UpdateSubscribersAttribs applies an attribute update to the given subscribers in
+// batches of batchSize. Subscribers whose attributes fail the patch or the attribute
+// schema validation are skipped. progress, if set, is called after every batch with
+// the number of subscribers processed, updated, and skipped so far.
+func (c *Core) UpdateSubscribersAttribs(subIDs []int, upd models.AttribsUpdate, batchSize int,
+	progress func(done, updated, failed int)) (int, int, error) {
+	if batchSize < 1 {
+		batchSize = 1000
+	}
+
+	var updated, failed int
+	for i := 0; i < len(subIDs); i += batchSize {
+		end := i + batchSize
+		if end > len(subIDs) {
+			end = len(subIDs)
+		}
+
+		ids, nFailed, err := c.updateSubscribersAttribsBatch(subIDs[i:end], upd)
+		if err != nil {
+			return updated, failed, err
+		}
+		updated += len(ids)
+		failed += nFailed
+
+		if len(ids) > 0 {
+			c.logAudit(models.AuditSubscriberUpdate, ids, nil, 0, nil, upd)
+		}
+
+		if progress != nil {
+			progress(end, updated, failed)
+		}
+	}
+
+	return updated, failed, nil
+}
+
+// updateSubscribersAttribsBatch applies an attribute update to a batch of subscribers in a
+// transaction. The subscribers' rows are locked while their attributes are read and updated
+// so that changes made to them in the meantime aren't lost. It returns the IDs of the
+// subscribers updated and the number of subscribers that failed the update.
+func (c *Core) updateSubscribersAttribsBatch(subIDs []int, upd models.AttribsUpdate) ([]int, int, error) {
+	tx, err := c.db.Beginx()
+	if err != nil {
+		c.log.Printf("error updating subscriber attributes: %v", err)
+		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+	defer tx.Rollback()
+
+	var rows []struct {
+		ID      int             `db:"id"`
+		Attribs json.RawMessage `db:"attribs"`
+	}
+	if err := tx.Stmtx(c.q.GetSubscribersAttribs).Select(&rows, pq.Array(subIDs)); err != nil {
+		c.log.Printf("error fetching subscriber attributes: %v", err)
+		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	var (
+		ids    = make([]int, 0, len(rows))
+		vals   = make([]string, 0, len(rows))
+		failed = 0
+	)
+	for _, r := range rows {
+		attr := models.JSON{}
+		if err := json.Unmarshal(r.Attribs, &attr); err != nil {
+			failed++
+			continue
+		}
+
+		out, err := c.applyAttribsUpdate(attr, upd)
+		if err != nil {
+			failed++
+			continue
+		}
+
+		b, err := json.Marshal(out)
+		if err != nil {
+			failed++
+			continue
+		}
+
+		ids = append(ids, r.ID)
+		vals = append(vals, string(b))
+	}
+
+	if len(ids) > 0 {
+		if _, err := tx.Stmtx(c.q.UpdateSubscribersAttribs).Exec(pq.Array(ids), pq.Array(vals)); err != nil {
+			c.log.Printf("error updating subscriber attributes: %v", err)
+			return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
+				c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.log.Printf("error updating subscriber attributes: %v", err)
+		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	return ids, failed, nil
+}
+
+// applyAttribsUpdate applies an attribute update to a subscriber's attributes and
+// validates the result against the attribute schema.
+func (c *Core) applyAttribsUpdate(attr models.JSON, upd models.AttribsUpdate) (models.JSON, error) {
+	if len(upd.Merge) > 0 {
+		attr = attribs.Merge(attr, upd.Merge)
+	} else {
+		out, err := attribs.Patch(attr, upd.Patch)
+		if err != nil {
+			return nil, err
+		}
+		attr = out
+	}
+
+	return c.attribs.Validate(attr)
+}
+
+// DeleteSubscribers moves the given list of subscribers to the trash, from where they can
+// be restored until they're purged. Use WipeSubscribers to delete them permanently.
 func (c *Core) DeleteSubscribers(subIDs []int, subUUIDs []string) error {
 	if subIDs == nil {
 		subIDs = []int{}
@@ -413,35 +661,152 @@ func (c *Core) DeleteSubscribers(subIDs []int, subUUIDs []string) error {
 		subUUIDs = []string{}
 	}
 
-	if _, err := c.q.DeleteSubscribers.Exec(pq.Array(subIDs), pq.Array(subUUIDs)); err != nil {
+	var ids []int
+	if err := c.q.TrashSubscribers.Select(&ids, pq.Array(subIDs), pq.Array(subUUIDs)); err != nil {
 		c.log.Printf("error deleting subscribers: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
 
+	if len(ids) > 0 {
+		c.logAudit(models.AuditSubscriberDelete, ids, nil, 0, nil, nil)
+	}
+
 	return nil
 }
 
-// DeleteSubscribersByQuery deletes subscribers by a given arbitrary query expression.
-func (c *Core) DeleteSubscribersByQuery(query string, listIDs []int) error {
-	err := c.q.ExecSubQueryTpl(sanitizeSQLExp(query), c.q.DeleteSubscribersByQuery, listIDs, c.db)
+// QueryDuplicateSubscribers finds groups of likely duplicate subscribers. Subscribers
+// match if their e-mails are the same after normalization (case, +tags, and dots in
+// Gmail addresses) or if they have the same value for any of the given attributes.
+func (c *Core) QueryDuplicateSubscribers(attribs []string, offset, limit int) ([]models.DuplicateSubscribers, int, error) {
+	if attribs == nil {
+		attribs = []string{}
+	}
+
+	out := []models.DuplicateSubscribers{}
+	if err := c.q.QueryDuplicateSubscribers.Select(&out, pq.Array(attribs), offset, limit); err != nil {
+		c.log.Printf("error fetching duplicate subscribers: %v", err)
+		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	total := 0
+	if len(out) > 0 {
+		total = out[0].Total
+	}
+
+	return out, total, nil
+}
+
+// MergeSubscribers merges the given subscribers into the subscriber id. Their list
+// subscriptions, bounces, views, clicks, and e-mail history are moved to subscriber id,
+// and they are then deleted.
+func (c *Core) MergeSubscribers(id int, mergeIDs []int) (models.Subscriber, error) {
+	ids := make([]int, 0, len(mergeIDs))
+	for _, m := range mergeIDs {
+		if m != id {
+			ids = append(ids, m)
+		}
+	}
+	if len(ids) == 0 {
+		return models.Subscriber{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.invalidFields", "name", "ids"))
+	}
+
+	// Check that the surviving subscriber exists.
+	before, err := c.GetSubscriber(id, "", "")
+	if err != nil {
+		return models.Subscriber{}, err
+	}
+
+	tx, err := c.db.Beginx()
+	if err != nil {
+		c.log.Printf("error merging subscribers: %v", err)
+		return models.Subscriber{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("subscribers.errorMerging", "error", pqErrMsg(err)))
+	}
+	defer tx.Rollback()
+
+	var res struct {
+		Merged int            `db:"merged"`
+		Status sql.NullString `db:"status"`
+	}
+	if err := tx.Stmtx(c.q.MergeSubscribers).Get(&res, id, pq.Array(ids)); err != nil {
+		c.log.Printf("error merging subscribers: %v", err)
+		return models.Subscriber{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("subscribers.errorMerging", "error", pqErrMsg(err)))
+	}
+	if res.Merged == 0 {
+		return models.Subscriber{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.subscribers}"))
+	}
+
+	// If any of the subscribers was blocklisted, the merged subscriber is blocklisted
+	// and unsubscribed from all lists, including the subscriptions carried over.
+	if res.Status.String == models.SubscriberStatusBlockListed {
+		if _, err := tx.Stmtx(c.q.BlocklistSubscribers).Exec(pq.Array([]int{id})); err != nil {
+			c.log.Printf("error blocklisting merged subscriber: %v", err)
+			return models.Subscriber{}, echo.NewHTTPError(http.StatusInternalServerError,
+				c.i18n.Ts("subscribers.errorMerging", "error", pqErrMsg(err)))
+		}
+	}
+
+	if _, err := tx.Stmtx(c.q.DeleteSubscribers).Exec(pq.Array(ids), pq.Array([]string{})); err != nil {
+		c.log.Printf("error deleting merged subscribers: %v", err)
+		return models.Subscriber{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("subscribers.errorMerging", "error", pqErrMsg(err)))
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.log.Printf("error merging subscribers: %v", err)
+		return models.Subscriber{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("subscribers.errorMerging", "error", pqErrMsg(err)))
+	}
+
+	out, err := c.GetSubscriber(id, "", "")
+	if err != nil {
+		return models.Subscriber{}, err
+	}
+
+	b, a := auditDiff(subscriberAuditData(before), subscriberAuditData(out))
+	a["merged"] = ids
+	c.logAudit(models.AuditSubscriberMerge, []int{id}, nil, 0, b, a)
+	c.logAudit(models.AuditSubscriberDelete, ids, nil, 0, nil, map[string]interface{}{"merged_into": id})
+
+	return out, nil
+}
+
+// DeleteSubscribersByQuery moves subscribers matching a given arbitrary query expression to the trash.
+func (c *Core) DeleteSubscribersByQuery(query string, filter *models.SegmentFilter, listIDs []int) error {
+	segExp, segArgs, err := c.compileSegmentFilter(filter, 2)
+	if err != nil {
+		return err
+	}
+
+	err = c.q.ExecSubQueryTpl(sanitizeSQLExp(query), segExp, c.q.TrashSubscribersByQuery, listIDs, c.db, segArgs...)
 	if err != nil {
 		c.log.Printf("error deleting subscribers: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
+	c.logAudit(models.AuditSubscriberDelete, nil, nil, 0, nil, auditQuery(query, filter, listIDs))
 
 	return err
 }
 
 // UnsubscribeByCampaign unsubscribes a given subscriber from lists in a given campaign.
 func (c *Core) UnsubscribeByCampaign(subUUID, campUUID string, blocklist bool) error {
+	before, _ := c.GetSubscriber(0, subUUID, "")
+
 	if _, err := c.q.UnsubscribeByCampaign.Exec(campUUID, subUUID, blocklist); err != nil {
 		c.log.Printf("error unsubscribing: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
 
+	after, _ := c.GetSubscriber(0, subUUID, "")
+	c.logSubscriberAudit(models.AuditSubscriptionUnsub, before, after)
+
 	return nil
 }
 
@@ -451,12 +816,17 @@ func (c *Core) ConfirmOptionSubscription(subUUID string, listUUIDs []string, met
 		meta = models.JSON{}
 	}
 
+	before, _ := c.GetSubscriber(0, subUUID, "")
+
 	if _, err := c.q.ConfirmSubscriptionOptin.Exec(subUUID, pq.Array(listUUIDs), meta); err != nil {
 		c.log.Printf("error confirming subscription: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
 
+	after, _ := c.GetSubscriber(0, subUUID, "")
+	c.logSubscriberAudit(models.AuditSubscriptionConfirm, before, after)
+
 	return nil
 }
 
@@ -486,6 +856,7 @@ func (c *Core) DeleteOrphanSubscribers() (int, error) {
 	}
 
 	n, _ := res.RowsAffected()
+	c.logAudit(models.AuditSubscriberDelete, nil, nil, 0, nil, map[string]interface{}{"orphans": n})
 	return int(n), nil
 }
 
@@ -499,10 +870,11 @@ func (c *Core) DeleteBlocklistedSubscribers() (int, error) {
 	}
 
 	n, _ := res.RowsAffected()
+	c.logAudit(models.AuditSubscriberDelete, nil, nil, 0, nil, map[string]interface{}{"blocklisted": n})
 	return int(n), nil
 }
 
-func (c *Core) getSubscriberCount(cond, subStatus string, listIDs []int) (int, error) {
+func (c *Core) getSubscriberCount(cond, subStatus string, listIDs []int, args ...interface{}) (int, error) {
 	// If there's no condition, it's a "get all" call which can probably be optionally pulled from cache.
 	if cond == "" {
 		_ = c.refreshCache(matListSubStats, false)
@@ -528,10 +900,31 @@ func (c *Core) getSubscriberCount(cond, subStatus string, listIDs []int) (int, e
 
 	// Execute the readonly query and get the count of results.
 	total := 0
-	if err := tx.Get(&total, stmt, pq.Array(listIDs), subStatus); err != nil {
+	args = append([]interface{}{pq.Array(listIDs), subStatus}, args...)
+	if err := tx.Get(&total, stmt, args...); err != nil {
 		return 0, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
 
 	return total, nil
 }
+
+// validateAttribs validates subscriber attributes against the attribute schema.
+func (c *Core) validateAttribs(attr models.JSON) (models.JSON, error) {
+	out, err := c.attribs.Validate(attr)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return out, nil
+}
+
+// auditQuery returns the audit log representation of a change made to subscribers
+// by an arbitrary query.
+func auditQuery(query string, filter *models.SegmentFilter, listIDs []int) map[string]interface{} {
+	out := map[string]interface{}{"query": query, "list_ids": listIDs}
+	if filter != nil {
+		out["filter"] = filter
+	}
+	return out
+}
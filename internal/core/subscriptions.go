@@ -24,29 +24,41 @@ func (c *Core) GetSubscriptions(subID int, subUUID string, allLists bool) ([]mod
 
 // AddSubscriptions adds list subscriptions to subscribers.
 func (c *Core) AddSubscriptions(subIDs, listIDs []int, status string) error {
-	if _, err := c.q.AddSubscribersToLists.Exec(pq.Array(subIDs), pq.Array(listIDs), status); err != nil {
+	if _, err := c.q.AddSubscribersToLists.Exec(pq.Array(subIDs), pq.Array(listIDs), status, c.consentJSON()); err != nil {
 		c.log.Printf("error adding subscriptions: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", err.Error()))
 	}
+	c.logAudit(models.AuditSubscriptionAdd, subIDs, nil, 0, nil, map[string]interface{}{"lists": listIDs, "status": status})
 
 	return nil
 }
 
 // AddSubscriptionsByQuery adds list subscriptions to subscribers by a given arbitrary query expression.
 // sourceListIDs is the list of list IDs to filter the subscriber query with.
-func (c *Core) AddSubscriptionsByQuery(query string, sourceListIDs, targetListIDs []int, status string) error {
+func (c *Core) AddSubscriptionsByQuery(query string, filter *models.SegmentFilter, sourceListIDs, targetListIDs []int, status string) error {
 	if sourceListIDs == nil {
 		sourceListIDs = []int{}
 	}
 
-	err := c.q.ExecSubQueryTpl(sanitizeSQLExp(query), c.q.AddSubscribersToListsByQuery, sourceListIDs, c.db, pq.Array(targetListIDs), status)
+	// The query template takes 5 arguments before the segment filter's.
+	segExp, segArgs, err := c.compileSegmentFilter(filter, 5)
+	if err != nil {
+		return err
+	}
+
+	args := append([]interface{}{pq.Array(targetListIDs), status, c.consentJSON()}, segArgs...)
+	err = c.q.ExecSubQueryTpl(sanitizeSQLExp(query), segExp, c.q.AddSubscribersToListsByQuery, sourceListIDs, c.db, args...)
 	if err != nil {
 		c.log.Printf("error adding subscriptions by query: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
 
+	a := auditQuery(query, filter, sourceListIDs)
+	a["lists"], a["status"] = targetListIDs, status
+	c.logAudit(models.AuditSubscriptionAdd, nil, nil, 0, nil, a)
+
 	return nil
 }
 
@@ -58,24 +70,36 @@ func (c *Core) DeleteSubscriptions(subIDs, listIDs []int) error {
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", err.Error()))
 
 	}
+	c.logAudit(models.AuditSubscriptionDelete, subIDs, nil, 0, nil, map[string]interface{}{"lists": listIDs})
 
 	return nil
 }
 
 // DeleteSubscriptionsByQuery deletes list subscriptions from subscribers by a given arbitrary query expression.
 // sourceListIDs is the list of list IDs to filter the subscriber query with.
-func (c *Core) DeleteSubscriptionsByQuery(query string, sourceListIDs, targetListIDs []int) error {
+func (c *Core) DeleteSubscriptionsByQuery(query string, filter *models.SegmentFilter, sourceListIDs, targetListIDs []int) error {
 	if sourceListIDs == nil {
 		sourceListIDs = []int{}
 	}
 
-	err := c.q.ExecSubQueryTpl(sanitizeSQLExp(query), c.q.DeleteSubscriptionsByQuery, sourceListIDs, c.db, pq.Array(targetListIDs))
+	// The query template takes 3 arguments before the segment filter's.
+	segExp, segArgs, err := c.compileSegmentFilter(filter, 3)
+	if err != nil {
+		return err
+	}
+
+	args := append([]interface{}{pq.Array(targetListIDs)}, segArgs...)
+	err = c.q.ExecSubQueryTpl(sanitizeSQLExp(query), segExp, c.q.DeleteSubscriptionsByQuery, sourceListIDs, c.db, args...)
 	if err != nil {
 		c.log.Printf("error deleting subscriptions by query: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
 
+	a := auditQuery(query, filter, sourceListIDs)
+	a["lists"] = targetListIDs
+	c.logAudit(models.AuditSubscriptionDelete, nil, nil, 0, nil, a)
+
 	return nil
 }
 
@@ -86,24 +110,36 @@ func (c *Core) UnsubscribeLists(subIDs, listIDs []int, listUUIDs []string) error
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", err.Error()))
 	}
+	c.logAudit(models.AuditSubscriptionUnsub, subIDs, nil, 0, nil, map[string]interface{}{"lists": listIDs, "list_uuids": listUUIDs})
 
 	return nil
 }
 
 // UnsubscribeListsByQuery sets list subscriptions to 'unsubscribed' by a given arbitrary query expression.
 // sourceListIDs is the list of list IDs to filter the subscriber query with.
-func (c *Core) UnsubscribeListsByQuery(query string, sourceListIDs, targetListIDs []int) error {
+func (c *Core) UnsubscribeListsByQuery(query string, filter *models.SegmentFilter, sourceListIDs, targetListIDs []int) error {
 	if sourceListIDs == nil {
 		sourceListIDs = []int{}
 	}
 
-	err := c.q.ExecSubQueryTpl(sanitizeSQLExp(query), c.q.UnsubscribeSubscribersFromListsByQuery, sourceListIDs, c.db, pq.Array(targetListIDs))
+	// The query template takes 3 arguments before the segment filter's.
+	segExp, segArgs, err := c.compileSegmentFilter(filter, 3)
+	if err != nil {
+		return err
+	}
+
+	args := append([]interface{}{pq.Array(targetListIDs)}, segArgs...)
+	err = c.q.ExecSubQueryTpl(sanitizeSQLExp(query), segExp, c.q.UnsubscribeSubscribersFromListsByQuery, sourceListIDs, c.db, args...)
 	if err != nil {
 		c.log.Printf("error unsubscribing from lists by query: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
 
+	a := auditQuery(query, filter, sourceListIDs)
+	a["lists"] = targetListIDs
+	c.logAudit(models.AuditSubscriptionUnsub, nil, nil, 0, nil, a)
+
 	return nil
 }
 
@@ -118,5 +154,88 @@ func (c *Core) DeleteUnconfirmedSubscriptions(beforeDate time.Time) (int, error)
 	}
 
 	n, _ := res.RowsAffected()
+	c.logAudit(models.AuditSubscriptionDelete, nil, nil, 0, nil,
+		map[string]interface{}{"unconfirmed_before": beforeDate, "count": n})
+
 	return int(n), nil
 }
+
+// ExpireUnconfirmedSubscriptions unsubscribes the unconfirmed subscriptions on double
+// opt-in lists that have passed the lists' expiry days. It returns the number of
+// subscriptions expired.
+func (c *Core) ExpireUnconfirmedSubscriptions() (int, error) {
+	var rows []struct {
+		SubscriberID int `db:"subscriber_id"`
+		ListID       int `db:"list_id"`
+	}
+	if err := c.q.ExpireUnconfirmedSubscriptions.Select(&rows); err != nil {
+		c.log.Printf("error expiring unconfirmed subscriptions: %v", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscriptions}", "error", pqErrMsg(err)))
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	// Record the expired subscriptions of each list.
+	byList := map[int][]int{}
+	for _, r := range rows {
+		byList[r.ListID] = append(byList[r.ListID], r.SubscriberID)
+	}
+	for listID, subIDs := range byList {
+		c.logAudit(models.AuditSubscriptionUnsub, subIDs, nil, listID, nil,
+			map[string]interface{}{"lists": []int{listID}, "reason": "optin_expired"})
+	}
+	_ = c.refreshCache(matListSubStats, false)
+
+	return len(rows), nil
+}
+
+// SendOptinReminders sends opt-in reminder e-mails for the unconfirmed subscriptions
+// on double opt-in lists that are due for them, batchSize subscribers at a time. Only
+// one reminder is sent for the reminders of a subscription that are due at once. A
+// reminder is recorded even if sending it fails so that a failing address isn't retried
+// endlessly. It returns the number of reminder e-mails sent.
+func (c *Core) SendOptinReminders(batchSize int) (int, error) {
+	if batchSize < 1 {
+		batchSize = 1000
+	}
+
+	sent := 0
+	for {
+		var rows []struct {
+			SubscriberID int           `db:"subscriber_id"`
+			ListIDs      pq.Int64Array `db:"list_ids"`
+		}
+		if err := c.q.GetDueOptinReminders.Select(&rows, batchSize); err != nil {
+			c.log.Printf("error fetching due opt-in reminders: %v", err)
+			return sent, echo.NewHTTPError(http.StatusInternalServerError,
+				c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscriptions}", "error", pqErrMsg(err)))
+		}
+
+		for _, r := range rows {
+			listIDs := make([]int, len(r.ListIDs))
+			for i, id := range r.ListIDs {
+				listIDs[i] = int(id)
+			}
+
+			if sub, err := c.GetSubscriber(r.SubscriberID, "", ""); err == nil {
+				if n, err := c.h.SendOptinConfirmation(sub, listIDs); err == nil && n > 0 {
+					sent++
+				}
+			}
+
+			if _, err := c.q.UpdateOptinReminders.Exec(r.SubscriberID, pq.Array(listIDs)); err != nil {
+				c.log.Printf("error recording opt-in reminder: %v", err)
+				return sent, echo.NewHTTPError(http.StatusInternalServerError,
+					c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscriptions}", "error", pqErrMsg(err)))
+			}
+		}
+
+		if len(rows) < batchSize {
+			break
+		}
+	}
+
+	return sent, nil
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// QueryTrashedSubscribers returns the subscribers in the trash, optionally matching the
+// given e-mail or name search string. Along with the paginated and sliced results,
+// the total number of subscribers in the trash is returned.
+func (c *Core) QueryTrashedSubscribers(search string, offset, limit int) ([]models.TrashedSubscriber, int, error) {
+	if search = strings.TrimSpace(search); search != "" {
+		search = "%" + search + "%"
+	}
+
+	out := []models.TrashedSubscriber{}
+	if err := c.q.QueryTrashedSubscribers.Select(&out, search, offset, limit); err != nil {
+		c.log.Printf("error fetching trashed subscribers: %v", err)
+		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	total := 0
+	if len(out) > 0 {
+		total = out[0].Total
+	}
+
+	return out, total, nil
+}
+
+// RestoreSubscribers restores the given subscribers from the trash and returns
+// the number of subscribers restored.
+func (c *Core) RestoreSubscribers(subIDs []int) (int, error) {
+	var ids []int
+	if err := c.q.RestoreSubscribers.Select(&ids, pq.Array(subIDs)); err != nil {
+		c.log.Printf("error restoring subscribers: %v", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	if len(ids) > 0 {
+		c.logAudit(models.AuditSubscriberRestore, ids, nil, 0, nil, nil)
+	}
+
+	return len(ids), nil
+}
+
+// PurgeTrashedSubscribers permanently deletes the given subscribers in the trash, or
+// if there are none, all subscribers that have been in the trash for more than the
+// given number of days. It returns the number of subscribers deleted.
+func (c *Core) PurgeTrashedSubscribers(subIDs []int, days int) (int, error) {
+	if subIDs == nil {
+		subIDs = []int{}
+	}
+
+	var ids []int
+	if err := c.q.PurgeTrashedSubscribers.Select(&ids, pq.Array(subIDs), days); err != nil {
+		c.log.Printf("error purging trashed subscribers: %v", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	if len(ids) > 0 {
+		c.logAudit(models.AuditSubscriberPurge, ids, nil, 0, nil, nil)
+	}
+
+	return len(ids), nil
+}
+
+// WipeSubscribers permanently deletes the given subscribers without moving them to
+// the trash. This is used for subscribers' requests to wipe their data.
+func (c *Core) WipeSubscribers(subIDs []int, subUUIDs []string) error {
+	if subIDs == nil {
+		subIDs = []int{}
+	}
+	if subUUIDs == nil {
+		subUUIDs = []string{}
+	}
+
+	// Record the deletion first as the subscribers' UUIDs can't be resolved after.
+	c.logAudit(models.AuditSubscriberPurge, subIDs, subUUIDs, 0, nil, nil)
+
+	if _, err := c.q.DeleteSubscribers.Exec(pq.Array(subIDs), pq.Array(subUUIDs)); err != nil {
+		c.log.Printf("error deleting subscribers: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	return nil
+}
+
+// restoreTrashedSubscriberByEmail restores a subscriber in the trash that has the
+// given e-mail, the same as importing the e-mail does. It returns the ID of the
+// subscriber restored, or 0 if there's none in the trash. A blocklisted subscriber
+// in the trash is not restored and an error is returned instead, as restoring it
+// would subscribe it to lists again, and deleting it would lose the blocklisting.
+func (c *Core) restoreTrashedSubscriberByEmail(email string) (int, error) {
+	var out struct {
+		ID     int    `db:"id"`
+		Status string `db:"status"`
+	}
+	if err := c.q.RestoreTrashedSubscriberByEmail.Get(&out, email); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+
+		c.log.Printf("error restoring trashed subscriber: %v", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorCreating", "name", "{globals.terms.subscriber}", "error", pqErrMsg(err)))
+	}
+
+	if out.Status == models.SubscriberStatusBlockListed {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, c.i18n.T("subscribers.trashedBlocklisted"))
+	}
+	c.logAudit(models.AuditSubscriberRestore, []int{out.ID}, nil, 0, nil, map[string]interface{}{"email_reused": true})
+
+	return out.ID, nil
+}
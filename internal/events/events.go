@@ -11,7 +11,8 @@ import (
 )
 
 const (
-	TypeError = "error"
+	TypeError    = "error"
+	TypeProgress = "progress"
 )
 
 // Event represents a single event in the system.
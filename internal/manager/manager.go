@@ -533,8 +533,14 @@ func (m *Manager) worker() {
 			if err != nil {
 				m.log.Printf("error sending message '%s': %v", msg.Subject, err)
 			} else {
+				// Arbitrary (tx) messages are not necessarily tied to a campaign.
+				campUUID := ""
+				if msg.Campaign != nil {
+					campUUID = msg.Campaign.UUID
+				}
+
 				email := models.Email{
-					CampaignUUID:   msg.Campaign.UUID,
+					CampaignUUID:   campUUID,
 					SubscriberUUID: msg.Subscriber.UUID,
 					MessageID:      message_id,
 					Recipient:      msg.To[0],
@@ -0,0 +1,225 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// dkimHeaders are the message headers that are signed.
+var dkimHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-Id",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+	"List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+// DKIMKey represents a DKIM private key used to sign messages from a sending domain.
+type DKIMKey struct {
+	Domain     string `json:"domain"`
+	Selector   string `json:"selector"`
+	PrivateKey string `json:"private_key"`
+}
+
+// DKIMTestResult is the result of test signing a message with a DKIM key.
+type DKIMTestResult struct {
+	Signature string `json:"signature"`
+
+	// Record is the TXT record that has to be published in DNS for the key.
+	Record string `json:"record"`
+
+	// DNSValid indicates if the signature verifies against the public key
+	// published in DNS at <selector>._domainkey.<domain>.
+	DNSValid bool   `json:"dns_valid"`
+	DNSError string `json:"dns_error"`
+}
+
+// dkimSigner is a parsed DKIMKey.
+type dkimSigner struct {
+	domain   string
+	selector string
+	signer   crypto.Signer
+}
+
+// ValidateDKIMKey checks that a DKIMKey has a domain, a selector, and a
+// parsable private key.
+func ValidateDKIMKey(k DKIMKey) error {
+	_, err := newDKIMSigner(k)
+	return err
+}
+
+// newDKIMSigner validates a DKIMKey and parses its private key.
+func newDKIMSigner(k DKIMKey) (*dkimSigner, error) {
+	k.Domain = strings.ToLower(strings.TrimSpace(k.Domain))
+	k.Selector = strings.TrimSpace(k.Selector)
+	if k.Domain == "" || k.Selector == "" {
+		return nil, errors.New("DKIM domain and selector are required")
+	}
+
+	signer, err := parsePrivateKey(k.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing DKIM private key for '%s': %v", k.Domain, err)
+	}
+
+	return &dkimSigner{domain: k.Domain, selector: k.Selector, signer: signer}, nil
+}
+
+// sign signs the given raw message and returns the signed message.
+func (d *dkimSigner) sign(msg []byte) ([]byte, error) {
+	var b bytes.Buffer
+	if err := dkim.Sign(&b, bytes.NewReader(msg), &dkim.SignOptions{
+		Domain:                 d.domain,
+		Selector:               d.selector,
+		Signer:                 d.signer,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             dkimHeaders,
+	}); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// txtRecord returns the DNS TXT record value for the signer's public key.
+func (d *dkimSigner) txtRecord() (string, error) {
+	var (
+		typ = "rsa"
+		pub []byte
+		err error
+	)
+	switch k := d.signer.Public().(type) {
+	case *rsa.PublicKey:
+		pub, err = x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			return "", err
+		}
+	case ed25519.PublicKey:
+		typ = "ed25519"
+		pub = []byte(k)
+	default:
+		return "", errors.New("unsupported public key type")
+	}
+
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", typ, base64.StdEncoding.EncodeToString(pub)), nil
+}
+
+// getDKIMSigner returns the signer whose domain matches the domain of the
+// given From address or its parent domains. It returns nil if there's none.
+func getDKIMSigner(signers []*dkimSigner, from string) *dkimSigner {
+	if len(signers) == 0 {
+		return nil
+	}
+
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil
+	}
+
+	parts := strings.SplitN(strings.ToLower(addr.Address), "@", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+
+	for dom := parts[1]; dom != ""; {
+		for _, s := range signers {
+			if s.domain == dom {
+				return s
+			}
+		}
+
+		i := strings.Index(dom, ".")
+		if i < 0 {
+			break
+		}
+		dom = dom[i+1:]
+	}
+
+	return nil
+}
+
+// TestDKIM signs a sample message with the given key and verifies the signature
+// against the public key published in DNS.
+func TestDKIM(k DKIMKey) (DKIMTestResult, error) {
+	var out DKIMTestResult
+
+	s, err := newDKIMSigner(k)
+	if err != nil {
+		return out, err
+	}
+
+	msg := fmt.Sprintf("From: <test@%s>\r\nTo: <test@%s>\r\nSubject: DKIM test\r\nDate: %s\r\n"+
+		"Message-Id: <dkim-test@%s>\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n"+
+		"DKIM test message.\r\n", s.domain, s.domain, time.Now().Format(time.RFC1123Z), s.domain)
+
+	signed, err := s.sign([]byte(msg))
+	if err != nil {
+		return out, err
+	}
+	out.Signature = strings.SplitN(string(signed), "\r\nFrom:", 2)[0]
+
+	if out.Record, err = s.txtRecord(); err != nil {
+		return out, err
+	}
+
+	out.DNSValid, out.DNSError = verifyDKIM(signed, net.LookupTXT)
+
+	return out, nil
+}
+
+// verifyDKIM verifies the signatures in a message with the given TXT record lookup.
+func verifyDKIM(msg []byte, lookup func(string) ([]string, error)) (bool, string) {
+	res, err := dkim.VerifyWithOptions(bytes.NewReader(msg), &dkim.VerifyOptions{LookupTXT: lookup})
+	if err != nil {
+		return false, err.Error()
+	}
+	if len(res) == 0 {
+		return false, "no DKIM signature found"
+	}
+	if res[0].Err != nil {
+		return false, res[0].Err.Error()
+	}
+
+	return true, ""
+}
+
+// parsePrivateKey parses a PEM encoded PKCS1 or PKCS8 RSA or Ed25519 private key.
+func parsePrivateKey(key string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(strings.TrimSpace(key)))
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		s, ok := k.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("unsupported private key type")
+		}
+		switch s.(type) {
+		case *rsa.PrivateKey, ed25519.PrivateKey:
+			return s, nil
+		}
+		return nil, errors.New("unsupported private key type")
+	}
+
+	return nil, fmt.Errorf("unsupported PEM block type '%s'", block.Type)
+}
@@ -2,11 +2,14 @@ package email
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net/smtp"
 	"net/textproto"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/knadh/listmonk/models"
 	"github.com/knadh/smtppool"
@@ -17,10 +20,16 @@ const (
 	hdrReturnPath = "Return-Path"
 	hdrBcc        = "Bcc"
 	hdrCc         = "Cc"
+
+	// maxServerFails is the number of consecutive failed pushes after which
+	// a server is taken out of rotation for serverCooldown.
+	maxServerFails = 3
+	serverCooldown = time.Minute
 )
 
 // Server represents an SMTP server's credentials.
 type Server struct {
+	UUID          string            `json:"uuid"`
 	Username      string            `json:"username"`
 	Password      string            `json:"password"`
 	AuthProtocol  string            `json:"auth_protocol"`
@@ -28,11 +37,43 @@ type Server struct {
 	TLSSkipVerify bool              `json:"tls_skip_verify"`
 	EmailHeaders  map[string]string `json:"email_headers"`
 
+	// DKIM keys for signing messages based on the domain of the From address.
+	DKIM []DKIMKey `json:"dkim"`
+
+	// Weight is the relative share of messages sent through the server.
+	// Values < 1 are treated as 1.
+	Weight int `json:"weight"`
+
 	// Rest of the options are embedded directly from the smtppool lib.
 	// The JSON tag is for config unmarshal to work.
 	smtppool.Opt `json:",squash"`
 
-	pool *smtppool.Pool
+	pool   *smtppool.Pool
+	health *health
+
+	// Servers with DKIM keys send signed messages via rawPool.
+	dkim    []*dkimSigner
+	rawPool *rawPool
+}
+
+// health is the passive health state of a server derived from the results of pushes.
+type health struct {
+	fails     int
+	downUntil time.Time
+	lastErr   string
+	sync.Mutex
+}
+
+// ServerHealth represents the health state of an SMTP server.
+type ServerHealth struct {
+	UUID      string     `json:"uuid"`
+	Host      string     `json:"host"`
+	Port      int        `json:"port"`
+	Weight    int        `json:"weight"`
+	Healthy   bool       `json:"healthy"`
+	Failures  int        `json:"failures"`
+	DownUntil *time.Time `json:"down_until"`
+	LastError string     `json:"last_error"`
 }
 
 // Emailer is the SMTP e-mail messenger.
@@ -77,12 +118,29 @@ func New(servers ...Server) (*Emailer, error) {
 			}
 		}
 
+		if s.Weight < 1 {
+			s.Weight = 1
+		}
+
 		pool, err := smtppool.New(s.Opt)
 		if err != nil {
 			return nil, err
 		}
 
 		s.pool = pool
+		s.health = &health{}
+
+		// DKIM signing.
+		for _, k := range s.DKIM {
+			d, err := newDKIMSigner(k)
+			if err != nil {
+				return nil, err
+			}
+			s.dkim = append(s.dkim, d)
+		}
+		if len(s.dkim) > 0 {
+			s.rawPool = newRawPool(s.Opt)
+		}
 		e.servers = append(e.servers, &s)
 	}
 
@@ -94,20 +152,61 @@ func (e *Emailer) Name() string {
 	return emName
 }
 
-// Push pushes a message to the server.
+// Push pushes a message to the server. If there are multiple SMTP servers,
+// one is picked at random based on the server weights from the healthy ones.
+// If the push fails, it is retried on the other servers.
 func (e *Emailer) Push(m models.Message) (string, error) {
-	// If there are more than one SMTP servers, send to a random
-	// one from the list.
 	var (
-		ln  = len(e.servers)
-		srv *Server
+		tried   = make(map[*Server]bool, len(e.servers))
+		lastErr error
 	)
-	if ln > 1 {
-		srv = e.servers[rand.Intn(ln)]
-	} else {
-		srv = e.servers[0]
+	for len(tried) < len(e.servers) {
+		srv := e.pickServer(tried)
+		tried[srv] = true
+
+		err := e.push(srv, m)
+		if err == nil {
+			srv.markSuccess()
+			return "", nil
+		}
+		lastErr = err
+
+		// Permanent (5xx) SMTP errors are specific to the message, for instance,
+		// an invalid recipient, and neither indicate a bad server nor warrant a retry.
+		var tErr *textproto.Error
+		if errors.As(err, &tErr) && tErr.Code >= 500 {
+			return "", err
+		}
+
+		srv.markFail(err)
 	}
 
+	return "", lastErr
+}
+
+// push sends a message via the given server.
+func (e *Emailer) push(srv *Server, m models.Message) error {
+	em := makeEmail(m, srv.EmailHeaders)
+
+	// If there's a DKIM key for the sender's domain, render and sign
+	// the message and send it raw.
+	if d := getDKIMSigner(srv.dkim, m.From); d != nil {
+		return sendSigned(srv, d, em)
+	}
+
+	return srv.pool.Send(em)
+}
+
+// Render renders a message into a raw RFC 5322 e-mail with the full
+// MIME structure, headers, and attachments as it would be sent.
+func Render(m models.Message) ([]byte, error) {
+	em := makeEmail(m, nil)
+	return em.Bytes()
+}
+
+// makeEmail prepares an e-mail from a message with the given
+// additional (SMTP server level) headers.
+func makeEmail(m models.Message, hdrs map[string]string) smtppool.Email {
 	// Are there attachments?
 	var files []smtppool.Attachment
 	if m.Attachments != nil {
@@ -133,7 +232,7 @@ func (e *Emailer) Push(m models.Message) (string, error) {
 	em.Headers = textproto.MIMEHeader{}
 
 	// Attach SMTP level headers.
-	for k, v := range srv.EmailHeaders {
+	for k, v := range hdrs {
 		em.Headers.Set(k, v)
 	}
 
@@ -175,7 +274,135 @@ func (e *Emailer) Push(m models.Message) (string, error) {
 		}
 	}
 
-	return "", srv.pool.Send(em)
+	return em
+}
+
+// sendSigned renders an e-mail, signs it with the given DKIM signer,
+// and sends it via the server's raw pool.
+func sendSigned(srv *Server, d *dkimSigner, em smtppool.Email) error {
+	from, to, err := envelope(em)
+	if err != nil {
+		return err
+	}
+
+	b, err := em.Bytes()
+	if err != nil {
+		return err
+	}
+
+	signed, err := d.sign(b)
+	if err != nil {
+		return fmt.Errorf("error DKIM signing message: %v", err)
+	}
+
+	return srv.rawPool.send(from, to, signed)
+}
+
+// Health returns the health state of all the SMTP servers.
+func (e *Emailer) Health() []ServerHealth {
+	var (
+		out = make([]ServerHealth, 0, len(e.servers))
+		now = time.Now()
+	)
+	for _, s := range e.servers {
+		s.health.Lock()
+		h := ServerHealth{
+			UUID:      s.UUID,
+			Host:      s.Host,
+			Port:      s.Port,
+			Weight:    s.Weight,
+			Healthy:   !now.Before(s.health.downUntil),
+			Failures:  s.health.fails,
+			LastError: s.health.lastErr,
+		}
+		if !h.Healthy {
+			t := s.health.downUntil
+			h.DownUntil = &t
+		}
+		s.health.Unlock()
+
+		out = append(out, h)
+	}
+
+	return out
+}
+
+// pickServer picks a random server weighted by the server weights from
+// the healthy servers that haven't been tried yet. If there are no healthy
+// servers left, the untried ones are considered regardless of their health.
+func (e *Emailer) pickServer(tried map[*Server]bool) *Server {
+	var (
+		now       = time.Now()
+		healthy   = make([]*Server, 0, len(e.servers))
+		unhealthy = make([]*Server, 0)
+	)
+	for _, s := range e.servers {
+		if tried[s] {
+			continue
+		}
+
+		if s.isHealthy(now) {
+			healthy = append(healthy, s)
+		} else {
+			unhealthy = append(unhealthy, s)
+		}
+	}
+
+	if len(healthy) > 0 {
+		return pickWeighted(healthy)
+	}
+	return pickWeighted(unhealthy)
+}
+
+// pickWeighted picks a random server from the given list based on the server weights.
+func pickWeighted(servers []*Server) *Server {
+	if len(servers) == 1 {
+		return servers[0]
+	}
+
+	total := 0
+	for _, s := range servers {
+		total += s.Weight
+	}
+
+	n := rand.Intn(total)
+	for _, s := range servers {
+		if n < s.Weight {
+			return s
+		}
+		n -= s.Weight
+	}
+
+	return servers[len(servers)-1]
+}
+
+// isHealthy tells if the server is in rotation (not cooling down after failures).
+func (s *Server) isHealthy(now time.Time) bool {
+	s.health.Lock()
+	defer s.health.Unlock()
+	return !now.Before(s.health.downUntil)
+}
+
+// markSuccess resets the consecutive failure count of the server.
+func (s *Server) markSuccess() {
+	s.health.Lock()
+	s.health.fails = 0
+	s.health.Unlock()
+}
+
+// markFail records a failed push and takes the server out of rotation for
+// a cooldown period if it has failed too many times consecutively. As the
+// failure count is only reset on a successful push, a server that fails again
+// after its cooldown is immediately taken out of rotation again.
+func (s *Server) markFail(err error) {
+	s.health.Lock()
+	defer s.health.Unlock()
+
+	s.health.fails++
+	s.health.lastErr = err.Error()
+	if s.health.fails >= maxServerFails {
+		s.health.downUntil = time.Now().Add(serverCooldown)
+	}
 }
 
 // Flush flushes the message queue to the server.
@@ -187,6 +414,9 @@ func (e *Emailer) Flush() error {
 func (e *Emailer) Close() error {
 	for _, s := range e.servers {
 		s.pool.Close()
+		if s.rawPool != nil {
+			s.rawPool.close()
+		}
 	}
 	return nil
 }
@@ -0,0 +1,261 @@
+package email
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"github.com/knadh/smtppool"
+)
+
+// rawPool is a minimal pool of SMTP connections for sending pre-rendered raw
+// messages. smtppool renders messages (with random MIME boundaries) at the time
+// of sending, which makes it unusable for messages that have to be signed
+// (DKIM) before they're sent. It follows smtppool's options for the idle timeout
+// of connections and the number of retries of a message.
+type rawPool struct {
+	opt   smtppool.Opt
+	conns chan *rawConn
+
+	// slots limits the number of open connections to MaxConns.
+	slots chan struct{}
+}
+
+// rawConn is a pooled SMTP connection.
+type rawConn struct {
+	*smtp.Client
+	lastUsed time.Time
+}
+
+func newRawPool(o smtppool.Opt) *rawPool {
+	if o.MaxConns < 1 {
+		o.MaxConns = 1
+	}
+	if o.PoolWaitTimeout == 0 {
+		o.PoolWaitTimeout = time.Second * 3
+	}
+	if o.MaxMessageRetries < 1 {
+		o.MaxMessageRetries = 2
+	}
+
+	return &rawPool{
+		opt:   o,
+		conns: make(chan *rawConn, o.MaxConns),
+		slots: make(chan struct{}, o.MaxConns),
+	}
+}
+
+// send sends a raw message to the given recipients. If sending fails, for instance,
+// because the server closed the connection, it's retried on another connection up
+// to MaxMessageRetries times.
+func (p *rawPool) send(from string, to []string, msg []byte) error {
+	var err error
+	for i := 0; i < p.opt.MaxMessageRetries; i++ {
+		var c *rawConn
+		if c, err = p.borrow(); err != nil {
+			return err
+		}
+
+		if err = rawSend(c.Client, from, to, msg); err == nil {
+			p.release(c)
+			return nil
+		}
+
+		// An error response from the server, for instance, a rejected recipient.
+		// The connection is still usable and a retry wouldn't help.
+		var tErr *textproto.Error
+		if errors.As(err, &tErr) {
+			if c.Reset() == nil {
+				p.release(c)
+			} else {
+				p.discard(c)
+			}
+			return err
+		}
+
+		p.discard(c)
+	}
+
+	return err
+}
+
+// borrow returns an idle connection from the pool, or a new one if the pool
+// has free slots. Otherwise, it waits for a connection to be released.
+// Connections that have been idle for longer than IdleTimeout are closed.
+func (p *rawPool) borrow() (*rawConn, error) {
+	for {
+		select {
+		case c := <-p.conns:
+			if p.isIdle(c) {
+				p.discard(c)
+				continue
+			}
+			return c, nil
+		default:
+		}
+		break
+	}
+
+	select {
+	case c := <-p.conns:
+		if p.isIdle(c) {
+			p.discard(c)
+			return p.borrow()
+		}
+		return c, nil
+	case p.slots <- struct{}{}:
+		return p.dial()
+	case <-time.After(p.opt.PoolWaitTimeout):
+		return nil, errors.New("timed out waiting for free SMTP connection")
+	}
+}
+
+// isIdle checks if a pooled connection has been idle for longer than IdleTimeout.
+func (p *rawPool) isIdle(c *rawConn) bool {
+	return p.opt.IdleTimeout > 0 && time.Since(c.lastUsed) > p.opt.IdleTimeout
+}
+
+// dial connects and authenticates to the server. The caller must hold a slot.
+func (p *rawPool) dial() (*rawConn, error) {
+	var (
+		conn net.Conn
+		err  error
+		addr = net.JoinHostPort(p.opt.Host, strconv.Itoa(p.opt.Port))
+	)
+	if p.opt.TLSConfig != nil && p.opt.SSL {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: p.opt.PoolWaitTimeout}, "tcp", addr, p.opt.TLSConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, p.opt.PoolWaitTimeout)
+	}
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+
+	c, err := smtp.NewClient(conn, p.opt.Host)
+	if err != nil {
+		conn.Close()
+		<-p.slots
+		return nil, err
+	}
+
+	rc := &rawConn{Client: c}
+	if err := p.setup(c); err != nil {
+		p.discard(rc)
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+// setup sends HELO, upgrades to STARTTLS, and authenticates a new connection.
+func (p *rawPool) setup(c *smtp.Client) error {
+	if p.opt.HelloHostname != "" {
+		if err := c.Hello(p.opt.HelloHostname); err != nil {
+			return err
+		}
+	}
+
+	if p.opt.TLSConfig != nil && !p.opt.SSL {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(p.opt.TLSConfig); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Never fall back to sending unauthenticated when auth is configured.
+	if p.opt.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("SMTP server doesn't support AUTH")
+		}
+		if err := c.Auth(p.opt.Auth); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// release returns a connection to the pool.
+func (p *rawPool) release(c *rawConn) {
+	c.lastUsed = time.Now()
+	select {
+	case p.conns <- c:
+	default:
+		p.discard(c)
+	}
+}
+
+// discard closes a connection and frees its slot.
+func (p *rawPool) discard(c *rawConn) {
+	c.Close()
+	<-p.slots
+}
+
+// close closes all idle connections.
+func (p *rawPool) close() {
+	for {
+		select {
+		case c := <-p.conns:
+			c.Quit()
+			<-p.slots
+		default:
+			return
+		}
+	}
+}
+
+// rawSend sends a raw message on the given connection.
+func rawSend(c *smtp.Client, from string, to []string, msg []byte) error {
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+// envelope returns the SMTP envelope sender and recipients of an e-mail.
+func envelope(em smtppool.Email) (string, []string, error) {
+	sender := em.Sender
+	if sender == "" {
+		sender = em.From
+	}
+
+	from, err := mail.ParseAddress(sender)
+	if err != nil {
+		return "", nil, err
+	}
+
+	rcpts := make([]string, 0, len(em.To)+len(em.Cc)+len(em.Bcc))
+	for _, list := range [][]string{em.To, em.Cc, em.Bcc} {
+		for _, a := range list {
+			addr, err := mail.ParseAddress(a)
+			if err != nil {
+				return "", nil, err
+			}
+			rcpts = append(rcpts, addr.Address)
+		}
+	}
+
+	return from.Address, rcpts, nil
+}
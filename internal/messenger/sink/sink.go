@@ -0,0 +1,218 @@
+// Package sink implements a "sink" messenger that writes messages to the
+// local filesystem instead of sending them, either as individual RFC 5322
+// .eml files or appended to an mbox file. It is meant for staging and test
+// environments where no real messages should go out.
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/knadh/listmonk/internal/messenger/email"
+	"github.com/knadh/listmonk/models"
+)
+
+// Output formats.
+const (
+	FormatEML  = "eml"
+	FormatMbox = "mbox"
+)
+
+// Options represents sink messenger options.
+type Options struct {
+	Name      string `json:"name"`
+	Directory string `json:"directory"`
+	Format    string `json:"format"`
+
+	// Root is the directory on the server, from the config file, that the
+	// directory has to be in.
+	Root string `json:"-"`
+}
+
+// Sink is the file sink messenger.
+type Sink struct {
+	o Options
+
+	// Serializes appends to the mbox file.
+	mut sync.Mutex
+}
+
+// New returns a new instance of the sink messenger.
+func New(o Options) (*Sink, error) {
+	dir, err := Dir(o.Root, o.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	switch o.Format {
+	case "":
+		o.Format = FormatEML
+	case FormatEML, FormatMbox:
+	default:
+		return nil, fmt.Errorf("unknown format '%s'", o.Format)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory '%s': %v", dir, err)
+	}
+
+	// Check that the directory is still within the root with symlinks resolved.
+	root, err := filepath.EvalSymlinks(o.Root)
+	if err != nil {
+		return nil, err
+	}
+	if root, err = filepath.Abs(root); err != nil {
+		return nil, err
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return nil, err
+	}
+	if !isSubDir(root, dir) {
+		return nil, fmt.Errorf("directory '%s' is outside the sink root '%s'", dir, root)
+	}
+	o.Directory = dir
+
+	return &Sink{o: o}, nil
+}
+
+// Dir returns the absolute path of a sink directory, where relative paths are
+// relative to the root. It returns an error if there's no root or if the
+// directory is outside it.
+func Dir(root, dir string) (string, error) {
+	if root == "" {
+		return "", errors.New("sink messengers are disabled as there's no sink root (app.sink_root) in the config")
+	}
+	if strings.TrimSpace(dir) == "" {
+		return "", errors.New("no directory specified")
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(root, dir)
+	}
+	dir = filepath.Clean(dir)
+
+	if !isSubDir(root, dir) {
+		return "", fmt.Errorf("directory '%s' is outside the sink root '%s'", dir, root)
+	}
+
+	return dir, nil
+}
+
+// Name returns the messenger's name.
+func (f *Sink) Name() string {
+	return f.o.Name
+}
+
+// Push renders the message and writes it to the directory.
+func (f *Sink) Push(m models.Message) (string, error) {
+	// Copy the headers and assign a Message-Id if there isn't one
+	// so that it can be returned as the message ID.
+	hdr := make(textproto.MIMEHeader, len(m.Headers)+1)
+	for k, v := range m.Headers {
+		hdr[k] = v
+	}
+
+	id := hdr.Get(models.EmailHeaderMessageId)
+	if id == "" {
+		id = fmt.Sprintf("<%s@listmonk>", uuid.Must(uuid.NewV4()).String())
+		hdr.Set(models.EmailHeaderMessageId, id)
+	}
+	m.Headers = hdr
+
+	b, err := email.Render(m)
+	if err != nil {
+		return "", err
+	}
+
+	if f.o.Format == FormatMbox {
+		return id, f.appendMbox(m.From, b)
+	}
+
+	return id, f.writeEML(b)
+}
+
+// Flush flushes the message queue to the server.
+func (f *Sink) Flush() error {
+	return nil
+}
+
+// Close closes the messenger.
+func (f *Sink) Close() error {
+	return nil
+}
+
+// writeEML writes a message to a new .eml file.
+func (f *Sink) writeEML(b []byte) error {
+	var (
+		now  = time.Now()
+		name = fmt.Sprintf("%s-%s.eml", now.Format("20060102-150405.000000000"), uuid.Must(uuid.NewV4()).String()[:8])
+	)
+
+	return os.WriteFile(filepath.Join(f.o.Directory, name), b, 0644)
+}
+
+// appendMbox appends a message to the messenger's mbox file (mboxrd format).
+func (f *Sink) appendMbox(from string, b []byte) error {
+	sender := "MAILER-DAEMON"
+	if a, err := mail.ParseAddress(from); err == nil {
+		sender = a.Address
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "From %s %s\n", sender, time.Now().UTC().Format(time.ANSIC))
+
+	// Convert CRLF line endings to LF and quote "From " lines.
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(make([]byte, 0, 64*1024), len(b)+1)
+	for sc.Scan() {
+		ln := bytes.TrimSuffix(sc.Bytes(), []byte("\r"))
+		if bytes.HasPrefix(bytes.TrimLeft(ln, ">"), []byte("From ")) {
+			out.WriteByte('>')
+		}
+		out.Write(ln)
+		out.WriteByte('\n')
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	fl, err := os.OpenFile(filepath.Join(f.o.Directory, f.o.Name+".mbox"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fl.Write(out.Bytes()); err != nil {
+		fl.Close()
+		return err
+	}
+
+	return fl.Close()
+}
+
+// isSubDir checks if the (absolute, clean) path dir is root or a directory in it.
+func isSubDir(root, dir string) bool {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
@@ -0,0 +1,367 @@
+// Package subprocess implements a messenger that launches a local executable
+// and streams messages to it as JSON lines over stdin. For every message, the
+// executable is expected to write back a JSON line to stdout with the result.
+// This allows messaging channels (SMS, push etc.) to be implemented as small
+// standalone binaries. If the process exits or crashes, it is restarted.
+//
+// Request (one line on stdin):
+//
+//	{"id": 1, "message": {"subject": "", "body": "", "recipients": [...], ...}}
+//
+// Response (one line on stdout):
+//
+//	{"id": 1, "message_id": "optional-id", "error": "optional error"}
+package subprocess
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/textproto"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+const (
+	// Maximum size of a single response line from the process.
+	maxLineLen = 1024 * 1024
+
+	// Delay between restarts of the process.
+	restartWait = time.Second * 2
+)
+
+var (
+	errNotRunning   = errors.New("messenger process is not running")
+	errWriteTimeout = errors.New("timed out writing to messenger process")
+)
+
+// Options represents subprocess messenger options.
+type Options struct {
+	Name    string        `json:"name"`
+	Command string        `json:"command"`
+	Args    []string      `json:"args"`
+	Timeout time.Duration `json:"timeout"`
+}
+
+// request is the line written to the process's stdin for every message.
+type request struct {
+	ID      uint64  `json:"id"`
+	Message message `json:"message"`
+}
+
+// response is the line read from the process's stdout for every message.
+type response struct {
+	ID        uint64 `json:"id"`
+	MessageID string `json:"message_id"`
+	Error     string `json:"error"`
+}
+
+type message struct {
+	Subject     string               `json:"subject"`
+	FromEmail   string               `json:"from_email"`
+	To          []string             `json:"to"`
+	ContentType string               `json:"content_type"`
+	Body        string               `json:"body"`
+	AltBody     string               `json:"alt_body"`
+	Headers     textproto.MIMEHeader `json:"headers"`
+	Recipients  []recipient          `json:"recipients"`
+	Campaign    *campaign            `json:"campaign"`
+	Attachments []attachment         `json:"attachments"`
+}
+
+type campaign struct {
+	FromEmail string         `json:"from_email"`
+	UUID      string         `json:"uuid"`
+	Name      string         `json:"name"`
+	Headers   models.Headers `json:"headers"`
+	Tags      []string       `json:"tags"`
+}
+
+type recipient struct {
+	UUID    string      `json:"uuid"`
+	Email   string      `json:"email"`
+	Name    string      `json:"name"`
+	Attribs models.JSON `json:"attribs"`
+	Status  string      `json:"status"`
+}
+
+type attachment struct {
+	Name    string               `json:"name"`
+	Header  textproto.MIMEHeader `json:"header"`
+	Content []byte               `json:"content"`
+}
+
+// Subprocess is the subprocess messenger.
+type Subprocess struct {
+	o   Options
+	log *log.Logger
+
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	// Pending requests waiting for a response from the process.
+	pending map[uint64]chan response
+	lastID  uint64
+
+	closed bool
+	mut    sync.Mutex
+
+	// Serializes writes to the process's stdin.
+	wMut sync.Mutex
+}
+
+// New launches the given executable and returns a new instance of the messenger.
+func New(o Options, lo *log.Logger) (*Subprocess, error) {
+	if o.Command == "" {
+		return nil, errors.New("no command specified")
+	}
+	if o.Timeout == 0 {
+		o.Timeout = time.Second * 5
+	}
+
+	s := &Subprocess{
+		o:       o,
+		log:     lo,
+		pending: make(map[uint64]chan response),
+	}
+
+	if err := s.start(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Name returns the messenger's name.
+func (s *Subprocess) Name() string {
+	return s.o.Name
+}
+
+// Push writes a message to the process and waits for its response.
+func (s *Subprocess) Push(m models.Message) (string, error) {
+	msg := makeMessage(m)
+
+	s.mut.Lock()
+	if s.stdin == nil {
+		s.mut.Unlock()
+		return "", errNotRunning
+	}
+	s.lastID++
+	var (
+		id    = s.lastID
+		ch    = make(chan response, 1)
+		cmd   = s.cmd
+		stdin = s.stdin
+	)
+	s.pending[id] = ch
+	s.mut.Unlock()
+
+	defer func() {
+		s.mut.Lock()
+		delete(s.pending, id)
+		s.mut.Unlock()
+	}()
+
+	b, err := json.Marshal(request{ID: id, Message: msg})
+	if err != nil {
+		return "", err
+	}
+	b = append(b, '\n')
+
+	s.wMut.Lock()
+	err = s.write(cmd, stdin, b)
+	s.wMut.Unlock()
+	if err != nil {
+		return "", fmt.Errorf("error writing to messenger process: %v", err)
+	}
+
+	select {
+	case r := <-ch:
+		if r.Error != "" {
+			return "", errors.New(r.Error)
+		}
+		return r.MessageID, nil
+	case <-time.After(s.o.Timeout):
+		return "", errors.New("timed out waiting for messenger process")
+	}
+}
+
+// write writes a line to the process's stdin. If the process doesn't read it
+// within the timeout, for instance, because it's hung, the process is killed,
+// upon which it's restarted by read().
+func (s *Subprocess) write(cmd *exec.Cmd, stdin io.Writer, b []byte) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := stdin.Write(b)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(s.o.Timeout):
+		s.log.Printf("messenger process '%s' is not reading messages. killing", s.o.Name)
+		if cmd.Process != nil {
+			_ = cmd.Process.Kill()
+		}
+		return errWriteTimeout
+	}
+}
+
+// Flush flushes the message queue to the server.
+func (s *Subprocess) Flush() error {
+	return nil
+}
+
+// Close stops the process.
+func (s *Subprocess) Close() error {
+	s.mut.Lock()
+	s.closed = true
+	stdin := s.stdin
+	s.mut.Unlock()
+
+	// Closing stdin signals the process to exit.
+	if stdin != nil {
+		stdin.Close()
+	}
+
+	return nil
+}
+
+// start launches the process and starts reading its responses.
+func (s *Subprocess) start() error {
+	cmd := exec.Command(s.o.Command, s.o.Args...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = s.log.Writer()
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting messenger process '%s': %v", s.o.Command, err)
+	}
+
+	s.mut.Lock()
+	s.cmd = cmd
+	s.stdin = stdin
+	s.mut.Unlock()
+
+	go s.read(stdout)
+	return nil
+}
+
+// read reads responses from the process's stdout and dispatches them to
+// the waiting pushes. When the process exits, it is restarted.
+func (s *Subprocess) read(stdout io.Reader) {
+	sc := bufio.NewScanner(stdout)
+	sc.Buffer(make([]byte, 0, 4096), maxLineLen)
+	for sc.Scan() {
+		var r response
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			s.log.Printf("error parsing response from messenger '%s': %v", s.o.Name, err)
+			continue
+		}
+
+		s.mut.Lock()
+		ch, ok := s.pending[r.ID]
+		s.mut.Unlock()
+		if ok {
+			select {
+			case ch <- r:
+			default:
+			}
+		}
+	}
+
+	// stdout is closed. Wait for the process to exit.
+	s.mut.Lock()
+	cmd := s.cmd
+	s.mut.Unlock()
+	err := cmd.Wait()
+
+	// Fail all pending pushes.
+	s.mut.Lock()
+	s.stdin = nil
+	for id, ch := range s.pending {
+		select {
+		case ch <- response{ID: id, Error: errNotRunning.Error()}:
+		default:
+		}
+		delete(s.pending, id)
+	}
+	closed := s.closed
+	s.mut.Unlock()
+
+	if closed {
+		return
+	}
+
+	s.log.Printf("messenger process '%s' exited (%v). restarting", s.o.Name, err)
+	for {
+		time.Sleep(restartWait)
+
+		s.mut.Lock()
+		closed := s.closed
+		s.mut.Unlock()
+		if closed {
+			return
+		}
+
+		if err := s.start(); err != nil {
+			s.log.Printf("error restarting messenger '%s': %v", s.o.Name, err)
+			continue
+		}
+		return
+	}
+}
+
+// makeMessage converts a message into the payload sent to the process.
+func makeMessage(m models.Message) message {
+	out := message{
+		Subject:     m.Subject,
+		FromEmail:   m.From,
+		To:          m.To,
+		ContentType: m.ContentType,
+		Body:        string(m.Body),
+		AltBody:     string(m.AltBody),
+		Headers:     m.Headers,
+		Recipients: []recipient{{
+			UUID:    m.Subscriber.UUID,
+			Email:   m.Subscriber.Email,
+			Name:    m.Subscriber.Name,
+			Status:  m.Subscriber.Status,
+			Attribs: m.Subscriber.Attribs,
+		}},
+	}
+
+	if m.Campaign != nil {
+		out.Campaign = &campaign{
+			FromEmail: m.Campaign.FromEmail,
+			UUID:      m.Campaign.UUID,
+			Name:      m.Campaign.Name,
+			Headers:   m.Campaign.Headers,
+			Tags:      m.Campaign.Tags,
+		}
+	}
+
+	for _, f := range m.Attachments {
+		out.Attachments = append(out.Attachments, attachment{
+			Name:    f.Name,
+			Header:  f.Header,
+			Content: f.Content,
+		})
+	}
+
+	return out
+}
@@ -0,0 +1,331 @@
+package migrations
+
+import (
+	"log"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/knadh/koanf/v2"
+	"github.com/knadh/stuffbin"
+)
+
+// V3_1_0 performs the DB migrations.
+func V3_1_0(db *sqlx.DB, fs stuffbin.FileSystem, ko *koanf.Koanf, lo *log.Logger) error {
+	// New enum values can't be used in the transaction that adds them.
+	if _, err := db.Exec(`ALTER TYPE list_type ADD VALUE IF NOT EXISTS 'dynamic'`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS segments (
+			id               SERIAL PRIMARY KEY,
+			uuid             uuid NOT NULL UNIQUE,
+			name             TEXT NOT NULL,
+			query            TEXT NOT NULL DEFAULT '',
+			filter           JSONB NULL,
+			subscriber_count INTEGER NOT NULL DEFAULT 0,
+			counted_at       TIMESTAMP WITH TIME ZONE NULL,
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+
+		CREATE TABLE IF NOT EXISTS campaign_segments (
+			id           BIGSERIAL PRIMARY KEY,
+			campaign_id  INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			segment_id   INTEGER NULL REFERENCES segments(id) ON DELETE SET NULL ON UPDATE CASCADE,
+			segment_name TEXT NOT NULL DEFAULT '',
+			snapshot_at  TIMESTAMP WITH TIME ZONE NULL
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS campaign_segments_campaign_id_segment_id_idx ON campaign_segments (campaign_id, segment_id);
+		CREATE INDEX IF NOT EXISTS idx_camp_segments_camp_id ON campaign_segments(campaign_id);
+
+		CREATE TABLE IF NOT EXISTS campaign_subscribers (
+			campaign_id   INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			subscriber_id INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			PRIMARY KEY (campaign_id, subscriber_id)
+		);
+
+		INSERT INTO settings (key, value) VALUES ('attribs', '[]')
+			ON CONFLICT DO NOTHING;
+
+		ALTER TABLE subscribers ADD COLUMN IF NOT EXISTS engagement_score REAL NOT NULL DEFAULT 0;
+		ALTER TABLE subscribers ADD COLUMN IF NOT EXISTS last_engaged_at TIMESTAMP WITH TIME ZONE NULL;
+		CREATE INDEX IF NOT EXISTS idx_subs_engagement_score ON subscribers(engagement_score);
+
+		INSERT INTO settings (key, value) VALUES
+			('engagement.score_interval', '"0 2 * * *"'),
+			('engagement.half_life_days', '30'),
+			('engagement.sunset_enabled', 'false'),
+			('engagement.sunset_days', '365'),
+			('engagement.sunset_action', '"unsubscribe"'),
+			('engagement.sunset_list_id', '0')
+			ON CONFLICT DO NOTHING;
+
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id               BIGSERIAL PRIMARY KEY,
+			subscriber_id    INTEGER NULL,
+			list_id          INTEGER NULL,
+			action           TEXT NOT NULL,
+			source           TEXT NOT NULL DEFAULT '',
+			actor            TEXT NOT NULL DEFAULT '',
+			ip               TEXT NOT NULL DEFAULT '',
+			before           JSONB NULL,
+			after            JSONB NULL,
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_audit_sub_id ON audit_log(subscriber_id);
+		CREATE INDEX IF NOT EXISTS idx_audit_list_id ON audit_log(list_id);
+
+		-- Include the audit log in subscriber data exports.
+		UPDATE settings SET value = value || '["audit"]'
+			WHERE key = 'privacy.exportable' AND NOT (value ? 'audit');
+
+		ALTER TABLE subscribers ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE NULL;
+
+		-- Dynamic lists.
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS query TEXT NOT NULL DEFAULT '';
+		ALTER TABLE campaign_lists ADD COLUMN IF NOT EXISTS snapshot_at TIMESTAMP WITH TIME ZONE NULL;
+
+		-- List-level sending defaults for campaigns.
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS from_email TEXT NOT NULL DEFAULT '';
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS template_id INTEGER NULL;
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS messenger TEXT NOT NULL DEFAULT '';
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS reply_to TEXT NOT NULL DEFAULT '';
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS headers JSONB NOT NULL DEFAULT '[]';
+
+		-- Proof-of-consent records for subscriptions.
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS consent_text TEXT NOT NULL DEFAULT '';
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS consent_version INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE subscriber_lists ADD COLUMN IF NOT EXISTS consent JSONB NOT NULL DEFAULT '{}';
+		CREATE TABLE IF NOT EXISTS list_consent_texts (
+			list_id     INTEGER NOT NULL REFERENCES lists(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			version     INTEGER NOT NULL,
+			text        TEXT NOT NULL DEFAULT '',
+			created_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+			PRIMARY KEY(list_id, version)
+		);
+
+		-- Daily growth and churn stats of lists.
+		CREATE TABLE IF NOT EXISTS list_daily_stats (
+			list_id          INTEGER NOT NULL REFERENCES lists(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			date             DATE NOT NULL,
+			subscriptions    INTEGER NOT NULL DEFAULT 0,
+			confirmations    INTEGER NOT NULL DEFAULT 0,
+			unsubscriptions  INTEGER NOT NULL DEFAULT 0,
+			bounces          INTEGER NOT NULL DEFAULT 0,
+			net_growth       INTEGER NOT NULL DEFAULT 0,
+			total            INTEGER NOT NULL DEFAULT 0,
+			optin_pending    INTEGER NOT NULL DEFAULT 0,
+			optin_reminded   INTEGER NOT NULL DEFAULT 0,
+			optin_expired    INTEGER NOT NULL DEFAULT 0,
+
+			PRIMARY KEY(list_id, date)
+		);
+		CREATE INDEX IF NOT EXISTS idx_list_daily_stats_date ON list_daily_stats(date);
+
+		-- Double opt-in reminders and expiry.
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS optin_reminder_days INTEGER[] NOT NULL DEFAULT '{}';
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS optin_expiry_days INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE subscriber_lists ADD COLUMN IF NOT EXISTS optin_reminders INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE subscriber_lists ADD COLUMN IF NOT EXISTS optin_reminded_at TIMESTAMP WITH TIME ZONE NULL;
+		ALTER TABLE subscriber_lists ADD COLUMN IF NOT EXISTS optin_expired_at TIMESTAMP WITH TIME ZONE NULL;
+
+		-- The double opt-in of existing subscriptions started when they were made.
+		ALTER TABLE subscriber_lists ADD COLUMN IF NOT EXISTS optin_started_at TIMESTAMP WITH TIME ZONE NULL;
+		UPDATE subscriber_lists SET optin_started_at = created_at WHERE optin_started_at IS NULL;
+		ALTER TABLE subscriber_lists ALTER COLUMN optin_started_at SET DEFAULT NOW();
+
+		-- Existing unsubscriptions are dated by their last update, which is the closest there is.
+		ALTER TABLE subscriber_lists ADD COLUMN IF NOT EXISTS unsubscribed_at TIMESTAMP WITH TIME ZONE NULL;
+		UPDATE subscriber_lists SET unsubscribed_at = updated_at WHERE status = 'unsubscribed' AND unsubscribed_at IS NULL;
+
+		-- Records when subscriptions are unsubscribed for the churn stats of lists. Only the
+		-- change of a subscription's status to 'unsubscribed' sets the time, and not updates to
+		-- subscriptions that are already unsubscribed, eg: by imports. A change of the status to
+		-- 'unconfirmed', eg: re-subscribing after unsubscribing or expiring, starts the double
+		-- opt-in over, with the reminders and expiry counted from then.
+		CREATE OR REPLACE FUNCTION SET_SUBSCRIPTION_STATUS_TIMES() RETURNS TRIGGER AS $$
+		BEGIN
+		    IF NEW.status != 'unsubscribed' THEN
+		        NEW.unsubscribed_at := NULL;
+		    ELSIF TG_OP = 'INSERT' THEN
+		        NEW.unsubscribed_at := COALESCE(NEW.unsubscribed_at, NOW());
+		    ELSIF OLD.status != 'unsubscribed' THEN
+		        NEW.unsubscribed_at := NOW();
+		    END IF;
+
+		    IF TG_OP = 'UPDATE' AND NEW.status = 'unconfirmed' AND OLD.status != 'unconfirmed' THEN
+		        NEW.optin_started_at := NOW();
+		        NEW.optin_reminders := 0;
+		        NEW.optin_reminded_at := NULL;
+		        NEW.optin_expired_at := NULL;
+		    END IF;
+		    RETURN NEW;
+		END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS subscriber_lists_status_times ON subscriber_lists;
+		CREATE TRIGGER subscriber_lists_status_times BEFORE INSERT OR UPDATE ON subscriber_lists
+		    FOR EACH ROW EXECUTE FUNCTION SET_SUBSCRIPTION_STATUS_TIMES();
+
+		-- Counts the subscribers matching the query of a dynamic list, except the ones who
+		-- have unsubscribed from it. An invalid query counts as 0 so that it doesn't break
+		-- the refreshing of the list stats, and the error is logged as a warning.
+		CREATE OR REPLACE FUNCTION COUNT_DYNAMIC_LIST_SUBSCRIBERS(list_id INT, query TEXT) RETURNS BIGINT AS $$
+		DECLARE
+		    num BIGINT;
+		BEGIN
+		    IF query = '' THEN
+		        RETURN 0;
+		    END IF;
+
+		    EXECUTE 'SELECT COUNT(*) FROM subscribers WHERE subscribers.deleted_at IS NULL
+		        AND subscribers.status != ''blocklisted'' AND NOT EXISTS (
+		            SELECT 1 FROM subscriber_lists WHERE subscriber_lists.subscriber_id = subscribers.id
+		            AND subscriber_lists.list_id = $1 AND subscriber_lists.status = ''unsubscribed''
+		        ) AND (' || query || ')' INTO num USING list_id;
+		    RETURN num;
+		EXCEPTION WHEN OTHERS THEN
+		    RAISE WARNING 'error counting subscribers of dynamic list %: %', list_id, SQLERRM;
+		    RETURN 0;
+		END;
+		$$ LANGUAGE plpgsql STABLE;
+		CREATE INDEX IF NOT EXISTS idx_subs_deleted_at ON subscribers(deleted_at) WHERE deleted_at IS NOT NULL;
+
+		INSERT INTO settings (key, value) VALUES ('privacy.trash_retention_days', '30')
+			ON CONFLICT DO NOTHING;
+
+		-- Recreate the subscriber count views to exclude subscribers in the trash.
+		DROP MATERIALIZED VIEW IF EXISTS mat_dashboard_counts;
+		CREATE MATERIALIZED VIEW mat_dashboard_counts AS
+		    WITH subs AS (
+		        SELECT COUNT(*) AS num, status FROM subscribers WHERE deleted_at IS NULL GROUP BY status
+		    )
+		    SELECT NOW() AS updated_at,
+		        JSON_BUILD_OBJECT(
+		            'subscribers', JSON_BUILD_OBJECT(
+		                'total', (SELECT SUM(num) FROM subs),
+		                'blocklisted', (SELECT num FROM subs WHERE status='blocklisted'),
+		                'orphans', (
+		                    SELECT COUNT(id) FROM subscribers
+		                    LEFT JOIN subscriber_lists ON (subscribers.id = subscriber_lists.subscriber_id)
+		                    WHERE subscriber_lists.subscriber_id IS NULL AND subscribers.deleted_at IS NULL
+		                )
+		            ),
+		            'lists', JSON_BUILD_OBJECT(
+		                'total', (SELECT COUNT(*) FROM lists),
+		                'private', (SELECT COUNT(*) FROM lists WHERE type='private'),
+		                'public', (SELECT COUNT(*) FROM lists WHERE type='public'),
+		                'optin_single', (SELECT COUNT(*) FROM lists WHERE optin='single'),
+		                'optin_double', (SELECT COUNT(*) FROM lists WHERE optin='double')
+		            ),
+		            'campaigns', JSON_BUILD_OBJECT(
+		                'total', (SELECT COUNT(*) FROM campaigns),
+		                'by_status', (
+		                    SELECT JSON_OBJECT_AGG (status, num) FROM
+		                    (SELECT status, COUNT(*) AS num FROM campaigns GROUP BY status) r
+		                )
+		            ),
+		            'messages', (SELECT SUM(sent) AS messages FROM campaigns)
+		        ) AS data;
+		CREATE UNIQUE INDEX IF NOT EXISTS mat_dashboard_stats_idx ON mat_dashboard_counts (updated_at);
+
+		DROP MATERIALIZED VIEW IF EXISTS mat_list_subscriber_stats;
+		CREATE MATERIALIZED VIEW mat_list_subscriber_stats AS
+		    SELECT NOW() AS updated_at, lists.id AS list_id, subscriber_lists.status, COUNT(subscribers.id) AS subscriber_count FROM lists
+		    LEFT JOIN subscriber_lists ON (subscriber_lists.list_id = lists.id)
+		    LEFT JOIN subscribers ON (subscribers.id = subscriber_lists.subscriber_id AND subscribers.deleted_at IS NULL)
+		    WHERE lists.type != 'dynamic'
+		    GROUP BY lists.id, subscriber_lists.status
+		    UNION ALL
+		    -- The subscribers matching the queries of dynamic lists are counted as confirmed.
+		    SELECT NOW() AS updated_at, lists.id AS list_id, 'confirmed'::subscription_status AS status,
+		        COUNT_DYNAMIC_LIST_SUBSCRIBERS(lists.id, lists.query) AS subscriber_count
+		    FROM lists WHERE lists.type = 'dynamic'
+		    UNION ALL
+		    SELECT NOW() AS updated_at, lists.id AS list_id, subscriber_lists.status, COUNT(subscribers.id) AS subscriber_count FROM lists
+		    INNER JOIN subscriber_lists ON (subscriber_lists.list_id = lists.id AND subscriber_lists.status = 'unsubscribed')
+		    LEFT JOIN subscribers ON (subscribers.id = subscriber_lists.subscriber_id AND subscribers.deleted_at IS NULL)
+		    WHERE lists.type = 'dynamic'
+		    GROUP BY lists.id, subscriber_lists.status
+		    UNION ALL
+		    SELECT NOW() AS updated_at, 0 AS list_id, NULL AS status, COUNT(*) AS subscriber_count FROM subscribers WHERE deleted_at IS NULL;
+		CREATE UNIQUE INDEX IF NOT EXISTS mat_list_subscriber_stats_idx ON mat_list_subscriber_stats (list_id, status);
+
+		-- Applies a JSON merge patch (RFC 7396) to a JSONB value. Nested objects are
+		-- merged recursively and null values in the patch remove keys.
+		CREATE OR REPLACE FUNCTION JSONB_MERGE_PATCH(target JSONB, patch JSONB) RETURNS JSONB AS $$
+		BEGIN
+		    IF JSONB_TYPEOF(patch) IS DISTINCT FROM 'object' THEN
+		        RETURN patch;
+		    END IF;
+		    IF JSONB_TYPEOF(target) IS DISTINCT FROM 'object' THEN
+		        target := '{}';
+		    END IF;
+
+		    RETURN (
+		        SELECT COALESCE(JSONB_OBJECT_AGG(COALESCE(p.key, t.key),
+		            CASE WHEN p.key IS NULL THEN t.value ELSE JSONB_MERGE_PATCH(t.value, p.value) END), '{}')
+		        FROM JSONB_EACH(target) t FULL OUTER JOIN JSONB_EACH(patch) p ON (p.key = t.key)
+		        WHERE p.value IS NULL OR p.value != 'null'::JSONB
+		    );
+		END;
+		$$ LANGUAGE plpgsql IMMUTABLE;
+
+		INSERT INTO settings (key, value) VALUES ('import.sources', '[]')
+			ON CONFLICT DO NOTHING;
+
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'import_run_status') THEN
+				CREATE TYPE import_run_status AS ENUM ('importing', 'stopping', 'stopped', 'finished', 'failed');
+			END IF;
+		END$$;
+
+		CREATE TABLE IF NOT EXISTS import_runs (
+			id            BIGSERIAL PRIMARY KEY,
+			source        TEXT NOT NULL DEFAULT '',
+			filename      TEXT NOT NULL DEFAULT '',
+			status        import_run_status NOT NULL DEFAULT 'importing',
+			dry_run       BOOLEAN NOT NULL DEFAULT false,
+			total         INTEGER NOT NULL DEFAULT 0,
+			imported      INTEGER NOT NULL DEFAULT 0,
+			rejected      INTEGER NOT NULL DEFAULT 0,
+			unsubscribed  INTEGER NOT NULL DEFAULT 0,
+			new           INTEGER NOT NULL DEFAULT 0,
+			updated       INTEGER NOT NULL DEFAULT 0,
+			unchanged     INTEGER NOT NULL DEFAULT 0,
+			error         TEXT NOT NULL DEFAULT '',
+			log           TEXT NOT NULL DEFAULT '',
+			started_at    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			finished_at   TIMESTAMP WITH TIME ZONE NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_import_runs_started_at ON import_runs(started_at);
+
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'export_job_status') THEN
+				CREATE TYPE export_job_status AS ENUM ('running', 'finished', 'failed');
+			END IF;
+		END$$;
+
+		CREATE TABLE IF NOT EXISTS export_jobs (
+			id             BIGSERIAL PRIMARY KEY,
+			uuid           UUID NOT NULL UNIQUE,
+			status         export_job_status NOT NULL DEFAULT 'running',
+			format         TEXT NOT NULL DEFAULT 'csv',
+			fields         TEXT[] NOT NULL DEFAULT '{}',
+			include_lists  BOOLEAN NOT NULL DEFAULT false,
+			filename       TEXT NOT NULL DEFAULT '',
+			exported       INTEGER NOT NULL DEFAULT 0,
+			error          TEXT NOT NULL DEFAULT '',
+			created_by     TEXT NOT NULL DEFAULT '',
+			created_at     TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			finished_at    TIMESTAMP WITH TIME ZONE NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_export_jobs_created_at ON export_jobs(created_at);
+	`); err != nil {
+		return err
+	}
+
+	return nil
+}
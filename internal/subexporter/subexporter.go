@@ -0,0 +1,370 @@
+// Package subexporter writes subscriber records to CSV, NDJSON, or XLSX files
+// with a selection of fields, including attribute keys flattened into their own
+// columns, and optionally, the subscriptions of the subscribers.
+package subexporter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	// AttribPrefix is the prefix of fields that are attribute keys, eg: attribs.city.
+	// Nested keys are separated by dots, eg: attribs.address.city.
+	AttribPrefix = "attribs."
+
+	// listsField is the name of the field with the subscriptions of a subscriber.
+	listsField = "lists"
+
+	xlsxSheet = "Sheet1"
+)
+
+var (
+	// BaseFields are the subscriber fields that can be exported.
+	BaseFields = []string{"uuid", "email", "name", "attributes", "status", "created_at", "updated_at"}
+
+	// contentTypes maps the export formats to the content types of their files.
+	contentTypes = map[string]string{
+		models.ExportFormatCSV:    "text/csv",
+		models.ExportFormatNDJSON: "application/x-ndjson",
+		models.ExportFormatXLSX:   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	}
+
+	baseFields = func() map[string]bool {
+		out := make(map[string]bool, len(BaseFields))
+		for _, f := range BaseFields {
+			out[f] = true
+		}
+		return out
+	}()
+
+	// ErrTooManyRows is returned when the records exceed the rows in an XLSX sheet.
+	ErrTooManyRows = errors.New("the export exceeds the maximum number of rows in an XLSX sheet")
+)
+
+// Writer writes subscriber records to a file.
+type Writer interface {
+	// Write writes a subscriber. lists is the JSON array of the subscriber's
+	// subscriptions, which is ignored if the lists aren't being exported.
+	Write(sub models.SubscriberExport, lists json.RawMessage) error
+
+	// Close writes any buffered records and finalizes the file.
+	Close() error
+}
+
+// row holds the fields being exported.
+type row struct {
+	fields    []string
+	withLists bool
+	hasAttrib bool
+}
+
+// New returns a Writer that writes the given fields of subscribers in the given
+// format to w. withLists adds a "lists" field with the subscriptions of the
+// subscribers.
+func New(format string, w io.Writer, fields []string, withLists bool) (Writer, error) {
+	if err := ValidateFields(fields); err != nil {
+		return nil, err
+	}
+
+	r := row{fields: fields, withLists: withLists}
+	for _, f := range fields {
+		if strings.HasPrefix(f, AttribPrefix) {
+			r.hasAttrib = true
+		}
+	}
+
+	switch format {
+	case models.ExportFormatCSV:
+		wr := csv.NewWriter(w)
+		if err := wr.Write(r.header()); err != nil {
+			return nil, err
+		}
+		return &csvWriter{row: r, wr: wr}, nil
+
+	case models.ExportFormatNDJSON:
+		return &ndjsonWriter{row: r, wr: bufio.NewWriter(w)}, nil
+
+	case models.ExportFormatXLSX:
+		f := excelize.NewFile()
+		sw, err := f.NewStreamWriter(xlsxSheet)
+		if err != nil {
+			return nil, err
+		}
+
+		hdr := r.header()
+		vals := make([]interface{}, len(hdr))
+		for i, h := range hdr {
+			vals[i] = h
+		}
+		if err := sw.SetRow("A1", vals); err != nil {
+			return nil, err
+		}
+		return &xlsxWriter{row: r, f: f, sw: sw, w: w, n: 1}, nil
+	}
+
+	return nil, fmt.Errorf("unknown export format '%s'", format)
+}
+
+// IsFormat returns true if the given export format is supported.
+func IsFormat(format string) bool {
+	_, ok := contentTypes[format]
+	return ok
+}
+
+// ContentType returns the content type of the files of an export format.
+func ContentType(format string) string {
+	return contentTypes[format]
+}
+
+// ValidateFields checks that the fields are known subscriber fields or attribute
+// keys and that there are no duplicates.
+func ValidateFields(fields []string) error {
+	if len(fields) == 0 {
+		return errors.New("no fields to export")
+	}
+
+	seen := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		if seen[f] {
+			return fmt.Errorf("duplicate field '%s'", f)
+		}
+		seen[f] = true
+
+		if baseFields[f] {
+			continue
+		}
+
+		key, ok := strings.CutPrefix(f, AttribPrefix)
+		if !ok {
+			return fmt.Errorf("unknown field '%s'", f)
+		}
+		for _, k := range strings.Split(key, ".") {
+			if k == "" {
+				return fmt.Errorf("invalid attribute field '%s'", f)
+			}
+		}
+	}
+
+	return nil
+}
+
+// header returns the names of the fields in a row.
+func (r row) header() []string {
+	if !r.withLists {
+		return r.fields
+	}
+	return append(append([]string{}, r.fields...), listsField)
+}
+
+// values returns the values of the fields of a subscriber in a row. Attribute
+// values are decoded JSON values and are nil when the keys don't exist. The
+// attributes and lists are raw JSON.
+func (r row) values(sub models.SubscriberExport, lists json.RawMessage) ([]interface{}, error) {
+	var attribs map[string]interface{}
+	if r.hasAttrib && sub.Attribs != "" {
+		d := json.NewDecoder(strings.NewReader(sub.Attribs))
+		d.UseNumber()
+		if err := d.Decode(&attribs); err != nil {
+			return nil, fmt.Errorf("error decoding attributes of '%s': %v", sub.Email, err)
+		}
+	}
+
+	out := make([]interface{}, 0, len(r.fields)+1)
+	for _, f := range r.fields {
+		switch f {
+		case "uuid":
+			out = append(out, sub.UUID)
+		case "email":
+			out = append(out, sub.Email)
+		case "name":
+			out = append(out, sub.Name)
+		case "status":
+			out = append(out, sub.Status)
+		case "attributes":
+			attr := sub.Attribs
+			if attr == "" {
+				attr = "{}"
+			}
+			out = append(out, json.RawMessage(attr))
+		case "created_at":
+			out = append(out, sub.CreatedAt.Time.Format(time.RFC3339))
+		case "updated_at":
+			out = append(out, sub.UpdatedAt.Time.Format(time.RFC3339))
+		default:
+			out = append(out, lookupAttrib(attribs, strings.TrimPrefix(f, AttribPrefix)))
+		}
+	}
+
+	if r.withLists {
+		if len(lists) == 0 {
+			lists = json.RawMessage("[]")
+		}
+		out = append(out, lists)
+	}
+
+	return out, nil
+}
+
+// lookupAttrib returns the value of a dot separated, nested attribute key.
+func lookupAttrib(attribs map[string]interface{}, key string) interface{} {
+	var v interface{} = attribs
+	for _, k := range strings.Split(key, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if v, ok = m[k]; !ok {
+			return nil
+		}
+	}
+	return v
+}
+
+// toString returns the string representation of a value in a CSV or XLSX cell.
+// Objects and arrays are JSON encoded.
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case json.RawMessage:
+		return string(v)
+	}
+
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// csvWriter writes subscribers as CSV rows.
+type csvWriter struct {
+	row
+	wr *csv.Writer
+}
+
+func (w *csvWriter) Write(sub models.SubscriberExport, lists json.RawMessage) error {
+	vals, err := w.values(sub, lists)
+	if err != nil {
+		return err
+	}
+
+	rec := make([]string, len(vals))
+	for i, v := range vals {
+		rec[i] = toString(v)
+	}
+	return w.wr.Write(rec)
+}
+
+func (w *csvWriter) Close() error {
+	w.wr.Flush()
+	return w.wr.Error()
+}
+
+// ndjsonWriter writes subscribers as JSON objects, one per line, with the
+// fields in the order they were selected.
+type ndjsonWriter struct {
+	row
+	wr *bufio.Writer
+}
+
+func (w *ndjsonWriter) Write(sub models.SubscriberExport, lists json.RawMessage) error {
+	vals, err := w.values(sub, lists)
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, f := range w.header() {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		k, _ := json.Marshal(f)
+		v, err := json.Marshal(vals[i])
+		if err != nil {
+			return err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteString("}\n")
+
+	_, err = w.wr.Write(b.Bytes())
+	return err
+}
+
+func (w *ndjsonWriter) Close() error {
+	return w.wr.Flush()
+}
+
+// xlsxWriter writes subscribers as rows in the first sheet of an XLSX file. The
+// file is written when it's closed.
+type xlsxWriter struct {
+	row
+	f  *excelize.File
+	sw *excelize.StreamWriter
+	w  io.Writer
+
+	// Number of rows written, including the header.
+	n int
+}
+
+func (w *xlsxWriter) Write(sub models.SubscriberExport, lists json.RawMessage) error {
+	if w.n >= excelize.TotalRows {
+		return ErrTooManyRows
+	}
+
+	vals, err := w.values(sub, lists)
+	if err != nil {
+		return err
+	}
+
+	// Keep numbers and booleans typed and write everything else as text.
+	for i, v := range vals {
+		switch v := v.(type) {
+		case bool, nil:
+		case json.Number:
+			if f, err := v.Float64(); err == nil {
+				vals[i] = f
+			} else {
+				vals[i] = v.String()
+			}
+		default:
+			vals[i] = toString(v)
+		}
+	}
+
+	w.n++
+	cell, err := excelize.CoordinatesToCellName(1, w.n)
+	if err != nil {
+		return err
+	}
+	return w.sw.SetRow(cell, vals)
+}
+
+func (w *xlsxWriter) Close() error {
+	defer w.f.Close()
+
+	if err := w.sw.Flush(); err != nil {
+		return err
+	}
+	return w.f.Write(w.w)
+}
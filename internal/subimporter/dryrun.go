@@ -0,0 +1,236 @@
+package subimporter
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/knadh/listmonk/internal/attribs"
+	"github.com/knadh/listmonk/models"
+	"github.com/lib/pq"
+)
+
+// dryRunBatchSize is the number of rows looked up in the DB at a time in a dry run.
+const dryRunBatchSize = 1000
+
+// existingSub represents the state of a subscriber before a row is imported.
+type existingSub struct {
+	name     string
+	attribs  models.JSON
+	status   string
+	trashed  bool
+	subStats map[int]string
+}
+
+// dryRun is the dry run counterpart of Start. Instead of importing the subscribers
+// in the queue, it classifies them against the DB as new, to be updated, or unchanged.
+func (s *Session) dryRun() {
+	var (
+		batch = make([]SubReq, 0, dryRunBatchSize)
+
+		// Subscribers seen so far, including the rows in the file, so that
+		// repeated e-mails in the file are classified like they would be imported.
+		seen = make(map[string]*existingSub)
+	)
+
+	for sub := range s.subQueue {
+		batch = append(batch, sub)
+		if len(batch) < dryRunBatchSize {
+			continue
+		}
+
+		if err := s.classify(batch, seen); err != nil {
+			s.log.Printf("error classifying subscribers: %v", err)
+			s.fail(err)
+
+			// Drain the queue so that the loader doesn't block.
+			for range s.subQueue {
+			}
+			return
+		}
+		batch = batch[:0]
+	}
+
+	if len(batch) > 0 {
+		if err := s.classify(batch, seen); err != nil {
+			s.log.Printf("error classifying subscribers: %v", err)
+			s.fail(err)
+			return
+		}
+	}
+
+	// The session was aborted by an error while loading the file.
+	st := s.stats()
+	if st.Status == StatusFailed {
+		s.log.Printf("dry run failed")
+		return
+	}
+
+	s.log.Printf("dry run %s: %d new, %d to update, %d unchanged, %d rejected",
+		s.complete(), st.New, st.Updated, st.Unchanged, st.Rejected)
+}
+
+// classify classifies a batch of subscribers against the subscribers that exist
+// in the DB or have been seen earlier in the file.
+func (s *Session) classify(subs []SubReq, seen map[string]*existingSub) error {
+	emails := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		if _, ok := seen[sub.Email]; !ok {
+			emails = append(emails, sub.Email)
+		}
+	}
+
+	if len(emails) > 0 {
+		if err := s.getExisting(emails, seen); err != nil {
+			return err
+		}
+	}
+
+	var numNew, numUpdated, numUnchanged, numRejected int
+	for _, sub := range subs {
+		// Normalize the attributes to how they'd be read back from the DB.
+		attr := models.JSON{}
+		if b, err := json.Marshal(sub.Attribs); err == nil {
+			_ = json.Unmarshal(b, &attr)
+		}
+
+		ex, ok := seen[sub.Email]
+		if !ok {
+			// In the merge mode, new subscribers get the attributes validated against the full schema.
+			if s.opt.Merge {
+				if sub.newErr != nil {
+					s.reject(sub.row, sub.raw, sub.newErr.Error())
+					numRejected++
+					continue
+				}
+
+				attr = models.JSON{}
+				if b, err := json.Marshal(sub.newAttribs); err == nil {
+					_ = json.Unmarshal(b, &attr)
+				}
+				attr = attribs.Merge(models.JSON{}, attr)
+			}
+
+			numNew++
+
+			ex = &existingSub{name: sub.Name, attribs: attr, subStats: make(map[int]string)}
+			if s.opt.Mode == ModeBlocklist {
+				ex.status = models.SubscriberStatusBlockListed
+			}
+			for _, id := range s.opt.ListIDs {
+				ex.subStats[id] = s.opt.SubStatus
+			}
+			seen[sub.Email] = ex
+			continue
+		}
+
+		// In the merge mode, compare the existing subscriber with the merged result.
+		name := sub.Name
+		if s.opt.Merge {
+			attr = attribs.Merge(ex.attribs, attr)
+			if sub.keepName {
+				name = ex.name
+			}
+		}
+
+		if s.isChanged(ex, name, attr) {
+			numUpdated++
+		} else {
+			numUnchanged++
+		}
+
+		// Apply the row to the seen subscriber as the import would.
+		ex.trashed = false
+		if s.opt.Mode == ModeBlocklist {
+			ex.status = models.SubscriberStatusBlockListed
+			continue
+		}
+		if s.opt.Overwrite || s.opt.Merge {
+			ex.name, ex.attribs = name, attr
+		}
+		for _, id := range s.opt.ListIDs {
+			if _, ok := ex.subStats[id]; !ok || s.opt.Overwrite {
+				ex.subStats[id] = s.opt.SubStatus
+			}
+		}
+	}
+
+	s.Lock()
+	s.run.New += numNew
+	s.run.Updated += numUpdated
+	s.run.Unchanged += numUnchanged
+	s.Unlock()
+	s.incrementImportCount(len(subs) - numRejected)
+
+	return nil
+}
+
+// isChanged returns true if importing a row would change an existing subscriber.
+func (s *Session) isChanged(ex *existingSub, name string, attr models.JSON) bool {
+	// Importing restores subscribers in the trash.
+	if ex.trashed {
+		return true
+	}
+
+	if s.opt.Mode == ModeBlocklist {
+		return ex.status != models.SubscriberStatusBlockListed
+	}
+
+	if (s.opt.Overwrite || s.opt.Merge) && (ex.name != name || !reflect.DeepEqual(ex.attribs, attr)) {
+		return true
+	}
+
+	for _, id := range s.opt.ListIDs {
+		st, ok := ex.subStats[id]
+		if !ok || (s.opt.Overwrite && st != s.opt.SubStatus) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getExisting fetches the existing subscribers with the given e-mails from the DB
+// into the seen map.
+func (s *Session) getExisting(emails []string, seen map[string]*existingSub) error {
+	listIDs := s.opt.ListIDs
+	if listIDs == nil {
+		listIDs = []int{}
+	}
+
+	rows, err := s.im.opt.ExistingStmt.Query(pq.Array(emails), pq.Array(listIDs))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			email, name, status string
+			attr                []byte
+			trashed             bool
+			ids                 pq.Int64Array
+			statuses            pq.StringArray
+		)
+		if err := rows.Scan(&email, &name, &attr, &status, &trashed, &ids, &statuses); err != nil {
+			return err
+		}
+
+		ex := &existingSub{
+			name:     name,
+			attribs:  models.JSON{},
+			status:   status,
+			trashed:  trashed,
+			subStats: make(map[int]string, len(ids)),
+		}
+		if err := json.Unmarshal(attr, &ex.attribs); err != nil {
+			return err
+		}
+		for i, id := range ids {
+			ex.subStats[int(id)] = statuses[i]
+		}
+
+		seen[email] = ex
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,398 @@
+package subimporter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/xuri/excelize/v2"
+)
+
+// Formats of the files that can be imported.
+const (
+	formatCSV  = "csv"
+	formatJSON = "json"
+	formatXLSX = "xlsx"
+)
+
+var (
+	// fileFormats maps the extensions of files that can be imported to their formats.
+	fileFormats = map[string]string{
+		".csv":    formatCSV,
+		".json":   formatJSON,
+		".ndjson": formatJSON,
+		".jsonl":  formatJSON,
+		".xlsx":   formatXLSX,
+	}
+
+	// jsonKeys are the known keys in JSON subscriber records.
+	jsonKeys = map[string]bool{
+		"email":   true,
+		"name":    true,
+		"attribs": true,
+	}
+)
+
+// IsLoadable returns true if a file can be loaded (without extracting it from a ZIP)
+// based on its extension.
+func IsLoadable(filename string) bool {
+	_, ok := fileFormats[strings.ToLower(filepath.Ext(filename))]
+	return ok
+}
+
+// Load loads a CSV, JSON, NDJSON, or XLSX file based on its extension and validates
+// and imports the subscriber entries in it. delim is the delimiter for CSV files.
+// If loading fails, the session is ended as failed.
+func (s *Session) Load(srcPath string, delim rune) error {
+	var err error
+	switch fileFormats[strings.ToLower(filepath.Ext(srcPath))] {
+	case formatCSV:
+		err = s.LoadCSV(srcPath, delim)
+	case formatJSON:
+		err = s.LoadJSON(srcPath)
+	case formatXLSX:
+		err = s.LoadXLSX(srcPath, s.opt.Sheet)
+	default:
+		s.log.Printf("unsupported file '%s'", filepath.Base(srcPath))
+		err = errors.New("unsupported file")
+	}
+
+	if err != nil {
+		s.abort(err)
+	}
+	return err
+}
+
+// LoadJSON loads a JSON file with an array of subscriber records, or an NDJSON file
+// with one record per line, and validates and imports the subscriber entries in it.
+// Records have the keys email, name, and attribs, where attribs is an object that's
+// imported as-is.
+func (s *Session) LoadJSON(srcPath string) error {
+	if s.isDone() {
+		return errSessionOver
+	}
+
+	// Default status is "failed" in case the function
+	// returns at one of the many possible errors.
+	failed := true
+	defer func() {
+		if failed {
+			s.setStatus(StatusFailed)
+		}
+	}()
+
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// A JSON array begins with '[', and NDJSON, with the first record's '{'.
+	isArray, err := isJSONArray(f)
+	if err != nil {
+		s.log.Printf("error reading '%s': %v", srcPath, err)
+		return err
+	}
+	_, _ = f.Seek(0, 0)
+
+	var (
+		next  func() ([]byte, error)
+		total int
+	)
+	if isArray {
+		// Count the records in the array for the progress and rewind.
+		total, err = countJSONArray(f)
+		if err != nil {
+			s.log.Printf("error reading JSON array in '%s': %v", srcPath, err)
+			return err
+		}
+		_, _ = f.Seek(0, 0)
+
+		dec := json.NewDecoder(f)
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		next = func() ([]byte, error) {
+			if !dec.More() {
+				return nil, io.EOF
+			}
+
+			var rec json.RawMessage
+			if err := dec.Decode(&rec); err != nil {
+				return nil, err
+			}
+			return rec, nil
+		}
+	} else {
+		// Like CSVs, the line count is only used to derive the progress.
+		total, err = countLines(f)
+		if err != nil {
+			s.log.Printf("error counting lines in '%s': %v", srcPath, err)
+			return err
+		}
+		_, _ = f.Seek(0, 0)
+
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+		next = func() ([]byte, error) {
+			for sc.Scan() {
+				if b := bytes.TrimSpace(sc.Bytes()); len(b) > 0 {
+					return append([]byte(nil), b...), nil
+				}
+			}
+			if err := sc.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+	}
+
+	if total == 0 {
+		return errors.New("empty file")
+	}
+
+	s.Lock()
+	s.run.Total = total
+	s.Unlock()
+
+	if err := s.loadRecords(srcPath, next); err != nil {
+		return err
+	}
+
+	failed = false
+	return nil
+}
+
+// LoadXLSX loads the given sheet, or if it's empty, the first sheet, of an XLSX
+// workbook, and validates and imports the subscriber entries in it. The sheet is
+// read like a CSV file where the first row is the header.
+func (s *Session) LoadXLSX(srcPath, sheet string) error {
+	if s.isDone() {
+		return errSessionOver
+	}
+
+	// Default status is "failed" in case the function
+	// returns at one of the many possible errors.
+	failed := true
+	defer func() {
+		if failed {
+			s.setStatus(StatusFailed)
+		}
+	}()
+
+	f, err := excelize.OpenFile(srcPath)
+	if err != nil {
+		s.log.Printf("error opening '%s': %v", srcPath, err)
+		return err
+	}
+	defer f.Close()
+
+	if sheet == "" {
+		sheet = f.GetSheetName(0)
+	}
+	if idx, err := f.GetSheetIndex(sheet); err != nil || idx < 0 {
+		s.log.Printf("sheet '%s' not found in '%s'", sheet, srcPath)
+		return fmt.Errorf("sheet '%s' not found", sheet)
+	}
+	s.log.Printf("reading sheet '%s'", sheet)
+
+	// Count the rows in the sheet for the progress.
+	numRows, err := countSheetRows(f, sheet)
+	if err != nil {
+		s.log.Printf("error reading sheet '%s': %v", sheet, err)
+		return err
+	}
+	if numRows == 0 {
+		return errors.New("empty file")
+	}
+
+	s.Lock()
+	// Exclude the header from count.
+	s.run.Total = numRows - 1
+	s.Unlock()
+
+	rows, err := f.Rows(sheet)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// Read the header.
+	var hdr []string
+	if rows.Next() {
+		hdr, err = rows.Columns()
+	}
+	if err != nil || len(hdr) == 0 {
+		s.log.Printf("error reading header from '%s': %v", srcPath, err)
+		return errors.New("error reading header")
+	}
+
+	next := func() ([]string, error) {
+		for rows.Next() {
+			cols, err := rows.Columns()
+			if err != nil {
+				return nil, err
+			}
+
+			// Skip blank rows like the CSV reader does.
+			if strings.TrimSpace(strings.Join(cols, "")) == "" {
+				continue
+			}
+
+			// Trailing empty cells aren't stored in XLSX rows.
+			for len(cols) < len(hdr) {
+				cols = append(cols, "")
+			}
+			return cols, nil
+		}
+		if err := rows.Error(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+
+	if err := s.loadTable(srcPath, hdr, next); err != nil {
+		return err
+	}
+
+	failed = false
+	return nil
+}
+
+// loadRecords validates and imports the subscriber entries in JSON records. next
+// returns the next record and io.EOF when there are no more records. The queue is
+// closed once all records are loaded.
+func (s *Session) loadRecords(srcPath string, next func() ([]byte, error)) error {
+	s.Lock()
+	s.rejectedHdr = []string{"record"}
+	s.Unlock()
+
+	for i := 1; ; i++ {
+		// Check for the stop signal.
+		select {
+		case <-s.stop:
+			s.closeQueue()
+			s.log.Println("stop request received")
+			return nil
+		default:
+		}
+
+		b, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			s.log.Printf("error reading '%s': %v", srcPath, err)
+			return err
+		}
+
+		raw := []string{string(b)}
+
+		var rec map[string]interface{}
+		if err := json.Unmarshal(b, &rec); err != nil {
+			s.reject(i, raw, err.Error())
+			continue
+		}
+
+		sub, err := s.recordToSub(rec)
+		if err != nil {
+			s.reject(i, raw, err.Error())
+			continue
+		}
+
+		s.enqueue(i, sub, raw)
+	}
+
+	s.closeQueue()
+	return nil
+}
+
+// recordToSub returns the subscriber entry in a JSON record.
+func (s *Session) recordToSub(rec map[string]interface{}) (SubReq, error) {
+	sub := SubReq{}
+	sub.Email, _ = rec["email"].(string)
+	sub.Name, _ = rec["name"].(string)
+
+	switch a := rec["attribs"].(type) {
+	case nil:
+	case map[string]interface{}:
+		sub.Attribs = models.JSON(a)
+	default:
+		return sub, errors.New(s.im.i18n.T("subscribers.invalidJSON"))
+	}
+
+	// In the merge mode, the other keys are attributes.
+	if s.opt.Merge {
+		for k, v := range rec {
+			if jsonKeys[k] {
+				continue
+			}
+			if sub.Attribs == nil {
+				sub.Attribs = make(models.JSON)
+			}
+			sub.Attribs[k] = v
+		}
+	}
+
+	return sub, nil
+}
+
+// isJSONArray returns true if the first non-whitespace character in a file is '['.
+func isJSONArray(r io.Reader) (bool, error) {
+	br := bufio.NewReader(r)
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return c == '[', nil
+	}
+}
+
+// countJSONArray counts the elements in a JSON array.
+func countJSONArray(r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+	if _, err := dec.Token(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for dec.More() {
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// countSheetRows counts the rows in an XLSX sheet.
+func countSheetRows(f *excelize.File, sheet string) (int, error) {
+	rows, err := f.Rows(sheet)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		count++
+	}
+
+	return count, rows.Error()
+}
@@ -1,9 +1,9 @@
-// Package subimporter implements a bulk ZIP/CSV importer of subscribers.
+// Package subimporter implements a bulk importer of subscribers from CSV, JSON,
+// NDJSON, and XLSX files, optionally in a ZIP.
 // It implements a simple queue for buffering imports and committing records
-// to DB along with ZIP and CSV handling utilities. It is meant to be used as
-// a singleton as each Importer instance is stateful, where it keeps track of
-// an import in progress. Only one import should happen on a single importer
-// instance at a time.
+// to DB along with ZIP and CSV handling utilities. The Importer keeps track of
+// the import sessions in progress, which can run concurrently, and records the
+// status, counters, and log of each session in the DB.
 package subimporter
 
 import (
@@ -21,8 +21,10 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gofrs/uuid/v5"
+	"github.com/knadh/listmonk/internal/attribs"
 	"github.com/knadh/listmonk/internal/i18n"
 	"github.com/knadh/listmonk/models"
 	"github.com/lib/pq"
@@ -34,6 +36,14 @@ const (
 
 	// commitBatchSize is the number of inserts to commit in a single SQL transaction.
 	commitBatchSize = 10000
+
+	// maxRejectedRows is the maximum number of rejected rows retained for the
+	// rejected rows report. Rows rejected after that are only counted.
+	maxRejectedRows = 50000
+
+	// maxKeptSessions is the number of finished sessions that are kept in memory
+	// for their rejected rows reports.
+	maxKeptSessions = 10
 )
 
 // Various import statuses.
@@ -41,11 +51,16 @@ const (
 	StatusNone      = "none"
 	StatusImporting = "importing"
 	StatusStopping  = "stopping"
+	StatusStopped   = "stopped"
 	StatusFinished  = "finished"
 	StatusFailed    = "failed"
 
 	ModeSubscribe = "subscribe"
 	ModeBlocklist = "blocklist"
+
+	// What empty attribute cells in an import in the merge mode mean.
+	EmptyCellsKeep  = "keep"
+	EmptyCellsClear = "clear"
 )
 
 // Importer represents the bulk CSV subscriber import system.
@@ -56,20 +71,46 @@ type Importer struct {
 	domainBlocklist       map[string]bool
 	hasBlocklistWildcards bool
 
-	stop   chan bool
-	status Status
+	// Sessions in progress and the recently finished ones, by ID.
+	sessions map[int64]*Session
+	kept     []int64
+
+	// Names of the import sources being run.
+	runningSrcs map[string]bool
+
 	sync.RWMutex
 }
 
 // Options represents import options.
 type Options struct {
 	UpsertStmt         *sql.Stmt
+	MergeStmt          *sql.Stmt
 	BlocklistStmt      *sql.Stmt
 	UpdateListDateStmt *sql.Stmt
 	NotifCB            models.AdminNotifCallback
 
+	// Fetches existing subscribers by e-mail for classifying rows in dry runs.
+	ExistingStmt *sql.Stmt
+
+	// Records an audit log entry for an imported subscriber. Optional.
+	AuditStmt *sql.Stmt
+
+	// Record the import sessions in the DB.
+	InsertRunStmt *sql.Stmt
+	UpdateRunStmt *sql.Stmt
+
+	// Unsubscribes the list members absent from an imported file in a full sync.
+	UnsubAbsentStmt *sql.Stmt
+
 	// Lookup table for blocklisted domains.
 	DomainBlocklist []string
+
+	// Directory that the directories of directory import sources have to be in.
+	// If it's empty, directory sources are disabled.
+	SourceDirRoot string
+
+	// Schema against which subscriber attributes are validated.
+	Attribs *attribs.Schema
 }
 
 // Session represents a single import session.
@@ -79,6 +120,22 @@ type Session struct {
 	log      *log.Logger
 
 	opt SessionOpt
+
+	// Status and counters of the session, which are recorded in the DB.
+	run    models.ImportRun
+	logBuf *bytes.Buffer
+
+	// Header and rows of the rejected rows report.
+	rejectedHdr  []string
+	rejectedRows [][]string
+
+	stop chan bool
+
+	// Closed once the session is over and recorded.
+	done      chan struct{}
+	closeOnce sync.Once
+
+	sync.RWMutex
 }
 
 // SessionOpt represents the options for an importer session.
@@ -89,15 +146,31 @@ type SessionOpt struct {
 	Overwrite bool   `json:"overwrite"`
 	Delim     string `json:"delim"`
 	ListIDs   []int  `json:"lists"`
-}
 
-// Status represents statistics from an ongoing import session.
-type Status struct {
-	Name     string `json:"name"`
-	Total    int    `json:"total"`
-	Imported int    `json:"imported"`
-	Status   string `json:"status"`
-	logBuf   *bytes.Buffer
+	// Sheet to import from XLSX files. The first sheet if it's empty.
+	Sheet string `json:"sheet"`
+
+	// Merge deep merges the imported attributes into existing subscribers'
+	// attributes instead of replacing them. Columns other than the known headers
+	// are imported as attributes, and EmptyCells decides whether empty cells in
+	// them leave the attributes unchanged or clear them.
+	Merge      bool   `json:"merge"`
+	EmptyCells string `json:"empty_cells"`
+
+	// DryRun validates and classifies the rows against the database
+	// without importing them.
+	DryRun bool `json:"dry_run"`
+
+	// FullSync unsubscribes the subscribers on the lists who are absent from
+	// the file once it's fully imported. It only applies to the subscribe mode.
+	FullSync bool `json:"full_sync"`
+
+	// Name of the import source the file is from. Empty for uploads.
+	Source string `json:"-"`
+
+	// Admin user who started the import and their IP, for the audit log.
+	Actor string `json:"-"`
+	IP    string `json:"-"`
 }
 
 // SubReq is a wrapper over the Subscriber model.
@@ -106,6 +179,20 @@ type SubReq struct {
 	Lists          []int    `json:"lists"`
 	ListUUIDs      []string `json:"list_uuids"`
 	PreconfirmSubs bool     `json:"preconfirm_subscriptions"`
+
+	// keepName is set on imports in the merge mode for rows without a name
+	// so that existing subscribers' names are left unchanged.
+	keepName bool
+
+	// newAttribs are the attributes for creating a new subscriber in the merge
+	// mode, validated against the full schema, with defaults. newErr is set if
+	// they aren't valid, in which case the row can only update an existing subscriber.
+	newAttribs models.JSON
+	newErr     error
+
+	// row and raw are the row's number and raw values for the rejected rows report.
+	row int
+	raw []string
 }
 
 type importStatusTpl struct {
@@ -116,9 +203,17 @@ type importStatusTpl struct {
 }
 
 var (
-	// ErrIsImporting is thrown when an import request is made while an
-	// import is already running.
-	ErrIsImporting = errors.New("import is already running")
+	// ErrSessionNotFound is returned for sessions that aren't running
+	// or have been removed from memory.
+	ErrSessionNotFound = errors.New("import session not found")
+
+	// ErrSourceRunning is returned when an import source that's already
+	// being run is run.
+	ErrSourceRunning = errors.New("import source is already running")
+
+	// errSessionOver is returned when a file is loaded into a session
+	// that's been stopped or has failed.
+	errSessionOver = errors.New("import session is over")
 
 	csvHeaders = map[string]bool{
 		"email":      true,
@@ -135,8 +230,8 @@ func New(opt Options, db *sql.DB, i *i18n.I18n) *Importer {
 		db:              db,
 		i18n:            i,
 		domainBlocklist: make(map[string]bool, len(opt.DomainBlocklist)),
-		status:          Status{Status: StatusNone, logBuf: bytes.NewBuffer(nil)},
-		stop:            make(chan bool, 1),
+		sessions:        make(map[int64]*Session),
+		runningSrcs:     make(map[string]bool),
 	}
 
 	// Domain blocklist.
@@ -155,115 +250,232 @@ func New(opt Options, db *sql.DB, i *i18n.I18n) *Importer {
 	return &im
 }
 
-// NewSession returns an new instance of Session. It takes the name
-// of the uploaded file, but doesn't do anything with it but retains it for stats.
+// NewSession records a new import session in the DB and returns it. It takes the
+// name of the uploaded file, but doesn't do anything with it but retains it for
+// the session's stats.
 func (im *Importer) NewSession(opt SessionOpt) (*Session, error) {
-	if !im.isDone() {
-		return nil, errors.New("an import is already running")
-	}
-
-	im.Lock()
-	im.status = Status{Status: StatusImporting,
-		Name:   opt.Filename,
-		logBuf: bytes.NewBuffer(nil)}
-	im.Unlock()
-
 	s := &Session{
 		im:       im,
-		log:      log.New(im.status.logBuf, "", log.Ldate|log.Ltime|log.Lshortfile),
 		subQueue: make(chan SubReq, commitBatchSize),
 		opt:      opt,
+		logBuf:   bytes.NewBuffer(nil),
+		stop:     make(chan bool, 1),
+		done:     make(chan struct{}),
+		run: models.ImportRun{
+			Source:   opt.Source,
+			Filename: opt.Filename,
+			Status:   StatusImporting,
+			DryRun:   opt.DryRun,
+		},
+	}
+	s.log = log.New(s.logBuf, "", log.Ldate|log.Ltime|log.Lshortfile)
+
+	if err := im.opt.InsertRunStmt.QueryRow(opt.Source, opt.Filename, opt.DryRun).Scan(&s.run.ID, &s.run.StartedAt); err != nil {
+		return nil, err
 	}
 
-	s.log.Printf("processing '%s'", opt.Filename)
+	im.Lock()
+	im.sessions[s.run.ID] = s
+	im.Unlock()
+
+	if opt.Source != "" {
+		s.log.Printf("processing '%s' from source '%s'", opt.Filename, opt.Source)
+	} else {
+		s.log.Printf("processing '%s'", opt.Filename)
+	}
 	return s, nil
 }
 
-// GetStats returns the global Stats of the importer.
-func (im *Importer) GetStats() Status {
+// GetSession returns the status and counters of a session that's in progress or
+// has recently finished.
+func (im *Importer) GetSession(id int64) (models.ImportRun, bool) {
 	im.RLock()
-	defer im.RUnlock()
-	return Status{
-		Name:     im.status.Name,
-		Status:   im.status.Status,
-		Total:    im.status.Total,
-		Imported: im.status.Imported,
+	s, ok := im.sessions[id]
+	im.RUnlock()
+	if !ok {
+		return models.ImportRun{}, false
 	}
+
+	return s.stats(), true
 }
 
-// GetLogs returns the log entries of the last import session.
-func (im *Importer) GetLogs() []byte {
+// WriteRejectedCSV writes the rows rejected in a session that's in progress or has
+// recently finished as CSV with the row number and the reason for the rejection
+// preceding each row.
+func (im *Importer) WriteRejectedCSV(id int64, w io.Writer) error {
 	im.RLock()
-	defer im.RUnlock()
+	s, ok := im.sessions[id]
+	im.RUnlock()
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	s.RLock()
+	defer s.RUnlock()
 
-	if im.status.logBuf == nil {
-		return []byte{}
+	wr := csv.NewWriter(w)
+	if err := wr.Write(append([]string{"row", "reason"}, s.rejectedHdr...)); err != nil {
+		return err
 	}
-	return im.status.logBuf.Bytes()
+	if err := wr.WriteAll(s.rejectedRows); err != nil {
+		return err
+	}
+
+	return nil
 }
 
-// setStatus sets the Importer's status.
-func (im *Importer) setStatus(status string) {
-	im.Lock()
-	im.status.Status = status
-	im.Unlock()
+// GetLogs returns the log entries of a session that's in progress or has recently
+// finished. The logs of other sessions are in the DB.
+func (im *Importer) GetLogs(id int64) ([]byte, bool) {
+	im.RLock()
+	s, ok := im.sessions[id]
+	im.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+	return append([]byte(nil), s.logBuf.Bytes()...), true
 }
 
-// getStatus get's the Importer's status.
-func (im *Importer) getStatus() string {
+// Stop sends a signal to stop a session in progress.
+func (im *Importer) Stop(id int64) error {
 	im.RLock()
-	status := im.status.Status
+	s, ok := im.sessions[id]
 	im.RUnlock()
-	return status
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	s.Stop()
+	return nil
 }
 
-// isDone returns true if the importer is working (importing|stopping).
-func (im *Importer) isDone() bool {
-	s := true
+// StopAll sends a signal to stop all sessions in progress.
+func (im *Importer) StopAll() {
 	im.RLock()
-	if im.getStatus() == StatusImporting || im.getStatus() == StatusStopping {
-		s = false
+	sessions := make([]*Session, 0, len(im.sessions))
+	for _, s := range im.sessions {
+		sessions = append(sessions, s)
 	}
 	im.RUnlock()
-	return s
+
+	for _, s := range sessions {
+		s.Stop()
+	}
 }
 
-// incrementImportCount sets the Importer's "imported" counter.
-func (im *Importer) incrementImportCount(n int) {
+// release removes a finished session from the sessions in progress, retaining it
+// in memory until it's one of the maxKeptSessions last finished sessions.
+func (im *Importer) release(s *Session) {
 	im.Lock()
-	im.status.Imported += n
-	im.Unlock()
+	defer im.Unlock()
+
+	im.kept = append(im.kept, s.run.ID)
+	if len(im.kept) > maxKeptSessions {
+		delete(im.sessions, im.kept[0])
+		im.kept = im.kept[1:]
+	}
+}
+
+// stats returns the status and counters of the session.
+func (s *Session) stats() models.ImportRun {
+	s.RLock()
+	defer s.RUnlock()
+	return s.run
+}
+
+// setStatus sets the session's status.
+func (s *Session) setStatus(status string) {
+	s.Lock()
+	s.run.Status = status
+	s.Unlock()
+}
+
+// getStatus get's the session's status.
+func (s *Session) getStatus() string {
+	s.RLock()
+	status := s.run.Status
+	s.RUnlock()
+	return status
+}
+
+// isDone returns true if the session isn't working (importing|stopping).
+func (s *Session) isDone() bool {
+	status := s.getStatus()
+	return status != StatusImporting && status != StatusStopping
+}
+
+// incrementImportCount sets the session's "imported" counter.
+func (s *Session) incrementImportCount(n int) {
+	s.Lock()
+	s.run.Imported += n
+	s.Unlock()
+}
+
+// save records the status, counters, and log of the session in the DB.
+// finished sets the time the session finished.
+func (s *Session) save(finished bool) {
+	s.RLock()
+	r := s.run
+	logs := s.logBuf.String()
+	s.RUnlock()
+
+	if _, err := s.im.opt.UpdateRunStmt.Exec(r.ID, r.Status, r.Total, r.Imported, r.Rejected,
+		r.Unsubscribed, r.New, r.Updated, r.Unchanged, r.Error, logs, finished); err != nil {
+		s.log.Printf("error recording import session: %v", err)
+	}
 }
 
 // sendNotif sends admin notifications for import completions.
-func (im *Importer) sendNotif(status string) error {
+func (s *Session) sendNotif(status string) error {
 	var (
-		s   = im.GetStats()
+		st  = s.stats()
 		out = importStatusTpl{
-			Name:     s.Name,
+			Name:     st.Filename,
 			Status:   status,
-			Imported: s.Imported,
-			Total:    s.Total,
+			Imported: st.Imported,
+			Total:    st.Total,
 		}
 		subject = fmt.Sprintf("%s: %s import",
 			strings.Title(status),
-			s.Name)
+			st.Filename)
 	)
-	return im.opt.NotifCB(subject, out)
+	return s.im.opt.NotifCB(subject, out)
 }
 
 // Start is a blocking function that selects on a channel queue until all
 // subscriber entries in the import session are imported. It should be
 // invoked as a goroutine.
 func (s *Session) Start() {
+	defer s.finish()
+
+	if s.opt.DryRun {
+		s.dryRun()
+		return
+	}
+
 	var (
-		tx    *sql.Tx
-		stmt  *sql.Stmt
-		err   error
-		total = 0
-		cur   = 0
+		tx        *sql.Tx
+		stmt      *sql.Stmt
+		auditStmt *sql.Stmt
+		err       error
+		total     = 0
+		cur       = 0
+
+		// Whether any rows were lost to DB errors, which rules out a full sync.
+		incomplete = false
 
 		listIDs = make([]int, len(s.opt.ListIDs))
+
+		// Proof-of-consent record of the imported subscriptions.
+		consent, _ = json.Marshal(models.SubscriptionConsent{
+			Source:      models.ConsentSourceImport,
+			SourceName:  s.opt.Filename,
+			ConsentedAt: time.Now(),
+			IP:          s.opt.IP,
+		})
 	)
 
 	for i, v := range s.opt.ListIDs {
@@ -276,13 +488,21 @@ func (s *Session) Start() {
 			tx, err = s.im.db.Begin()
 			if err != nil {
 				s.log.Printf("error creating DB transaction: %v", err)
+				incomplete = true
 				continue
 			}
 
-			if s.opt.Mode == ModeSubscribe {
-				stmt = tx.Stmt(s.im.opt.UpsertStmt)
-			} else {
+			switch {
+			case s.opt.Mode == ModeBlocklist:
 				stmt = tx.Stmt(s.im.opt.BlocklistStmt)
+			case s.opt.Merge:
+				stmt = tx.Stmt(s.im.opt.MergeStmt)
+			default:
+				stmt = tx.Stmt(s.im.opt.UpsertStmt)
+			}
+
+			if s.im.opt.AuditStmt != nil {
+				auditStmt = tx.Stmt(s.im.opt.AuditStmt)
 			}
 		}
 
@@ -290,18 +510,56 @@ func (s *Session) Start() {
 		if err != nil {
 			s.log.Printf("error generating UUID: %v", err)
 			tx.Rollback()
-			break
+			s.failImport(err)
+			return
 		}
 
-		if s.opt.Mode == ModeSubscribe {
-			_, err = stmt.Exec(uu, sub.Email, sub.Name, sub.Attribs, pq.Array(listIDs), s.opt.SubStatus, s.opt.Overwrite)
+		if s.opt.Mode == ModeSubscribe && s.opt.Merge {
+			// A row that isn't valid for a new subscriber can only update an existing one.
+			newAttribs := sub.newAttribs
+			if sub.newErr != nil {
+				ok, err := s.subscriberExists(tx, sub.Email)
+				if err != nil {
+					s.log.Printf("error checking subscriber: %v", err)
+					tx.Rollback()
+					s.failImport(err)
+					return
+				}
+				if !ok {
+					s.reject(sub.row, sub.raw, sub.newErr.Error())
+					if cur == 0 {
+						tx.Rollback()
+					}
+					continue
+				}
+				newAttribs = models.JSON{}
+			}
+
+			_, err = stmt.Exec(uu, sub.Email, sub.Name, sub.Attribs, pq.Array(listIDs), s.opt.SubStatus, s.opt.Overwrite, sub.keepName, consent, newAttribs)
+		} else if s.opt.Mode == ModeSubscribe {
+			_, err = stmt.Exec(uu, sub.Email, sub.Name, sub.Attribs, pq.Array(listIDs), s.opt.SubStatus, s.opt.Overwrite, consent)
 		} else if s.opt.Mode == ModeBlocklist {
 			_, err = stmt.Exec(uu, sub.Email, sub.Name, sub.Attribs)
 		}
 		if err != nil {
 			s.log.Printf("error executing insert: %v", err)
 			tx.Rollback()
-			break
+			s.failImport(err)
+			return
+		}
+
+		if auditStmt != nil {
+			action := models.AuditSubscriberImport
+			if s.opt.Mode == ModeBlocklist {
+				action = models.AuditSubscriberBlocklist
+			}
+
+			if _, err := auditStmt.Exec(sub.Email, action, s.opt.Actor, s.opt.IP); err != nil {
+				s.log.Printf("error recording audit log: %v", err)
+				tx.Rollback()
+				s.failImport(err)
+				return
+			}
 		}
 		cur++
 		total++
@@ -311,9 +569,11 @@ func (s *Session) Start() {
 			if err := tx.Commit(); err != nil {
 				tx.Rollback()
 				s.log.Printf("error committing to DB: %v", err)
+				incomplete = true
 			} else {
-				s.im.incrementImportCount(cur)
+				s.incrementImportCount(cur)
 				s.log.Printf("imported %d", total)
+				s.save(false)
 			}
 
 			cur = 0
@@ -322,50 +582,181 @@ func (s *Session) Start() {
 
 	// Queue's closed and there's nothing left to commit.
 	if cur == 0 {
-		s.im.setStatus(StatusFinished)
-		s.log.Printf("imported finished")
-		if _, err := s.im.opt.UpdateListDateStmt.Exec(pq.Array(listIDs)); err != nil {
-			s.log.Printf("error updating lists date: %v", err)
-		}
-		s.im.sendNotif(StatusFinished)
+		s.finishImport(listIDs, incomplete)
 		return
 	}
 
 	// Queue's closed and there are records left to commit.
 	if err := tx.Commit(); err != nil {
 		tx.Rollback()
-		s.im.setStatus(StatusFailed)
+		s.fail(err)
 		s.log.Printf("error committing to DB: %v", err)
-		s.im.sendNotif(StatusFailed)
+		s.sendNotif(StatusFailed)
 		return
 	}
 
-	s.im.incrementImportCount(cur)
-	s.im.setStatus(StatusFinished)
-	s.log.Printf("imported finished")
+	s.incrementImportCount(cur)
+	s.finishImport(listIDs, incomplete)
+}
+
+// finishImport marks an import whose queue has been closed as finished, and runs
+// the full sync, if it's enabled.
+func (s *Session) finishImport(listIDs []int, incomplete bool) {
+	// The session was aborted by an error while loading the file.
+	if s.getStatus() == StatusFailed {
+		s.log.Printf("import failed")
+		s.sendNotif(StatusFailed)
+		return
+	}
+
+	// Only a file that has been fully imported can be synced.
+	if s.opt.FullSync {
+		if incomplete || s.getStatus() == StatusStopping {
+			s.log.Printf("skipping full sync as the file wasn't fully imported")
+		} else {
+			s.fullSync(listIDs)
+		}
+	}
+
+	status := s.complete()
+	s.log.Printf("imported %s", status)
 	if _, err := s.im.opt.UpdateListDateStmt.Exec(pq.Array(listIDs)); err != nil {
 		s.log.Printf("error updating lists date: %v", err)
 	}
-	s.im.sendNotif(StatusFinished)
+	s.sendNotif(status)
+}
+
+// subscriberExists checks if a subscriber with the given e-mail exists, in the trash
+// or not, in the import's transaction.
+func (s *Session) subscriberExists(tx *sql.Tx, email string) (bool, error) {
+	rows, err := tx.Stmt(s.im.opt.ExistingStmt).Query(pq.Array([]string{email}), pq.Array([]int{}))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	return rows.Next(), rows.Err()
+}
+
+// failImport fails a session whose import was broken off mid-file by a DB error.
+// As the file wasn't fully imported, the full sync, if it's enabled, is never
+// run. The rest of the queue is drained so that the loader doesn't block.
+func (s *Session) failImport(err error) {
+	s.fail(err)
+	for range s.subQueue {
+	}
+
+	s.log.Printf("import failed")
+	s.sendNotif(StatusFailed)
+}
+
+// complete sets the status of a session that's run its course to finished,
+// or stopped, if it was being stopped, and returns it.
+func (s *Session) complete() string {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.run.Status == StatusStopping {
+		s.run.Status = StatusStopped
+	} else {
+		s.run.Status = StatusFinished
+	}
+	return s.run.Status
+}
+
+// fullSync unsubscribes the subscriptions on the lists that weren't touched by the
+// import, that is, of subscribers absent from the file. Subscribers in rejected rows
+// are absent as well.
+func (s *Session) fullSync(listIDs []int) {
+	if s.opt.Mode != ModeSubscribe || s.im.opt.UnsubAbsentStmt == nil || len(listIDs) == 0 {
+		return
+	}
+
+	// An empty file would unsubscribe everyone, which is more likely a broken export.
+	if s.stats().Imported == 0 {
+		s.log.Printf("skipping full sync as no subscribers were imported")
+		return
+	}
+
+	var n int
+	if err := s.im.opt.UnsubAbsentStmt.QueryRow(pq.Array(listIDs), s.run.ID,
+		models.AuditSubscriptionUnsub, s.opt.Actor).Scan(&n); err != nil {
+		s.log.Printf("error unsubscribing absent subscribers: %v", err)
+		return
+	}
+
+	s.Lock()
+	s.run.Unsubscribed = n
+	s.Unlock()
+	s.log.Printf("full sync: unsubscribed %d subscriptions absent from the file", n)
+}
+
+// finish records the result of the session in the DB, removes it from the
+// sessions in progress, and releases Wait.
+func (s *Session) finish() {
+	s.save(true)
+	s.im.release(s)
+	close(s.done)
+}
+
+// Wait blocks until the session, started with Start, is over.
+func (s *Session) Wait() {
+	<-s.done
+}
+
+// ID returns the ID of the session.
+func (s *Session) ID() int64 {
+	return s.run.ID
 }
 
-// Stop stops an active import session.
+// Stop sends a signal to stop the session if it's in progress.
 func (s *Session) Stop() {
-	close(s.subQueue)
+	if s.getStatus() != StatusImporting {
+		return
+	}
+
+	select {
+	case s.stop <- true:
+		s.setStatus(StatusStopping)
+	default:
+	}
+}
+
+// closeQueue closes the queue, which ends the session once the subscribers
+// in it are imported. It's safe to call more than once.
+func (s *Session) closeQueue() {
+	s.closeOnce.Do(func() {
+		close(s.subQueue)
+	})
+}
+
+// fail marks the session as failed with the given error.
+func (s *Session) fail(err error) {
+	s.Lock()
+	s.run.Status = StatusFailed
+	s.run.Error = err.Error()
+	s.Unlock()
 }
 
-// ExtractZIP takes a ZIP file's path and extracts all .csv files in it to
-// a temporary directory, and returns the name of the temp directory and the
-// list of extracted .csv files.
+// abort fails the session with the given error while loading a file and
+// closes the queue so that Start and Wait return.
+func (s *Session) abort(err error) {
+	s.fail(err)
+	s.closeQueue()
+}
+
+// ExtractZIP takes a ZIP file's path and extracts all files in it that can be
+// loaded (.csv, .json, .ndjson, .jsonl, .xlsx) to a temporary directory, and
+// returns the name of the temp directory and the list of extracted files.
 func (s *Session) ExtractZIP(srcPath string, maxCSVs int) (string, []string, error) {
-	if s.im.isDone() {
-		return "", nil, ErrIsImporting
+	if s.isDone() {
+		return "", nil, errSessionOver
 	}
 
 	failed := true
 	defer func() {
 		if failed {
-			s.im.setStatus(StatusFailed)
+			s.abort(errors.New("error extracting ZIP"))
 		}
 	}()
 
@@ -392,9 +783,9 @@ func (s *Session) ExtractZIP(srcPath string, maxCSVs int) (string, []string, err
 			continue
 		}
 
-		// Skip files without the .csv extension.
-		if !strings.HasSuffix(strings.ToLower(fName), ".csv") {
-			s.log.Printf("skipping non .csv file '%s'", fName)
+		// Skip files that can't be loaded.
+		if !IsLoadable(fName) {
+			s.log.Printf("skipping unsupported file '%s'", fName)
 			continue
 		}
 
@@ -427,8 +818,8 @@ func (s *Session) ExtractZIP(srcPath string, maxCSVs int) (string, []string, err
 	}
 
 	if len(files) == 0 {
-		s.log.Println("no CSV files found in the ZIP")
-		return "", nil, errors.New("no CSV files found in the ZIP")
+		s.log.Println("no importable files found in the ZIP")
+		return "", nil, errors.New("no importable files found in the ZIP")
 	}
 
 	failed = false
@@ -437,8 +828,8 @@ func (s *Session) ExtractZIP(srcPath string, maxCSVs int) (string, []string, err
 
 // LoadCSV loads a CSV file and validates and imports the subscriber entries in it.
 func (s *Session) LoadCSV(srcPath string, delim rune) error {
-	if s.im.isDone() {
-		return ErrIsImporting
+	if s.isDone() {
+		return errSessionOver
 	}
 
 	// Default status is "failed" in case the function
@@ -446,7 +837,7 @@ func (s *Session) LoadCSV(srcPath string, delim rune) error {
 	failed := true
 	defer func() {
 		if failed {
-			s.im.setStatus(StatusFailed)
+			s.setStatus(StatusFailed)
 		}
 	}()
 
@@ -468,10 +859,10 @@ func (s *Session) LoadCSV(srcPath string, delim rune) error {
 		return errors.New("empty file")
 	}
 
-	s.im.Lock()
+	s.Lock()
 	// Exclude the header from count.
-	s.im.status.Total = numLines - 1
-	s.im.Unlock()
+	s.run.Total = numLines - 1
+	s.Unlock()
 
 	// Rewind, now that we've done a linecount on the same handler.
 	_, _ = f.Seek(0, 0)
@@ -485,7 +876,29 @@ func (s *Session) LoadCSV(srcPath string, delim rune) error {
 		return err
 	}
 
-	hdrKeys := s.mapCSVHeaders(csvHdr, csvHeaders)
+	if err := s.loadTable(srcPath, csvHdr, rd.Read); err != nil {
+		return err
+	}
+
+	failed = false
+	return nil
+}
+
+// loadTable validates and imports the subscriber entries in the rows of a tabular
+// file (CSV, XLSX) with the given header row. next returns the next row and io.EOF
+// when there are no more rows. The queue is closed once all rows are loaded.
+func (s *Session) loadTable(srcPath string, hdr []string, next func() ([]string, error)) error {
+	s.Lock()
+	s.rejectedHdr = hdr
+	s.Unlock()
+
+	hdrKeys := s.mapCSVHeaders(hdr, csvHeaders)
+
+	// In the merge mode, the other columns are attributes.
+	var attrKeys map[string]int
+	if s.opt.Merge {
+		attrKeys = s.mapAttribHeaders(hdr, csvHeaders)
+	}
 	// email is a required header.
 	if _, ok := hdrKeys["email"]; !ok {
 		s.log.Printf("'email' column not found in '%s'", srcPath)
@@ -501,30 +914,29 @@ func (s *Session) LoadCSV(srcPath string, delim rune) error {
 
 		// Check for the stop signal.
 		select {
-		case <-s.im.stop:
-			failed = false
-			close(s.subQueue)
+		case <-s.stop:
+			s.closeQueue()
 			s.log.Println("stop request received")
 			return nil
 		default:
 		}
 
-		cols, err := rd.Read()
+		cols, err := next()
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			if err, ok := err.(*csv.ParseError); ok && err.Err == csv.ErrFieldCount {
-				s.log.Printf("skipping line %d. %v", i, err)
+				s.reject(i, cols, err.Error())
 				continue
 			} else {
-				s.log.Printf("error reading CSV '%s'", err)
+				s.log.Printf("error reading '%s': %v", srcPath, err)
 				return err
 			}
 		}
 
 		lnCols := len(cols)
 		if lnCols < lnHdr {
-			s.log.Printf("skipping line %d. column count (%d) does not match minimum header count (%d)", i, lnCols, lnHdr)
+			s.reject(i, cols, s.im.i18n.Ts("import.invalidColumnCount", "num", fmt.Sprintf("%d", lnCols), "min", fmt.Sprintf("%d", lnHdr)))
 			continue
 		}
 
@@ -542,12 +954,6 @@ func (s *Session) LoadCSV(srcPath string, delim rune) error {
 			sub.Name = v
 		}
 
-		sub, err = s.im.ValidateFields(sub)
-		if err != nil {
-			s.log.Printf("skipping line %d: %s: %v", i, sub.Email, err)
-			continue
-		}
-
 		// JSON attributes.
 		if len(row["attributes"]) > 0 {
 			var (
@@ -561,29 +967,49 @@ func (s *Session) LoadCSV(srcPath string, delim rune) error {
 			}
 		}
 
-		// Send the subscriber to the queue.
-		s.subQueue <- sub
+		if s.opt.Merge {
+			sub.Attribs = s.mergeAttribCols(sub.Attribs, cols, attrKeys)
+		}
+
+		s.enqueue(i, sub, cols)
 	}
 
-	close(s.subQueue)
-	failed = false
+	s.closeQueue()
 	return nil
 }
 
-// Stop sends a signal to stop the existing import.
-func (im *Importer) Stop() {
-	if im.getStatus() != StatusImporting {
-		im.Lock()
-		im.status = Status{Status: StatusNone}
-		im.Unlock()
+// enqueue validates a subscriber entry loaded from a file and sends it to the queue
+// for importing, or rejects it. raw is the entry's raw row for the rejected rows report.
+func (s *Session) enqueue(row int, sub SubReq, raw []string) {
+	sub.row, sub.raw = row, raw
+
+	var err error
+	if s.opt.Merge {
+		sub.keepName = strings.TrimSpace(sub.Name) == ""
+		sub, err = s.im.validateMergeFields(sub)
+	} else {
+		sub, err = s.im.ValidateFields(sub)
+	}
+	if err != nil {
+		s.reject(row, raw, err.Error())
 		return
 	}
 
-	select {
-	case im.stop <- true:
-		im.setStatus(StatusStopping)
-	default:
+	// Send the subscriber to the queue.
+	s.subQueue <- sub
+}
+
+// reject logs a row that's skipped and records it for the rejected rows report.
+func (s *Session) reject(row int, cols []string, reason string) {
+	s.log.Printf("skipping line %d: %s", row, reason)
+
+	s.Lock()
+	s.run.Rejected++
+	if len(s.rejectedRows) < maxRejectedRows {
+		s.rejectedRows = append(s.rejectedRows,
+			append([]string{fmt.Sprintf("%d", row), reason}, cols...))
 	}
+	s.Unlock()
 }
 
 // SanitizeEmail validates and sanitizes an e-mail string and returns the lowercased,
@@ -629,8 +1055,49 @@ func (im *Importer) SanitizeEmail(email string) (string, error) {
 	return em.Address, nil
 }
 
-// ValidateFields validates incoming subscriber field values and returns sanitized fields.
+// ValidateFields validates incoming subscriber field values and attributes
+// and returns sanitized fields.
 func (im *Importer) ValidateFields(s SubReq) (SubReq, error) {
+	s, err := im.SanitizeFields(s)
+	if err != nil {
+		return s, err
+	}
+
+	attr, err := im.opt.Attribs.Validate(s.Attribs)
+	if err != nil {
+		return s, err
+	}
+	s.Attribs = attr
+
+	return s, nil
+}
+
+// validateMergeFields validates incoming subscriber field values and the partial
+// attributes that are to be merged into existing subscribers' attributes. The
+// attributes are also validated against the full schema for creating new subscribers.
+func (im *Importer) validateMergeFields(s SubReq) (SubReq, error) {
+	s, err := im.SanitizeFields(s)
+	if err != nil {
+		return s, err
+	}
+
+	s.newAttribs, s.newErr = im.opt.Attribs.Validate(s.Attribs)
+	if s.newAttribs == nil {
+		s.newAttribs = models.JSON{}
+	}
+
+	attr, err := im.opt.Attribs.ValidatePartial(s.Attribs)
+	if err != nil {
+		return s, err
+	}
+	s.Attribs = attr
+
+	return s, nil
+}
+
+// SanitizeFields validates and sanitizes the e-mail and name of a subscriber,
+// deriving a name from the e-mail if there isn't one.
+func (im *Importer) SanitizeFields(s SubReq) (SubReq, error) {
 	if len(s.Email) > 1000 {
 		return s, errors.New(im.i18n.T("subscribers.invalidEmail"))
 	}
@@ -668,7 +1135,9 @@ func (s *Session) mapCSVHeaders(csvHdrs []string, knownHdrs map[string]bool) map
 		// Clean the string of non-ASCII characters (BOM etc.).
 		h := regexCleanStr.ReplaceAllString(h, "")
 		if _, ok := knownHdrs[h]; !ok {
-			s.log.Printf("ignoring unknown header '%s'", h)
+			if !s.opt.Merge {
+				s.log.Printf("ignoring unknown header '%s'", h)
+			}
 			continue
 		}
 		hdrKeys[h] = i
@@ -677,6 +1146,43 @@ func (s *Session) mapCSVHeaders(csvHdrs []string, knownHdrs map[string]bool) map
 	return hdrKeys
 }
 
+// mapAttribHeaders returns the headers obtained from a CSV file that aren't in the
+// map of known headers, which are imported as attributes, mapped by their position.
+func (s *Session) mapAttribHeaders(csvHdrs []string, knownHdrs map[string]bool) map[string]int {
+	hdrKeys := make(map[string]int)
+	for i, h := range csvHdrs {
+		h := strings.TrimSpace(regexCleanStr.ReplaceAllString(h, ""))
+		if _, ok := knownHdrs[h]; ok || h == "" {
+			continue
+		}
+
+		s.log.Printf("importing header '%s' as an attribute", h)
+		hdrKeys[h] = i
+	}
+
+	return hdrKeys
+}
+
+// mergeAttribCols sets the values of the attribute columns in a CSV row on the
+// row's attributes. Empty cells are skipped or cleared (set to null) based on the
+// session's EmptyCells option.
+func (s *Session) mergeAttribCols(attr models.JSON, cols []string, attrKeys map[string]int) models.JSON {
+	if attr == nil {
+		attr = make(models.JSON, len(attrKeys))
+	}
+
+	for key, i := range attrKeys {
+		v := strings.TrimSpace(cols[i])
+		if v != "" {
+			attr[key] = v
+		} else if s.opt.EmptyCells == EmptyCellsClear {
+			attr[key] = nil
+		}
+	}
+
+	return attr
+}
+
 // countLines counts the number of line breaks in a file. This does not
 // distinguish between "blank" and non "blank" lines.
 // Credit: https://stackoverflow.com/a/24563853
@@ -0,0 +1,322 @@
+package subimporter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+const (
+	// sourceFetchTimeout is the timeout for downloading the file of a URL source.
+	sourceFetchTimeout = time.Minute * 10
+
+	// Subdirectories of directory sources that files are moved to once imported.
+	sourceDirProcessed = "processed"
+	sourceDirFailed    = "failed"
+)
+
+// sourceContentTypes maps the content types of the files of URL sources without
+// a known extension to extensions.
+var sourceContentTypes = map[string]string{
+	"text/csv":             ".csv",
+	"application/json":     ".json",
+	"application/x-ndjson": ".ndjson",
+	"application/zip":      ".zip",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": ".xlsx",
+}
+
+// RunSource imports the files of an import source. The file of a URL source is
+// downloaded and imported. The importable and ZIP files in a directory source are
+// imported one after the other, oldest first, and moved to its processed/ or failed/
+// subdirectory. It blocks until the imports are over. If the source is already
+// being run, eg: when a run takes longer than its schedule, the run is skipped.
+func (im *Importer) RunSource(src models.ImportSource) error {
+	im.Lock()
+	if im.runningSrcs[src.Name] {
+		im.Unlock()
+		return ErrSourceRunning
+	}
+	im.runningSrcs[src.Name] = true
+	im.Unlock()
+
+	defer func() {
+		im.Lock()
+		delete(im.runningSrcs, src.Name)
+		im.Unlock()
+	}()
+
+	switch src.Type {
+	case models.ImportSourceURL:
+		return im.runURLSource(src)
+	case models.ImportSourceDir:
+		return im.runDirSource(src)
+	}
+
+	return fmt.Errorf("unknown import source type '%s'", src.Type)
+}
+
+// runURLSource downloads and imports the file of a URL source.
+func (im *Importer) runURLSource(src models.ImportSource) error {
+	filename := src.URL
+	if u, err := url.Parse(src.URL); err == nil {
+		filename = path.Base(u.Path)
+	}
+
+	fPath, err := fetchSourceFile(src)
+	if err != nil {
+		im.recordFailedRun(src, filename, err)
+		return err
+	}
+	defer os.Remove(fPath)
+
+	return im.runSourceFile(src, fPath, filename)
+}
+
+// SourceDir returns the absolute path of the directory of a directory source. Relative
+// directories are relative to the import source root (SourceDirRoot), and directories
+// outside the root are rejected.
+func (im *Importer) SourceDir(dir string) (string, error) {
+	if im.opt.SourceDirRoot == "" {
+		return "", errors.New("directory import sources are disabled as there's no import source root (app.import_source_root) in the config")
+	}
+
+	root, err := filepath.Abs(im.opt.SourceDirRoot)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(root, dir)
+	}
+	dir = filepath.Clean(dir)
+
+	if !isSubDir(root, dir) {
+		return "", fmt.Errorf("directory '%s' is outside the import source root '%s'", dir, root)
+	}
+
+	return dir, nil
+}
+
+// resolveSourceDir returns the directory of a directory source with symlinks
+// resolved, and checks that it's still within the import source root.
+func (im *Importer) resolveSourceDir(dir string) (string, error) {
+	dir, err := im.SourceDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	root, err := filepath.EvalSymlinks(im.opt.SourceDirRoot)
+	if err != nil {
+		return "", err
+	}
+	if root, err = filepath.Abs(root); err != nil {
+		return "", err
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return "", err
+	}
+
+	if !isSubDir(root, dir) {
+		return "", fmt.Errorf("directory '%s' is outside the import source root '%s'", dir, root)
+	}
+
+	return dir, nil
+}
+
+// runDirSource imports the files in the directory of a directory source.
+func (im *Importer) runDirSource(src models.ImportSource) error {
+	srcDir, err := im.resolveSourceDir(src.Directory)
+	if err != nil {
+		im.recordFailedRun(src, src.Directory, err)
+		return err
+	}
+
+	entries, err := os.ReadDir(srcDir)
+	if err != nil {
+		im.recordFailedRun(src, src.Directory, err)
+		return err
+	}
+
+	type file struct {
+		name  string
+		mTime time.Time
+	}
+	files := make([]file, 0, len(entries))
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		if !IsLoadable(e.Name()) && strings.ToLower(filepath.Ext(e.Name())) != ".zip" {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, file{name: e.Name(), mTime: info.ModTime()})
+	}
+
+	// Import the files in the order they were dropped in.
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].mTime.Before(files[j].mTime)
+	})
+
+	var errs []error
+	for _, f := range files {
+		fPath := filepath.Join(srcDir, f.name)
+
+		dest := sourceDirProcessed
+		if err := im.runSourceFile(src, fPath, f.name); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.name, err))
+			dest = sourceDirFailed
+		}
+
+		// Move the file out of the way so that it's not imported again. The subdirectory
+		// shouldn't be a symlink that could lead outside the source directory.
+		dir := filepath.Join(srcDir, dest)
+		if fi, err := os.Lstat(dir); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			errs = append(errs, fmt.Errorf("'%s' is a symlink", dir))
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := os.Rename(fPath, filepath.Join(dir, f.name)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// runSourceFile imports a file of an import source and waits for the import to be over.
+func (im *Importer) runSourceFile(src models.ImportSource, fPath, filename string) error {
+	sess, err := im.NewSession(SessionOpt{
+		Filename:   filename,
+		Mode:       src.Mode,
+		SubStatus:  src.SubStatus,
+		Overwrite:  src.Overwrite,
+		Delim:      src.Delim,
+		ListIDs:    src.ListIDs,
+		Sheet:      src.Sheet,
+		Merge:      src.Merge,
+		EmptyCells: src.EmptyCells,
+		FullSync:   src.FullSync,
+		Source:     src.Name,
+		Actor:      src.Name,
+	})
+	if err != nil {
+		im.recordFailedRun(src, filename, err)
+		return err
+	}
+	go sess.Start()
+
+	delim := ','
+	if len(src.Delim) == 1 {
+		delim = rune(src.Delim[0])
+	}
+
+	if IsLoadable(fPath) {
+		_ = sess.Load(fPath, delim)
+	} else {
+		// Like uploads, only the first file in a ZIP is imported.
+		dir, files, err := sess.ExtractZIP(fPath, 1)
+		if err == nil {
+			_ = sess.Load(filepath.Join(dir, files[0]), delim)
+			defer os.RemoveAll(dir)
+		}
+	}
+	sess.Wait()
+
+	if st := sess.stats(); st.Status == StatusFailed {
+		if st.Error != "" {
+			return errors.New(st.Error)
+		}
+		return errors.New("import failed")
+	}
+
+	return nil
+}
+
+// recordFailedRun records a run of an import source that failed before its file
+// could be loaded, eg: when it couldn't be fetched, as a failed session.
+func (im *Importer) recordFailedRun(src models.ImportSource, filename string, runErr error) {
+	var (
+		id        int64
+		startedAt time.Time
+	)
+	if err := im.opt.InsertRunStmt.QueryRow(src.Name, filename, false).Scan(&id, &startedAt); err != nil {
+		return
+	}
+	_, _ = im.opt.UpdateRunStmt.Exec(id, StatusFailed, 0, 0, 0, 0, 0, 0, 0, runErr.Error(), "", true)
+}
+
+// fetchSourceFile downloads the file of a URL source to a temporary file and returns
+// its path. The file's extension is derived from the URL, or the content type.
+func fetchSourceFile(src models.ImportSource) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, src.URL, nil)
+	if err != nil {
+		return "", err
+	}
+	for _, h := range src.Headers {
+		for k, v := range h {
+			req.Header.Set(k, v)
+		}
+	}
+
+	client := &http.Client{Timeout: sourceFetchTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error fetching '%s': %s", src.URL, resp.Status)
+	}
+
+	ext := strings.ToLower(path.Ext(resp.Request.URL.Path))
+	if !IsLoadable(ext) && ext != ".zip" {
+		ext = ".csv"
+		if t, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil {
+			if e, ok := sourceContentTypes[t]; ok {
+				ext = e
+			}
+		}
+	}
+
+	out, err := os.CreateTemp("", "listmonk*"+ext)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+
+	return out.Name(), nil
+}
+
+// isSubDir checks if the (absolute, clean) path dir is root or a directory in it.
+func isSubDir(root, dir string) bool {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
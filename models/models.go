@@ -52,6 +52,7 @@ const (
 	// List.
 	ListTypePrivate = "private"
 	ListTypePublic  = "public"
+	ListTypeDynamic = "dynamic"
 	ListOptinSingle = "single"
 	ListOptinDouble = "double"
 
@@ -86,6 +87,73 @@ const (
 	// Templates.
 	TemplateTypeCampaign = "campaign"
 	TemplateTypeTx       = "tx"
+
+	// Transactional message recipient modes.
+	TxSubscriberModeDefault  = "default"
+	TxSubscriberModeExternal = "external"
+
+	// Subscriber attribute types.
+	AttribTypeString  = "string"
+	AttribTypeNumber  = "number"
+	AttribTypeBoolean = "boolean"
+	AttribTypeDate    = "date"
+	AttribTypeEnum    = "enum"
+
+	// Audit log sources.
+	AuditSourceAPI    = "api"
+	AuditSourcePublic = "public"
+	AuditSourceOptin  = "optin"
+	AuditSourceImport = "import"
+	AuditSourceSystem = "system"
+
+	// Subscription consent sources.
+	ConsentSourceForm   = "form"
+	ConsentSourceAPI    = "api"
+	ConsentSourceImport = "import"
+	ConsentSourceSystem = "system"
+
+	// Audit log actions.
+	AuditSubscriberCreate    = "subscriber.create"
+	AuditSubscriberUpdate    = "subscriber.update"
+	AuditSubscriberBlocklist = "subscriber.blocklist"
+	AuditSubscriberDelete    = "subscriber.delete"
+	AuditSubscriberRestore   = "subscriber.restore"
+	AuditSubscriberPurge     = "subscriber.purge"
+	AuditSubscriberMerge     = "subscriber.merge"
+	AuditSubscriberImport    = "subscriber.import"
+	AuditSubscriptionAdd     = "subscription.add"
+	AuditSubscriptionDelete  = "subscription.delete"
+	AuditSubscriptionUnsub   = "subscription.unsubscribe"
+	AuditSubscriptionConfirm = "subscription.confirm"
+	AuditListCreate          = "list.create"
+	AuditListUpdate          = "list.update"
+	AuditListDelete          = "list.delete"
+
+	// Sunset policy actions.
+	SunsetActionUnsubscribe = "unsubscribe"
+	SunsetActionMove        = "move"
+
+	// Import source types.
+	ImportSourceURL = "url"
+	ImportSourceDir = "dir"
+
+	// JSON patch (RFC 6902) operations for bulk attribute updates.
+	AttribPatchAdd     = "add"
+	AttribPatchRemove  = "remove"
+	AttribPatchReplace = "replace"
+	AttribPatchMove    = "move"
+	AttribPatchCopy    = "copy"
+	AttribPatchTest    = "test"
+
+	// Background job statuses.
+	JobStatusRunning  = "running"
+	JobStatusFinished = "finished"
+	JobStatusFailed   = "failed"
+
+	// Subscriber export formats.
+	ExportFormatCSV    = "csv"
+	ExportFormatNDJSON = "ndjson"
+	ExportFormatXLSX   = "xlsx"
 )
 
 // Headers represents an array of string maps used to represent SMTP, HTTP headers etc.
@@ -165,6 +233,13 @@ type Subscriber struct {
 	Attribs JSON           `db:"attribs" json:"attribs"`
 	Status  string         `db:"status" json:"status"`
 	Lists   types.JSONText `db:"lists" json:"lists"`
+
+	// Computed periodically from the subscriber's views, clicks, and e-mail events.
+	EngagementScore float64   `db:"engagement_score" json:"engagement_score"`
+	LastEngagedAt   null.Time `db:"last_engaged_at" json:"last_engaged_at"`
+
+	// Set when the subscriber is in the trash.
+	DeletedAt null.Time `db:"deleted_at" json:"deleted_at"`
 }
 type subLists struct {
 	SubscriberID int            `db:"subscriber_id"`
@@ -200,6 +275,25 @@ type Subscription struct {
 	SubscriptionStatus    null.String     `db:"subscription_status" json:"subscription_status"`
 	SubscriptionCreatedAt null.String     `db:"subscription_created_at" json:"subscription_created_at"`
 	Meta                  json.RawMessage `db:"meta" json:"meta"`
+	Consent               json.RawMessage `db:"subscription_consent" json:"consent"`
+}
+
+// SubscriptionConsent is the proof-of-consent record stored against a subscription.
+// The version of the list's consent text and the double opt-in confirmation
+// time are added to it by the database.
+type SubscriptionConsent struct {
+	// Source is how the subscription was given. One of the ConsentSource* values.
+	Source string `json:"source"`
+
+	// SourceName is the admin user (api) or the file name (import).
+	SourceName  string    `json:"source_name,omitempty"`
+	ConsentedAt time.Time `json:"consented_at"`
+	IP          string    `json:"ip,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+
+	// CopiedFrom is the list the subscription was copied from by a list operation
+	// (merge, split, sample), with the consent record given on that list.
+	CopiedFrom int `json:"copied_from,omitempty"`
 }
 
 // SubscriberExportProfile represents a subscriber's collated data in JSON for export.
@@ -209,11 +303,55 @@ type SubscriberExportProfile struct {
 	Subscriptions json.RawMessage `db:"subscriptions" json:"subscriptions,omitempty"`
 	CampaignViews json.RawMessage `db:"campaign_views" json:"campaign_views,omitempty"`
 	LinkClicks    json.RawMessage `db:"link_clicks" json:"link_clicks,omitempty"`
+	Audit         json.RawMessage `db:"audit" json:"audit,omitempty"`
 }
 
 // JSON is the wrapper for reading and writing arbitrary JSONB fields from the DB.
 type JSON map[string]interface{}
 
+// AttribDef represents the definition of a subscriber attribute in the
+// admin-defined attribute schema.
+type AttribDef struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Enum     []string    `json:"enum"`
+	Required bool        `json:"required"`
+	Default  interface{} `json:"default"`
+
+	// Whether subscribers can edit the attribute on the public preferences page.
+	Public bool `json:"public"`
+}
+
+// AttribsUpdate represents an update to the attributes of many subscribers, either as
+// a JSON merge patch (RFC 7396) or as a list of JSON patch (RFC 6902) operations.
+type AttribsUpdate struct {
+	Merge map[string]interface{} `json:"merge,omitempty"`
+	Patch []AttribPatchOp        `json:"patch,omitempty"`
+}
+
+// AttribPatchOp represents a JSON patch (RFC 6902) operation on subscriber attributes.
+type AttribPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value"`
+}
+
+// JobProgress represents the progress of a background job on subscribers that's
+// published on the event stream.
+type JobProgress struct {
+	ID      string `json:"id"`
+	Job     string `json:"job"`
+	Status  string `json:"status"`
+	Total   int    `json:"total"`
+	Done    int    `json:"done"`
+	Updated int    `json:"updated"`
+	Failed  int    `json:"failed"`
+
+	// URL of the job's output, eg: an exported file.
+	URL string `json:"url,omitempty"`
+}
+
 // StringIntMap is used to define DB Scan()s.
 type StringIntMap map[string]int
 
@@ -231,6 +369,202 @@ type SubscriberExport struct {
 	Status  string `db:"status" json:"status"`
 }
 
+// SegmentFilter is a node in a structured subscriber query. A node is either a
+// group of child nodes combined with And, Or, or Not, or a single condition that
+// compares a Field with a Value using Op, for instance,
+// {"field": "attribs.city", "op": "eq", "value": "Bengaluru"}.
+type SegmentFilter struct {
+	And []SegmentFilter `json:"and,omitempty"`
+	Or  []SegmentFilter `json:"or,omitempty"`
+	Not *SegmentFilter  `json:"not,omitempty"`
+
+	Field string      `json:"field,omitempty"`
+	Op    string      `json:"op,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+
+	// Optional qualifiers for list membership and engagement conditions.
+	SubscriptionStatus string `json:"subscription_status,omitempty"`
+	CampaignIDs        []int  `json:"campaign_ids,omitempty"`
+	Within             string `json:"within,omitempty"`
+}
+
+// AuditMeta represents who made a change and how, for recording in the audit log.
+type AuditMeta struct {
+	// Actor is the admin user who made the change. It's empty for changes made
+	// by subscribers on public pages and by the system.
+	Actor     string
+	Source    string
+	IP        string
+	UserAgent string
+}
+
+// AuditEntry represents an entry in the audit log of changes to subscribers,
+// subscriptions, and lists.
+type AuditEntry struct {
+	ID           int64          `db:"id" json:"id"`
+	SubscriberID null.Int       `db:"subscriber_id" json:"subscriber_id"`
+	ListID       null.Int       `db:"list_id" json:"list_id"`
+	Action       string         `db:"action" json:"action"`
+	Source       string         `db:"source" json:"source"`
+	Actor        string         `db:"actor" json:"actor"`
+	IP           string         `db:"ip" json:"ip"`
+	Before       types.JSONText `db:"before" json:"before"`
+	After        types.JSONText `db:"after" json:"after"`
+	CreatedAt    null.Time      `db:"created_at" json:"created_at"`
+
+	// Pseudofield for getting the total number of entries
+	// in searches and queries.
+	Total int `db:"total" json:"-"`
+}
+
+// SunsetPolicy represents the policy for unsubscribing subscribers who have not
+// engaged with any campaign in a given number of days.
+type SunsetPolicy struct {
+	Days   int    `json:"days"`
+	Action string `json:"action"`
+
+	// Dormant list that subscribers are moved to with SunsetActionMove.
+	ListID int `json:"list_id"`
+}
+
+// ImportSource represents a source of subscribers that's imported on a schedule, either
+// a file fetched from an HTTP(S) URL or the files dropped into a local directory.
+type ImportSource struct {
+	UUID    string `json:"uuid"`
+	Enabled bool   `json:"enabled"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Cron    string `json:"cron"`
+
+	// URL source options. Headers are sent with the request, eg: for auth.
+	URL     string              `json:"url"`
+	Headers []map[string]string `json:"headers"`
+
+	// Directory source options.
+	Directory string `json:"directory"`
+
+	// Import options.
+	Mode       string `json:"mode"`
+	SubStatus  string `json:"subscription_status"`
+	Overwrite  bool   `json:"overwrite"`
+	Merge      bool   `json:"merge"`
+	EmptyCells string `json:"empty_cells"`
+	Delim      string `json:"delim"`
+	Sheet      string `json:"sheet"`
+	ListIDs    []int  `json:"lists"`
+
+	// FullSync unsubscribes the subscribers on the lists who are absent
+	// from the imported file.
+	FullSync bool `json:"full_sync"`
+}
+
+// ImportRun represents an import session of an uploaded file or a file from an import source.
+type ImportRun struct {
+	ID           int64     `db:"id" json:"id"`
+	Source       string    `db:"source" json:"source"`
+	Filename     string    `db:"filename" json:"filename"`
+	Status       string    `db:"status" json:"status"`
+	DryRun       bool      `db:"dry_run" json:"dry_run"`
+	Total        int       `db:"total" json:"total"`
+	Imported     int       `db:"imported" json:"imported"`
+	Rejected     int       `db:"rejected" json:"rejected"`
+	Unsubscribed int       `db:"unsubscribed" json:"unsubscribed"`
+	Error        string    `db:"error" json:"error"`
+	StartedAt    null.Time `db:"started_at" json:"started_at"`
+	FinishedAt   null.Time `db:"finished_at" json:"finished_at"`
+
+	// Classification of the rows in a dry run.
+	New       int `db:"new" json:"new"`
+	Updated   int `db:"updated" json:"updated"`
+	Unchanged int `db:"unchanged" json:"unchanged"`
+
+	// Pseudofield for getting the total number of runs.
+	TotalRuns int `db:"total_runs" json:"-"`
+}
+
+// ExportJob represents a background subscriber export whose file is written
+// to the media store.
+type ExportJob struct {
+	ID           int64          `db:"id" json:"id"`
+	UUID         string         `db:"uuid" json:"uuid"`
+	Status       string         `db:"status" json:"status"`
+	Format       string         `db:"format" json:"format"`
+	Fields       pq.StringArray `db:"fields" json:"fields"`
+	IncludeLists bool           `db:"include_lists" json:"include_lists"`
+	Filename     string         `db:"filename" json:"filename"`
+	Exported     int            `db:"exported" json:"exported"`
+	Error        string         `db:"error" json:"error"`
+	CreatedBy    string         `db:"created_by" json:"created_by"`
+	CreatedAt    null.Time      `db:"created_at" json:"created_at"`
+	FinishedAt   null.Time      `db:"finished_at" json:"finished_at"`
+
+	// URL of the exported file in the media store.
+	URL string `db:"-" json:"url"`
+
+	// Pseudofield for getting the total number of jobs.
+	Total int `db:"total" json:"-"`
+}
+
+// SubscriberExportLists represents the subscriptions of a subscriber in an export.
+type SubscriberExportLists struct {
+	SubscriberID int             `db:"subscriber_id"`
+	Lists        json.RawMessage `db:"lists"`
+}
+
+// SunsetSubscriber represents a subscriber that the sunset policy applies to.
+type SunsetSubscriber struct {
+	Subscriber
+
+	// Pseudofield for getting the total number of subscribers
+	// in searches and queries.
+	Total int `db:"total" json:"-"`
+}
+
+// TrashedSubscriber represents a subscriber in the trash.
+type TrashedSubscriber struct {
+	Subscriber
+
+	// Pseudofield for getting the total number of subscribers
+	// in searches and queries.
+	Total int `db:"total" json:"-"`
+}
+
+// DuplicateSubscribers represents a group of subscribers that are likely duplicates
+// of each other.
+type DuplicateSubscribers struct {
+	// Match is what the subscribers matched on, eg: email or attribs.$name.
+	Match string `db:"match" json:"match"`
+
+	// Key is the normalized value that the subscribers have in common.
+	Key         string         `db:"key" json:"key"`
+	Subscribers types.JSONText `db:"subscribers" json:"subscribers"`
+
+	// Pseudofield for getting the total number of groups
+	// in searches and queries.
+	Total int `db:"total" json:"-"`
+}
+
+// Segment represents a named, saved subscriber query.
+type Segment struct {
+	Base
+
+	UUID   string         `db:"uuid" json:"uuid"`
+	Name   string         `db:"name" json:"name"`
+	Query  string         `db:"query" json:"query"`
+	Filter *SegmentFilter `db:"filter" json:"filter"`
+
+	// Cached count of the subscribers matching the segment.
+	SubscriberCount int       `db:"subscriber_count" json:"subscriber_count"`
+	CountedAt       null.Time `db:"counted_at" json:"counted_at"`
+
+	// Pseudofield for getting the total number of segments
+	// in searches and queries.
+	Total int `db:"total" json:"-"`
+
+	// CampaignID is joined in when snapshotting campaign segments.
+	CampaignID int `db:"campaign_id" json:"-"`
+}
+
 // List represents a mailing list.
 type List struct {
 	Base
@@ -241,15 +575,34 @@ type List struct {
 	Optin            string         `db:"optin" json:"optin"`
 	Tags             pq.StringArray `db:"tags" json:"tags"`
 	Description      string         `db:"description" json:"description"`
+	Query            string         `db:"query" json:"query"`
 	SubscriberCount  int            `db:"-" json:"subscriber_count"`
 	SubscriberCounts StringIntMap   `db:"subscriber_statuses" json:"subscriber_statuses"`
 	SubscriberID     int            `db:"subscriber_id" json:"-"`
 
+	// Optional defaults for campaigns that target the list.
+	FromEmail  string   `db:"from_email" json:"from_email"`
+	TemplateID null.Int `db:"template_id" json:"template_id"`
+	Messenger  string   `db:"messenger" json:"messenger"`
+	ReplyTo    string   `db:"reply_to" json:"reply_to"`
+	Headers    Headers  `db:"headers" json:"headers"`
+
+	// Consent text shown on subscription forms and its current version.
+	ConsentText    string `db:"consent_text" json:"consent_text"`
+	ConsentVersion int    `db:"consent_version" json:"consent_version"`
+
+	// Double opt-in reminders (days after subscribing) and expiry (0 = never).
+	OptinReminderDays pq.Int64Array `db:"optin_reminder_days" json:"optin_reminder_days"`
+	OptinExpiryDays   int           `db:"optin_expiry_days" json:"optin_expiry_days"`
+
 	// This is only relevant when querying the lists of a subscriber.
 	SubscriptionStatus    string    `db:"subscription_status" json:"subscription_status,omitempty"`
 	SubscriptionCreatedAt null.Time `db:"subscription_created_at" json:"subscription_created_at,omitempty"`
 	SubscriptionUpdatedAt null.Time `db:"subscription_updated_at" json:"subscription_updated_at,omitempty"`
 
+	// This is only relevant when snapshotting the dynamic lists of campaigns.
+	CampaignID int `db:"campaign_id" json:"-"`
+
 	// Pseudofield for getting the total number of subscribers
 	// in searches and queries.
 	Total int `db:"total" json:"-"`
@@ -313,6 +666,9 @@ type CampaignMeta struct {
 	Lists types.JSONText `db:"lists" json:"lists"`
 	Media types.JSONText `db:"media" json:"media"`
 
+	// List of {segment_id, name} pairs maintained in campaign_segments like lists.
+	Segments types.JSONText `db:"segments" json:"segments"`
+
 	StartedAt null.Time `db:"started_at" json:"started_at"`
 	ToSend    int       `db:"to_send" json:"to_send"`
 	Sent      int       `db:"sent" json:"sent"`
@@ -329,6 +685,20 @@ type CampaignStats struct {
 	NetRate   int       `json:"net_rate"`
 }
 
+// ListDailyStats represents the growth and churn of a list on a day.
+type ListDailyStats struct {
+	Date            time.Time `db:"date" json:"date"`
+	Subscriptions   int       `db:"subscriptions" json:"subscriptions"`
+	Confirmations   int       `db:"confirmations" json:"confirmations"`
+	Unsubscriptions int       `db:"unsubscriptions" json:"unsubscriptions"`
+	Bounces         int       `db:"bounces" json:"bounces"`
+	NetGrowth       int       `db:"net_growth" json:"net_growth"`
+	Total           int       `db:"total" json:"total"`
+	OptinPending    int       `db:"optin_pending" json:"optin_pending"`
+	OptinReminded   int       `db:"optin_reminded" json:"optin_reminded"`
+	OptinExpired    int       `db:"optin_expired" json:"optin_expired"`
+}
+
 type CampaignAnalyticsCount struct {
 	CampaignID int       `db:"campaign_id" json:"campaign_id"`
 	Count      int       `db:"count" json:"count"`
@@ -413,6 +783,12 @@ type TxMessage struct {
 	SubscriberEmails []string `json:"subscriber_emails"`
 	SubscriberIDs    []int    `json:"subscriber_ids"`
 
+	// SubscriberMode decides how recipients are resolved. In the default mode,
+	// recipients are looked up in the subscribers table. In the external mode,
+	// Recipients are messaged directly without being stored as subscribers.
+	SubscriberMode string        `json:"subscriber_mode"`
+	Recipients     []TxRecipient `json:"recipients"`
+
 	// Deprecated.
 	SubscriberEmail string `json:"subscriber_email"`
 	SubscriberID    int    `json:"subscriber_id"`
@@ -433,6 +809,14 @@ type TxMessage struct {
 	SubjectTpl *txttpl.Template   `json:"-"`
 }
 
+// TxRecipient represents a raw recipient of a transactional message
+// who is not (necessarily) a subscriber.
+type TxRecipient struct {
+	Email   string `json:"email"`
+	Name    string `json:"name"`
+	Attribs JSON   `json:"attribs"`
+}
+
 // markdown is a global instance of Markdown parser and renderer.
 var markdown = goldmark.New(
 	goldmark.WithParserOptions(
@@ -542,6 +926,7 @@ func (camps Campaigns) LoadStats(stmt *sqlx.Stmt) error {
 	for i, c := range meta {
 		if c.CampaignID == camps[i].ID {
 			camps[i].Lists = c.Lists
+			camps[i].Segments = c.Segments
 			camps[i].Views = c.Views
 			camps[i].Clicks = c.Clicks
 			camps[i].Bounces = c.Bounces
@@ -762,3 +1147,17 @@ func (h Headers) Value() (driver.Value, error) {
 
 	return "[]", nil
 }
+
+// Scan unmarshals a JSONB SegmentFilter from the DB.
+func (f *SegmentFilter) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case []byte:
+		return json.Unmarshal(src, f)
+	case string:
+		return json.Unmarshal([]byte(src), f)
+	case nil:
+		return nil
+	}
+
+	return fmt.Errorf("could not not decode type %T -> %T", src, f)
+}
@@ -16,9 +16,12 @@ type Queries struct {
 
 	InsertSubscriber                *sqlx.Stmt `query:"insert-subscriber"`
 	UpsertSubscriber                *sqlx.Stmt `query:"upsert-subscriber"`
+	UpsertMergeSubscriber           *sqlx.Stmt `query:"upsert-merge-subscriber"`
 	UpsertBlocklistSubscriber       *sqlx.Stmt `query:"upsert-blocklist-subscriber"`
+	GetImportSubscribers            *sqlx.Stmt `query:"get-import-subscribers"`
 	GetSubscriber                   *sqlx.Stmt `query:"get-subscriber"`
 	GetSubscribersByEmails          *sqlx.Stmt `query:"get-subscribers-by-emails"`
+	GetSuppressedEmails             *sqlx.Stmt `query:"get-suppressed-emails"`
 	GetSubscriberLists              *sqlx.Stmt `query:"get-subscriber-lists"`
 	GetSubscriptions                *sqlx.Stmt `query:"get-subscriptions"`
 	GetSubscriberListsLazy          *sqlx.Stmt `query:"get-subscriber-lists-lazy"`
@@ -28,13 +31,45 @@ type Queries struct {
 	AddSubscribersToLists           *sqlx.Stmt `query:"add-subscribers-to-lists"`
 	DeleteSubscriptions             *sqlx.Stmt `query:"delete-subscriptions"`
 	DeleteUnconfirmedSubscriptions  *sqlx.Stmt `query:"delete-unconfirmed-subscriptions"`
+	GetDueOptinReminders            *sqlx.Stmt `query:"get-due-optin-reminders"`
+	UpdateOptinReminders            *sqlx.Stmt `query:"update-optin-reminders"`
+	ExpireUnconfirmedSubscriptions  *sqlx.Stmt `query:"expire-unconfirmed-subscriptions"`
 	ConfirmSubscriptionOptin        *sqlx.Stmt `query:"confirm-subscription-optin"`
 	UnsubscribeSubscribersFromLists *sqlx.Stmt `query:"unsubscribe-subscribers-from-lists"`
 	DeleteSubscribers               *sqlx.Stmt `query:"delete-subscribers"`
+	TrashSubscribers                *sqlx.Stmt `query:"trash-subscribers"`
+	QueryTrashedSubscribers         *sqlx.Stmt `query:"query-trashed-subscribers"`
+	RestoreSubscribers              *sqlx.Stmt `query:"restore-subscribers"`
+	PurgeTrashedSubscribers         *sqlx.Stmt `query:"purge-trashed-subscribers"`
+	RestoreTrashedSubscriberByEmail *sqlx.Stmt `query:"restore-trashed-subscriber-by-email"`
 	DeleteBlocklistedSubscribers    *sqlx.Stmt `query:"delete-blocklisted-subscribers"`
+	MergeSubscribers                *sqlx.Stmt `query:"merge-subscribers"`
+	GetSubscribersAttribs           *sqlx.Stmt `query:"get-subscribers-attribs"`
+	UpdateSubscribersAttribs        *sqlx.Stmt `query:"update-subscribers-attribs"`
+	QueryDuplicateSubscribers       *sqlx.Stmt `query:"query-duplicate-subscribers"`
+	UpdateEngagementScores          *sqlx.Stmt `query:"update-engagement-scores"`
+	SunsetSubscribersCriteria       string     `query:"sunset-subscribers-criteria"`
+	QuerySunsetSubscribers          string     `query:"query-sunset-subscribers"`
+	SunsetSubscribers               string     `query:"sunset-subscribers"`
 	DeleteOrphanSubscribers         *sqlx.Stmt `query:"delete-orphan-subscribers"`
 	UnsubscribeByCampaign           *sqlx.Stmt `query:"unsubscribe-by-campaign"`
 	ExportSubscriberData            *sqlx.Stmt `query:"export-subscriber-data"`
+	InsertAuditLog                  *sqlx.Stmt `query:"insert-audit-log"`
+	InsertImportAuditLog            *sqlx.Stmt `query:"insert-import-audit-log"`
+	InsertImportRun                 *sqlx.Stmt `query:"insert-import-run"`
+	UpdateImportRun                 *sqlx.Stmt `query:"update-import-run"`
+	GetImportRuns                   *sqlx.Stmt `query:"get-import-runs"`
+	GetImportRunLog                 *sqlx.Stmt `query:"get-import-run-log"`
+	FailInterruptedImportRuns       *sqlx.Stmt `query:"fail-interrupted-import-runs"`
+	GetSubscriberListsForExport     *sqlx.Stmt `query:"get-subscriber-lists-for-export"`
+	InsertExportJob                 *sqlx.Stmt `query:"insert-export-job"`
+	UpdateExportJob                 *sqlx.Stmt `query:"update-export-job"`
+	GetExportJobs                   *sqlx.Stmt `query:"get-export-jobs"`
+	DeleteExportJob                 *sqlx.Stmt `query:"delete-export-job"`
+	ExpireExportJobs                *sqlx.Stmt `query:"expire-export-jobs"`
+	FailInterruptedExportJobs       *sqlx.Stmt `query:"fail-interrupted-export-jobs"`
+	UnsubscribeAbsentSubscribers    *sqlx.Stmt `query:"unsubscribe-absent-subscribers"`
+	GetSubscriberAuditLog           *sqlx.Stmt `query:"get-subscriber-audit-log"`
 
 	// Non-prepared arbitrary subscriber queries.
 	QuerySubscribers                       string     `query:"query-subscribers"`
@@ -42,19 +77,34 @@ type Queries struct {
 	QuerySubscribersCountAll               *sqlx.Stmt `query:"query-subscribers-count-all"`
 	QuerySubscribersForExport              string     `query:"query-subscribers-for-export"`
 	QuerySubscribersTpl                    string     `query:"query-subscribers-template"`
-	DeleteSubscribersByQuery               string     `query:"delete-subscribers-by-query"`
+	TrashSubscribersByQuery                string     `query:"trash-subscribers-by-query"`
+	QuerySubscriberIDsByQuery              string     `query:"query-subscriber-ids-by-query"`
 	AddSubscribersToListsByQuery           string     `query:"add-subscribers-to-lists-by-query"`
 	BlocklistSubscribersByQuery            string     `query:"blocklist-subscribers-by-query"`
 	DeleteSubscriptionsByQuery             string     `query:"delete-subscriptions-by-query"`
 	UnsubscribeSubscribersFromListsByQuery string     `query:"unsubscribe-subscribers-from-lists-by-query"`
 
-	CreateList      *sqlx.Stmt `query:"create-list"`
-	QueryLists      string     `query:"query-lists"`
-	GetLists        *sqlx.Stmt `query:"get-lists"`
-	GetListsByOptin *sqlx.Stmt `query:"get-lists-by-optin"`
-	UpdateList      *sqlx.Stmt `query:"update-list"`
-	UpdateListsDate *sqlx.Stmt `query:"update-lists-date"`
-	DeleteLists     *sqlx.Stmt `query:"delete-lists"`
+	CreateList           *sqlx.Stmt `query:"create-list"`
+	QueryLists           string     `query:"query-lists"`
+	GetLists             *sqlx.Stmt `query:"get-lists"`
+	GetListsByOptin      *sqlx.Stmt `query:"get-lists-by-optin"`
+	UpdateList           *sqlx.Stmt `query:"update-list"`
+	UpdateListsDate      *sqlx.Stmt `query:"update-lists-date"`
+	DeleteLists          *sqlx.Stmt `query:"delete-lists"`
+	GetListSubscriberIDs *sqlx.Stmt `query:"get-list-subscriber-ids"`
+	CopySubscriptions    *sqlx.Stmt `query:"copy-subscriptions"`
+	SnapshotListStats    *sqlx.Stmt `query:"snapshot-list-stats"`
+	GetListStats         *sqlx.Stmt `query:"get-list-stats"`
+
+	QuerySegments                  string     `query:"query-segments"`
+	CreateSegment                  *sqlx.Stmt `query:"create-segment"`
+	UpdateSegment                  *sqlx.Stmt `query:"update-segment"`
+	UpdateSegmentCount             *sqlx.Stmt `query:"update-segment-count"`
+	DeleteSegments                 *sqlx.Stmt `query:"delete-segments"`
+	GetCampaignSegmentsForSnapshot *sqlx.Stmt `query:"get-campaign-segments-for-snapshot"`
+	SnapshotCampaignSegment        string     `query:"snapshot-campaign-segment"`
+	GetCampaignListsForSnapshot    *sqlx.Stmt `query:"get-campaign-lists-for-snapshot"`
+	SnapshotCampaignList           string     `query:"snapshot-campaign-list"`
 
 	StoreEmail                       *sqlx.Stmt `query:"store-email"`
 	GetEmailByMessageId              *sqlx.Stmt `query:"get-email-by-message-id"`
@@ -129,9 +179,10 @@ func (q *Queries) CompileSubscriberQueryTpl(exp string, db *sqlx.DB) (string, er
 	}
 	defer tx.Rollback()
 
-	// Perform the dry run.
+	// Perform the dry run. The expression is parenthesized so that it can't
+	// escape the template's conditions, eg: `a OR b` matching trashed subscribers.
 	if exp != "" {
-		exp = " AND " + exp
+		exp = " AND (" + exp + ")"
 	}
 	stmt := fmt.Sprintf(q.QuerySubscribersTpl, exp)
 	if _, err := tx.Exec(stmt, true, pq.Int64Array{}); err != nil {
@@ -143,10 +194,10 @@ func (q *Queries) CompileSubscriberQueryTpl(exp string, db *sqlx.DB) (string, er
 
 // compileSubscriberQueryTpl takes an arbitrary WHERE expressions and a subscriber
 // query template that depends on the filter (eg: delete by query, blocklist by query etc.)
-// combines and executes them.
-func (q *Queries) ExecSubQueryTpl(exp, tpl string, listIDs []int, db *sqlx.DB, args ...interface{}) error {
-	// Perform a dry run.
-	filterExp, err := q.CompileSubscriberQueryTpl(exp, db)
+// combines and executes them. segExp is an optional, parameterized segment filter
+// expression whose positional arguments are at the end of args.
+func (q *Queries) ExecSubQueryTpl(exp, segExp, tpl string, listIDs []int, db *sqlx.DB, args ...interface{}) error {
+	filterExp, err := q.compileSubQueryFilter(exp, segExp, db)
 	if err != nil {
 		return err
 	}
@@ -163,3 +214,41 @@ func (q *Queries) ExecSubQueryTpl(exp, tpl string, listIDs []int, db *sqlx.DB, a
 
 	return nil
 }
+
+// SelectSubQueryTpl is the same as ExecSubQueryTpl, but instead of executing the
+// combined query, it scans the rows that it returns into dest.
+func (q *Queries) SelectSubQueryTpl(dest interface{}, exp, segExp, tpl string, listIDs []int, db *sqlx.DB, args ...interface{}) error {
+	filterExp, err := q.compileSubQueryFilter(exp, segExp, db)
+	if err != nil {
+		return err
+	}
+
+	if len(listIDs) == 0 {
+		listIDs = []int{}
+	}
+
+	a := append([]interface{}{false, pq.Array(listIDs)}, args...)
+	return db.Select(dest, fmt.Sprintf(tpl, filterExp), a...)
+}
+
+// compileSubQueryFilter dry runs an arbitrary expression and returns the subscriber
+// query template combined with it and the optional segment filter expression.
+func (q *Queries) compileSubQueryFilter(exp, segExp string, db *sqlx.DB) (string, error) {
+	// Perform a dry run of the arbitrary expression.
+	filterExp, err := q.CompileSubscriberQueryTpl(exp, db)
+	if err != nil {
+		return "", err
+	}
+
+	// Add the segment filter, which is generated and is safe to be combined. Both
+	// are parenthesized so that the filter applies to the whole expression, eg: `a OR b`.
+	if segExp != "" {
+		cond := " AND (" + segExp + ")"
+		if exp != "" {
+			cond = " AND (" + exp + ")" + cond
+		}
+		filterExp = fmt.Sprintf(q.QuerySubscribersTpl, cond)
+	}
+
+	return filterExp, nil
+}
@@ -34,6 +34,7 @@ type Settings struct {
 	PrivacyAllowWipe          bool     `json:"privacy.allow_wipe"`
 	PrivacyExportable         []string `json:"privacy.exportable"`
 	PrivacyRecordOptinIP      bool     `json:"privacy.record_optin_ip"`
+	PrivacyTrashRetentionDays int      `json:"privacy.trash_retention_days"`
 	DomainBlocklist           []string `json:"privacy.domain_blocklist"`
 
 	SecurityEnableCaptcha bool   `json:"security.enable_captcha"`
@@ -67,15 +68,22 @@ type Settings struct {
 		EmailHeaders  []map[string]string `json:"email_headers"`
 		MaxConns      int                 `json:"max_conns"`
 		MaxMsgRetries int                 `json:"max_msg_retries"`
+		Weight        int                 `json:"weight"`
 		IdleTimeout   string              `json:"idle_timeout"`
 		WaitTimeout   string              `json:"wait_timeout"`
 		TLSType       string              `json:"tls_type"`
 		TLSSkipVerify bool                `json:"tls_skip_verify"`
+		DKIM          []struct {
+			Domain     string `json:"domain"`
+			Selector   string `json:"selector"`
+			PrivateKey string `json:"private_key,omitempty"`
+		} `json:"dkim"`
 	} `json:"smtp"`
 
 	Messengers []struct {
 		UUID          string `json:"uuid"`
 		Enabled       bool   `json:"enabled"`
+		Type          string `json:"type"`
 		Name          string `json:"name"`
 		RootURL       string `json:"root_url"`
 		Username      string `json:"username"`
@@ -83,8 +91,23 @@ type Settings struct {
 		MaxConns      int    `json:"max_conns"`
 		Timeout       string `json:"timeout"`
 		MaxMsgRetries int    `json:"max_msg_retries"`
+
+		// Sink messenger options.
+		Directory string `json:"directory"`
+		Format    string `json:"format"`
 	} `json:"messengers"`
 
+	Attribs []AttribDef `json:"attribs"`
+
+	ImportSources []ImportSource `json:"import.sources"`
+
+	EngagementScoreInterval string `json:"engagement.score_interval"`
+	EngagementHalfLifeDays  int    `json:"engagement.half_life_days"`
+	SunsetEnabled           bool   `json:"engagement.sunset_enabled"`
+	SunsetDays              int    `json:"engagement.sunset_days"`
+	SunsetAction            string `json:"engagement.sunset_action"`
+	SunsetListID            int    `json:"engagement.sunset_list_id"`
+
 	BounceEnabled        bool `json:"bounce.enabled"`
 	BounceEnableWebhooks bool `json:"bounce.webhooks_enabled"`
 	BounceActions        map[string]struct {
@@ -2,7 +2,7 @@
 -- subscribers
 -- name: get-subscriber
 -- Get a single subscriber by id or UUID or email.
-SELECT * FROM subscribers WHERE
+SELECT * FROM subscribers WHERE deleted_at IS NULL AND
     CASE
         WHEN $1 > 0 THEN id = $1
         WHEN $2 != '' THEN uuid = $2::UUID
@@ -11,11 +11,20 @@ SELECT * FROM subscribers WHERE
 
 -- name: get-subscribers-by-emails
 -- Get subscribers by emails.
-SELECT * FROM subscribers WHERE email=ANY($1);
+SELECT * FROM subscribers WHERE email=ANY($1) AND deleted_at IS NULL;
+
+-- name: get-suppressed-emails
+-- Returns the e-mails among the given ones that belong to blocklisted or hard-bounced
+-- subscribers. Used to guard messages sent to addresses outside the subscribers table.
+-- The e-mails ($1) are expected in lowercase and are returned in lowercase.
+SELECT LOWER(email) FROM subscribers s WHERE LOWER(email) = ANY($1) AND (
+    status = 'blocklisted' OR
+    EXISTS (SELECT 1 FROM bounces WHERE subscriber_id = s.id AND type = 'hard')
+);
 
 -- name: get-subscriber-lists
 WITH sub AS (
-    SELECT id FROM subscribers WHERE CASE WHEN $1 > 0 THEN id = $1 ELSE uuid = $2 END
+    SELECT id FROM subscribers WHERE deleted_at IS NULL AND CASE WHEN $1 > 0 THEN id = $1 ELSE uuid = $2 END
 )
 SELECT * FROM lists
     LEFT JOIN subscriber_lists ON (lists.id = subscriber_lists.list_id)
@@ -44,6 +53,7 @@ WITH subs AS (
                     subscriber_lists.created_at AS subscription_created_at,
                     subscriber_lists.updated_at AS subscription_updated_at,
                     subscriber_lists.meta AS subscription_meta,
+                    subscriber_lists.consent AS subscription_consent,
                     lists.*
             ) l)
         )
@@ -63,12 +73,13 @@ SELECT id as subscriber_id,
 -- if $3 is set to true, all lists are fetched including the subscriber's subscriptions.
 -- subscription_status, and subscription_created_at are null in that case.
 WITH sub AS (
-    SELECT id FROM subscribers WHERE CASE WHEN $1 > 0 THEN id = $1 ELSE uuid = $2 END
+    SELECT id FROM subscribers WHERE deleted_at IS NULL AND CASE WHEN $1 > 0 THEN id = $1 ELSE uuid = $2 END
 )
 SELECT lists.*,
     subscriber_lists.status as subscription_status,
     subscriber_lists.created_at as subscription_created_at,
-    subscriber_lists.meta as subscription_meta
+    subscriber_lists.meta as subscription_meta,
+    subscriber_lists.consent as subscription_consent
     FROM lists LEFT JOIN subscriber_lists
     ON (subscriber_lists.list_id = lists.id AND subscriber_lists.subscriber_id = (SELECT id FROM sub))
     WHERE CASE WHEN $3 = TRUE THEN TRUE ELSE subscriber_lists.status IS NOT NULL END
@@ -81,17 +92,19 @@ WITH sub AS (
     RETURNING id, status
 ),
 listIDs AS (
-    SELECT id FROM lists WHERE
+    SELECT id, consent_version FROM lists WHERE
         (CASE WHEN CARDINALITY($6::INT[]) > 0 THEN id=ANY($6)
               ELSE uuid=ANY($7::UUID[]) END)
 ),
 subs AS (
-    INSERT INTO subscriber_lists (subscriber_id, list_id, status)
-    VALUES(
+    -- $9 is the consent record, which is stamped with the version of each list's consent text.
+    INSERT INTO subscriber_lists (subscriber_id, list_id, status, consent)
+    SELECT
         (SELECT id FROM sub),
-        UNNEST(ARRAY(SELECT id FROM listIDs)),
-        (CASE WHEN $4='blocklisted' THEN 'unsubscribed'::subscription_status ELSE $8::subscription_status END)
-    )
+        listIDs.id,
+        (CASE WHEN $4='blocklisted' THEN 'unsubscribed'::subscription_status ELSE $8::subscription_status END),
+        $9::JSONB || JSONB_BUILD_OBJECT('version', listIDs.consent_version)
+    FROM listIDs
     ON CONFLICT (subscriber_id, list_id) DO UPDATE
         SET updated_at=NOW(),
             status=(
@@ -104,7 +117,8 @@ SELECT id from sub;
 
 -- name: upsert-subscriber
 -- Upserts a subscriber where existing subscribers get their names and attributes overwritten.
--- If $7 = true, update values, otherwise, skip.
+-- If $7 = true, update values, otherwise, skip. Subscribers in the trash are restored.
+-- $8 is the consent record of new subscriptions.
 WITH sub AS (
     INSERT INTO subscribers as s (uuid, email, name, attribs, status)
     VALUES($1, $2, $3, $4, 'enabled')
@@ -112,14 +126,49 @@ WITH sub AS (
     DO UPDATE SET
         name=(CASE WHEN $7 THEN $3 ELSE s.name END),
         attribs=(CASE WHEN $7 THEN $4 ELSE s.attribs END),
+        deleted_at=NULL,
         updated_at=NOW()
     RETURNING uuid, id
 ),
 subs AS (
-    INSERT INTO subscriber_lists (subscriber_id, list_id, status)
-    VALUES((SELECT id FROM sub), UNNEST($5::INT[]), $6)
+    INSERT INTO subscriber_lists (subscriber_id, list_id, status, consent)
+    SELECT (SELECT id FROM sub), lists.id, $6, $8::JSONB || JSONB_BUILD_OBJECT('version', lists.consent_version)
+        FROM lists WHERE lists.id = ANY($5::INT[])
+    ON CONFLICT (subscriber_id, list_id) DO UPDATE
+    SET updated_at=NOW(), status=(CASE WHEN $7 THEN $6 ELSE subscriber_lists.status END),
+        -- Consent is recorded again when an unsubscribed subscription is renewed.
+        consent=(CASE WHEN $7 AND subscriber_lists.status = 'unsubscribed' AND $6 != 'unsubscribed'
+            THEN EXCLUDED.consent ELSE subscriber_lists.consent END)
+)
+SELECT uuid, id from sub;
+
+-- name: upsert-merge-subscriber
+-- Upserts a subscriber where the attributes of existing subscribers are deep merged with
+-- the given attributes, where null values remove attributes. If $8 = true, the names of
+-- existing subscribers are left unchanged. If $7 = true, subscription statuses are
+-- updated, otherwise, skipped. Subscribers in the trash are restored. $9 is the consent
+-- record of new subscriptions. $10 is the attributes of new subscribers, which unlike
+-- the partial attributes that are merged, are validated against the full schema.
+WITH sub AS (
+    INSERT INTO subscribers as s (uuid, email, name, attribs, status)
+    VALUES($1, $2, $3, JSONB_MERGE_PATCH('{}', $10), 'enabled')
+    ON CONFLICT (email)
+    DO UPDATE SET
+        name=(CASE WHEN $8 THEN s.name ELSE $3 END),
+        attribs=JSONB_MERGE_PATCH(s.attribs, $4),
+        deleted_at=NULL,
+        updated_at=NOW()
+    RETURNING uuid, id
+),
+subs AS (
+    INSERT INTO subscriber_lists (subscriber_id, list_id, status, consent)
+    SELECT (SELECT id FROM sub), lists.id, $6, $9::JSONB || JSONB_BUILD_OBJECT('version', lists.consent_version)
+        FROM lists WHERE lists.id = ANY($5::INT[])
     ON CONFLICT (subscriber_id, list_id) DO UPDATE
-    SET updated_at=NOW(), status=(CASE WHEN $7 THEN $6 ELSE subscriber_lists.status END)
+    SET updated_at=NOW(), status=(CASE WHEN $7 THEN $6 ELSE subscriber_lists.status END),
+        -- Consent is recorded again when an unsubscribed subscription is renewed.
+        consent=(CASE WHEN $7 AND subscriber_lists.status = 'unsubscribed' AND $6 != 'unsubscribed'
+            THEN EXCLUDED.consent ELSE subscriber_lists.consent END)
 )
 SELECT uuid, id from sub;
 
@@ -131,12 +180,112 @@ SELECT uuid, id from sub;
 WITH sub AS (
     INSERT INTO subscribers (uuid, email, name, attribs, status)
     VALUES($1, $2, $3, $4, 'blocklisted')
-    ON CONFLICT (email) DO UPDATE SET status='blocklisted', updated_at=NOW()
+    ON CONFLICT (email) DO UPDATE SET status='blocklisted', deleted_at=NULL, updated_at=NOW()
     RETURNING id
 )
 UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
     WHERE subscriber_id = (SELECT id FROM sub);
 
+-- name: get-import-subscribers
+-- Returns existing subscribers by e-mail, along with their subscription statuses on
+-- the given lists, for classifying rows in an import dry run.
+SELECT s.email, s.name, s.attribs, s.status, s.deleted_at IS NOT NULL AS trashed,
+    COALESCE(ARRAY_AGG(sl.list_id) FILTER (WHERE sl.list_id IS NOT NULL), '{}') AS list_ids,
+    COALESCE(ARRAY_AGG(sl.status::TEXT) FILTER (WHERE sl.list_id IS NOT NULL), '{}') AS list_statuses
+    FROM subscribers s
+    LEFT JOIN subscriber_lists sl ON (sl.subscriber_id = s.id AND sl.list_id = ANY($2::INT[]))
+    WHERE s.email = ANY($1::TEXT[])
+    GROUP BY s.id;
+
+-- name: insert-import-run
+INSERT INTO import_runs (source, filename, dry_run) VALUES($1, $2, $3) RETURNING id, started_at;
+
+-- name: update-import-run
+-- Records the status, counters, and log of an import session. finished_at is set if $12 = true.
+UPDATE import_runs SET status=$2, total=$3, imported=$4, rejected=$5, unsubscribed=$6,
+    new=$7, updated=$8, unchanged=$9, error=$10, log=$11,
+    finished_at=(CASE WHEN $12 THEN NOW() ELSE NULL END) WHERE id=$1;
+
+-- name: get-import-runs
+-- Returns import sessions, latest first, or the one with the ID $1 if it's > 0. COUNT() OVER()
+-- is named total_runs as the sessions have a total column of their own. The logs are fetched
+-- separately.
+SELECT COUNT(*) OVER () AS total_runs, id, source, filename, status, dry_run, total, imported,
+    rejected, unsubscribed, new, updated, unchanged, error, started_at, finished_at
+    FROM import_runs WHERE ($1 = 0 OR id = $1)
+    ORDER BY id DESC OFFSET $2 LIMIT (CASE WHEN $3 < 1 THEN NULL ELSE $3 END);
+
+-- name: get-import-run-log
+SELECT log FROM import_runs WHERE id = $1;
+
+-- name: fail-interrupted-import-runs
+-- Marks the import sessions that were running when the app was stopped as failed.
+UPDATE import_runs SET status='failed', error=$1, finished_at=NOW()
+    WHERE status IN ('importing', 'stopping');
+
+-- name: unsubscribe-absent-subscribers
+-- Unsubscribes the subscriptions on the lists ($1) that weren't touched by the import
+-- run ($2), ie, those of subscribers absent from the imported file in a full sync, and
+-- records them in the audit log. Imports update subscriber_lists.updated_at on every
+-- imported row. The run's DB timestamp is used to avoid clock skew.
+WITH u AS (
+    UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
+        WHERE list_id = ANY($1::INT[]) AND status != 'unsubscribed'
+        AND updated_at < (SELECT started_at FROM import_runs WHERE id = $2)
+        RETURNING subscriber_id, list_id
+),
+a AS (
+    INSERT INTO audit_log (subscriber_id, list_id, action, source, actor, ip)
+        SELECT subscriber_id, list_id, $3, 'import', $4, '' FROM u
+)
+SELECT COUNT(*) FROM u;
+
+-- name: get-subscriber-lists-for-export
+-- Returns the subscriptions of the given subscribers for exports.
+SELECT subscriber_lists.subscriber_id, JSON_AGG(JSON_BUILD_OBJECT(
+        'id', lists.id,
+        'name', lists.name,
+        'subscription_status', subscriber_lists.status
+    ) ORDER BY lists.id) AS lists
+    FROM subscriber_lists
+    JOIN lists ON (lists.id = subscriber_lists.list_id)
+    WHERE subscriber_lists.subscriber_id = ANY($1::INT[])
+    GROUP BY subscriber_lists.subscriber_id;
+
+-- name: insert-export-job
+INSERT INTO export_jobs (uuid, format, fields, include_lists, created_by)
+    VALUES($1, $2, $3, $4, $5) RETURNING id, created_at;
+
+-- name: update-export-job
+-- Records the progress of an export job. finished_at is set if the status isn't running.
+UPDATE export_jobs SET status=$2, exported=$3, filename=$4, error=$5,
+    finished_at=(CASE WHEN $2 != 'running' THEN NOW() ELSE NULL END) WHERE id=$1;
+
+-- name: get-export-jobs
+-- Returns export jobs, latest first, or the one with the ID $1 if it's > 0.
+SELECT COUNT(*) OVER () AS total, export_jobs.* FROM export_jobs
+    WHERE ($1 = 0 OR id = $1)
+    ORDER BY id DESC OFFSET $2 LIMIT (CASE WHEN $3 < 1 THEN NULL ELSE $3 END);
+
+-- name: delete-export-job
+DELETE FROM export_jobs WHERE id = $1 AND status != 'running' RETURNING filename;
+
+-- name: expire-export-jobs
+-- Clears the files of the export jobs that finished more than $1 seconds ago.
+-- Returns the names of the files, which are to be deleted.
+WITH jobs AS (
+    SELECT id, filename FROM export_jobs WHERE status != 'running' AND filename != ''
+    AND finished_at < NOW() - MAKE_INTERVAL(secs => $1)
+),
+u AS (
+    UPDATE export_jobs SET filename='' WHERE id IN (SELECT id FROM jobs)
+)
+SELECT filename FROM jobs;
+
+-- name: fail-interrupted-export-jobs
+-- Marks the export jobs that were running when the app was stopped as failed.
+UPDATE export_jobs SET status='failed', error=$1, finished_at=NOW() WHERE status = 'running';
+
 -- name: update-subscriber
 UPDATE subscribers SET
     email=(CASE WHEN $2 != '' THEN $2 ELSE email END),
@@ -144,7 +293,7 @@ UPDATE subscribers SET
     status=(CASE WHEN $4 != '' THEN $4::subscriber_status ELSE status END),
     attribs=(CASE WHEN $5 != '' THEN $5::JSONB ELSE attribs END),
     updated_at=NOW()
-WHERE id = $1;
+WHERE id = $1 AND deleted_at IS NULL;
 
 -- name: update-subscriber-with-lists
 -- Updates a subscriber's data, and given a list of list_ids, inserts subscriptions
@@ -156,22 +305,24 @@ WITH s AS (
         status=(CASE WHEN $4 != '' THEN $4::subscriber_status ELSE status END),
         attribs=(CASE WHEN $5 != '' THEN $5::JSONB ELSE attribs END),
         updated_at=NOW()
-    WHERE id = $1 RETURNING id
+    WHERE id = $1 AND deleted_at IS NULL RETURNING id
 ),
 listIDs AS (
-    SELECT id FROM lists WHERE
+    SELECT id, consent_version FROM lists WHERE
         (CASE WHEN CARDINALITY($6::INT[]) > 0 THEN id=ANY($6)
               ELSE uuid=ANY($7::UUID[]) END)
 ),
 d AS (
     DELETE FROM subscriber_lists WHERE $9 = TRUE AND subscriber_id = $1 AND list_id != ALL(SELECT id FROM listIDs)
 )
-INSERT INTO subscriber_lists (subscriber_id, list_id, status)
-    VALUES(
+-- $10 is the consent record of new subscriptions.
+INSERT INTO subscriber_lists (subscriber_id, list_id, status, consent)
+    SELECT
         (SELECT id FROM s),
-        UNNEST(ARRAY(SELECT id FROM listIDs)),
-        (CASE WHEN $4='blocklisted' THEN 'unsubscribed'::subscription_status ELSE $8::subscription_status END)
-    )
+        listIDs.id,
+        (CASE WHEN $4='blocklisted' THEN 'unsubscribed'::subscription_status ELSE $8::subscription_status END),
+        $10::JSONB || JSONB_BUILD_OBJECT('version', listIDs.consent_version)
+    FROM listIDs
     ON CONFLICT (subscriber_id, list_id) DO UPDATE
     SET status = (
         CASE
@@ -181,12 +332,235 @@ INSERT INTO subscriber_lists (subscriber_id, list_id, status)
             WHEN subscriber_lists.status = 'confirmed' THEN 'confirmed'
             ELSE $8::subscription_status
         END
-    );
+    ),
+    -- Consent is recorded again when an unsubscribed subscription is renewed.
+    consent = (CASE WHEN subscriber_lists.status = 'unsubscribed' AND EXCLUDED.status != 'unsubscribed'
+        THEN EXCLUDED.consent ELSE subscriber_lists.consent END);
 
 -- name: delete-subscribers
--- Delete one or more subscribers by ID or UUID.
+-- Permanently delete one or more subscribers by ID or UUID.
 DELETE FROM subscribers WHERE CASE WHEN ARRAY_LENGTH($1::INT[], 1) > 0 THEN id = ANY($1) ELSE uuid = ANY($2::UUID[]) END;
 
+-- name: trash-subscribers
+-- Move one or more subscribers by ID or UUID to the trash. Returns the IDs of the subscribers trashed.
+UPDATE subscribers SET deleted_at=NOW()
+    WHERE deleted_at IS NULL AND
+    CASE WHEN ARRAY_LENGTH($1::INT[], 1) > 0 THEN id = ANY($1) ELSE uuid = ANY($2::UUID[]) END
+    RETURNING id;
+
+-- name: query-trashed-subscribers
+-- Subscribers in the trash, optionally matching the e-mail or name $1, latest first.
+SELECT COUNT(*) OVER () AS total, subscribers.* FROM subscribers
+    WHERE deleted_at IS NOT NULL
+    AND ($1 = '' OR email ILIKE $1 OR name ILIKE $1)
+    ORDER BY deleted_at DESC, id
+    OFFSET $2 LIMIT (CASE WHEN $3 < 1 THEN NULL ELSE $3 END);
+
+-- name: restore-subscribers
+-- Restore subscribers from the trash. Returns the IDs of the subscribers restored.
+UPDATE subscribers SET deleted_at=NULL, updated_at=NOW()
+    WHERE deleted_at IS NOT NULL AND id = ANY($1::INT[])
+    RETURNING id;
+
+-- name: purge-trashed-subscribers
+-- Permanently delete the subscribers $1 in the trash, or if $1 is empty, all subscribers
+-- that have been in the trash for more than $2 days. Returns the IDs of the subscribers deleted.
+DELETE FROM subscribers WHERE deleted_at IS NOT NULL AND
+    (CASE WHEN CARDINALITY($1::INT[]) > 0 THEN id = ANY($1::INT[])
+          ELSE deleted_at < NOW() - MAKE_INTERVAL(days => $2) END)
+    RETURNING id;
+
+-- name: restore-trashed-subscriber-by-email
+-- Restore a subscriber in the trash with the given e-mail, unless it's blocklisted.
+-- Returns the ID and status of the subscriber in the trash.
+WITH sub AS (
+    SELECT id, status FROM subscribers WHERE deleted_at IS NOT NULL AND LOWER(email) = LOWER($1)
+),
+r AS (
+    UPDATE subscribers SET deleted_at=NULL, updated_at=NOW()
+    WHERE id = (SELECT id FROM sub) AND status != 'blocklisted'
+)
+SELECT id, status FROM sub;
+
+-- name: merge-subscribers
+-- Moves the subscriptions, bounces, views, clicks, and e-mail history of the subscribers $2
+-- onto the subscriber $1. Attributes missing on $1 are copied from the other subscribers.
+-- $1's own subscriptions and attributes take precedence, except that an unsubscription
+-- from a list on any of the subscribers wins. The most restrictive subscriber status of all
+-- of them (blocklisted, disabled, enabled) is carried over. The other subscribers are to be
+-- deleted after this. Returns the number of subscribers merged and the resulting status.
+WITH sub AS (
+    SELECT id, uuid, status FROM subscribers WHERE id = $1
+),
+others AS (
+    SELECT id, uuid, attribs, status FROM subscribers WHERE id = ANY($2::INT[]) AND id != $1
+    AND EXISTS (SELECT 1 FROM sub)
+),
+subs AS (
+    INSERT INTO subscriber_lists (subscriber_id, list_id, meta, consent, status, unsubscribed_at, created_at)
+        (SELECT DISTINCT ON (list_id) $1, list_id, meta, consent, status, unsubscribed_at, created_at FROM subscriber_lists
+        WHERE subscriber_id IN (SELECT id FROM others)
+        ORDER BY list_id, (status = 'unsubscribed') DESC, subscriber_id)
+        ON CONFLICT (subscriber_id, list_id) DO UPDATE SET status = 'unsubscribed', updated_at = NOW()
+        WHERE EXCLUDED.status = 'unsubscribed'
+),
+attr AS (
+    UPDATE subscribers SET
+        attribs = (SELECT COALESCE(JSONB_OBJECT_AGG(a.key, a.value), '{}') FROM others, JSONB_EACH(others.attribs) a) || attribs,
+        status = (SELECT s.status FROM (SELECT status FROM sub UNION ALL SELECT status FROM others) s
+            ORDER BY (CASE s.status WHEN 'blocklisted' THEN 0 WHEN 'disabled' THEN 1 ELSE 2 END) LIMIT 1),
+        updated_at = NOW()
+    WHERE id = (SELECT id FROM sub)
+    RETURNING status
+),
+b AS (
+    UPDATE bounces SET subscriber_id = $1 WHERE subscriber_id IN (SELECT id FROM others)
+),
+v AS (
+    UPDATE campaign_views SET subscriber_id = $1 WHERE subscriber_id IN (SELECT id FROM others)
+),
+c AS (
+    UPDATE link_clicks SET subscriber_id = $1 WHERE subscriber_id IN (SELECT id FROM others)
+),
+camps AS (
+    INSERT INTO campaign_subscribers (campaign_id, subscriber_id)
+        SELECT campaign_id, $1 FROM campaign_subscribers WHERE subscriber_id IN (SELECT id FROM others)
+        ON CONFLICT DO NOTHING
+),
+em AS (
+    UPDATE emails SET subscriber_uuid = (SELECT uuid::TEXT FROM sub)
+    WHERE subscriber_uuid IN (SELECT uuid::TEXT FROM others)
+),
+ev AS (
+    UPDATE email_events SET subscriber_uuid = (SELECT uuid::TEXT FROM sub)
+    WHERE subscriber_uuid IN (SELECT uuid::TEXT FROM others)
+)
+SELECT COUNT(*) AS merged, (SELECT status FROM attr) AS status FROM others;
+
+-- name: get-subscribers-attribs
+-- Get the attributes of the given subscribers for updating them in bulk. The rows are
+-- locked until the end of the transaction so that concurrent changes aren't overwritten.
+SELECT id, attribs FROM subscribers WHERE id = ANY($1::INT[]) AND deleted_at IS NULL ORDER BY id FOR UPDATE;
+
+-- name: update-subscribers-attribs
+-- Set the attributes $2 of the subscribers $1 in bulk. The arrays are of the same length.
+UPDATE subscribers SET attribs = u.attribs, updated_at = NOW()
+    FROM (SELECT UNNEST($1::INT[]) AS id, UNNEST($2::JSONB[]) AS attribs) u
+    WHERE subscribers.id = u.id AND subscribers.deleted_at IS NULL;
+
+-- name: query-duplicate-subscribers
+-- Finds groups of subscribers whose e-mails are the same after normalization (lowercased,
+-- +tags removed, and dots removed for Gmail) or who have the same value for any of the
+-- attributes $1.
+WITH keys AS (
+    SELECT id, 'email' AS match,
+        (CASE WHEN SPLIT_PART(LOWER(email), '@', 2) IN ('gmail.com', 'googlemail.com')
+            THEN REPLACE(SPLIT_PART(SPLIT_PART(LOWER(email), '@', 1), '+', 1), '.', '') || '@gmail.com'
+            ELSE SPLIT_PART(SPLIT_PART(LOWER(email), '@', 1), '+', 1) || '@' || SPLIT_PART(LOWER(email), '@', 2)
+        END) AS key
+    FROM subscribers WHERE deleted_at IS NULL
+
+    UNION ALL
+
+    SELECT id, 'attribs.' || k AS match, LOWER(TRIM(attribs->>k)) AS key
+    FROM subscribers, UNNEST($1::TEXT[]) k
+    WHERE deleted_at IS NULL AND COALESCE(TRIM(attribs->>k), '') != ''
+),
+groups AS (
+    SELECT match, key, ARRAY_AGG(id ORDER BY id) AS ids FROM keys
+    GROUP BY match, key HAVING COUNT(*) > 1
+)
+SELECT COUNT(*) OVER () AS total, g.match, g.key,
+    (SELECT JSON_AGG(JSON_BUILD_OBJECT('id', s.id, 'uuid', s.uuid, 'email', s.email, 'name', s.name,
+        'status', s.status, 'created_at', s.created_at) ORDER BY s.id)
+        FROM subscribers s WHERE s.id = ANY(g.ids)) AS subscribers
+FROM groups g ORDER BY g.match, g.key
+OFFSET $2 LIMIT (CASE WHEN $3 < 1 THEN NULL ELSE $3 END);
+
+-- name: update-engagement-scores
+-- Recomputes the engagement scores of all subscribers. Every campaign view and 'open'
+-- e-mail event is worth 1 point and every link click and 'click' e-mail event 2 points.
+-- The points decay by half every $1 days, so recent and frequent engagement scores higher.
+-- Events older than 10 half-lives are ignored. Returns the number of subscribers updated.
+WITH ev AS (
+    SELECT subscriber_id, created_at, 1 AS weight FROM campaign_views
+        WHERE subscriber_id IS NOT NULL AND created_at > NOW() - MAKE_INTERVAL(days => $1 * 10)
+    UNION ALL
+    SELECT subscriber_id, created_at, 2 AS weight FROM link_clicks
+        WHERE subscriber_id IS NOT NULL AND created_at > NOW() - MAKE_INTERVAL(days => $1 * 10)
+    UNION ALL
+    SELECT s.id, e.timestamp::TIMESTAMP WITH TIME ZONE, (CASE WHEN e.event = 'click' THEN 2 ELSE 1 END) AS weight
+        FROM email_events e JOIN subscribers s ON (s.uuid::TEXT = e.subscriber_uuid)
+        WHERE e.event IN ('open', 'click') AND e.timestamp > NOW() - MAKE_INTERVAL(days => $1 * 10)
+),
+scores AS (
+    SELECT subscriber_id,
+        ROUND(SUM(weight * POWER(0.5, EXTRACT(EPOCH FROM NOW() - created_at) / 86400 / $1))::NUMERIC, 2) AS score,
+        MAX(created_at) AS last_engaged_at
+    FROM ev GROUP BY subscriber_id
+),
+subs AS (
+    SELECT s.id, COALESCE(sc.score, 0)::REAL AS score,
+        GREATEST(s.last_engaged_at, sc.last_engaged_at) AS last_engaged_at
+    FROM subscribers s LEFT JOIN scores sc ON (sc.subscriber_id = s.id)
+)
+UPDATE subscribers SET engagement_score = subs.score, last_engaged_at = subs.last_engaged_at
+    FROM subs WHERE subscribers.id = subs.id
+    AND (subscribers.engagement_score != subs.score OR subscribers.last_engaged_at IS DISTINCT FROM subs.last_engaged_at);
+
+-- name: sunset-subscribers-criteria
+-- raw: true
+-- Subscribers that the sunset policy acts on: subscribers that are older than $1 days,
+-- have no views, clicks, or open/click e-mail events in the last $1 days, and are subscribed
+-- to lists other than the dormant list $2. This is the subs CTE (%s) of the sunset queries
+-- below, and for that reason, it is not terminated with a semicolon. Views and clicks are
+-- only recorded against subscribers with individual tracking on.
+SELECT s.id FROM subscribers s
+    WHERE s.status != 'blocklisted' AND s.deleted_at IS NULL
+        AND s.created_at < NOW() - MAKE_INTERVAL(days => $1)
+        AND EXISTS (
+            SELECT 1 FROM subscriber_lists sl WHERE sl.subscriber_id = s.id
+            AND sl.status != 'unsubscribed' AND sl.list_id != $2
+        )
+        AND NOT EXISTS (
+            SELECT 1 FROM campaign_views v WHERE v.subscriber_id = s.id
+            AND v.created_at > NOW() - MAKE_INTERVAL(days => $1)
+        )
+        AND NOT EXISTS (
+            SELECT 1 FROM link_clicks c WHERE c.subscriber_id = s.id
+            AND c.created_at > NOW() - MAKE_INTERVAL(days => $1)
+        )
+        AND NOT EXISTS (
+            SELECT 1 FROM email_events e WHERE e.subscriber_uuid = s.uuid::TEXT
+            AND e.event IN ('open', 'click') AND e.timestamp > NOW() - MAKE_INTERVAL(days => $1)
+        )
+
+-- name: query-sunset-subscribers
+-- raw: true
+-- Subscribers that the sunset policy would act on (%s = sunset-subscribers-criteria).
+WITH subs AS (%s)
+SELECT COUNT(*) OVER () AS total, subscribers.* FROM subscribers
+    WHERE id IN (SELECT id FROM subs)
+    ORDER BY last_engaged_at ASC NULLS FIRST, id
+    OFFSET $3 LIMIT (CASE WHEN $4 < 1 THEN NULL ELSE $4 END);
+
+-- name: sunset-subscribers
+-- raw: true
+-- Applies the sunset policy to the subscribers in sunset-subscribers-criteria (%s). Their
+-- subscriptions (except to the dormant list $2) are unsubscribed, and if $2 is set,
+-- they're subscribed to the dormant list. Returns the IDs of the subscribers affected.
+WITH subs AS (%s),
+unsub AS (
+    UPDATE subscriber_lists SET status = 'unsubscribed', updated_at = NOW()
+    WHERE subscriber_id IN (SELECT id FROM subs) AND list_id != $2 AND status != 'unsubscribed'
+),
+dormant AS (
+    INSERT INTO subscriber_lists (subscriber_id, list_id, status)
+        SELECT subs.id, $2, 'confirmed'::subscription_status FROM subs WHERE $2 > 0
+        ON CONFLICT (subscriber_id, list_id) DO NOTHING
+)
+SELECT id FROM subs;
+
 -- name: delete-blocklisted-subscribers
 DELETE FROM subscribers WHERE status = 'blocklisted';
 
@@ -203,9 +577,15 @@ UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
     WHERE subscriber_id = ANY($1::INT[]);
 
 -- name: add-subscribers-to-lists
-INSERT INTO subscriber_lists (subscriber_id, list_id, status)
-    (SELECT a, b, (CASE WHEN $3 != '' THEN $3::subscription_status ELSE 'unconfirmed' END) FROM UNNEST($1::INT[]) a, UNNEST($2::INT[]) b)
-    ON CONFLICT (subscriber_id, list_id) DO UPDATE SET status=(CASE WHEN $3 != '' THEN $3::subscription_status ELSE subscriber_lists.status END);
+-- $4 is the consent record of new subscriptions.
+INSERT INTO subscriber_lists (subscriber_id, list_id, status, consent)
+    (SELECT a, lists.id, (CASE WHEN $3 != '' THEN $3::subscription_status ELSE 'unconfirmed' END),
+        $4::JSONB || JSONB_BUILD_OBJECT('version', lists.consent_version)
+        FROM UNNEST($1::INT[]) a, lists WHERE lists.id = ANY($2::INT[]))
+    ON CONFLICT (subscriber_id, list_id) DO UPDATE SET status=(CASE WHEN $3 != '' THEN $3::subscription_status ELSE subscriber_lists.status END),
+        -- Consent is recorded again when an unsubscribed subscription is renewed.
+        consent=(CASE WHEN subscriber_lists.status = 'unsubscribed' AND $3 != '' AND $3 != 'unsubscribed'
+            THEN EXCLUDED.consent ELSE subscriber_lists.consent END);
 
 -- name: delete-subscriptions
 DELETE FROM subscriber_lists
@@ -213,12 +593,13 @@ DELETE FROM subscriber_lists
 
 -- name: confirm-subscription-optin
 WITH subID AS (
-    SELECT id FROM subscribers WHERE uuid = $1::UUID
+    SELECT id FROM subscribers WHERE uuid = $1::UUID AND deleted_at IS NULL
 ),
 listIDs AS (
     SELECT id FROM lists WHERE uuid = ANY($2::UUID[])
 )
-UPDATE subscriber_lists SET status='confirmed', meta=meta || $3, updated_at=NOW()
+UPDATE subscriber_lists SET status='confirmed', meta=meta || $3,
+    consent=consent || JSONB_BUILD_OBJECT('confirmed_at', NOW()), updated_at=NOW()
     WHERE subscriber_id = (SELECT id FROM subID) AND list_id = ANY(SELECT id FROM listIDs);
 
 -- name: unsubscribe-subscribers-from-lists
@@ -227,6 +608,13 @@ WITH listIDs AS (
         SELECT id FROM lists WHERE
         (CASE WHEN CARDINALITY($2::INT[]) > 0 THEN id=ANY($2) ELSE uuid=ANY($3::UUID[]) END)
     ) id
+),
+dyn AS (
+    -- Dynamic lists have no subscriptions to update. Record the unsubscriptions against them.
+    INSERT INTO subscriber_lists (subscriber_id, list_id, status)
+        SELECT a, b, 'unsubscribed' FROM UNNEST($1::INT[]) a,
+            UNNEST(ARRAY(SELECT id FROM lists WHERE id = ANY((SELECT id FROM listIDs)) AND type = 'dynamic')) b
+        ON CONFLICT (subscriber_id, list_id) DO NOTHING
 )
 UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
     WHERE (subscriber_id, list_id) = ANY(SELECT a, b FROM UNNEST($1::INT[]) a, UNNEST((SELECT id FROM listIDs)) b);
@@ -235,7 +623,7 @@ UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
 -- Unsubscribes a subscriber given a campaign UUID (from all the lists in the campaign) and the subscriber UUID.
 -- If $3 is TRUE, then all subscriptions of the subscriber is blocklisted
 -- and all existing subscriptions, irrespective of lists, unsubscribed.
-WITH lists AS (
+WITH campLists AS (
     SELECT list_id FROM campaign_lists
     LEFT JOIN campaigns ON (campaign_lists.campaign_id = campaigns.id)
     WHERE campaigns.uuid = $1
@@ -243,11 +631,19 @@ WITH lists AS (
 sub AS (
     UPDATE subscribers SET status = (CASE WHEN $3 IS TRUE THEN 'blocklisted' ELSE status END)
     WHERE uuid = $2 RETURNING id
+),
+dyn AS (
+    -- Dynamic lists have no subscriptions to update. Record the unsubscription against
+    -- the campaign's dynamic lists so that the subscriber is excluded from them.
+    INSERT INTO subscriber_lists (subscriber_id, list_id, status)
+        SELECT (SELECT id FROM sub), id, 'unsubscribed' FROM lists
+        WHERE id = ANY(SELECT list_id FROM campLists) AND type = 'dynamic' AND EXISTS (SELECT 1 FROM sub)
+        ON CONFLICT (subscriber_id, list_id) DO NOTHING
 )
 UPDATE subscriber_lists SET status = 'unsubscribed', updated_at=NOW() WHERE
     subscriber_id = (SELECT id FROM sub) AND status != 'unsubscribed' AND
     -- If $3 is false, unsubscribe from the campaign's lists, otherwise all lists.
-    CASE WHEN $3 IS FALSE THEN list_id = ANY(SELECT list_id FROM lists) ELSE list_id != 0 END;
+    CASE WHEN $3 IS FALSE THEN list_id = ANY(SELECT list_id FROM campLists) ELSE list_id != 0 END;
 
 -- name: delete-unconfirmed-subscriptions
 WITH optins AS (
@@ -256,6 +652,50 @@ WITH optins AS (
 DELETE FROM subscriber_lists
     WHERE status = 'unconfirmed' AND list_id IN (SELECT id FROM optins) AND created_at < $1;
 
+-- name: get-due-optin-reminders
+-- Retrieves the unconfirmed subscriptions on double opt-in lists that are due for their next
+-- opt-in reminder, grouped by subscriber. The nth reminder of a subscription is due
+-- optin_reminder_days[n] days after its opt-in started (it was subscribed or re-subscribed). Subscriptions that are
+-- past the lists' expiry days are left to be expired instead.
+SELECT subscriber_lists.subscriber_id, ARRAY_AGG(subscriber_lists.list_id) AS list_ids
+    FROM subscriber_lists
+    INNER JOIN lists ON (lists.id = subscriber_lists.list_id)
+    INNER JOIN subscribers ON (subscribers.id = subscriber_lists.subscriber_id)
+    WHERE lists.optin = 'double' AND subscriber_lists.status = 'unconfirmed'
+        AND subscribers.status = 'enabled' AND subscribers.deleted_at IS NULL
+        AND subscriber_lists.optin_reminders < CARDINALITY(lists.optin_reminder_days)
+        AND subscriber_lists.optin_started_at +
+            MAKE_INTERVAL(days => lists.optin_reminder_days[subscriber_lists.optin_reminders + 1]) <= NOW()
+        AND (lists.optin_expiry_days = 0 OR
+            subscriber_lists.optin_started_at + MAKE_INTERVAL(days => lists.optin_expiry_days) > NOW())
+    GROUP BY subscriber_lists.subscriber_id
+    ORDER BY subscriber_lists.subscriber_id
+    LIMIT $1;
+
+-- name: update-optin-reminders
+-- Records an opt-in reminder sent for a subscriber's unconfirmed subscriptions on the given lists.
+-- The count of reminders is set to the index of the latest reminder that's due (the days are in
+-- ascending order) so that reminders that were missed, eg: while the app was down, are skipped
+-- instead of being sent one after another.
+UPDATE subscriber_lists SET optin_reminders = GREATEST(subscriber_lists.optin_reminders + 1, (
+        SELECT COUNT(*) FROM UNNEST(lists.optin_reminder_days) d
+        WHERE subscriber_lists.optin_started_at + MAKE_INTERVAL(days => d) <= NOW()
+    )), optin_reminded_at = NOW()
+    FROM lists
+    WHERE lists.id = subscriber_lists.list_id
+        AND subscriber_lists.subscriber_id = $1 AND subscriber_lists.list_id = ANY($2::INT[])
+        AND subscriber_lists.status = 'unconfirmed';
+
+-- name: expire-unconfirmed-subscriptions
+-- Unsubscribes the unconfirmed subscriptions on double opt-in lists whose opt-in started
+-- longer ago than the lists' expiry days.
+UPDATE subscriber_lists SET status = 'unsubscribed', optin_expired_at = NOW(), updated_at = NOW()
+    FROM lists
+    WHERE lists.id = subscriber_lists.list_id AND lists.optin = 'double' AND lists.optin_expiry_days > 0
+        AND subscriber_lists.status = 'unconfirmed'
+        AND subscriber_lists.optin_started_at + MAKE_INTERVAL(days => lists.optin_expiry_days) <= NOW()
+    RETURNING subscriber_lists.subscriber_id, subscriber_lists.list_id;
+
 -- privacy
 -- name: export-subscriber-data
 WITH prof AS (
@@ -265,9 +705,15 @@ WITH prof AS (
 subs AS (
     SELECT subscriber_lists.status AS subscription_status,
             (CASE WHEN lists.type = 'private' THEN 'Private list' ELSE lists.name END) as name,
-            lists.type, subscriber_lists.created_at
+            lists.type, subscriber_lists.created_at, subscriber_lists.consent,
+            list_consent_texts.text AS consent_text
     FROM lists
     LEFT JOIN subscriber_lists ON (subscriber_lists.list_id = lists.id)
+    -- The consent text that was shown when the subscription was given.
+    LEFT JOIN list_consent_texts ON (
+        list_consent_texts.list_id = lists.id AND
+        list_consent_texts.version = (subscriber_lists.consent->>'version')::INT
+    )
     WHERE subscriber_lists.subscriber_id = (SELECT id FROM prof)
 ),
 views AS (
@@ -281,12 +727,49 @@ clicks AS (
         LEFT JOIN links ON (links.id = link_clicks.link_id)
         WHERE subscriber_id = (SELECT id FROM prof)
         GROUP BY links.id ORDER BY links.id
+),
+audit AS (
+    SELECT action, source, ip, before, after, created_at FROM audit_log
+        WHERE subscriber_id = (SELECT id FROM prof)
+        ORDER BY id
 )
 SELECT (SELECT email FROM prof) as email,
         COALESCE((SELECT JSON_AGG(t) FROM prof t), '{}') AS profile,
         COALESCE((SELECT JSON_AGG(t) FROM subs t), '[]') AS subscriptions,
         COALESCE((SELECT JSON_AGG(t) FROM views t), '[]') AS campaign_views,
-        COALESCE((SELECT JSON_AGG(t) FROM clicks t), '[]') AS link_clicks;
+        COALESCE((SELECT JSON_AGG(t) FROM clicks t), '[]') AS link_clicks,
+        COALESCE((SELECT JSON_AGG(t) FROM audit t), '[]') AS audit;
+
+-- name: insert-audit-log
+-- Records an audit log entry for each of the subscribers in $1 (IDs) and $2 (UUIDs),
+-- or a single entry without a subscriber if there are none.
+WITH subs AS (
+    SELECT UNNEST($1::INT[]) AS id
+    UNION
+    SELECT id FROM subscribers WHERE uuid = ANY($2::UUID[])
+),
+ids AS (
+    SELECT id FROM subs
+    UNION ALL
+    SELECT NULL WHERE NOT EXISTS (SELECT 1 FROM subs)
+)
+INSERT INTO audit_log (subscriber_id, list_id, action, source, actor, ip, before, after)
+    SELECT ids.id, NULLIF($3::INT, 0), $4, $5, $6, $7, $8, $9 FROM ids;
+
+-- name: insert-import-audit-log
+-- Records an audit log entry for a subscriber imported by the bulk importer with the
+-- subscriber's data after the import.
+INSERT INTO audit_log (subscriber_id, action, source, actor, ip, after)
+    SELECT id, $2, 'import', $3, $4, JSONB_BUILD_OBJECT(
+        'email', email, 'name', name, 'status', status, 'attribs', attribs,
+        'lists', (SELECT COALESCE(JSONB_OBJECT_AGG(list_id::TEXT, status), '{}') FROM subscriber_lists WHERE subscriber_id = subscribers.id)
+    )
+    FROM subscribers WHERE LOWER(email) = LOWER($1);
+
+-- name: get-subscriber-audit-log
+SELECT COUNT(*) OVER () AS total, audit_log.* FROM audit_log
+    WHERE subscriber_id = $1
+    ORDER BY id DESC OFFSET $2 LIMIT (CASE WHEN $3 < 1 THEN NULL ELSE $3 END);
 
 -- Partial and RAW queries used to construct arbitrary subscriber
 -- queries for segmentation follow.
@@ -307,7 +790,8 @@ SELECT subscribers.* FROM subscribers
         AND subscriber_lists.subscriber_id = subscribers.id
         AND ($2 = '' OR subscriber_lists.status = $2::subscription_status)
     )
-    WHERE (CARDINALITY($1) = 0 OR subscriber_lists.list_id = ANY($1::INT[]))
+    WHERE subscribers.deleted_at IS NULL
+    AND (CARDINALITY($1) = 0 OR subscriber_lists.list_id = ANY($1::INT[]))
     %query%
     ORDER BY %order% OFFSET $3 LIMIT (CASE WHEN $4 < 1 THEN NULL ELSE $4 END);
 
@@ -321,7 +805,8 @@ SELECT COUNT(*) AS total FROM subscribers
         AND subscriber_lists.subscriber_id = subscribers.id
         AND ($2 = '' OR subscriber_lists.status = $2::subscription_status)
     )
-    WHERE (CARDINALITY($1) = 0 OR subscriber_lists.list_id = ANY($1::INT[])) %s;
+    WHERE subscribers.deleted_at IS NULL
+    AND (CARDINALITY($1) = 0 OR subscriber_lists.list_id = ANY($1::INT[])) %s;
 
 -- name: query-subscribers-count-all
 -- Cached query for getting the "all" subscriber count without arbitrary conditions.
@@ -350,7 +835,7 @@ SELECT subscribers.id,
         AND subscriber_lists.subscriber_id = subscribers.id
         AND ($4 = '' OR subscriber_lists.status = $4::subscription_status)
     )
-    WHERE subscriber_lists.list_id = ALL($1::INT[]) AND id > $2
+    WHERE subscribers.deleted_at IS NULL AND subscriber_lists.list_id = ALL($1::INT[]) AND id > $2
     AND (CASE WHEN CARDINALITY($3::INT[]) > 0 THEN id=ANY($3) ELSE true END)
     %query%
     ORDER BY subscribers.id ASC LIMIT (CASE WHEN $5 < 1 THEN NULL ELSE $5 END);
@@ -371,13 +856,18 @@ ON (
     (CASE WHEN CARDINALITY($2::INT[]) > 0 THEN true ELSE false END)
     AND subscriber_lists.subscriber_id = subscribers.id
 )
-WHERE subscriber_lists.list_id = ALL($2::INT[]) %s
+WHERE subscribers.deleted_at IS NULL AND subscriber_lists.list_id = ALL($2::INT[]) %s
 LIMIT (CASE WHEN $1 THEN 1 END)
 
--- name: delete-subscribers-by-query
+-- name: trash-subscribers-by-query
+-- raw: true
+WITH subs AS (%s)
+UPDATE subscribers SET deleted_at=NOW() WHERE id=ANY(SELECT id FROM subs);
+
+-- name: query-subscriber-ids-by-query
 -- raw: true
 WITH subs AS (%s)
-DELETE FROM subscribers WHERE id=ANY(SELECT id FROM subs);
+SELECT DISTINCT id FROM subs ORDER BY id;
 
 -- name: blocklist-subscribers-by-query
 -- raw: true
@@ -391,9 +881,12 @@ UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
 
 -- name: add-subscribers-to-lists-by-query
 -- raw: true
+-- $5 is the consent record of the subscriptions.
 WITH subs AS (%s)
-INSERT INTO subscriber_lists (subscriber_id, list_id, status)
-    (SELECT a, b, (CASE WHEN $4 != '' THEN $4::subscription_status ELSE 'unconfirmed' END) FROM UNNEST(ARRAY(SELECT id FROM subs)) a, UNNEST($3::INT[]) b)
+INSERT INTO subscriber_lists (subscriber_id, list_id, status, consent)
+    (SELECT a, lists.id, (CASE WHEN $4 != '' THEN $4::subscription_status ELSE 'unconfirmed' END),
+        $5::JSONB || JSONB_BUILD_OBJECT('version', lists.consent_version)
+        FROM UNNEST(ARRAY(SELECT id FROM subs)) a, lists WHERE lists.id = ANY($3::INT[]))
     ON CONFLICT (subscriber_id, list_id) DO NOTHING;
 
 -- name: delete-subscriptions-by-query
@@ -404,7 +897,13 @@ DELETE FROM subscriber_lists
 
 -- name: unsubscribe-subscribers-from-lists-by-query
 -- raw: true
-WITH subs AS (%s)
+WITH subs AS (%s),
+dyn AS (
+    -- Dynamic lists have no subscriptions to update. Record the unsubscriptions against them.
+    INSERT INTO subscriber_lists (subscriber_id, list_id, status)
+        SELECT subs.id, lists.id, 'unsubscribed' FROM subs, lists WHERE lists.id = ANY($3::INT[]) AND lists.type = 'dynamic'
+        ON CONFLICT (subscriber_id, list_id) DO NOTHING
+)
 UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
     WHERE (subscriber_id, list_id) = ANY(SELECT a, b FROM UNNEST(ARRAY(SELECT id FROM subs)) a, UNNEST($3::INT[]) b);
 
@@ -446,15 +945,43 @@ SELECT * FROM lists WHERE (CASE WHEN $1 != '' THEN optin=$1::list_optin ELSE TRU
     END) ORDER BY name;
 
 -- name: create-list
-INSERT INTO lists (uuid, name, type, optin, tags, description) VALUES($1, $2, $3, $4, $5, $6) RETURNING id;
+-- The consent text ($13) of a list is versioned and every version is kept for proof of consent.
+WITH l AS (
+    INSERT INTO lists (uuid, name, type, optin, tags, description, query, from_email, template_id, messenger, reply_to, headers,
+        consent_text, consent_version, optin_reminder_days, optin_expiry_days)
+    VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, (CASE WHEN $13 != '' THEN 1 ELSE 0 END), $14, $15)
+    RETURNING id, consent_text, consent_version
+),
+txt AS (
+    INSERT INTO list_consent_texts (list_id, version, text)
+        SELECT id, consent_version, consent_text FROM l WHERE consent_version > 0
+)
+SELECT id FROM l;
 
 -- name: update-list
+-- name, type, optin, and description are kept if they're empty. The other fields
+-- are replaced as a whole, which is what allows them to be cleared.
+-- A change to the consent text ($13) creates a new version of it.
+WITH txt AS (
+    INSERT INTO list_consent_texts (list_id, version, text)
+        SELECT id, consent_version + 1, $13 FROM lists WHERE id = $1 AND consent_text != $13
+)
 UPDATE lists SET
     name=(CASE WHEN $2 != '' THEN $2 ELSE name END),
     type=(CASE WHEN $3 != '' THEN $3::list_type ELSE type END),
     optin=(CASE WHEN $4 != '' THEN $4::list_optin ELSE optin END),
     tags=$5::VARCHAR(100)[],
     description=(CASE WHEN $6 != '' THEN $6 ELSE description END),
+    query=$7,
+    from_email=$8,
+    template_id=$9,
+    messenger=$10,
+    reply_to=$11,
+    headers=$12,
+    consent_version=(CASE WHEN consent_text != $13 THEN consent_version + 1 ELSE consent_version END),
+    consent_text=$13,
+    optin_reminder_days=$14,
+    optin_expiry_days=$15,
     updated_at=NOW()
 WHERE id = $1;
 
@@ -464,6 +991,102 @@ UPDATE lists SET updated_at=NOW() WHERE id = ANY($1);
 -- name: delete-lists
 DELETE FROM lists WHERE id = ALL($1);
 
+-- name: get-list-subscriber-ids
+-- Retrieves the IDs of the subscribers on a list, excluding trashed subscribers, in a
+-- random order if $2 is true.
+SELECT subscriber_lists.subscriber_id FROM subscriber_lists
+    INNER JOIN subscribers ON (subscribers.id = subscriber_lists.subscriber_id AND subscribers.deleted_at IS NULL)
+    WHERE subscriber_lists.list_id = $1
+    ORDER BY (CASE WHEN $2 THEN RANDOM() ELSE subscriber_lists.subscriber_id END);
+
+-- name: copy-subscriptions
+-- Copies the subscriptions of the given subscribers ($3) on a list ($1) to another list ($2)
+-- along with their statuses, meta, and consent records. The consent records are kept as
+-- they were given and are marked with the source list (copied_from). Existing subscriptions
+-- on the target list are left as they are.
+INSERT INTO subscriber_lists (subscriber_id, list_id, meta, consent, status, unsubscribed_at)
+    SELECT subscriber_id, $2, meta, consent || JSONB_BUILD_OBJECT('copied_from', $1::INT),
+        status, unsubscribed_at FROM subscriber_lists
+    WHERE list_id = $1 AND subscriber_id = ANY($3::INT[])
+    ON CONFLICT (subscriber_id, list_id) DO NOTHING;
+
+-- name: snapshot-list-stats
+-- Records the daily growth and churn stats of all lists for the days since the last
+-- snapshot up to yesterday, going back at most $1 days. Subscriptions and unsubscriptions
+-- are counted by the days they were made (created_at and unsubscribed_at), confirmations
+-- by the days of the double opt-in confirmations, and bounces by the days of the bounces
+-- of the lists' subscribers. The totals of past days include the subscriptions that were
+-- unsubscribed after them. The EXISTS checks are evaluated once and skip the scans when
+-- there are no days due, which is most of the hourly runs.
+WITH days AS (
+    SELECT d::DATE AS date FROM GENERATE_SERIES(
+        GREATEST(
+            COALESCE((SELECT MAX(date) + 1 FROM list_daily_stats), CURRENT_DATE - 1),
+            CURRENT_DATE - $1::INT
+        )::TIMESTAMP,
+        (CURRENT_DATE - 1)::TIMESTAMP,
+        '1 day'
+    ) d
+),
+subs AS (
+    SELECT days.date, lists.id AS list_id, lists.type, lists.query,
+        -- Dynamic lists only have subscriptions that record unsubscriptions.
+        COUNT(subscriber_lists.subscriber_id) FILTER (
+            WHERE lists.type != 'dynamic' AND subscriber_lists.created_at::DATE = days.date
+        ) AS subscriptions,
+        COUNT(subscriber_lists.subscriber_id) FILTER (
+            WHERE (subscriber_lists.consent->>'confirmed_at')::TIMESTAMP WITH TIME ZONE::DATE = days.date
+        ) AS confirmations,
+        COUNT(subscriber_lists.subscriber_id) FILTER (
+            WHERE subscriber_lists.status = 'unsubscribed' AND subscriber_lists.optin_expired_at IS NULL
+            AND subscriber_lists.unsubscribed_at::DATE = days.date
+        ) AS unsubscriptions,
+        COUNT(subscriber_lists.subscriber_id) FILTER (
+            WHERE subscriber_lists.created_at::DATE <= days.date
+            AND (subscriber_lists.unsubscribed_at IS NULL OR subscriber_lists.unsubscribed_at::DATE > days.date)
+        ) AS total,
+        COUNT(subscriber_lists.subscriber_id) FILTER (
+            WHERE lists.optin = 'double' AND subscriber_lists.status = 'unconfirmed'
+            AND subscriber_lists.optin_started_at::DATE <= days.date
+        ) AS optin_pending,
+        COUNT(subscriber_lists.subscriber_id) FILTER (
+            WHERE lists.optin = 'double' AND subscriber_lists.status = 'unconfirmed'
+            AND subscriber_lists.optin_reminded_at::DATE <= days.date
+        ) AS optin_reminded,
+        COUNT(subscriber_lists.subscriber_id) FILTER (
+            WHERE subscriber_lists.optin_expired_at::DATE = days.date
+        ) AS optin_expired
+    FROM days
+    CROSS JOIN lists
+    LEFT JOIN subscriber_lists ON (subscriber_lists.list_id = lists.id)
+    WHERE EXISTS (SELECT 1 FROM days)
+    GROUP BY days.date, lists.id
+),
+bnc AS (
+    SELECT days.date, subscriber_lists.list_id, COUNT(*) AS bounces FROM days
+    INNER JOIN bounces ON (bounces.created_at::DATE = days.date)
+    INNER JOIN subscriber_lists ON (subscriber_lists.subscriber_id = bounces.subscriber_id)
+    WHERE EXISTS (SELECT 1 FROM days)
+    GROUP BY days.date, subscriber_lists.list_id
+)
+INSERT INTO list_daily_stats (list_id, date, subscriptions, confirmations, unsubscriptions, bounces, net_growth, total,
+    optin_pending, optin_reminded, optin_expired)
+    SELECT subs.list_id, subs.date, subs.subscriptions, subs.confirmations, subs.unsubscriptions,
+        COALESCE(bnc.bounces, 0),
+        subs.subscriptions - subs.unsubscriptions - subs.optin_expired,
+        (CASE WHEN subs.type = 'dynamic' THEN COUNT_DYNAMIC_LIST_SUBSCRIBERS(subs.list_id, subs.query) ELSE subs.total END),
+        subs.optin_pending, subs.optin_reminded, subs.optin_expired
+    FROM subs
+    LEFT JOIN bnc ON (bnc.date = subs.date AND bnc.list_id = subs.list_id)
+    ON CONFLICT (list_id, date) DO NOTHING;
+
+-- name: get-list-stats
+-- Retrieves the daily growth and churn stats of a list between two dates.
+SELECT date, subscriptions, confirmations, unsubscriptions, bounces, net_growth, total,
+    optin_pending, optin_reminded, optin_expired
+    FROM list_daily_stats WHERE list_id = $1 AND date >= $2::DATE AND date <= $3::DATE
+    ORDER BY date;
+
 -- name: store-email
 INSERT INTO emails (message_id, campaign_uuid, subscriber_uuid, recipient, source, subject, status, sent_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8);
 
@@ -483,6 +1106,76 @@ UPDATE emails SET status=$2 WHERE message_id = $1;
 INSERT INTO email_events (email_id, message_id, campaign_uuid, subscriber_uuid, event, event_data, timestamp) VALUES($1, $2, $3, $4, $5, $6, $7);
 
 -- campaigns
+-- segments
+-- name: query-segments
+SELECT COUNT(*) OVER () AS total, segments.* FROM segments
+    WHERE ($1 = 0 OR id = $1) AND ($2 = '' OR name ILIKE $2)
+    ORDER BY %order% OFFSET $3 LIMIT (CASE WHEN $4 < 1 THEN NULL ELSE $4 END);
+
+-- name: create-segment
+INSERT INTO segments (uuid, name, query, filter) VALUES($1, $2, $3, $4) RETURNING id;
+
+-- name: update-segment
+UPDATE segments SET name=$2, query=$3, filter=$4, updated_at=NOW() WHERE id=$1;
+
+-- name: update-segment-count
+UPDATE segments SET subscriber_count=$2, counted_at=NOW() WHERE id=$1;
+
+-- name: delete-segments
+DELETE FROM segments WHERE id = ANY($1);
+
+-- name: get-campaign-segments-for-snapshot
+-- Segments of campaigns that are due to start (or have been started) whose
+-- subscribers haven't been snapshotted yet.
+SELECT campaign_segments.campaign_id, segments.* FROM campaign_segments
+    INNER JOIN segments ON (segments.id = campaign_segments.segment_id)
+    INNER JOIN campaigns ON (campaigns.id = campaign_segments.campaign_id)
+    WHERE campaign_segments.snapshot_at IS NULL
+    AND campaigns.type = 'regular'
+    AND (campaigns.status = 'running' OR (campaigns.status = 'scheduled' AND NOW() >= campaigns.send_at));
+
+-- name: snapshot-campaign-segment
+-- raw: true
+-- Records the subscribers matching a segment (%s = query-subscribers-template) as the
+-- recipients of a campaign. $3 = campaign ID, $4 = segment ID.
+-- Subscribers who have unsubscribed from all their lists have opted out of
+-- e-mails altogether and are skipped. Subscribers on no lists are included.
+WITH subs AS (%s),
+ins AS (
+    INSERT INTO campaign_subscribers (campaign_id, subscriber_id)
+        (SELECT $3, id FROM subs WHERE
+            EXISTS (SELECT 1 FROM subscriber_lists sl WHERE sl.subscriber_id = subs.id AND sl.status != 'unsubscribed')
+            OR NOT EXISTS (SELECT 1 FROM subscriber_lists sl WHERE sl.subscriber_id = subs.id))
+        ON CONFLICT DO NOTHING
+)
+UPDATE campaign_segments SET snapshot_at=NOW() WHERE campaign_id=$3 AND segment_id=$4;
+
+-- name: get-campaign-lists-for-snapshot
+-- Dynamic lists of campaigns that are due to start (or have been started) whose
+-- subscribers haven't been snapshotted yet.
+SELECT campaign_lists.campaign_id, lists.* FROM campaign_lists
+    INNER JOIN lists ON (lists.id = campaign_lists.list_id)
+    INNER JOIN campaigns ON (campaigns.id = campaign_lists.campaign_id)
+    WHERE campaign_lists.snapshot_at IS NULL AND lists.type = 'dynamic'
+    AND campaigns.type = 'regular'
+    AND (campaigns.status = 'running' OR (campaigns.status = 'scheduled' AND NOW() >= campaigns.send_at));
+
+-- name: snapshot-campaign-list
+-- raw: true
+-- Records the subscribers matching the query of a dynamic list (%s = query-subscribers-template),
+-- except the ones who have unsubscribed from it, as the recipients of a campaign.
+-- $3 = campaign ID, $4 = list ID.
+WITH subs AS (%s),
+ins AS (
+    INSERT INTO campaign_subscribers (campaign_id, subscriber_id)
+        (SELECT $3, id FROM subs WHERE NOT EXISTS (
+            SELECT 1 FROM subscriber_lists WHERE subscriber_lists.subscriber_id = subs.id
+            AND subscriber_lists.list_id = $4 AND subscriber_lists.status = 'unsubscribed'
+        ))
+        ON CONFLICT DO NOTHING
+)
+UPDATE campaign_lists SET snapshot_at=NOW() WHERE campaign_id=$3 AND list_id=$4;
+
 -- name: create-campaign
 -- This creates the campaign and inserts campaign_lists relationships.
 WITH campLists AS (
@@ -509,7 +1202,7 @@ counts AS (
         (CASE WHEN campLists.optin = 'double' THEN subscriber_lists.status = 'confirmed' ELSE true END)
     )
     WHERE subscriber_lists.list_id=ANY($14::INT[])
-    AND subscribers.status='enabled'
+    AND subscribers.status='enabled' AND subscribers.deleted_at IS NULL
 ),
 camp AS (
     INSERT INTO campaigns (uuid, type, name, subject, from_email, body, altbody, content_type, send_at, headers, tags, messenger, template_id, to_send, max_subscriber_id, archive, archive_slug, archive_template_id, archive_meta)
@@ -526,6 +1219,10 @@ med AS (
 insLists AS (
     INSERT INTO campaign_lists (campaign_id, list_id, list_name)
         SELECT (SELECT id FROM camp), id, name FROM lists WHERE id=ANY($14::INT[])
+),
+insSegments AS (
+    INSERT INTO campaign_segments (campaign_id, segment_id, segment_name)
+        SELECT (SELECT id FROM camp), id, name FROM segments WHERE id=ANY($20::INT[])
 )
 SELECT id FROM camp;
 
@@ -590,6 +1287,10 @@ WITH lists AS (
     SELECT campaign_id, JSON_AGG(JSON_BUILD_OBJECT('id', list_id, 'name', list_name)) AS lists FROM campaign_lists
     WHERE campaign_id = ANY($1) GROUP BY campaign_id
 ),
+segments AS (
+    SELECT campaign_id, JSON_AGG(JSON_BUILD_OBJECT('id', segment_id, 'name', segment_name)) AS segments FROM campaign_segments
+    WHERE campaign_id = ANY($1) GROUP BY campaign_id
+),
 media AS (
     SELECT campaign_id, JSON_AGG(JSON_BUILD_OBJECT('id', media_id, 'filename', filename)) AS media FROM campaign_media
     WHERE campaign_id = ANY($1) GROUP BY campaign_id
@@ -614,9 +1315,11 @@ SELECT id as campaign_id,
     COALESCE(c.num, 0) AS clicks,
     COALESCE(b.num, 0) AS bounces,
     COALESCE(l.lists, '[]') AS lists,
+    COALESCE(s.segments, '[]') AS segments,
     COALESCE(m.media, '[]') AS media
 FROM (SELECT id FROM UNNEST($1) AS id) x
 LEFT JOIN lists AS l ON (l.campaign_id = id)
+LEFT JOIN segments AS s ON (s.campaign_id = id)
 LEFT JOIN media AS m ON (m.campaign_id = id)
 LEFT JOIN views AS v ON (v.campaign_id = id)
 LEFT JOIN clicks AS c ON (c.campaign_id = id)
@@ -644,7 +1347,7 @@ SELECT id, status, to_send, sent, started_at, updated_at
 -- name: next-campaigns
 -- Retreives campaigns that are running (or scheduled and the time's up) and need
 -- to be processed. It updates the to_send count and max_subscriber_id of the campaign,
--- that is, the total number of subscribers to be processed across all lists of a campaign.
+-- that is, the total number of subscribers to be processed across all lists and segments of a campaign.
 -- Thus, it has a sideaffect.
 -- In addition, it finds the max_subscriber_id, the upper limit across all lists of
 -- a campaign. This is used to fetch and slice subscribers for the campaign in next-campaign-subscribers.
@@ -655,12 +1358,26 @@ WITH camps AS (
     LEFT JOIN templates ON (templates.id = campaigns.template_id)
     WHERE (status='running' OR (status='scheduled' AND NOW() >= campaigns.send_at))
     AND NOT(campaigns.id = ANY($1::INT[]))
+
+    -- Campaigns with segments are picked up only after their subscribers are snapshotted.
+    AND NOT EXISTS (
+        SELECT 1 FROM campaign_segments WHERE campaign_segments.campaign_id = campaigns.id
+        AND campaign_segments.segment_id IS NOT NULL AND campaign_segments.snapshot_at IS NULL
+    )
+
+    -- As are regular campaigns with dynamic lists.
+    AND (campaigns.type != 'regular' OR NOT EXISTS (
+        SELECT 1 FROM campaign_lists INNER JOIN lists ON (lists.id = campaign_lists.list_id)
+        WHERE campaign_lists.campaign_id = campaigns.id
+        AND lists.type = 'dynamic' AND campaign_lists.snapshot_at IS NULL
+    ))
 ),
 campLists AS (
     -- Get the list_ids and their optin statuses for the campaigns found in the previous step.
+    -- The subscribers of dynamic lists are snapshotted along with segment subscribers.
     SELECT lists.id AS list_id, campaign_id, optin FROM lists
     INNER JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
-    WHERE campaign_lists.campaign_id = ANY(SELECT id FROM camps)
+    WHERE campaign_lists.campaign_id = ANY(SELECT id FROM camps) AND lists.type != 'dynamic'
 ),
 campMedia AS (
     -- Get the list_ids and their optin statuses for the campaigns found in the previous step.
@@ -668,15 +1385,12 @@ campMedia AS (
     WHERE campaign_id = ANY(SELECT id FROM camps) AND media_id IS NOT NULL
     GROUP BY campaign_id
 ),
-counts AS (
-    -- For each campaign above, get the total number of subscribers and the max_subscriber_id
-    -- across all its lists.
-    SELECT id AS campaign_id,
-                 COUNT(DISTINCT(subscriber_lists.subscriber_id)) AS to_send,
-                 COALESCE(MAX(subscriber_lists.subscriber_id), 0) AS max_subscriber_id
+campSubs AS (
+    -- For each campaign above, get the subscribers across all its lists.
+    SELECT camps.id AS campaign_id, subscriber_lists.subscriber_id
     FROM camps
-    LEFT JOIN campLists ON (campLists.campaign_id = camps.id)
-    LEFT JOIN subscriber_lists ON (
+    INNER JOIN campLists ON (campLists.campaign_id = camps.id)
+    INNER JOIN subscriber_lists ON (
         subscriber_lists.list_id = campLists.list_id AND
         (CASE
             -- For optin campaigns, only e-mail 'unconfirmed' subscribers belonging to 'double' optin lists.
@@ -690,6 +1404,21 @@ counts AS (
             ELSE subscriber_lists.status != 'unsubscribed'
         END)
     )
+
+    UNION
+
+    -- And the subscribers snapshotted from its segments and dynamic lists.
+    SELECT campaign_id, subscriber_id FROM campaign_subscribers
+    WHERE campaign_id = ANY(SELECT id FROM camps)
+),
+counts AS (
+    -- For each campaign above, get the total number of subscribers and the max_subscriber_id
+    -- across all its lists and segments.
+    SELECT camps.id AS campaign_id,
+                 COUNT(campSubs.subscriber_id) AS to_send,
+                 COALESCE(MAX(campSubs.subscriber_id), 0) AS max_subscriber_id
+    FROM camps
+    LEFT JOIN campSubs ON (campSubs.campaign_id = camps.id)
     GROUP BY camps.id
 ),
 updateCounts AS (
@@ -764,10 +1493,15 @@ WITH camps AS (
 campLists AS (
     SELECT lists.id AS list_id, optin FROM lists
     LEFT JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
-    WHERE campaign_lists.campaign_id = $1
+    WHERE campaign_lists.campaign_id = $1 AND lists.type != 'dynamic'
+),
+dynLists AS (
+    SELECT lists.id AS list_id FROM lists
+    INNER JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
+    WHERE campaign_lists.campaign_id = $1 AND lists.type = 'dynamic'
 ),
 subIDs AS (
-    SELECT DISTINCT ON (subscriber_lists.subscriber_id) subscriber_id, list_id, status FROM subscriber_lists
+    (SELECT DISTINCT ON (subscriber_lists.subscriber_id) subscriber_id, list_id, status FROM subscriber_lists
     WHERE
         -- ARRAY_AGG is 20x faster instead of a simple SELECT because the query planner
         -- understands the CTE's cardinality after the scalar array conversion. Huh.
@@ -775,27 +1509,52 @@ subIDs AS (
         status != 'unsubscribed' AND
         subscriber_id > (SELECT last_subscriber_id FROM camps) AND
         subscriber_id <= (SELECT max_subscriber_id FROM camps)
-    ORDER BY subscriber_id LIMIT $2
-),
-subs AS (
-    SELECT subscribers.* FROM subIDs
-    LEFT JOIN campLists ON (campLists.list_id = subIDs.list_id)
-    INNER JOIN subscribers ON (
-        subscribers.status != 'blocklisted' AND
-        subscribers.id = subIDs.subscriber_id AND
+    ORDER BY subscriber_id LIMIT $2)
 
-        (CASE
-            -- For optin campaigns, only e-mail 'unconfirmed' subscribers.
-            WHEN (SELECT type FROM camps) = 'optin' THEN subIDs.status = 'unconfirmed' AND campLists.optin = 'double'
-
-            -- For regular campaigns with double optin lists, only e-mail 'confirmed' subscribers.
-            WHEN campLists.optin = 'double' THEN subIDs.status = 'confirmed'
+    UNION ALL
 
-            -- For regular campaigns with non-double optin lists, e-mail everyone
-            -- except unsubscribed subscribers.
-            ELSE subIDs.status != 'unsubscribed'
-        END)
+    -- Subscribers snapshotted from the campaign's segments and dynamic lists when it started. They
+    -- have no list (NULL list_id) and aren't bound by subscription statuses, except that the ones
+    -- who have since unsubscribed from any of the campaign's dynamic lists are skipped.
+    (SELECT subscriber_id, NULL, NULL FROM campaign_subscribers
+    WHERE
+        campaign_id = $1 AND
+        subscriber_id > (SELECT last_subscriber_id FROM camps) AND
+        subscriber_id <= (SELECT max_subscriber_id FROM camps) AND
+        NOT EXISTS (
+            SELECT 1 FROM subscriber_lists WHERE subscriber_lists.subscriber_id = campaign_subscribers.subscriber_id
+            AND subscriber_lists.list_id IN (SELECT list_id FROM dynLists) AND subscriber_lists.status = 'unsubscribed'
+        )
+    ORDER BY subscriber_id LIMIT $2)
+),
+batch AS (
+    -- Both the list and segment subscribers above are fetched in batches of $2. Cut
+    -- the combined set at the $2th ID, until which both the batches are complete.
+    SELECT subscriber_id FROM subIDs ORDER BY subscriber_id LIMIT $2
+),
+subs AS (
+    SELECT subscribers.* FROM subscribers
+    WHERE subscribers.status != 'blocklisted' AND subscribers.deleted_at IS NULL AND subscribers.id IN (
+        SELECT subIDs.subscriber_id FROM subIDs
+        LEFT JOIN campLists ON (campLists.list_id = subIDs.list_id)
+        WHERE
+            subIDs.subscriber_id <= (SELECT MAX(subscriber_id) FROM batch) AND
+            (CASE
+                -- Segment subscribers.
+                WHEN subIDs.list_id IS NULL THEN (SELECT type FROM camps) != 'optin'
+
+                -- For optin campaigns, only e-mail 'unconfirmed' subscribers.
+                WHEN (SELECT type FROM camps) = 'optin' THEN subIDs.status = 'unconfirmed' AND campLists.optin = 'double'
+
+                -- For regular campaigns with double optin lists, only e-mail 'confirmed' subscribers.
+                WHEN campLists.optin = 'double' THEN subIDs.status = 'confirmed'
+
+                -- For regular campaigns with non-double optin lists, e-mail everyone
+                -- except unsubscribed subscribers.
+                ELSE subIDs.status != 'unsubscribed'
+            END)
     )
+    ORDER BY subscribers.id
 ),
 u AS (
     UPDATE campaigns
@@ -813,7 +1572,7 @@ DELETE FROM link_clicks WHERE created_at < $1;
 -- name: get-one-campaign-subscriber
 SELECT * FROM subscribers
 LEFT JOIN subscriber_lists ON (subscribers.id = subscriber_lists.subscriber_id AND subscriber_lists.status != 'unsubscribed')
-WHERE subscriber_lists.list_id=ANY(
+WHERE subscribers.deleted_at IS NULL AND subscriber_lists.list_id=ANY(
     SELECT list_id FROM campaign_lists where campaign_id=$1 AND list_id IS NOT NULL
 )
 ORDER BY RANDOM() LIMIT 1;
@@ -853,6 +1612,15 @@ medi AS (
     INSERT INTO campaign_media (campaign_id, media_id, filename)
         (SELECT $1 AS campaign_id, id, filename FROM media WHERE id=ANY($19::INT[]))
         ON CONFLICT (campaign_id, media_id) DO NOTHING
+),
+csegs AS (
+    -- Reset segment relationships
+    DELETE FROM campaign_segments WHERE campaign_id = $1 AND NOT(segment_id = ANY($21))
+),
+isegs AS (
+    INSERT INTO campaign_segments (campaign_id, segment_id, segment_name)
+        (SELECT $1 as campaign_id, id, name FROM segments WHERE id=ANY($21::INT[]))
+        ON CONFLICT (campaign_id, segment_id) DO UPDATE SET segment_name = EXCLUDED.segment_name
 )
 INSERT INTO campaign_lists (campaign_id, list_id, list_name)
     (SELECT $1 as campaign_id, id, name FROM lists WHERE id=ANY($14::INT[]))
@@ -867,6 +1635,10 @@ UPDATE campaigns SET
 WHERE id=$1;
 
 -- name: update-campaign-status
+WITH subs AS (
+    -- Finished and cancelled campaigns can't be restarted. Clear their snapshot of segment subscribers.
+    DELETE FROM campaign_subscribers WHERE campaign_id = $1 AND $2::campaign_status IN ('finished', 'cancelled')
+)
 UPDATE campaigns SET status=$2, updated_at=NOW() WHERE id = $1;
 
 -- name: update-campaign-archive
@@ -948,6 +1720,10 @@ def AS (
 ),
 up AS (
     UPDATE campaigns SET template_id = (SELECT id FROM def) WHERE (SELECT id FROM tpl) > 0 AND template_id = $1
+),
+lists AS (
+    -- Lists with the template as their default fall back to the campaign's template.
+    UPDATE lists SET template_id = NULL WHERE (SELECT id FROM tpl) > 0 AND template_id = $1
 )
 SELECT id FROM tpl;
 
@@ -998,8 +1774,11 @@ UPDATE settings AS s SET value = c.value
 
 -- name: record-bounce
 -- Insert a bounce and count the bounces for the subscriber and either unsubscribe them,
+-- blocklist them, or move them to the trash. Subscribers in the trash are ignored.
+-- Returns the subscriber's ID, the action taken, if any, and the lists unsubscribed from.
 WITH sub AS (
-    SELECT id, status FROM subscribers WHERE CASE WHEN $1 != '' THEN uuid = $1::UUID ELSE email = $2 END
+    SELECT id, status FROM subscribers WHERE deleted_at IS NULL
+        AND CASE WHEN $1 != '' THEN uuid = $1::UUID ELSE email = $2 END
 ),
 camp AS (
     SELECT id FROM campaigns WHERE $3 != '' AND uuid = $3::UUID
@@ -1012,20 +1791,35 @@ num AS (
 block1 AS (
     UPDATE subscribers SET status='blocklisted'
     WHERE $9 = 'blocklist' AND (SELECT num FROM num) >= $8 AND id = (SELECT id FROM sub) AND (SELECT status FROM sub) != 'blocklisted'
+    RETURNING id
 ),
 block2 AS (
-    UPDATE subscriber_lists SET status='unsubscribed'
+    UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
     WHERE $9 = 'unsubscribe' AND (SELECT num FROM num) >= $8 AND subscriber_id = (SELECT id FROM sub) AND (SELECT status FROM sub) != 'blocklisted'
+        AND status != 'unsubscribed'
+    RETURNING list_id
 ),
 bounce AS (
     -- Record the bounce if the subscriber is not already blocklisted;
     INSERT INTO bounces (subscriber_id, campaign_id, type, source, meta, created_at)
     SELECT (SELECT id FROM sub), (SELECT id FROM camp), $4, $5, $6, $7
     WHERE NOT EXISTS (SELECT 1 WHERE (SELECT status FROM sub) = 'blocklisted' OR (SELECT num FROM num) > $8)
+),
+-- This will only run when $9 = 'delete' and the number of bounces exceed $8. Like
+-- deleting subscribers otherwise, it moves them to the trash.
+del AS (
+    UPDATE subscribers SET deleted_at=NOW()
+    WHERE $9 = 'delete' AND (SELECT num FROM num) >= $8 AND id = (SELECT id FROM sub)
+    RETURNING id
 )
--- This delete  will only run when $9 = 'delete' and the number of bounces exceed $8.
-DELETE FROM subscribers
-    WHERE $9 = 'delete' AND (SELECT num FROM num) >= $8 AND id = (SELECT id FROM sub);
+SELECT (SELECT id FROM sub) AS subscriber_id,
+    (CASE
+        WHEN EXISTS (SELECT 1 FROM block1) THEN 'blocklist'
+        WHEN EXISTS (SELECT 1 FROM block2) THEN 'unsubscribe'
+        WHEN EXISTS (SELECT 1 FROM del) THEN 'delete'
+        ELSE ''
+    END) AS action,
+    COALESCE((SELECT ARRAY_AGG(list_id) FROM block2), '{}') AS list_ids;
 
 -- name: query-bounces
 SELECT COUNT(*) OVER () AS total,
@@ -1,4 +1,4 @@
-DROP TYPE IF EXISTS list_type CASCADE; CREATE TYPE list_type AS ENUM ('public', 'private', 'temporary');
+DROP TYPE IF EXISTS list_type CASCADE; CREATE TYPE list_type AS ENUM ('public', 'private', 'temporary', 'dynamic');
 DROP TYPE IF EXISTS list_optin CASCADE; CREATE TYPE list_optin AS ENUM ('single', 'double');
 DROP TYPE IF EXISTS subscriber_status CASCADE; CREATE TYPE subscriber_status AS ENUM ('enabled', 'disabled', 'blocklisted');
 DROP TYPE IF EXISTS subscription_status CASCADE; CREATE TYPE subscription_status AS ENUM ('unconfirmed', 'confirmed', 'unsubscribed');
@@ -7,6 +7,28 @@ DROP TYPE IF EXISTS campaign_type CASCADE; CREATE TYPE campaign_type AS ENUM ('r
 DROP TYPE IF EXISTS content_type CASCADE; CREATE TYPE content_type AS ENUM ('richtext', 'html', 'plain', 'markdown');
 DROP TYPE IF EXISTS bounce_type CASCADE; CREATE TYPE bounce_type AS ENUM ('soft', 'hard', 'complaint');
 DROP TYPE IF EXISTS template_type CASCADE; CREATE TYPE template_type AS ENUM ('campaign', 'tx');
+DROP TYPE IF EXISTS import_run_status CASCADE; CREATE TYPE import_run_status AS ENUM ('importing', 'stopping', 'stopped', 'finished', 'failed');
+DROP TYPE IF EXISTS export_job_status CASCADE; CREATE TYPE export_job_status AS ENUM ('running', 'finished', 'failed');
+
+-- Applies a JSON merge patch (RFC 7396) to a JSONB value. Nested objects are
+-- merged recursively and null values in the patch remove keys.
+CREATE OR REPLACE FUNCTION JSONB_MERGE_PATCH(target JSONB, patch JSONB) RETURNS JSONB AS $$
+BEGIN
+    IF JSONB_TYPEOF(patch) IS DISTINCT FROM 'object' THEN
+        RETURN patch;
+    END IF;
+    IF JSONB_TYPEOF(target) IS DISTINCT FROM 'object' THEN
+        target := '{}';
+    END IF;
+
+    RETURN (
+        SELECT COALESCE(JSONB_OBJECT_AGG(COALESCE(p.key, t.key),
+            CASE WHEN p.key IS NULL THEN t.value ELSE JSONB_MERGE_PATCH(t.value, p.value) END), '{}')
+        FROM JSONB_EACH(target) t FULL OUTER JOIN JSONB_EACH(patch) p ON (p.key = t.key)
+        WHERE p.value IS NULL OR p.value != 'null'::JSONB
+    );
+END;
+$$ LANGUAGE plpgsql IMMUTABLE;
 
 -- subscribers
 DROP TABLE IF EXISTS subscribers CASCADE;
@@ -18,13 +40,22 @@ CREATE TABLE subscribers (
     attribs         JSONB NOT NULL DEFAULT '{}',
     status          subscriber_status NOT NULL DEFAULT 'enabled',
 
+    -- Computed periodically from campaign views, link clicks, and e-mail events.
+    engagement_score REAL NOT NULL DEFAULT 0,
+    last_engaged_at  TIMESTAMP WITH TIME ZONE NULL,
+
     created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
-    updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+    updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    -- Set when the subscriber is moved to the trash.
+    deleted_at      TIMESTAMP WITH TIME ZONE NULL
 );
 DROP INDEX IF EXISTS idx_subs_email; CREATE UNIQUE INDEX idx_subs_email ON subscribers(LOWER(email));
 DROP INDEX IF EXISTS idx_subs_status; CREATE INDEX idx_subs_status ON subscribers(status);
 DROP INDEX IF EXISTS idx_subs_created_at; CREATE INDEX idx_subs_created_at ON subscribers(created_at);
 DROP INDEX IF EXISTS idx_subs_updated_at; CREATE INDEX idx_subs_updated_at ON subscribers(updated_at);
+DROP INDEX IF EXISTS idx_subs_engagement_score; CREATE INDEX idx_subs_engagement_score ON subscribers(engagement_score);
+DROP INDEX IF EXISTS idx_subs_deleted_at; CREATE INDEX idx_subs_deleted_at ON subscribers(deleted_at) WHERE deleted_at IS NOT NULL;
 
 -- lists
 DROP TABLE IF EXISTS lists CASCADE;
@@ -37,6 +68,27 @@ CREATE TABLE lists (
     tags            VARCHAR(100)[],
     description     TEXT NOT NULL DEFAULT '',
 
+    -- Subscriber query (SQL expression) that defines the members of dynamic lists.
+    query           TEXT NOT NULL DEFAULT '',
+
+    -- Optional defaults for campaigns that target the list. The template isn't
+    -- a foreign key as the templates table is created after this one.
+    from_email      TEXT NOT NULL DEFAULT '',
+    template_id     INTEGER NULL,
+    messenger       TEXT NOT NULL DEFAULT '',
+    reply_to        TEXT NOT NULL DEFAULT '',
+    headers         JSONB NOT NULL DEFAULT '[]',
+
+    -- Consent text shown on subscription forms. Every change bumps the version
+    -- and is kept in list_consent_texts.
+    consent_text    TEXT NOT NULL DEFAULT '',
+    consent_version INTEGER NOT NULL DEFAULT 0,
+
+    -- Double opt-in policy: reminders are sent the given numbers of days after an
+    -- unconfirmed subscription, which expires after optin_expiry_days (0 = never).
+    optin_reminder_days INTEGER[] NOT NULL DEFAULT '{}',
+    optin_expiry_days   INTEGER NOT NULL DEFAULT 0,
+
     created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
@@ -46,6 +98,41 @@ DROP INDEX IF EXISTS idx_lists_name; CREATE INDEX idx_lists_name ON lists(name);
 DROP INDEX IF EXISTS idx_lists_created_at; CREATE INDEX idx_lists_created_at ON lists(created_at);
 DROP INDEX IF EXISTS idx_lists_updated_at; CREATE INDEX idx_lists_updated_at ON lists(updated_at);
 
+-- versions of list consent texts
+DROP TABLE IF EXISTS list_consent_texts CASCADE;
+CREATE TABLE list_consent_texts (
+    list_id         INTEGER NOT NULL REFERENCES lists(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    version         INTEGER NOT NULL,
+    text            TEXT NOT NULL DEFAULT '',
+    created_at      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    PRIMARY KEY(list_id, version)
+);
+
+-- daily growth and churn stats of lists
+DROP TABLE IF EXISTS list_daily_stats CASCADE;
+CREATE TABLE list_daily_stats (
+    list_id          INTEGER NOT NULL REFERENCES lists(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    date             DATE NOT NULL,
+    subscriptions    INTEGER NOT NULL DEFAULT 0,
+    confirmations    INTEGER NOT NULL DEFAULT 0,
+    unsubscriptions  INTEGER NOT NULL DEFAULT 0,
+    bounces          INTEGER NOT NULL DEFAULT 0,
+    net_growth       INTEGER NOT NULL DEFAULT 0,
+
+    -- Subscribers on the list at the end of the day.
+    total            INTEGER NOT NULL DEFAULT 0,
+
+    -- Unconfirmed double opt-in subscriptions at the end of the day, the ones among
+    -- them that have been sent reminders, and the ones that expired on the day.
+    optin_pending    INTEGER NOT NULL DEFAULT 0,
+    optin_reminded   INTEGER NOT NULL DEFAULT 0,
+    optin_expired    INTEGER NOT NULL DEFAULT 0,
+
+    PRIMARY KEY(list_id, date)
+);
+DROP INDEX IF EXISTS idx_list_daily_stats_date; CREATE INDEX idx_list_daily_stats_date ON list_daily_stats(date);
+
 
 DROP TABLE IF EXISTS subscriber_lists CASCADE;
 CREATE TABLE subscriber_lists (
@@ -54,6 +141,19 @@ CREATE TABLE subscriber_lists (
     meta               JSONB NOT NULL DEFAULT '{}',
     status             subscription_status NOT NULL DEFAULT 'unconfirmed',
 
+    -- Proof-of-consent record: source, consent text version, IP, user agent, timestamps.
+    consent            JSONB NOT NULL DEFAULT '{}',
+
+    -- When the double opt-in of the subscription started (it was subscribed or re-subscribed
+    -- as unconfirmed), the reminders sent since, and when it expired unconfirmed.
+    optin_started_at   TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    optin_reminders    INTEGER NOT NULL DEFAULT 0,
+    optin_reminded_at  TIMESTAMP WITH TIME ZONE NULL,
+    optin_expired_at   TIMESTAMP WITH TIME ZONE NULL,
+
+    -- When the subscription was unsubscribed, for churn stats.
+    unsubscribed_at    TIMESTAMP WITH TIME ZONE NULL,
+
     created_at         TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at         TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
 
@@ -63,6 +163,34 @@ DROP INDEX IF EXISTS idx_sub_lists_sub_id; CREATE INDEX idx_sub_lists_sub_id ON
 DROP INDEX IF EXISTS idx_sub_lists_list_id; CREATE INDEX idx_sub_lists_list_id ON subscriber_lists(list_id);
 DROP INDEX IF EXISTS idx_sub_lists_status; CREATE INDEX idx_sub_lists_status ON subscriber_lists(status);
 
+-- Records when subscriptions are unsubscribed for the churn stats of lists. Only the
+-- change of a subscription's status to 'unsubscribed' sets the time, and not updates to
+-- subscriptions that are already unsubscribed, eg: by imports. A change of the status to
+-- 'unconfirmed', eg: re-subscribing after unsubscribing or expiring, starts the double
+-- opt-in over, with the reminders and expiry counted from then.
+CREATE OR REPLACE FUNCTION SET_SUBSCRIPTION_STATUS_TIMES() RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.status != 'unsubscribed' THEN
+        NEW.unsubscribed_at := NULL;
+    ELSIF TG_OP = 'INSERT' THEN
+        NEW.unsubscribed_at := COALESCE(NEW.unsubscribed_at, NOW());
+    ELSIF OLD.status != 'unsubscribed' THEN
+        NEW.unsubscribed_at := NOW();
+    END IF;
+
+    IF TG_OP = 'UPDATE' AND NEW.status = 'unconfirmed' AND OLD.status != 'unconfirmed' THEN
+        NEW.optin_started_at := NOW();
+        NEW.optin_reminders := 0;
+        NEW.optin_reminded_at := NULL;
+        NEW.optin_expired_at := NULL;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS subscriber_lists_status_times ON subscriber_lists;
+CREATE TRIGGER subscriber_lists_status_times BEFORE INSERT OR UPDATE ON subscriber_lists
+    FOR EACH ROW EXECUTE FUNCTION SET_SUBSCRIPTION_STATUS_TIMES();
+
 -- templates
 DROP TABLE IF EXISTS templates CASCADE;
 CREATE TABLE templates (
@@ -134,12 +262,58 @@ CREATE TABLE campaign_lists (
     -- Lists may be deleted, so list_id is nullable
     -- and a copy of the original list name is maintained here.
     list_id      INTEGER NULL REFERENCES lists(id) ON DELETE SET NULL ON UPDATE CASCADE,
-    list_name    TEXT NOT NULL DEFAULT ''
+    list_name    TEXT NOT NULL DEFAULT '',
+
+    -- When the subscribers of a dynamic list were recorded as the campaign's recipients.
+    snapshot_at  TIMESTAMP WITH TIME ZONE NULL
 );
 CREATE UNIQUE INDEX ON campaign_lists (campaign_id, list_id);
 DROP INDEX IF EXISTS idx_camp_lists_camp_id; CREATE INDEX idx_camp_lists_camp_id ON campaign_lists(campaign_id);
 DROP INDEX IF EXISTS idx_camp_lists_list_id; CREATE INDEX idx_camp_lists_list_id ON campaign_lists(list_id);
 
+-- segments
+DROP TABLE IF EXISTS segments CASCADE;
+CREATE TABLE segments (
+    id               SERIAL PRIMARY KEY,
+    uuid             uuid NOT NULL UNIQUE,
+    name             TEXT NOT NULL,
+
+    -- An arbitrary SQL expression and/or a structured segment filter.
+    query            TEXT NOT NULL DEFAULT '',
+    filter           JSONB NULL,
+
+    -- Cached count of subscribers matching the segment.
+    subscriber_count INTEGER NOT NULL DEFAULT 0,
+    counted_at       TIMESTAMP WITH TIME ZONE NULL,
+
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+DROP TABLE IF EXISTS campaign_segments CASCADE;
+CREATE TABLE campaign_segments (
+    id           BIGSERIAL PRIMARY KEY,
+    campaign_id  INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+
+    -- Segments may be deleted, so segment_id is nullable
+    -- and a copy of the original segment name is maintained here.
+    segment_id   INTEGER NULL REFERENCES segments(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    segment_name TEXT NOT NULL DEFAULT '',
+
+    -- Time at which the segment's subscribers were snapshotted into campaign_subscribers.
+    snapshot_at  TIMESTAMP WITH TIME ZONE NULL
+);
+CREATE UNIQUE INDEX ON campaign_segments (campaign_id, segment_id);
+DROP INDEX IF EXISTS idx_camp_segments_camp_id; CREATE INDEX idx_camp_segments_camp_id ON campaign_segments(campaign_id);
+
+-- Recipients of a campaign from its segments, snapshotted when the campaign starts.
+DROP TABLE IF EXISTS campaign_subscribers CASCADE;
+CREATE TABLE campaign_subscribers (
+    campaign_id   INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    subscriber_id INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    PRIMARY KEY (campaign_id, subscriber_id)
+);
+
 DROP TABLE IF EXISTS campaign_views CASCADE;
 CREATE TABLE campaign_views (
     id               BIGSERIAL PRIMARY KEY,
@@ -241,9 +415,10 @@ INSERT INTO settings (key, value) VALUES
     ('privacy.allow_export', 'true'),
     ('privacy.allow_wipe', 'true'),
     ('privacy.allow_preferences', 'true'),
-    ('privacy.exportable', '["profile", "subscriptions", "campaign_views", "link_clicks"]'),
+    ('privacy.exportable', '["profile", "subscriptions", "campaign_views", "link_clicks", "audit"]'),
     ('privacy.domain_blocklist', '[]'),
     ('privacy.record_optin_ip', 'false'),
+    ('privacy.trash_retention_days', '30'),
     ('security.enable_captcha', 'false'),
     ('security.captcha_key', '""'),
     ('security.captcha_secret', '""'),
@@ -263,9 +438,17 @@ INSERT INTO settings (key, value) VALUES
     ('upload.s3.bucket_type', '"public"'),
     ('upload.s3.expiry', '"167h"'),
     ('smtp',
-        '[{"enabled":true, "host":"smtp.yoursite.com","port":25,"auth_protocol":"cram","username":"username","password":"password","hello_hostname":"","max_conns":10,"idle_timeout":"15s","wait_timeout":"5s","max_msg_retries":2,"tls_type":"STARTTLS","tls_skip_verify":false,"email_headers":[]},
-          {"enabled":false, "host":"smtp.gmail.com","port":465,"auth_protocol":"login","username":"username@gmail.com","password":"password","hello_hostname":"","max_conns":10,"idle_timeout":"15s","wait_timeout":"5s","max_msg_retries":2,"tls_type":"TLS","tls_skip_verify":false,"email_headers":[]}]'),
+        '[{"enabled":true, "host":"smtp.yoursite.com","port":25,"auth_protocol":"cram","username":"username","password":"password","hello_hostname":"","max_conns":10,"idle_timeout":"15s","wait_timeout":"5s","max_msg_retries":2,"weight":1,"tls_type":"STARTTLS","tls_skip_verify":false,"email_headers":[],"dkim":[]},
+          {"enabled":false, "host":"smtp.gmail.com","port":465,"auth_protocol":"login","username":"username@gmail.com","password":"password","hello_hostname":"","max_conns":10,"idle_timeout":"15s","wait_timeout":"5s","max_msg_retries":2,"weight":1,"tls_type":"TLS","tls_skip_verify":false,"email_headers":[],"dkim":[]}]'),
     ('messengers', '[]'),
+    ('attribs', '[]'),
+    ('import.sources', '[]'),
+    ('engagement.score_interval', '"0 2 * * *"'),
+    ('engagement.half_life_days', '30'),
+    ('engagement.sunset_enabled', 'false'),
+    ('engagement.sunset_days', '365'),
+    ('engagement.sunset_action', '"unsubscribe"'),
+    ('engagement.sunset_list_id', '0'),
     ('bounce.enabled', 'false'),
     ('bounce.webhooks_enabled', 'false'),
     ('bounce.actions', '{"soft": {"count": 2, "action": "none"}, "hard": {"count": 1, "action": "blocklist"}, "complaint" : {"count": 1, "action": "blocklist"}}'),
@@ -296,6 +479,67 @@ DROP INDEX IF EXISTS idx_bounces_camp_id; CREATE INDEX idx_bounces_camp_id ON bo
 DROP INDEX IF EXISTS idx_bounces_source; CREATE INDEX idx_bounces_source ON bounces(source);
 DROP INDEX IF EXISTS idx_bounces_date; CREATE INDEX idx_bounces_date ON bounces((TIMEZONE('UTC', created_at)::DATE));
 
+-- audit log
+-- Append-only log of changes to subscribers, subscriptions, and lists. Entries are retained
+-- after the subscribers and lists they refer to are deleted.
+DROP TABLE IF EXISTS audit_log CASCADE;
+CREATE TABLE audit_log (
+    id               BIGSERIAL PRIMARY KEY,
+    subscriber_id    INTEGER NULL,
+    list_id          INTEGER NULL,
+    action           TEXT NOT NULL,
+    source           TEXT NOT NULL DEFAULT '',
+    actor            TEXT NOT NULL DEFAULT '',
+    ip               TEXT NOT NULL DEFAULT '',
+    before           JSONB NULL,
+    after            JSONB NULL,
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_audit_sub_id; CREATE INDEX idx_audit_sub_id ON audit_log(subscriber_id);
+DROP INDEX IF EXISTS idx_audit_list_id; CREATE INDEX idx_audit_list_id ON audit_log(list_id);
+
+-- import runs
+-- Import sessions of uploaded files and scheduled import sources, with their logs.
+DROP TABLE IF EXISTS import_runs CASCADE;
+CREATE TABLE import_runs (
+    id            BIGSERIAL PRIMARY KEY,
+    source        TEXT NOT NULL DEFAULT '',
+    filename      TEXT NOT NULL DEFAULT '',
+    status        import_run_status NOT NULL DEFAULT 'importing',
+    dry_run       BOOLEAN NOT NULL DEFAULT false,
+    total         INTEGER NOT NULL DEFAULT 0,
+    imported      INTEGER NOT NULL DEFAULT 0,
+    rejected      INTEGER NOT NULL DEFAULT 0,
+    unsubscribed  INTEGER NOT NULL DEFAULT 0,
+    new           INTEGER NOT NULL DEFAULT 0,
+    updated       INTEGER NOT NULL DEFAULT 0,
+    unchanged     INTEGER NOT NULL DEFAULT 0,
+    error         TEXT NOT NULL DEFAULT '',
+    log           TEXT NOT NULL DEFAULT '',
+    started_at    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    finished_at   TIMESTAMP WITH TIME ZONE NULL
+);
+DROP INDEX IF EXISTS idx_import_runs_started_at; CREATE INDEX idx_import_runs_started_at ON import_runs(started_at);
+
+-- export jobs
+-- Background subscriber exports whose files are written to the media store.
+DROP TABLE IF EXISTS export_jobs CASCADE;
+CREATE TABLE export_jobs (
+    id             BIGSERIAL PRIMARY KEY,
+    uuid           UUID NOT NULL UNIQUE,
+    status         export_job_status NOT NULL DEFAULT 'running',
+    format         TEXT NOT NULL DEFAULT 'csv',
+    fields         TEXT[] NOT NULL DEFAULT '{}',
+    include_lists  BOOLEAN NOT NULL DEFAULT false,
+    filename       TEXT NOT NULL DEFAULT '',
+    exported       INTEGER NOT NULL DEFAULT 0,
+    error          TEXT NOT NULL DEFAULT '',
+    created_by     TEXT NOT NULL DEFAULT '',
+    created_at     TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    finished_at    TIMESTAMP WITH TIME ZONE NULL
+);
+DROP INDEX IF EXISTS idx_export_jobs_created_at; CREATE INDEX idx_export_jobs_created_at ON export_jobs(created_at);
+
 
 
 -- materialized views
@@ -304,7 +548,7 @@ DROP INDEX IF EXISTS idx_bounces_date; CREATE INDEX idx_bounces_date ON bounces(
 DROP MATERIALIZED VIEW IF EXISTS mat_dashboard_counts;
 CREATE MATERIALIZED VIEW mat_dashboard_counts AS
     WITH subs AS (
-        SELECT COUNT(*) AS num, status FROM subscribers GROUP BY status
+        SELECT COUNT(*) AS num, status FROM subscribers WHERE deleted_at IS NULL GROUP BY status
     )
     SELECT NOW() AS updated_at,
         JSON_BUILD_OBJECT(
@@ -314,7 +558,7 @@ CREATE MATERIALIZED VIEW mat_dashboard_counts AS
                 'orphans', (
                     SELECT COUNT(id) FROM subscribers
                     LEFT JOIN subscriber_lists ON (subscribers.id = subscriber_lists.subscriber_id)
-                    WHERE subscriber_lists.subscriber_id IS NULL
+                    WHERE subscriber_lists.subscriber_id IS NULL AND subscribers.deleted_at IS NULL
                 )
             ),
             'lists', JSON_BUILD_OBJECT(
@@ -372,11 +616,47 @@ CREATE MATERIALIZED VIEW mat_dashboard_charts AS
 DROP INDEX IF EXISTS mat_dashboard_charts_idx; CREATE UNIQUE INDEX mat_dashboard_charts_idx ON mat_dashboard_charts (updated_at);
 
 -- subscriber counts stats for lists
+-- Counts the subscribers matching the query of a dynamic list, except the ones who
+-- have unsubscribed from it. An invalid query counts as 0 so that it doesn't break
+-- the refreshing of the list stats, and the error is logged as a warning.
+CREATE OR REPLACE FUNCTION COUNT_DYNAMIC_LIST_SUBSCRIBERS(list_id INT, query TEXT) RETURNS BIGINT AS $$
+DECLARE
+    num BIGINT;
+BEGIN
+    IF query = '' THEN
+        RETURN 0;
+    END IF;
+
+    EXECUTE 'SELECT COUNT(*) FROM subscribers WHERE subscribers.deleted_at IS NULL
+        AND subscribers.status != ''blocklisted'' AND NOT EXISTS (
+            SELECT 1 FROM subscriber_lists WHERE subscriber_lists.subscriber_id = subscribers.id
+            AND subscriber_lists.list_id = $1 AND subscriber_lists.status = ''unsubscribed''
+        ) AND (' || query || ')' INTO num USING list_id;
+    RETURN num;
+EXCEPTION WHEN OTHERS THEN
+    RAISE WARNING 'error counting subscribers of dynamic list %: %', list_id, SQLERRM;
+    RETURN 0;
+END;
+$$ LANGUAGE plpgsql STABLE;
+
 DROP MATERIALIZED VIEW IF EXISTS mat_list_subscriber_stats;
 CREATE MATERIALIZED VIEW mat_list_subscriber_stats AS
-    SELECT NOW() AS updated_at, lists.id AS list_id, subscriber_lists.status, COUNT(*) AS subscriber_count FROM lists
+    SELECT NOW() AS updated_at, lists.id AS list_id, subscriber_lists.status, COUNT(subscribers.id) AS subscriber_count FROM lists
     LEFT JOIN subscriber_lists ON (subscriber_lists.list_id = lists.id)
+    LEFT JOIN subscribers ON (subscribers.id = subscriber_lists.subscriber_id AND subscribers.deleted_at IS NULL)
+    WHERE lists.type != 'dynamic'
+    GROUP BY lists.id, subscriber_lists.status
+    UNION ALL
+    -- The subscribers matching the queries of dynamic lists are counted as confirmed.
+    SELECT NOW() AS updated_at, lists.id AS list_id, 'confirmed'::subscription_status AS status,
+        COUNT_DYNAMIC_LIST_SUBSCRIBERS(lists.id, lists.query) AS subscriber_count
+    FROM lists WHERE lists.type = 'dynamic'
+    UNION ALL
+    SELECT NOW() AS updated_at, lists.id AS list_id, subscriber_lists.status, COUNT(subscribers.id) AS subscriber_count FROM lists
+    INNER JOIN subscriber_lists ON (subscriber_lists.list_id = lists.id AND subscriber_lists.status = 'unsubscribed')
+    LEFT JOIN subscribers ON (subscribers.id = subscriber_lists.subscriber_id AND subscribers.deleted_at IS NULL)
+    WHERE lists.type = 'dynamic'
     GROUP BY lists.id, subscriber_lists.status
     UNION ALL
-    SELECT NOW() AS updated_at, 0 AS list_id, NULL AS status, COUNT(*) AS subscriber_count FROM subscribers;
+    SELECT NOW() AS updated_at, 0 AS list_id, NULL AS status, COUNT(*) AS subscriber_count FROM subscribers WHERE deleted_at IS NULL;
 DROP INDEX IF EXISTS mat_list_subscriber_stats_idx; CREATE UNIQUE INDEX mat_list_subscriber_stats_idx ON mat_list_subscriber_stats (list_id, status);